@@ -16,6 +16,7 @@ package broker
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -29,9 +30,12 @@ import (
 	"github.com/emitter-io/emitter/internal/event"
 	"github.com/emitter-io/emitter/internal/message"
 	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/emitter-io/emitter/internal/provider/audit"
+	"github.com/emitter-io/emitter/internal/provider/auth"
 	"github.com/emitter-io/emitter/internal/provider/contract"
 	"github.com/emitter-io/emitter/internal/provider/logging"
 	"github.com/emitter-io/emitter/internal/security"
+	"github.com/emitter-io/emitter/internal/security/jwt"
 	"github.com/emitter-io/emitter/internal/service/keygen"
 	"github.com/emitter-io/stats"
 	"github.com/kelindar/binary"
@@ -41,6 +45,16 @@ import (
 
 const defaultReadRate = 100000
 
+// The number of authorization failures after which these are recorded in the audit log.
+const auditFailures = 5
+
+// The error returned when a connection is dropped for failing to authorize too often.
+var errAbusive = fmt.Errorf("connection dropped due to repeated authorization failures")
+var errTooManyConns = fmt.Errorf("connection dropped as the limit of concurrent connections was reached")
+
+// The key placeholder which refers to the token provided during MQTT connect.
+var tokenKey = []byte("jwt/")
+
 type response interface {
 	ForRequest(uint16)
 }
@@ -49,17 +63,31 @@ type response interface {
 type Conn struct {
 	sync.Mutex
 	tracked  uint32            // Whether the connection was already tracked or not.
+	failures uint32            // The number of authorization failures of the connection.
+	delayed  uint32            // The number of failures the connection was already delayed for.
+	refused  uint32            // Whether the connection was over the limit of concurrent connections.
 	socket   net.Conn          // The transport used to read and write messages.
 	luid     security.ID       // The locally unique id of the connection.
 	guid     string            // The globally unique id of the connection.
 	service  *Service          // The service for this connection.
 	subs     *message.Counters // The subscriptions for this connection.
+	channels channelIndex      // The channels subscribed to by their name, as their SSIDs may collide.
 	measurer stats.Measurer    // The measurer to use for monitoring.
 	limit    *rate.Limiter     // The read rate limiter.
 	keys     *keygen.Service   // The key generation provider.
 	connect  *event.Connection // The associated connection event.
 	username string            // The username provided by the client during MQTT connect.
+	token    string            // The token provided by the client during MQTT connect.
+	key      string            // The key provided by the client during MQTT connect, in the keyless mode.
 	links    map[string]string // The map of all pre-authorized links.
+	grants   map[uint32]grant  // The channels, with their keys, the subscriptions were granted for.
+	admitted map[string]bool   // The keys the connection was admitted with by the connection limits.
+}
+
+// grant represents a channel along with its key a subscription was authorized with.
+type grant struct {
+	ssid    message.Ssid
+	channel *security.Channel
 }
 
 // NewConn creates a new connection.
@@ -70,8 +98,11 @@ func (s *Service) newConn(t net.Conn, readRate int) *Conn {
 		service:  s,
 		socket:   t,
 		subs:     message.NewCounters(),
+		channels: channelIndex{},
 		measurer: s.measurer,
 		links:    map[string]string{},
+		grants:   map[uint32]grant{},
+		admitted: map[string]bool{},
 		keys:     s.keygen,
 	}
 
@@ -83,8 +114,9 @@ func (s *Service) newConn(t net.Conn, readRate int) *Conn {
 
 	c.limit = rate.New(readRate, time.Second)
 
-	// Increment the connection counter
+	// Increment the connection counter and register the connection
 	atomic.AddInt64(&s.connections, 1)
+	s.conns.Store(c.luid, c)
 	return c
 }
 
@@ -98,11 +130,38 @@ func (c *Conn) LocalID() security.ID {
 	return c.luid
 }
 
+// Addr returns the IP address of the remote client.
+func (c *Conn) Addr() string {
+	return addrOf(c.socket)
+}
+
+// addrOf returns the IP address of the remote end of a socket.
+func addrOf(socket net.Conn) string {
+	if tcp, ok := socket.RemoteAddr().(*net.TCPAddr); ok {
+		return tcp.IP.String() // We keep only the IP address for fair tracking
+	}
+	return socket.RemoteAddr().String()
+}
+
 // Username returns the associated username.
 func (c *Conn) Username() string {
 	return c.username
 }
 
+// ClientID returns the client ID provided during MQTT connect.
+func (c *Conn) ClientID() string {
+	if c.connect == nil {
+		return ""
+	}
+	return string(c.connect.ClientID)
+}
+
+// Key returns the key provided during MQTT connect in the keyless mode, which is used for all
+// of the plain topics of the connection.
+func (c *Conn) Key() string {
+	return c.key
+}
+
 // GetLink checks if the topic is a registered shortcut and expands it.
 func (c *Conn) GetLink(topic []byte) []byte {
 	if len(topic) <= 2 && c.links != nil {
@@ -135,14 +194,7 @@ func (c *Conn) MeasureElapsed(name string, since time.Time) {
 func (c *Conn) Track(contract contract.Contract) {
 
 	if atomic.CompareAndSwapUint32(&c.tracked, 0, 1) {
-		// We keep only the IP address for fair tracking
-		addr := c.socket.RemoteAddr().String()
-		if tcp, ok := c.socket.RemoteAddr().(*net.TCPAddr); ok {
-			addr = tcp.IP.String()
-		}
-
-		// Add the device to the stats and mark as done
-		contract.Stats().AddDevice(addr)
+		contract.Stats().AddDevice(c.Addr())
 	}
 }
 
@@ -179,6 +231,16 @@ func (c *Conn) Process() error {
 		if err := c.onReceive(msg); err != nil {
 			return err
 		}
+
+		// Drop the clients which are over the limit of concurrent connections
+		if atomic.LoadUint32(&c.refused) == 1 {
+			return errTooManyConns
+		}
+
+		// Slow down or drop the clients which keep failing to authorize
+		if err := c.throttle(); err != nil {
+			return err
+		}
 	}
 }
 
@@ -192,6 +254,9 @@ func (c *Conn) onReceive(msg mqtt.Message) error {
 		var result uint8
 		if !c.onConnect(msg.(*mqtt.Connect)) {
 			result = 0x05 // Unauthorized
+			c.onUnauthorized()
+		} else if !c.admitKey() {
+			result = 0x03 // Server unavailable
 		}
 
 		// Write the ack
@@ -210,7 +275,7 @@ func (c *Conn) onReceive(msg mqtt.Message) error {
 
 		// Subscribe for each subscription
 		for _, sub := range packet.Subscriptions {
-			if err := c.service.pubsub.OnSubscribe(c, sub.Topic); err != nil {
+			if err := c.service.pubsub.OnSubscribe(c, c.expandToken(sub.Topic)); err != nil {
 				ack.Qos = append(ack.Qos, 0x80) // 0x80 indicate subscription failure
 				c.notifyError(err, packet.MessageID)
 				continue
@@ -232,7 +297,7 @@ func (c *Conn) onReceive(msg mqtt.Message) error {
 
 		// Unsubscribe from each subscription
 		for _, sub := range packet.Topics {
-			if err := c.service.pubsub.OnUnsubscribe(c, sub.Topic); err != nil {
+			if err := c.service.pubsub.OnUnsubscribe(c, c.expandToken(sub.Topic)); err != nil {
 				c.notifyError(err, packet.MessageID)
 			}
 		}
@@ -254,6 +319,7 @@ func (c *Conn) onReceive(msg mqtt.Message) error {
 
 	case mqtt.TypeOfPublish:
 		packet := msg.(*mqtt.Publish)
+		packet.Topic = c.expandToken(packet.Topic)
 		if err := c.service.pubsub.OnPublish(c, packet); err != nil {
 			logging.LogError("conn", "publish received", err)
 			c.notifyError(err, packet.MessageID)
@@ -274,6 +340,10 @@ func (c *Conn) onReceive(msg mqtt.Message) error {
 // Send forwards the message to the underlying client.
 func (c *Conn) Send(m *message.Message) (err error) {
 	defer c.MeasureElapsed("send.pub", time.Now())
+	if c.service.Config.Hashing.Verify && !c.receives(m) {
+		return nil
+	}
+
 	packet := mqtt.Publish{
 		Header:  mqtt.Header{QOS: 0},
 		Topic:   m.Channel, // The channel for this message.
@@ -284,11 +354,69 @@ func (c *Conn) Send(m *message.Message) (err error) {
 	return
 }
 
+// receives checks whether the channel of a message is one the connection has subscribed to.
+// This protects against the different channels which end up with the same SSID.
+func (c *Conn) receives(m *message.Message) bool {
+	if len(m.ID) == 0 || m.Contract() == 0 {
+		return true // Responses and system messages, such as presence
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	return c.channels.Matches(m.Ssid(), m.Channel)
+}
+
 // notifyError notifies the connection about an error
 func (c *Conn) notifyError(err *errors.Error, requestID uint16) {
+	if err == errors.ErrUnauthorized || err == errors.ErrUnauthorizedExt {
+		c.onUnauthorized()
+	}
+
 	c.sendResponse("emitter/error/", err, requestID)
 }
 
+// onUnauthorized counts an authorization failure and records the repeated ones in the
+// audit log.
+func (c *Conn) onUnauthorized() {
+	if n := atomic.AddUint32(&c.failures, 1); n%auditFailures == 0 {
+		c.service.audit.Record(&audit.Event{
+			Actor: audit.ActorOf(c),
+			Type:  audit.EventUnauthorized,
+			Count: int(n),
+		})
+	}
+
+	// Count the failure for the address as well, which may block it
+	if c.service.guard.OnFailure(c.Addr()) {
+		c.service.audit.Record(&audit.Event{
+			Actor: audit.ActorOf(c),
+			Type:  audit.EventBlock,
+		})
+	}
+}
+
+// throttle delays the connection after each new authorization failure and drops it
+// once it failed too often or its address was blocked.
+func (c *Conn) throttle() error {
+	n := atomic.LoadUint32(&c.failures)
+	if n == c.delayed {
+		return nil
+	}
+
+	c.delayed = n
+	if c.service.guard.ShouldDrop(n) {
+		return errAbusive
+	}
+
+	if c.service.guard.IsBlocked(c.Addr()) {
+		c.service.guard.Refuse()
+		return errAbusive
+	}
+
+	time.Sleep(c.service.guard.Delay(n))
+	return nil
+}
+
 func (c *Conn) sendResponse(topic string, resp response, requestID uint16) {
 	switch m := resp.(type) {
 	case *errors.Error:
@@ -313,7 +441,7 @@ func (c *Conn) sendResponse(topic string, resp response, requestID uint16) {
 func (c *Conn) CanSubscribe(ssid message.Ssid, channel []byte) bool {
 	c.Lock()
 	defer c.Unlock()
-
+	c.channels.Add(ssid, channel)
 	return c.subs.IncrementOnce(ssid, channel)
 }
 
@@ -322,33 +450,156 @@ func (c *Conn) CanSubscribe(ssid message.Ssid, channel []byte) bool {
 func (c *Conn) CanUnsubscribe(ssid message.Ssid, channel []byte) bool {
 	c.Lock()
 	defer c.Unlock()
-	return c.subs.Decrement(ssid)
+	c.channels.Remove(ssid, channel)
+	if last := c.subs.Decrement(ssid); last {
+		delete(c.grants, ssid.GetHashCode())
+		return true
+	}
+	return false
+}
+
+// Grant records the channel, along with its key, a subscription was authorized with.
+func (c *Conn) Grant(ssid message.Ssid, channel *security.Channel) {
+	c.Lock()
+	defer c.Unlock()
+	c.grants[ssid.GetHashCode()] = grant{
+		ssid:    ssid,
+		channel: channel,
+	}
+}
+
+// reauthorize checks again the keys of all of the subscriptions and revokes the ones
+// which are no longer authorized, notifying the client about each of them.
+func (c *Conn) reauthorize() {
+	c.Lock()
+	grants := make([]grant, 0, len(c.grants))
+	for _, g := range c.grants {
+		grants = append(grants, g)
+	}
+	c.Unlock()
+
+	for _, g := range grants {
+		if err := c.service.pubsub.Reauthorize(c, g.ssid, g.channel); err != nil {
+			c.notifyError(err, 0)
+
+			// Closing the socket terminates the processing loop, which closes the connection
+			if c.service.Config.Revoke.Disconnect {
+				c.socket.Close()
+				return
+			}
+		}
+	}
 }
 
 // onConnect handles the connection authorization
 func (c *Conn) onConnect(packet *mqtt.Connect) bool {
 	c.username = string(packet.Username)
+
+	// If a token was provided as a password, make sure it is valid
+	password := string(packet.Password)
+	if c.service.tokens != nil && jwt.IsToken(password) {
+		if _, err := c.service.tokens.Verify(password); err != nil {
+			return false
+		}
+		c.token = password
+	}
+
+	// In the keyless mode, the key or the token provided as a password is used for all topics.
+	// Any other password is left to the authorization provider.
+	if c.service.Config.Keyless && (c.token != "" || c.service.isKey(password)) {
+		c.key, c.token = password, ""
+	}
+
+	// Consult the authorization provider
+	if !c.service.access.Authorize(&auth.Request{
+		Action:   auth.ActionConnect,
+		Username: c.username,
+		ClientID: string(packet.ClientID),
+	}) {
+		return false
+	}
+
 	c.connect = &event.Connection{
 		Peer:        c.service.ID(),
 		Conn:        c.luid,
 		WillFlag:    packet.WillFlag,
 		WillRetain:  packet.WillRetainFlag,
 		WillQoS:     packet.WillQOS,
-		WillTopic:   packet.WillTopic,
+		WillTopic:   c.expandToken(packet.WillTopic),
 		WillMessage: packet.WillMessage,
 		ClientID:    packet.ClientID,
 		Username:    packet.Username,
 	}
 
+	// The will topic of a keyless connection is a plain topic as well
+	if c.key != "" {
+		c.connect.WillTopic = c.service.pubsub.TopicOf(c, c.connect.WillTopic)
+	}
+
 	if c.service.cluster != nil {
 		c.service.cluster.Notify(c.connect, true)
 	}
+
+	c.service.audit.Record(&audit.Event{
+		Actor: audit.ActorOf(c),
+		Type:  audit.EventConnect,
+	})
 	return true
 }
 
+// admitKey admits the connection within the connection limits right away, if a key was
+// provided during MQTT connect in the keyless mode. Otherwise, the connection is admitted
+// the first time it is authorized with a key.
+func (c *Conn) admitKey() bool {
+	if c.key == "" {
+		return true
+	}
+
+	key, err := c.service.keygen.DecryptKey(c.key)
+	if err != nil {
+		return true // A token, which is admitted once authorized
+	}
+
+	contract, ok := c.service.contracts.Get(key.Contract())
+	return !ok || c.Admit(contract, key) == nil
+}
+
+// Admit admits the connection within the limits of concurrent connections of the contract
+// and of the key, the first time the connection is authorized with the key. A connection
+// over either of the limits is dropped once the request is answered.
+func (c *Conn) Admit(contract contract.Contract, key security.Key) *errors.Error {
+	c.Lock()
+	admitted := c.admitted[string(key)]
+	c.Unlock()
+	if admitted {
+		return nil
+	}
+
+	if err := c.service.limits.Admit(c, contract, key); err != nil {
+		atomic.StoreUint32(&c.refused, 1)
+		return err
+	}
+
+	c.Lock()
+	c.admitted[string(key)] = true
+	c.Unlock()
+	return nil
+}
+
+// expandToken replaces the "jwt" key placeholder of the topic with the token provided
+// during MQTT connect, if any.
+func (c *Conn) expandToken(topic []byte) []byte {
+	if c.token != "" && bytes.HasPrefix(topic, tokenKey) {
+		return append([]byte(c.token), topic[len(tokenKey)-1:]...)
+	}
+	return topic
+}
+
 // Close terminates the connection.
 func (c *Conn) Close() error {
 	atomic.AddInt64(&c.service.connections, -1)
+	c.service.conns.Delete(c.luid)
+	c.service.limits.Release(c.luid)
 	if r := recover(); r != nil {
 		logging.LogAction("closing", fmt.Sprintf("panic recovered: %s \n %s", r, debug.Stack()))
 	}
@@ -367,7 +618,73 @@ func (c *Conn) Close() error {
 
 	// Publish last will
 	c.service.pubsub.OnLastWill(c, c.connect)
+	if c.connect != nil {
+		c.service.audit.Record(&audit.Event{
+			Actor: audit.ActorOf(c),
+			Type:  audit.EventDisconnect,
+		})
+	}
 
 	//logging.LogTarget("conn", "closed", c.guid)
 	return c.socket.Close()
 }
+
+// ------------------------------------------------------------------------------------
+
+// channelIndex indexes the subscribed channels by the hash code of their SSID, so that only
+// the channels which may have been matched by the SSID of a message are checked. The channels
+// with wildcards are kept aside, since their SSIDs can't be derived from the ones of the
+// messages.
+type channelIndex map[uint32]map[string]bool
+
+// wildcards is the key of the channels with wildcards.
+const wildcards = 0
+
+// keyOf returns the key of a subscribed channel in the index.
+func keyOf(ssid message.Ssid, channel []byte) uint32 {
+	if bytes.ContainsAny(channel, "+#") {
+		return wildcards
+	}
+	return ssid.GetHashCode()
+}
+
+// Add adds a subscribed channel to the index.
+func (idx channelIndex) Add(ssid message.Ssid, channel []byte) {
+	key := keyOf(ssid, channel)
+	if idx[key] == nil {
+		idx[key] = make(map[string]bool, 1)
+	}
+	idx[key][string(channel)] = true
+}
+
+// Remove removes a subscribed channel from the index.
+func (idx channelIndex) Remove(ssid message.Ssid, channel []byte) {
+	key := keyOf(ssid, channel)
+	if delete(idx[key], string(channel)); len(idx[key]) == 0 {
+		delete(idx, key)
+	}
+}
+
+// Matches checks whether any of the subscribed channels matches the channel of a message. The
+// subscriptions of the message are the ones for the prefixes of its SSID, so the hash code of
+// each of them is computed in turn.
+func (idx channelIndex) Matches(ssid message.Ssid, channel []byte) bool {
+	h := ssid[0]
+	for _, v := range ssid[1:] {
+		h ^= v
+		if h != wildcards && idx.match(h, channel) {
+			return true
+		}
+	}
+	return idx.match(wildcards, channel)
+}
+
+// match checks whether any of the subscribed channels of a key matches a channel.
+func (idx channelIndex) match(key uint32, channel []byte) bool {
+	for v := range idx[key] {
+		if message.Match([]byte(v), channel) {
+			return true
+		}
+	}
+	return false
+}
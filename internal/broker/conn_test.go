@@ -16,12 +16,32 @@ package broker
 
 import (
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/emitter-io/emitter/internal/config"
 	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/event"
 	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/network/cidr"
 	netmock "github.com/emitter-io/emitter/internal/network/mock"
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/emitter-io/emitter/internal/provider/audit"
+	"github.com/emitter-io/emitter/internal/provider/auth"
+	"github.com/emitter-io/emitter/internal/provider/contract"
+	"github.com/emitter-io/emitter/internal/provider/storage"
+	"github.com/emitter-io/emitter/internal/provider/usage"
+	"github.com/emitter-io/emitter/internal/security"
 	"github.com/emitter-io/emitter/internal/security/license"
+	"github.com/emitter-io/emitter/internal/security/policy"
+	"github.com/emitter-io/emitter/internal/service/cluster"
+	"github.com/emitter-io/emitter/internal/service/fake"
+	"github.com/emitter-io/emitter/internal/service/guard"
+	"github.com/emitter-io/emitter/internal/service/keygen"
+	"github.com/emitter-io/emitter/internal/service/pubsub"
+	"github.com/emitter-io/emitter/internal/service/quota"
 	"github.com/emitter-io/stats"
 	"github.com/stretchr/testify/assert"
 )
@@ -29,9 +49,13 @@ import (
 func newTestConn() (pipe *netmock.Conn, conn *Conn) {
 	license, _ := license.Parse(testLicense)
 	s := &Service{
+		Config:        new(config.Config),
 		subscriptions: message.NewTrie(),
 		License:       license,
 		measurer:      stats.NewNoop(),
+		limits:        quota.New(nil),
+		audit:         audit.NewNoop(),
+		guard:         guard.New(nil, 0, 0, 0),
 	}
 
 	pipe = netmock.NewConn()
@@ -52,3 +76,301 @@ func TestNotifyError(t *testing.T) {
 	assert.Contains(t, string(b), errors.ErrUnauthorized.Message)
 	assert.NoError(t, err)
 }
+
+func TestExpandToken(t *testing.T) {
+	_, conn := newTestConn()
+	assert.Equal(t, "jwt/a/b/", string(conn.expandToken([]byte("jwt/a/b/"))))
+
+	conn.token = "x.y.z"
+	assert.Equal(t, "x.y.z/a/b/", string(conn.expandToken([]byte("jwt/a/b/"))))
+	assert.Equal(t, "key/a/b/", string(conn.expandToken([]byte("key/a/b/"))))
+}
+
+func TestReauthorize(t *testing.T) {
+	for _, disconnect := range []bool{false, true} {
+		pipe, conn := newTestConn()
+		authorizer := &fake.Authorizer{Contract: 1, Success: true}
+		conn.service.Config = &config.Config{Revoke: config.RevokeConfig{Disconnect: disconnect}}
+		conn.service.pubsub = pubsub.New(authorizer, auth.NewNoop(), new(fake.Limiter), storage.NewNoop(), new(fake.Notifier), conn.service.subscriptions)
+
+		// Subscribe and make sure nothing is revoked while authorized
+		assert.Nil(t, conn.service.pubsub.OnSubscribe(conn, []byte("key/a/b/c/")))
+		conn.service.reauthorize()
+		assert.Len(t, conn.grants, 1)
+		assert.Equal(t, 1, conn.service.subscriptions.Count())
+
+		// Refuse the key, the subscription should be revoked
+		authorizer.Success = false
+		go func() {
+			conn.service.reauthorize()
+			conn.Close()
+		}()
+
+		b, err := io.ReadAll(pipe.Server)
+		assert.NoError(t, err)
+		assert.Contains(t, string(b), errors.ErrRevoked.Message)
+		assert.Contains(t, string(b), `"channel":"a/b/c/"`)
+		assert.Len(t, conn.grants, 0)
+		assert.Equal(t, 0, conn.service.subscriptions.Count())
+
+		// The connection should no longer be registered
+		_, ok := conn.service.conns.Load(conn.luid)
+		assert.False(t, ok)
+	}
+}
+
+func TestGrant(t *testing.T) {
+	_, conn := newTestConn()
+	ssid := message.Ssid{1, 2, 3}
+	channel := security.ParseChannel([]byte("key/a/b/c/"))
+
+	assert.True(t, conn.CanSubscribe(ssid, channel.Channel))
+	conn.Grant(ssid, channel)
+	assert.Equal(t, channel, conn.grants[ssid.GetHashCode()].channel)
+
+	assert.True(t, conn.CanUnsubscribe(ssid, channel.Channel))
+	assert.Len(t, conn.grants, 0)
+}
+
+func TestReceives(t *testing.T) {
+	_, conn := newTestConn()
+	ssid := message.NewSsid(1, security.ParseChannel([]byte("key/a/c244/")).Query)
+	assert.True(t, conn.CanSubscribe(ssid, []byte("a/c244/")))
+
+	// The second segment collides with the one subscribed to
+	other := security.ParseChannel([]byte("key/a/c239655/"))
+	assert.Equal(t, ssid, message.NewSsid(1, other.Query))
+	assert.True(t, conn.receives(message.New(ssid, []byte("a/c244/"), nil)))
+	assert.True(t, conn.receives(message.New(ssid, []byte("a/c244/d/"), nil)))
+	assert.False(t, conn.receives(message.New(ssid, other.Channel, nil)))
+	assert.True(t, conn.receives(message.New(message.Ssid{0, 1}, []byte("emitter/presence/"), nil)))
+	assert.True(t, conn.receives(&message.Message{Channel: []byte("emitter/keygen/")}))
+
+	// Both of the colliding channels are received once subscribed to
+	assert.False(t, conn.CanSubscribe(ssid, other.Channel))
+	assert.True(t, conn.receives(message.New(ssid, []byte("a/c244/"), nil)))
+	assert.True(t, conn.receives(message.New(ssid, other.Channel, nil)))
+
+	conn.CanUnsubscribe(ssid, []byte("a/c244/"))
+	assert.False(t, conn.receives(message.New(ssid, []byte("a/c244/"), nil)))
+
+	// The channels with wildcards are matched against the messages of any SSID
+	wildcard := security.ParseChannel([]byte("key/b/+/c/"))
+	conn.CanSubscribe(message.NewSsid(1, wildcard.Query), wildcard.Channel)
+	target := security.ParseChannel([]byte("key/b/x/c/"))
+	assert.True(t, conn.receives(message.New(message.NewSsid(1, target.Query), target.Channel, nil)))
+	assert.Len(t, conn.channels[0], 1)
+
+	conn.CanUnsubscribe(message.NewSsid(1, wildcard.Query), wildcard.Channel)
+	assert.False(t, conn.receives(message.New(message.NewSsid(1, target.Query), target.Channel, nil)))
+	assert.Len(t, conn.channels, 1)
+}
+
+func TestAudit(t *testing.T) {
+	pipe, conn := newTestConn()
+	auditor := new(fake.Auditor)
+	conn.service.access = auth.NewNoop()
+	conn.service.audit = auditor
+
+	go func() {
+		conn.onConnect(&mqtt.Connect{ClientID: []byte("client"), Username: []byte("user")})
+		for i := 0; i < auditFailures; i++ {
+			conn.notifyError(errors.ErrUnauthorized, 1)
+		}
+		conn.Close()
+	}()
+
+	_, err := io.ReadAll(pipe.Server)
+	assert.NoError(t, err)
+	assert.Len(t, auditor.Events, 3)
+	assert.Equal(t, audit.EventConnect, auditor.Events[0].Type)
+	assert.Equal(t, "user", auditor.Events[0].Username)
+	assert.Equal(t, "client", auditor.Events[0].ClientID)
+	assert.NotEmpty(t, auditor.Events[0].Addr)
+	assert.Equal(t, audit.EventUnauthorized, auditor.Events[1].Type)
+	assert.Equal(t, auditFailures, auditor.Events[1].Count)
+	assert.Equal(t, audit.EventDisconnect, auditor.Events[2].Type)
+}
+
+func TestThrottle(t *testing.T) {
+	_, conn := newTestConn()
+	conn.service.guard = guard.New(nil, 2, 0, 0)
+	assert.NoError(t, conn.throttle())
+
+	// A single failure is not delayed, nor dropped
+	conn.onUnauthorized()
+	assert.NoError(t, conn.throttle())
+	assert.Equal(t, uint32(1), conn.delayed)
+
+	// Once the connection fails too often, it should be dropped
+	conn.onUnauthorized()
+	assert.Equal(t, errAbusive, conn.throttle())
+}
+
+func TestThrottle_Blocked(t *testing.T) {
+	_, conn := newTestConn()
+	conn.service.guard = guard.New(nil, 100, 1, 0)
+
+	// The first failure blocks the address
+	conn.onUnauthorized()
+	assert.Equal(t, errAbusive, conn.throttle())
+	assert.True(t, conn.service.guard.IsBlocked(conn.Addr()))
+}
+
+func TestConn_Admit(t *testing.T) {
+	_, first := newTestConn()
+	_, second := newTestConn()
+	second.service = first.service
+	c := &fake.Contract{Quota: contract.Limits{Contract: contract.Limit{Connections: 1}}}
+	key := security.Key(make([]byte, 24))
+	key.SetContract(1)
+
+	// The connection is admitted once and counts towards the limit until it is closed
+	assert.Nil(t, first.Admit(c, key))
+	assert.Nil(t, first.Admit(c, key))
+	assert.Equal(t, uint32(0), first.refused)
+
+	// The connection over the limit is refused and dropped
+	assert.Equal(t, errors.ErrTooManyConns, second.Admit(c, key))
+	assert.Equal(t, uint32(1), second.refused)
+
+	first.service.limits.Release(first.luid)
+	_, third := newTestConn()
+	third.service = first.service
+	assert.Nil(t, third.Admit(c, key))
+}
+
+func TestGuarded(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+	s.guard = guard.New(nil, 0, 2, 0)
+	calls := 0
+	handler := s.guarded(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+
+	// The unauthorized requests count as failures and block the address
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "/keygen", nil))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+	assert.True(t, s.guard.IsBlocked("192.0.2.1"))
+	assert.Zero(t, s.guard.Refused())
+
+	// The requests from a blocked address are refused
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/keygen", nil))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, int64(1), s.guard.Refused())
+}
+
+func TestAdmits(t *testing.T) {
+	s := new(Service)
+	assert.True(t, s.admits("203.0.113.7"))
+
+	s.allow, _ = cidr.Parse("10.0.0.0/8")
+	s.deny, _ = cidr.Parse("10.0.0.13")
+	assert.True(t, s.admits("10.1.2.3"))
+	assert.False(t, s.admits("10.0.0.13"))
+	assert.False(t, s.admits("203.0.113.7"))
+
+	s.allow = nil
+	assert.True(t, s.admits("203.0.113.7"))
+	assert.False(t, s.admits("10.0.0.13"))
+}
+
+func TestKeyless(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+	s.License, _ = license.Parse(testLicenseV2)
+	cipher, _ := s.License.Cipher()
+	s.contracts = contract.NewSingleContractProvider(s.License, usage.NewNoop())
+	s.keygen = keygen.New(cipher, s.contracts, s, audit.NewNoop())
+	s.pubsub = pubsub.New(s, auth.NewNoop(), new(fake.Limiter), storage.NewNoop(), new(fake.Notifier), s.subscriptions)
+	s.access = auth.NewNoop()
+	s.Config.Keyless = true
+
+	// A password which is not a key is left to the authorization provider
+	assert.True(t, conn.onConnect(&mqtt.Connect{Password: []byte("invalid")}))
+	assert.Empty(t, conn.Key())
+
+	s.access = &fake.Access{Denied: true}
+	assert.False(t, conn.onConnect(&mqtt.Connect{Password: []byte("invalid")}))
+	s.access = auth.NewNoop()
+
+	// The key is used for the plain topics, including the will topic
+	const key = "w07Jv3TMhYTg6lLk6fQoVG2KCe7gjFPk" // on a/b/c/ with 'rwslp'
+	assert.True(t, conn.onConnect(&mqtt.Connect{
+		Password:  []byte(key),
+		WillFlag:  true,
+		WillTopic: []byte("a/b/c/"),
+	}))
+	assert.Equal(t, key, conn.Key())
+	assert.True(t, conn.admitKey())
+	assert.Equal(t, key+"/a/b/c/", string(conn.connect.WillTopic))
+	assert.Nil(t, s.pubsub.OnSubscribe(conn, []byte("a/b/c/")))
+	assert.Equal(t, 1, s.subscriptions.Count())
+}
+
+func TestAuthorize_Public(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+	s.contracts = contract.NewSingleContractProvider(s.License, usage.NewNoop())
+
+	owner := security.Key(make([]byte, 24))
+	owner.SetMaster(1)
+	owner.SetContract(s.License.Contract())
+	owner.SetSignature(s.License.Signature())
+	s.public, _ = policy.New([]config.PublicConfig{{Channel: "status/", Access: "r"}}, owner, nil)
+
+	_, key, ok := s.Authorize(security.ParseChannel([]byte("public/status/eu/")), security.AllowRead)
+	assert.True(t, ok)
+	assert.Equal(t, s.License.Contract(), key.Contract())
+
+	_, _, ok = s.Authorize(security.ParseChannel([]byte("public/status/eu/")), security.AllowWrite)
+	assert.False(t, ok)
+
+	_, _, ok = s.Authorize(security.ParseChannel([]byte("public/private/")), security.AllowRead)
+	assert.False(t, ok)
+}
+
+func TestAuthorize_BannedMultiKey(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+	s.License, _ = license.Parse(testLicenseV2)
+	cipher, _ := s.License.Cipher()
+	s.contracts = contract.NewSingleContractProvider(s.License, usage.NewNoop())
+	s.keygen = keygen.New(cipher, s.contracts, s, audit.NewNoop())
+	s.cluster = cluster.NewSwarm(&config.ClusterConfig{
+		NodeName:      "00:00:00:00:00:01",
+		ListenAddr:    ":4000",
+		AdvertiseAddr: ":4001",
+		Directory:     t.TempDir(),
+	})
+	defer s.cluster.Close()
+
+	const banned = "w07Jv3TMhYTg6lLk6fQoVG2KCe7gjFPk" // on a/b/c/ with 'rwslp'
+	other, err := s.keygen.CreateKey("wnLJv3TMhYTg6lLkGfQoazo1-k7gjFPk", "x/", security.AllowRead, time.Unix(0, 0))
+	assert.Nil(t, err)
+
+	channel := func(key string) *security.Channel {
+		return security.ParseChannel([]byte(key + "/a/b/c/"))
+	}
+
+	_, _, ok := s.Authorize(channel(security.JoinKeys(banned, other)), security.AllowRead)
+	assert.True(t, ok)
+
+	// Once banned, the key should not be authorized, even as a part of a multi-channel key
+	s.cluster.Notify(&event.Ban{Target: banned}, true)
+	for _, key := range []string{
+		banned,
+		security.JoinKeys(banned, banned),
+		security.JoinKeys(other, banned),
+	} {
+		_, _, ok := s.Authorize(channel(key), security.AllowRead)
+		assert.False(t, ok, key)
+	}
+}
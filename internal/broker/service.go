@@ -26,30 +26,41 @@ import (
 	"os"
 	"os/signal"
 	"reflect"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/emitter-io/address"
+	"github.com/emitter-io/emitter/internal/async"
 	"github.com/emitter-io/emitter/internal/config"
 	"github.com/emitter-io/emitter/internal/event"
 	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/network/cidr"
 	"github.com/emitter-io/emitter/internal/network/listener"
 	"github.com/emitter-io/emitter/internal/network/websocket"
+	"github.com/emitter-io/emitter/internal/provider/audit"
+	"github.com/emitter-io/emitter/internal/provider/auth"
 	"github.com/emitter-io/emitter/internal/provider/contract"
 	"github.com/emitter-io/emitter/internal/provider/logging"
 	"github.com/emitter-io/emitter/internal/provider/monitor"
 	"github.com/emitter-io/emitter/internal/provider/storage"
 	"github.com/emitter-io/emitter/internal/provider/usage"
 	"github.com/emitter-io/emitter/internal/security"
+	"github.com/emitter-io/emitter/internal/security/jwt"
 	"github.com/emitter-io/emitter/internal/security/license"
+	"github.com/emitter-io/emitter/internal/security/policy"
+	"github.com/emitter-io/emitter/internal/service"
 	"github.com/emitter-io/emitter/internal/service/cluster"
+	"github.com/emitter-io/emitter/internal/service/guard"
 	"github.com/emitter-io/emitter/internal/service/history"
 	"github.com/emitter-io/emitter/internal/service/keyban"
 	"github.com/emitter-io/emitter/internal/service/keygen"
+	"github.com/emitter-io/emitter/internal/service/keyinfo"
 	"github.com/emitter-io/emitter/internal/service/link"
 	"github.com/emitter-io/emitter/internal/service/me"
 	"github.com/emitter-io/emitter/internal/service/presence"
 	"github.com/emitter-io/emitter/internal/service/pubsub"
+	"github.com/emitter-io/emitter/internal/service/quota"
 	"github.com/emitter-io/emitter/internal/service/survey"
 	"github.com/emitter-io/stats"
 	"github.com/kelindar/tcp"
@@ -58,9 +69,11 @@ import (
 // Service represents the main structure.
 type Service struct {
 	connections   int64              // The number of currently open connections.
+	conns         sync.Map           // The currently open connections, by their local ID.
 	context       context.Context    // The context for the service.
 	cancel        context.CancelFunc // The cancellation function.
 	License       license.License    // The licence for this emitter server.
+	retired       []license.License  // The retired licences, keys issued with them are still accepted.
 	Config        *config.Config     // The configuration for the service.
 	subscriptions *message.Trie      // The subscription matching trie.
 	http          *http.Server       // The underlying HTTP server.
@@ -68,6 +81,13 @@ type Service struct {
 	cluster       *cluster.Swarm     // The gossip-based cluster mechanism.
 	surveyor      *survey.Surveyor   // The generic query manager.
 	contracts     contract.Provider  // The contract provider for the service.
+	access        auth.Provider      // The authorization provider for the service.
+	audit         audit.Auditor      // The security audit log for the service.
+	limits        *quota.Limiter     // The rate and volume limits of the contracts.
+	guard         *guard.Guard       // The protection against brute-force attacks.
+	allow         cidr.List          // The networks the clients are allowed to connect from.
+	deny          cidr.List          // The networks the clients are not allowed to connect from.
+	collisions    *message.Detector  // The detector of the channel hash collisions (optional).
 	storage       storage.Storage    // The storage provider for the service.
 	monitor       monitor.Storage    // The storage provider for stats.
 	measurer      stats.Measurer     // The monitoring registry for the service.
@@ -75,6 +95,10 @@ type Service struct {
 	pubsub        *pubsub.Service    // The publish/subscribe service.
 	presence      *presence.Service  // The presence service.
 	keygen        *keygen.Service    // The key generation provider.
+	keyban        *keyban.Service    // The key blacklisting service.
+	keyinfo       *keyinfo.Service   // The key introspection service.
+	tokens        *jwt.Authorizer    // The JWT-based authorizer (optional).
+	public        policy.Policies    // The policies of the channels which can be accessed anonymously.
 }
 
 // NewService creates a new service.
@@ -94,6 +118,8 @@ func NewService(ctx context.Context, cfg *config.Config) (s *Service, err error)
 		http:          new(http.Server),
 		tcp:           new(tcp.Server),
 		storage:       new(storage.Noop),
+		access:        auth.NewNoop(),
+		audit:         audit.NewNoop(),
 		measurer:      stats.New(),
 	}
 
@@ -109,28 +135,52 @@ func NewService(ctx context.Context, cfg *config.Config) (s *Service, err error)
 		return nil, err
 	}
 
+	// Parse the retired licenses
+	for _, v := range cfg.Retired {
+		retired, err := license.Parse(v)
+		if err != nil {
+			return nil, err
+		}
+		s.retired = append(s.retired, retired)
+	}
+
 	// Load the logging provider
 	logging.Logger = config.LoadProvider(cfg.Logging, logging.NewStdErr()).(logging.Logging)
 	logging.LogTarget("service", "configured logging provider", logging.Logger.Name())
 
-	// Load the storage provider
-	ssdstore := storage.NewSSD(s)
-	memstore := storage.NewInMemory(s)
-	s.storage = config.LoadProvider(cfg.Storage, storage.NewNoop(), memstore, ssdstore).(storage.Storage)
-	logging.LogTarget("service", "configured message storage", s.storage.Name())
-
 	// Load the metering provider
 	s.metering = config.LoadProvider(cfg.Metering, usage.NewNoop(), usage.NewHTTP()).(usage.Metering)
 	logging.LogTarget("service", "configured usage metering", s.metering.Name())
 
 	// Load the contract provider
 	s.contracts = config.LoadProvider(cfg.Contract,
-		contract.NewSingleContractProvider(s.License, s.metering),
+		contract.NewSingleContractProvider(s.License, s.metering, s.retired...),
 		contract.NewHTTPContractProvider(s.License, s.metering)).(contract.Provider)
 	logging.LogTarget("service", "configured contracts provider", s.contracts.Name())
 
+	// Load the storage provider
+	ssdstore := storage.NewSSD(s, s.contracts)
+	memstore := storage.NewInMemory(s)
+	s.storage = config.LoadProvider(cfg.Storage, storage.NewNoop(), memstore, ssdstore).(storage.Storage)
+	logging.LogTarget("service", "configured message storage", s.storage.Name())
+
+	// Load the authorization provider
+	s.access = config.LoadProvider(cfg.Auth, auth.NewNoop(), auth.NewHTTP()).(auth.Provider)
+	logging.LogTarget("service", "configured authorization provider", s.access.Name())
+
+	// Load the security audit log
+	s.audit = config.LoadProvider(cfg.Audit,
+		audit.NewNoop(),
+		audit.NewFile(),
+		audit.NewHTTP(),
+		audit.NewSelf(s.selfPublish),
+	).(audit.Auditor)
+	logging.LogTarget("service", "configured audit log", s.audit.Name())
+
 	// Attach the pubsub service
-	s.pubsub = pubsub.New(s, s.storage, s, s.subscriptions)
+	s.limits = quota.New(s)
+	s.pubsub = pubsub.New(s, s.access, s.limits, s.storage, s, s.subscriptions)
+	s.pubsub.Cap(cfg.Limit.Last)
 
 	// Load the monitor storage provider
 	nodeName := address.Fingerprint(s.ID()).String()
@@ -153,6 +203,30 @@ func NewService(ctx context.Context, cfg *config.Config) (s *Service, err error)
 		s.cluster.OnDisconnect = s.pubsub.OnLastWill
 	}
 
+	// Protect against brute-force attacks, sharing the blocklist within the cluster
+	var replicator service.Replicator
+	if s.cluster != nil {
+		replicator = s.cluster
+	}
+	s.guard = guard.New(replicator,
+		cfg.Guard.ConnFailures,
+		cfg.Guard.AddrFailures,
+		time.Duration(cfg.Guard.BlockFor)*time.Second)
+
+	// Parse the networks the clients are allowed and not allowed to connect from
+	if s.allow, err = cidr.Parse(cfg.Network.Allow...); err != nil {
+		return nil, err
+	}
+	if s.deny, err = cidr.Parse(cfg.Network.Deny...); err != nil {
+		return nil, err
+	}
+
+	// Detect the collisions of the channel hashes, if configured
+	if cfg.Hashing.Detect > 0 {
+		s.collisions = message.NewDetector(cfg.Hashing.Detect)
+		s.pubsub.Observe(s.collisions)
+	}
+
 	// Attach survey handlers
 	s.surveyor = survey.New(s.pubsub, s.cluster)
 	s.presence = presence.New(s, s.pubsub, s.surveyor, s.subscriptions)
@@ -166,8 +240,39 @@ func NewService(ctx context.Context, cfg *config.Config) (s *Service, err error)
 		return nil, err
 	}
 
+	// Create the ciphers of the retired licences, used for decryption only
+	retired := make([]license.Cipher, 0, len(s.retired))
+	for _, l := range s.retired {
+		c, err := l.Cipher()
+		if err != nil {
+			return nil, err
+		}
+		retired = append(retired, c)
+	}
+
 	// Attach handlers
-	s.keygen = keygen.New(cipher, s.contracts, s)
+	s.keygen = keygen.New(cipher, s.contracts, s, s.audit, retired...)
+	s.keyban = keyban.New(s, s.keygen, s.cluster, s.audit)
+	s.keyinfo = keyinfo.New(s.keygen, s.contracts, replicator) // Bans can only be checked if the cluster is configured
+
+	if cfg.JWT != nil {
+		if s.tokens, err = jwt.New(cfg.JWT, s.keygen.DecryptKey); err != nil {
+			return nil, err
+		}
+		logging.LogAction("service", "configured JWT authorization")
+	}
+
+	// The public channels are owned by the contract of the license, unless specified otherwise
+	owner := security.Key(make([]byte, 24))
+	owner.SetMaster(1)
+	owner.SetContract(s.License.Contract())
+	owner.SetSignature(s.License.Signature())
+	if s.public, err = policy.New(cfg.Public, owner, s.keygen.DecryptKey); err != nil {
+		return nil, err
+	}
+
+	hist := history.New(s, s.keygen, s.contracts, replicator, s.storage)
+	hist.Cap(cfg.Limit.Last)
 	if cfg.Debug {
 		mux.HandleFunc("/debug/pprof/", pprof.Index)
 		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
@@ -176,17 +281,22 @@ func NewService(ctx context.Context, cfg *config.Config) (s *Service, err error)
 		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 	}
 	mux.HandleFunc("/health", s.onHealth)
-	mux.HandleFunc("/keygen", s.keygen.HTTP())
-	mux.HandleFunc("/presence", s.presence.OnHTTP)
+	mux.HandleFunc("/keygen", s.guarded(s.keygen.HTTP()))
+	mux.HandleFunc("/keygen/batch", s.guarded(s.keygen.OnHTTP))
+	mux.HandleFunc("/keyban", s.guarded(s.keyban.OnHTTP))
+	mux.HandleFunc("/keyinfo", s.guarded(s.keyinfo.OnHTTP))
+	mux.HandleFunc("/presence", s.guarded(s.presence.OnHTTP))
+	mux.HandleFunc("/history", s.guarded(hist.OnHTTP))
 	mux.HandleFunc("/", s.onRequest)
 
 	// Attach "emitter/..." handlers
 	s.pubsub.Handle("presence", s.presence.OnRequest)
 	s.pubsub.Handle("keygen", s.keygen.OnRequest)
-	s.pubsub.Handle("keyban", keyban.New(s, s.keygen, s.cluster).OnRequest)
+	s.pubsub.Handle("keyban", s.keyban.OnRequest)
+	s.pubsub.Handle("keyinfo", s.keyinfo.OnRequest)
 	s.pubsub.Handle("link", link.New(s, s.pubsub).OnRequest)
 	s.pubsub.Handle("me", me.New().OnRequest)
-	s.pubsub.Handle("history", history.New(s, s.storage).OnRequest)
+	s.pubsub.Handle("history", hist.OnRequest)
 
 	// Addresses and things
 	logging.LogTarget("service", "configured node name", nodeName)
@@ -229,6 +339,9 @@ func (s *Service) Listen() (err error) {
 		s.surveyor.Start()
 	}
 
+	// Periodically revoke the subscriptions which are no longer authorized
+	async.Repeat(s.context, s.Config.RevokeInterval(), s.reauthorize)
+
 	// Setup the listeners on both default and a secure addresses
 	s.listen(s.Config.Addr(), nil)
 	if tls, tlsValidator, ok := s.Config.Certificate(); ok {
@@ -258,6 +371,7 @@ func (s *Service) listen(addr *net.TCPAddr, conf *tls.Config) {
 	l, err := listener.New(addr.String(), listener.Config{
 		FlushRate: s.Config.Limit.FlushRate,
 		TLS:       conf,
+		Proxy:     s.Config.Network.Proxy,
 	})
 	if err != nil {
 		panic(err)
@@ -319,10 +433,31 @@ func (s *Service) NotifyUnsubscribe(sub message.Subscriber, ev *event.Subscripti
 
 // Occurs when a new client connection is accepted.
 func (s *Service) onAcceptConn(t net.Conn) {
+	addr := addrOf(t)
+	if !s.admits(addr) {
+		t.Close()
+		return
+	}
+
+	if s.guard.IsBlocked(addr) {
+		s.guard.Refuse()
+		t.Close()
+		return
+	}
+
 	conn := s.newConn(t, s.Config.Limit.ReadRate)
 	go conn.Process()
 }
 
+// admits checks whether a client address is allowed to connect by the global lists of
+// allowed and denied networks.
+func (s *Service) admits(addr string) bool {
+	if s.deny.Contains(addr) {
+		return false
+	}
+	return len(s.allow) == 0 || s.allow.Contains(addr)
+}
+
 // Occurs when a new HTTP request is received.
 func (s *Service) onRequest(w http.ResponseWriter, r *http.Request) {
 	if ws, ok := websocket.TryUpgrade(w, r); ok {
@@ -331,6 +466,41 @@ func (s *Service) onRequest(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// guarded protects an HTTP handler against brute-force attacks, as the MQTT connections are.
+// The requests from a blocked address are refused and each unauthorized request counts as
+// an authorization failure of its address.
+func (s *Service) guarded(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor := audit.ActorOfRequest(r)
+		if s.guard.IsBlocked(actor.Addr) {
+			s.guard.Refuse()
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		status := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(status, r)
+		if status.status == http.StatusUnauthorized && s.guard.OnFailure(actor.Addr) {
+			s.audit.Record(&audit.Event{
+				Actor: actor,
+				Type:  audit.EventBlock,
+			})
+		}
+	}
+}
+
+// statusWriter records the status code written by an HTTP handler.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code and writes it.
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
 // Occurs when a new HTTP health check is received.
 func (s *Service) onHealth(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(200)
@@ -367,6 +537,24 @@ func (s *Service) Query(query string, payload []byte) (message.Awaiter, error) {
 	return nil, errors.New("Query manager was not setup")
 }
 
+// Members returns the names of the active members of the cluster, including this node.
+func (s *Service) Members() []uint64 {
+	if s.cluster != nil {
+		return s.cluster.Members()
+	}
+
+	return []uint64{s.ID()}
+}
+
+// Ask issues a request to a single member of the cluster.
+func (s *Service) Ask(peer uint64, query string, payload []byte) (message.Awaiter, error) {
+	if s.surveyor != nil {
+		return s.surveyor.Ask(peer, query, payload)
+	}
+
+	return nil, errors.New("Query manager was not setup")
+}
+
 // Authorize attempts to authorize a channel with its key
 func (s *Service) Authorize(channel *security.Channel, permission uint8) (contract.Contract, security.Key, bool) {
 	if channel.ChannelType == security.ChannelInvalid {
@@ -375,12 +563,17 @@ func (s *Service) Authorize(channel *security.Channel, permission uint8) (contra
 
 	// Check if the key is blacklisted
 	channelKey := string(channel.Key)
-	if s.cluster != nil && s.cluster.Contains((*event.Ban)(&channelKey)) {
+	if s.isBanned(channelKey) {
 		return nil, nil, false
 	}
 
-	// Attempt to parse the key
-	key, err := s.keygen.DecryptKey(channelKey)
+	// The public channels can be accessed anonymously, if a policy allows it
+	if channelKey == policy.Key {
+		return s.public.Authorize(s.contracts, channel, permission)
+	}
+
+	// Attempt to parse the key, or derive it from the token if one was provided
+	key, err := s.decryptKey(channelKey, channel, permission)
 	if err != nil || key.IsExpired() {
 		return nil, nil, false
 	}
@@ -395,6 +588,60 @@ func (s *Service) Authorize(channel *security.Channel, permission uint8) (contra
 	return contract, key, true
 }
 
+// isBanned checks whether the key, or any of the keys a multi-channel key is made of, is banned.
+func (s *Service) isBanned(channelKey string) bool {
+	if s.cluster == nil {
+		return false
+	}
+
+	if s.cluster.Contains(&event.Ban{Target: channelKey}) {
+		return true
+	}
+
+	if security.IsMultiKey(channelKey) {
+		for _, part := range security.SplitKey(channelKey) {
+			if s.cluster.Contains(&event.Ban{Target: part}) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reauthorize authorizes again the subscriptions of all of the local connections. Since the
+// bans are replicated, each node of the cluster revokes the subscriptions of its own clients.
+func (s *Service) reauthorize() {
+	s.conns.Range(func(_, v interface{}) bool {
+		v.(*Conn).reauthorize()
+		return true
+	})
+}
+
+// decryptKey decrypts the channel key or, if JWT authorization is configured and the key
+// is a token, verifies the token and derives a key for the channel from its claims. For a
+// multi-channel key, the key which grants the permission on the channel is returned.
+func (s *Service) decryptKey(channelKey string, channel *security.Channel, permission uint8) (security.Key, error) {
+	if s.tokens != nil && jwt.IsToken(channelKey) {
+		return s.tokens.Key(channelKey, channel, permission)
+	}
+
+	if security.IsMultiKey(channelKey) {
+		return s.keygen.DecryptKeyFor(channelKey, channel, permission)
+	}
+
+	return s.keygen.DecryptKey(channelKey)
+}
+
+// isKey checks whether a key, or each of the keys of a multi-channel key, can be decrypted.
+func (s *Service) isKey(raw string) bool {
+	for _, part := range security.SplitKey(raw) {
+		if _, err := s.keygen.DecryptKey(part); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
 // SelfPublish publishes a message to itself.
 func (s *Service) selfPublish(channelName string, payload []byte) {
 	channel := security.ParseChannel([]byte("emitter/" + channelName))
@@ -439,6 +686,7 @@ func (s *Service) Close() {
 	// Gracefully dispose all of our resources
 	dispose(s.cluster)
 	dispose(s.storage)
+	dispose(s.audit)
 }
 
 func dispose(resource io.Closer) {
@@ -15,9 +15,12 @@
 package broker
 
 import (
+	"strconv"
 	"sync/atomic"
 
 	"github.com/emitter-io/address"
+	"github.com/emitter-io/emitter/internal/provider/audit"
+	"github.com/emitter-io/emitter/internal/provider/storage"
 	"github.com/emitter-io/stats"
 )
 
@@ -51,6 +54,34 @@ func (s *sampler) Snapshot() (snapshot []byte) {
 	stat.Measure("node.conns", int32(atomic.LoadInt64(&serv.connections)))
 	stat.Measure("node.subs", int32(serv.subscriptions.Count()))
 
+	// Track how many distinct keys are still in use with the retired licenses
+	if serv.keygen != nil {
+		for i, n := range serv.keygen.RetiredKeys() {
+			stat.Measure("license.retired."+strconv.Itoa(i), int32(n))
+		}
+	}
+
+	// Track the brute-force protection
+	if serv.guard != nil {
+		stat.Measure("guard.failures", int32(serv.guard.Failures()))
+		stat.Measure("guard.refused", int32(serv.guard.Refused()))
+	}
+
+	// Track the collisions of the channel hashes
+	if serv.collisions != nil {
+		stat.Measure("hash.collisions", int32(serv.collisions.Count()))
+	}
+
+	// Track the storage, such as its write queue
+	if m, ok := serv.storage.(storage.Measurable); ok {
+		m.Measure(stat)
+	}
+
+	// Track the audit log, such as the events it could not deliver
+	if m, ok := serv.audit.(audit.Measurable); ok {
+		m.Measure(stat)
+	}
+
 	// Add node tags
 	stat.Tag("node.id", node.String())
 	stat.Tag("node.addr", addr.String())
@@ -0,0 +1,116 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package keygen
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// row represents a single key of a batch.
+type row struct {
+	Channel string `json:"channel"`       // The channel to create a key for.
+	Access  string `json:"access"`        // The access rights for the channel (rwslpex).
+	TTL     int32  `json:"ttl"`           // The time to live of the key in seconds.
+	Key     string `json:"key,omitempty"` // The generated key.
+}
+
+// generateBatch generates a key for every row of a CSV or JSON file and writes the rows,
+// along with their keys, to the output in the same format.
+func generateBatch(gen generator, path string, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	isJSON := strings.EqualFold(filepath.Ext(path), ".json")
+	rows, err := readBatch(f, isJSON)
+	if err != nil {
+		return err
+	}
+
+	for i := range rows {
+		if rows[i].Key, err = gen.Generate(rows[i].Channel, rows[i].Access, rows[i].TTL); err != nil {
+			return fmt.Errorf("row %d (%s): %v", i+1, rows[i].Channel, err)
+		}
+	}
+
+	return writeBatch(w, rows, isJSON)
+}
+
+// readBatch reads the rows either from a JSON array or from CSV records of channel, access
+// and an optional ttl. A header row for the CSV is optional.
+func readBatch(r io.Reader, isJSON bool) (rows []row, err error) {
+	if isJSON {
+		err = json.NewDecoder(r).Decode(&rows)
+		return
+	}
+
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, record := range records {
+		if i == 0 && strings.EqualFold(record[0], "channel") {
+			continue // Skip the header
+		}
+
+		if len(record) < 2 {
+			return nil, fmt.Errorf("row %d: expected a channel and access rights", i+1)
+		}
+
+		item := row{Channel: record[0], Access: record[1]}
+		if len(record) > 2 && record[2] != "" {
+			ttl, err := strconv.ParseInt(record[2], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("row %d: invalid ttl %q", i+1, record[2])
+			}
+			item.TTL = int32(ttl)
+		}
+
+		rows = append(rows, item)
+	}
+	return
+}
+
+// writeBatch writes the generated rows either as a JSON array or as CSV records.
+func writeBatch(w io.Writer, rows []row, isJSON bool) error {
+	if isJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(rows)
+	}
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"channel", "access", "ttl", "key"})
+	for _, r := range rows {
+		writer.Write([]string{r.Channel, r.Access, strconv.Itoa(int(r.TTL)), r.Key})
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,164 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package keygen
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/provider/audit"
+	"github.com/emitter-io/emitter/internal/provider/contract"
+	"github.com/emitter-io/emitter/internal/provider/usage"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/emitter-io/emitter/internal/security/license"
+	"github.com/emitter-io/emitter/internal/service/keygen"
+)
+
+// generator represents a channel key generator.
+type generator interface {
+	Generate(channel, access string, ttl int32) (string, error)
+	Close()
+}
+
+// newGenerator creates a local generator if a license is provided, or a remote one otherwise.
+func newGenerator(masterKey, license, host string) (generator, error) {
+	if license != "" {
+		return newLocal(masterKey, license)
+	}
+
+	return newRemote(masterKey, host)
+}
+
+// ------------------------------------------------------------------------------------
+
+// local represents a generator which generates the keys using the license.
+type local struct {
+	masterKey string          // The master key to use.
+	service   *keygen.Service // The key generation service.
+}
+
+// newLocal creates a new local generator for the license.
+func newLocal(masterKey, rawLicense string) (*local, error) {
+	l, err := license.Parse(rawLicense)
+	if err != nil {
+		return nil, err
+	}
+
+	cipher, err := l.Cipher()
+	if err != nil {
+		return nil, err
+	}
+
+	return &local{
+		masterKey: masterKey,
+		service:   keygen.New(cipher, contract.NewSingleContractProvider(l, usage.NewNoop()), nil, audit.NewNoop()),
+	}, nil
+}
+
+// Generate generates a new channel key.
+func (g *local) Generate(channel, access string, ttl int32) (string, error) {
+	expires := time.Unix(0, 0)
+	if ttl > 0 {
+		expires = time.Now().Add(time.Duration(ttl) * time.Second).UTC()
+	}
+
+	key, err := g.service.CreateKey(g.masterKey, channel, security.ParseAccess(access), expires)
+	if err != nil {
+		return "", err
+	}
+
+	return key, nil
+}
+
+// Close closes the generator.
+func (g *local) Close() {}
+
+// ------------------------------------------------------------------------------------
+
+// remote represents a generator which requests a running broker to generate the keys.
+type remote struct {
+	masterKey string      // The master key to use.
+	client    mqtt.Client // The MQTT client connected to the broker.
+	responses chan []byte // The channel to receive the responses.
+}
+
+// newRemote creates a new remote generator and connects it to the broker.
+func newRemote(masterKey, host string) (*remote, error) {
+	g := &remote{
+		masterKey: masterKey,
+		responses: make(chan []byte),
+	}
+
+	// Create a new MQTT client.
+	opts := mqtt.NewClientOptions().AddBroker(fmt.Sprintf("tcp://%s", host))
+	opts.SetDefaultPublishHandler(func(client mqtt.Client, m mqtt.Message) {
+		g.responses <- m.Payload()
+	})
+
+	// Connect to the MQTT broker.
+	g.client = mqtt.NewClient(opts)
+	if token := g.client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, fmt.Errorf("failed to connect: %v", token.Error())
+	}
+
+	return g, nil
+}
+
+// Generate generates a new channel key.
+func (g *remote) Generate(channel, access string, ttl int32) (string, error) {
+	payload, err := json.Marshal(keygen.Request{
+		Key:     g.masterKey,
+		Channel: channel,
+		Type:    access,
+		TTL:     ttl,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Publish the request.
+	if token := g.client.Publish("emitter/keygen/", 1, false, payload); token.Wait() && token.Error() != nil {
+		return "", token.Error()
+	}
+
+	// Wait for the response and check whether it's an error.
+	var response []byte
+	select {
+	case response = <-g.responses:
+	case <-time.After(30 * time.Second):
+		return "", fmt.Errorf("timed out waiting for the response")
+	}
+
+	var errResponse errors.Error
+	if err := json.Unmarshal(response, &errResponse); err == nil && errResponse.Error() != "" {
+		return "", fmt.Errorf("error: %s", errResponse.Error())
+	}
+
+	// Parse the response and return the key.
+	var resp keygen.Response
+	if err := json.Unmarshal(response, &resp); err != nil {
+		return "", err
+	}
+
+	return resp.Key, nil
+}
+
+// Close disconnects from the broker.
+func (g *remote) Close() {
+	g.client.Disconnect(250)
+}
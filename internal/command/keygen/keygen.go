@@ -15,75 +15,62 @@
 package keygen
 
 import (
-	"encoding/json"
 	"fmt"
+	"os"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
-	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/command/license"
 	"github.com/emitter-io/emitter/internal/provider/logging"
-	"github.com/emitter-io/emitter/internal/service/keygen"
 	cli "github.com/jawher/mow.cli"
 )
 
-// Generate a new channel key.
+// NewKey generates a new channel key, or a batch of channel keys. If a license is provided,
+// the keys are generated locally, otherwise a running broker is asked to generate them.
 func NewKey(cmd *cli.Cmd) {
-	cmd.Spec = "MASTERKEY CHANNEL ACCESS [ -t=<ttl>] [ -h=<host> ]"
+	cmd.Spec = "MASTERKEY [ CHANNEL ACCESS ] [ -t=<ttl> ] [ -h=<host> ] [ -l=<license> ] [ -c=<configuration path> ] [ -b=<batch file> ]"
 	var (
-		masterkey = cmd.StringArg("MASTERKEY", "", "Specifies the master key for generating channel keys.")
-		channel   = cmd.StringArg("CHANNEL", "", "Specifies the name channel for which to generate key.")
-		access    = cmd.StringArg("ACCESS", "", "Specifies the access rights for the channel (rwslpex).")
-		ttl       = cmd.IntOpt("t ttl", 0, "Specifies the time to live for the key in seconds. By default, the key will never expire.")
-		host      = cmd.StringOpt("h host", "127.0.0.1:8080", "Specifies the broker host name and port. This must follow the <ip:port> format.")
+		masterkey  = cmd.StringArg("MASTERKEY", "", "Specifies the master key for generating channel keys.")
+		channel    = cmd.StringArg("CHANNEL", "", "Specifies the name channel for which to generate key.")
+		access     = cmd.StringArg("ACCESS", "", "Specifies the access rights for the channel (rwslpex).")
+		ttl        = cmd.IntOpt("t ttl", 0, "Specifies the time to live for the key in seconds. By default, the key will never expire.")
+		host       = cmd.StringOpt("h host", "127.0.0.1:8080", "Specifies the broker host name and port. This must follow the <ip:port> format.")
+		conf       = cmd.StringOpt("c config", "", "Specifies the configuration file to read the license from, for generating the keys locally.")
+		batch      = cmd.StringOpt("b batch", "", "Specifies a CSV or JSON file with the channel, access and ttl of each key to generate.")
+		rawLicense = cmd.String(cli.StringOpt{
+			Name:   "l license",
+			Desc:   "Specifies the license to use for generating the keys locally, without connecting to a broker.",
+			EnvVar: "EMITTER_LICENSE",
+		})
 	)
 
 	cmd.Action = func() {
-		// Create a channel to receive the response.
-		respChan := make(chan []byte)
-
-		// Create a new MQTT client.
-		opts := mqtt.NewClientOptions().AddBroker(fmt.Sprintf("tcp://%s", *host))
-		opts.SetDefaultPublishHandler(func(client mqtt.Client, m mqtt.Message) {
-			respChan <- m.Payload()
-		})
-		client := mqtt.NewClient(opts)
-
-		// Connect to the MQTT broker.
-		if token := client.Connect(); token.Wait() && token.Error() != nil {
-			panic(fmt.Errorf("failed to connect: %v", token.Error()))
+		if *batch == "" && (*channel == "" || *access == "") {
+			logging.LogAction("keygen", "either a channel and access rights or a batch file must be provided")
+			return
 		}
 
-		// Publish the request.
-		request := keygen.Request{
-			Key:     *masterkey,
-			Channel: *channel,
-			Type:    *access,
-			TTL:     int32(*ttl),
-		}
-		payload, err := json.Marshal(request)
+		// Create a generator, which generates the keys locally if we have a license
+		gen, err := newGenerator(*masterkey, license.Load(*rawLicense, *conf), *host)
 		if err != nil {
-			logging.LogError("keygen", "marshaling the request", err)
-			return
-		}
-		if token := client.Publish("emitter/keygen/", 1, false, payload); token.Wait() && token.Error() != nil {
-			logging.LogError("keygen", "publishing the request", token.Error())
+			logging.LogError("keygen", "creating the generator", err)
 			return
 		}
+		defer gen.Close()
 
-		// Wait for the response and check whether it's an error.
-		response := <-respChan
-		var errResponse errors.Error
-		if err := json.Unmarshal(response, &errResponse); err == nil && errResponse.Error() != "" {
-			logging.LogError("keygen", "generating the key", fmt.Errorf("error: %s", errResponse.Error()))
+		// Generate a batch of keys from the file
+		if *batch != "" {
+			if err := generateBatch(gen, *batch, os.Stdout); err != nil {
+				logging.LogError("keygen", "generating the batch", err)
+			}
 			return
 		}
 
-		// Parse the response and print the key.
-		keygen := keygen.Response{}
-		if err := json.Unmarshal(response, &keygen); err != nil {
-			logging.LogError("keygen", "parsing the response", err)
+		// Generate a single key and print it
+		key, err := gen.Generate(*channel, *access, int32(*ttl))
+		if err != nil {
+			logging.LogError("keygen", "generating the key", err)
 			return
 		}
-		fmt.Println(keygen.Key)
-		client.Disconnect(250)
+
+		fmt.Println(key)
 	}
 }
@@ -0,0 +1,136 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package keygen
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cmdlicense "github.com/emitter-io/emitter/internal/command/license"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/emitter-io/emitter/internal/security/license"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testLicense = "zT83oDV0DWY5_JysbSTPTDr8KB0AAAAAAAAAAAAAAAI:1"
+	testSecret  = "kBCZch5re3Ue-kpG1Aa8Vo7BYvXZ3UwR"
+)
+
+func decryptKey(t *testing.T, key string) security.Key {
+	l, err := license.Parse(testLicense)
+	assert.NoError(t, err)
+	cipher, err := l.Cipher()
+	assert.NoError(t, err)
+	k, err := cipher.DecryptKey([]byte(key))
+	assert.NoError(t, err)
+	return k
+}
+
+func TestLocal_Generate(t *testing.T) {
+	gen, err := newGenerator(testSecret, testLicense, "")
+	assert.NoError(t, err)
+	defer gen.Close()
+
+	key, err := gen.Generate("a/b/", "rw", 60)
+	assert.NoError(t, err)
+
+	k := decryptKey(t, key)
+	assert.Equal(t, security.AllowReadWrite, k.Permissions())
+	assert.False(t, k.Expires().IsZero())
+	assert.True(t, k.ValidateChannel(security.ParseChannel([]byte(key+"/a/b/"))))
+
+	_, err = gen.Generate("a/b", "rw", 0)
+	assert.Error(t, err)
+
+	_, err = newLocal(testSecret, "xxxxxx:3")
+	assert.Error(t, err)
+}
+
+func TestReadBatch(t *testing.T) {
+	tests := []struct {
+		input  string
+		isJSON bool
+		rows   []row
+		err    bool
+	}{
+		{
+			input: "channel,access,ttl\na/,rw,60\nb/c/, r\n# comment\n",
+			rows:  []row{{Channel: "a/", Access: "rw", TTL: 60}, {Channel: "b/c/", Access: "r"}},
+		},
+		{input: "a/,rw,xx\n", err: true},
+		{input: "a/\n", err: true},
+		{
+			input:  `[{"channel":"a/","access":"rw","ttl":60},{"channel":"b/","access":"s"}]`,
+			isJSON: true,
+			rows:   []row{{Channel: "a/", Access: "rw", TTL: 60}, {Channel: "b/", Access: "s"}},
+		},
+		{input: `{}`, isJSON: true, err: true},
+	}
+
+	for _, tc := range tests {
+		rows, err := readBatch(strings.NewReader(tc.input), tc.isJSON)
+		assert.Equal(t, tc.err, err != nil, tc.input)
+		if !tc.err {
+			assert.Equal(t, tc.rows, rows)
+		}
+	}
+}
+
+func TestGenerateBatch(t *testing.T) {
+	gen, err := newLocal(testSecret, testLicense)
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	csvFile := filepath.Join(dir, "keys.csv")
+	jsonFile := filepath.Join(dir, "keys.json")
+	assert.NoError(t, os.WriteFile(csvFile, []byte("a/,rw\nb/,r,3600\n"), 0644))
+	assert.NoError(t, os.WriteFile(jsonFile, []byte(`[{"channel":"a/","access":"rw"}]`), 0644))
+
+	// Generate from a CSV file
+	var out bytes.Buffer
+	assert.NoError(t, generateBatch(gen, csvFile, &out))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 3)
+	assert.Equal(t, "channel,access,ttl,key", lines[0])
+	assert.True(t, strings.HasPrefix(lines[2], "b/,r,3600,"))
+
+	// Generate from a JSON file
+	out.Reset()
+	assert.NoError(t, generateBatch(gen, jsonFile, &out))
+	var rows []row
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &rows))
+	assert.Len(t, rows, 1)
+	assert.Equal(t, security.AllowReadWrite, decryptKey(t, rows[0].Key).Permissions())
+
+	// Invalid rows should fail the batch
+	assert.NoError(t, os.WriteFile(csvFile, []byte("a,rw\n"), 0644))
+	assert.Error(t, generateBatch(gen, csvFile, &out))
+	assert.Error(t, generateBatch(gen, filepath.Join(dir, "missing.csv"), &out))
+}
+
+func TestLoadLicense(t *testing.T) {
+	assert.Equal(t, "abc", cmdlicense.Load("abc", "emitter.conf"))
+	assert.Equal(t, "", cmdlicense.Load("", ""))
+	assert.Equal(t, "", cmdlicense.Load("", filepath.Join(t.TempDir(), "missing.conf")))
+
+	path := filepath.Join(t.TempDir(), "emitter.conf")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"license":"`+testLicense+`"}`), 0644))
+	assert.Equal(t, testLicense, cmdlicense.Load("", path))
+}
@@ -16,8 +16,13 @@ package license
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"time"
 
+	"github.com/emitter-io/emitter/internal/config"
 	"github.com/emitter-io/emitter/internal/provider/logging"
+	"github.com/emitter-io/emitter/internal/security"
 	"github.com/emitter-io/emitter/internal/security/license"
 	"github.com/jawher/mow.cli"
 )
@@ -31,3 +36,171 @@ func New(cmd *cli.Cmd) {
 		logging.LogAction("license", fmt.Sprintf("generated new secret key: %v", secret))
 	}
 }
+
+// Inspect prints the details of a license.
+func Inspect(cmd *cli.Cmd) {
+	cmd.Spec = "LICENSE"
+	raw := cmd.StringArg("LICENSE", "", "Specifies the license to inspect.")
+	cmd.Action = func() {
+		l, err := license.Parse(*raw)
+		if err != nil {
+			logging.LogError("license", "parsing the license", err)
+			return
+		}
+
+		inspect(os.Stdout, l)
+	}
+}
+
+// Master generates an additional master key for the license.
+func Master(cmd *cli.Cmd) {
+	cmd.Spec = "ID [ -l=<license> ] [ -c=<configuration path> ]"
+	id := cmd.IntArg("ID", 0, "Specifies the identifier of the master key to generate.")
+	raw, conf := licenseOpts(cmd)
+	cmd.Action = func() {
+		l, err := license.Parse(Load(*raw, *conf))
+		if err != nil {
+			logging.LogError("license", "parsing the license", err)
+			return
+		}
+
+		if *id <= 0 || *id > 0xffff {
+			logging.LogAction("license", "the identifier of the master key must be between 1 and 65535")
+			return
+		}
+
+		secret, err := newMasterKey(l, uint16(*id))
+		if err != nil {
+			logging.LogError("license", "generating the master key", err)
+			return
+		}
+
+		fmt.Println(secret)
+	}
+}
+
+// Verify decodes a key using the license and prints its details.
+func Verify(cmd *cli.Cmd) {
+	cmd.Spec = "KEY [ CHANNEL ] [ -l=<license> ] [ -c=<configuration path> ]"
+	key := cmd.StringArg("KEY", "", "Specifies the key to verify.")
+	channel := cmd.StringArg("CHANNEL", "", "Specifies the channel used to recover the target of the key.")
+	raw, conf := licenseOpts(cmd)
+	cmd.Action = func() {
+		l, err := license.Parse(Load(*raw, *conf))
+		if err != nil {
+			logging.LogError("license", "parsing the license", err)
+			return
+		}
+
+		if err := verify(os.Stdout, l, *key, *channel); err != nil {
+			logging.LogError("license", "decrypting the key", err)
+		}
+	}
+}
+
+// Load returns the license provided through the flag or the environment, otherwise
+// attempts to read the license from the configuration file, if one was specified.
+func Load(license, path string) string {
+	if license != "" || path == "" {
+		return license
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		logging.LogError("license", "reading the configuration", err)
+		return ""
+	}
+
+	return config.New(path).License
+}
+
+// licenseOpts declares the options for providing the license to a command.
+func licenseOpts(cmd *cli.Cmd) (license, conf *string) {
+	license = cmd.String(cli.StringOpt{
+		Name:   "l license",
+		Desc:   "Specifies the license to use.",
+		EnvVar: "EMITTER_LICENSE",
+	})
+	conf = cmd.StringOpt("c config", "", "Specifies the configuration file to read the license from.")
+	return
+}
+
+// newMasterKey generates and encrypts a new master key for the license. Since the contract
+// of the license only accepts its own master key, any other identifier is refused.
+func newMasterKey(l license.License, id uint16) (string, error) {
+	if uint32(id) != l.Master() {
+		return "", fmt.Errorf("the contract of the license only accepts the master key %d", l.Master())
+	}
+
+	cipher, err := l.Cipher()
+	if err != nil {
+		return "", err
+	}
+
+	key, err := l.NewMasterKey(id)
+	if err != nil {
+		return "", err
+	}
+
+	return cipher.EncryptKey(key)
+}
+
+// inspect writes the details of a license.
+func inspect(w io.Writer, l license.License) {
+	fmt.Fprintf(w, "version:   %d\n", license.Version(l))
+	fmt.Fprintf(w, "contract:  %d (0x%08x)\n", l.Contract(), l.Contract())
+	fmt.Fprintf(w, "signature: 0x%08x\n", l.Signature())
+	fmt.Fprintf(w, "master:    %d\n", l.Master())
+}
+
+// verify decrypts a key and writes its details.
+func verify(w io.Writer, l license.License, rawKey, channel string) error {
+	cipher, err := l.Cipher()
+	if err != nil {
+		return err
+	}
+
+	key, err := cipher.DecryptKey([]byte(rawKey))
+	if err != nil {
+		return err
+	}
+
+	// Recover the static parts of the target from the channel, if provided
+	var target *security.Channel
+	if channel != "" {
+		target = security.ParseChannel([]byte(rawKey + "/" + channel))
+	}
+
+	fmt.Fprintf(w, "contract:    %d (0x%08x)\n", key.Contract(), key.Contract())
+	fmt.Fprintf(w, "signature:   0x%08x (%s)\n", key.Signature(), matches(key, l))
+	fmt.Fprintf(w, "master:      %d\n", key.Master())
+	if key.IsMaster() {
+		fmt.Fprintf(w, "permissions: master\n")
+	} else {
+		fmt.Fprintf(w, "permissions: %s\n", security.FormatAccess(key.Permissions()))
+		fmt.Fprintf(w, "channel:     %s\n", key.TargetPattern(target))
+	}
+
+	fmt.Fprintf(w, "expires:     %s\n", expiry(key))
+	return nil
+}
+
+// matches describes whether the key was issued for the contract of the license.
+func matches(key security.Key, l license.License) string {
+	if key.Contract() == l.Contract() && key.Signature() == l.Signature() {
+		return "matches the license"
+	}
+	return "does not match the license"
+}
+
+// expiry describes the expiration of the key.
+func expiry(key security.Key) string {
+	expires := key.Expires()
+	switch {
+	case expires.Unix() == 0:
+		return "never"
+	case key.IsExpired():
+		return expires.Format(time.RFC3339) + " (expired)"
+	default:
+		return expires.Format(time.RFC3339)
+	}
+}
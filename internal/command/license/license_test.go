@@ -15,18 +15,115 @@
 package license
 
 import (
+	"bytes"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/emitter-io/emitter/internal/security/license"
 	"github.com/jawher/mow.cli"
 	"github.com/stretchr/testify/assert"
 )
 
+const (
+	testLicense = "zT83oDV0DWY5_JysbSTPTDr8KB0AAAAAAAAAAAAAAAI:1"
+	testSecret  = "kBCZch5re3Ue-kpG1Aa8Vo7BYvXZ3UwR"
+)
+
 func TestNew(t *testing.T) {
 	assert.NotPanics(t, func() {
 		runCommand(New)
 	})
 }
 
+func TestCommands(t *testing.T) {
+	assert.NotPanics(t, func() {
+		runCommand(Inspect, testLicense)
+		runCommand(Inspect, "xxxxxx:3")
+		runCommand(Master, "2", "-l", testLicense)
+		runCommand(Master, "0", "-l", testLicense)
+		runCommand(Verify, testSecret, "-l", testLicense)
+		runCommand(Verify, testSecret, "a/", "-l", "xxxxxx:3")
+	})
+}
+
+func TestInspect(t *testing.T) {
+	l, err := license.Parse(testLicense)
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	inspect(&out, l)
+	assert.Equal(t, "version:   1\n"+
+		"contract:  989603869 (0x3afc281d)\n"+
+		"signature: 0x00000000\n"+
+		"master:    1\n", out.String())
+}
+
+func TestMaster(t *testing.T) {
+	l := license.NewV4()
+	l.Index = 5
+	secret, err := newMasterKey(l, 5)
+	assert.NoError(t, err)
+
+	cipher, _ := l.Cipher()
+	key, err := cipher.DecryptKey([]byte(secret))
+	assert.NoError(t, err)
+	assert.True(t, key.IsMaster())
+	assert.Equal(t, uint16(5), key.Master())
+	assert.Equal(t, l.Contract(), key.Contract())
+
+	// The master keys which the contract does not accept are refused
+	_, err = newMasterKey(l, 2)
+	assert.Error(t, err)
+}
+
+func TestVerify(t *testing.T) {
+	l, _ := license.Parse(testLicense)
+	cipher, _ := l.Cipher()
+
+	// Verify the master key
+	var out bytes.Buffer
+	assert.NoError(t, verify(&out, l, testSecret, ""))
+	assert.Equal(t, "contract:    989603869 (0x3afc281d)\n"+
+		"signature:   0x00000000 (matches the license)\n"+
+		"master:      1\n"+
+		"permissions: master\n"+
+		"expires:     never\n", out.String())
+
+	// Verify a channel key
+	key := security.Key(make([]byte, 24))
+	key.SetMaster(1)
+	key.SetContract(l.Contract())
+	key.SetSignature(1)
+	key.SetPermissions(security.AllowReadWrite)
+	key.SetTarget("a/b/#/")
+	key.SetExpires(time.Unix(1500000000, 0))
+	encrypted, _ := cipher.EncryptKey(key)
+
+	out.Reset()
+	assert.NoError(t, verify(&out, l, encrypted, "a/b/c/"))
+	assert.Equal(t, "contract:    989603869 (0x3afc281d)\n"+
+		"signature:   0x00000001 (does not match the license)\n"+
+		"master:      1\n"+
+		"permissions: rw\n"+
+		"channel:     a/b/#/\n"+
+		"expires:     2017-07-14T02:40:00Z (expired)\n", out.String())
+
+	assert.Error(t, verify(&out, l, "invalid", ""))
+}
+
+func TestLoad(t *testing.T) {
+	assert.Equal(t, "abc", Load("abc", "emitter.conf"))
+	assert.Equal(t, "", Load("", ""))
+	assert.Equal(t, "", Load("", filepath.Join(t.TempDir(), "missing.conf")))
+
+	path := filepath.Join(t.TempDir(), "emitter.conf")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"license":"`+testLicense+`"}`), 0644))
+	assert.Equal(t, testLicense, Load("", path))
+}
+
 func runCommand(f func(cmd *cli.Cmd), args ...string) {
 	app := cli.App("emitter", "")
 	app.Command("test", "", f)
@@ -19,6 +19,7 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/emitter-io/address"
 	cfg "github.com/emitter-io/config"
@@ -29,6 +30,8 @@ import (
 const (
 	ChannelSeparator = '/'   // The separator character.
 	maxMessageSize   = 65536 // Default Maximum message size allowed from/to the peer.
+
+	defaultRevokeInterval = 10 * time.Second // Default interval for authorizing the subscriptions again.
 )
 
 // VaultUser is the vault user to use for authentication
@@ -84,14 +87,24 @@ func New(filename string, stores ...cfg.SecretStore) *Config {
 type Config struct {
 	ListenAddr string              `json:"listen"`             // The API port used for TCP & Websocket communication.
 	License    string              `json:"license"`            // The license file to use for the broker.
+	Retired    []string            `json:"retired,omitempty"`  // The retired licenses, keys issued with them are still accepted.
 	Matcher    string              `json:"matcher,omitempty"`  // If "mqtt", then topic matching would follow MQTT specification.
 	Debug      bool                `json:"debug,omitempty"`    // The debug mode flag.
+	Keyless    bool                `json:"keyless,omitempty"`  // If set, clients presenting a key during MQTT connect use plain topics.
 	Limit      LimitConfig         `json:"limit,omitempty"`    // Configuration for various limits such as message size.
+	Revoke     RevokeConfig        `json:"revoke,omitempty"`   // Configuration for the revocation of subscriptions.
+	Guard      GuardConfig         `json:"guard,omitempty"`    // Configuration for the protection against brute-force attacks.
+	Network    NetworkConfig       `json:"network,omitempty"`  // Configuration for the networks the clients can connect from.
+	Hashing    HashingConfig       `json:"hashing,omitempty"`  // Configuration for the handling of channel hash collisions.
 	TLS        *cfg.TLSConfig      `json:"tls,omitempty"`      // The API port used for Secure TCP & Websocket communication.
 	Cluster    *ClusterConfig      `json:"cluster,omitempty"`  // The configuration for the clustering.
+	JWT        *JWTConfig          `json:"jwt,omitempty"`      // The configuration for the JWT-based authorization.
+	Public     []PublicConfig      `json:"public,omitempty"`   // The channels which can be accessed anonymously.
 	Storage    *cfg.ProviderConfig `json:"storage,omitempty"`  // The configuration for the storage provider.
 	Contract   *cfg.ProviderConfig `json:"contract,omitempty"` // The configuration for the contract provider.
 	Metering   *cfg.ProviderConfig `json:"metering,omitempty"` // The configuration for the usage storage for metering.
+	Auth       *cfg.ProviderConfig `json:"auth,omitempty"`     // The configuration for the authorization provider.
+	Audit      *cfg.ProviderConfig `json:"audit,omitempty"`    // The configuration for the security audit log.
 	Logging    *cfg.ProviderConfig `json:"logging,omitempty"`  // The configuration for the logger.
 	Monitor    *cfg.ProviderConfig `json:"monitor,omitempty"`  // The configuration for the monitoring storage.
 	Vault      secretStoreConfig   `json:"vault,omitempty"`    // The configuration for the Hashicorp Vault Secret Store.
@@ -109,6 +122,14 @@ func (c *Config) MaxMessageBytes() int64 {
 	return int64(c.Limit.MessageSize)
 }
 
+// RevokeInterval returns the interval at which the subscriptions are authorized again.
+func (c *Config) RevokeInterval() time.Duration {
+	if c.Revoke.Interval <= 0 {
+		return defaultRevokeInterval
+	}
+	return time.Duration(c.Revoke.Interval) * time.Second
+}
+
 // Addr returns the listen address configured.
 func (c *Config) Addr() *net.TCPAddr {
 	if c.listenAddr == nil {
@@ -162,6 +183,56 @@ type ClusterConfig struct {
 	Directory string `json:"dir,omitempty"`
 }
 
+// JWTConfig represents the configuration for authorizing channels with JSON Web Tokens
+// issued by an external identity provider.
+type JWTConfig struct {
+
+	// The master keys under which the tokens are accepted. The contract of a token is
+	// mapped to the master key of the same contract and keys derived from a token are
+	// validated as if they were generated by that master key.
+	Masters []string `json:"masters"`
+
+	// The shared secret used to verify the HS256 signatures.
+	Secret string `json:"secret,omitempty"`
+
+	// The files containing PEM-encoded public keys or certificates used to verify the
+	// RS256 and ES256 signatures.
+	Keys []string `json:"keys,omitempty"`
+
+	// The local file containing a JSON Web Key Set used to verify the signatures.
+	JWKS string `json:"jwks,omitempty"`
+
+	// The expected issuer of the tokens, if specified.
+	Issuer string `json:"issuer,omitempty"`
+
+	// The expected audience of the tokens, if specified.
+	Audience string `json:"audience,omitempty"`
+}
+
+// PublicConfig represents a policy which allows the channels under a prefix to be accessed
+// anonymously, using "public" in place of the key.
+type PublicConfig struct {
+
+	// The channel prefix, such as "status/", under which the channels are public.
+	Channel string `json:"channel"`
+
+	// The permissions granted on the channels, such as "r" or "rw".
+	Access string `json:"access"`
+
+	// The master key of the contract which owns the channels and is metered for them. If not
+	// specified, the channels are owned by the contract of the license.
+	Master string `json:"master,omitempty"`
+
+	// The maximum number of messages per second published by all of the anonymous clients.
+	Rate int `json:"rate,omitempty"`
+
+	// The maximum number of bytes per day published by all of the anonymous clients.
+	Daily int64 `json:"daily,omitempty"`
+
+	// The maximum number of concurrent anonymous clients.
+	Connections int `json:"connections,omitempty"`
+}
+
 // LimitConfig represents various limit configurations - such as message size.
 type LimitConfig struct {
 
@@ -175,6 +246,71 @@ type LimitConfig struct {
 	// The maximum socket write rate per connection. This does not limit QpS but instead
 	// can be used to scale throughput. Defaults to 60.
 	FlushRate int `json:"flushRate,omitempty"`
+
+	// The maximum number of messages which can be retrieved by a single subscription with
+	// the 'last' option or by a single history request. Defaults to 1000.
+	Last int `json:"last,omitempty"`
+}
+
+// RevokeConfig represents the configuration for the continuous authorization of the
+// subscriptions, which revokes them once their key expires, is banned or its contract
+// is refused.
+type RevokeConfig struct {
+
+	// The interval in seconds at which the keys of the active subscriptions are checked
+	// again. Defaults to 10 seconds.
+	Interval int `json:"interval,omitempty"`
+
+	// If set, the client is disconnected instead of only having the affected subscriptions
+	// revoked.
+	Disconnect bool `json:"disconnect,omitempty"`
+}
+
+// GuardConfig represents the configuration for the protection against brute-force attacks,
+// which slows down and drops the clients that keep failing to authorize.
+type GuardConfig struct {
+
+	// The number of authorization failures after which a connection is dropped. Defaults
+	// to 10.
+	ConnFailures int `json:"connFailures,omitempty"`
+
+	// The number of authorization failures per minute after which an IP address is blocked
+	// across the cluster. Defaults to 50.
+	AddrFailures int `json:"addrFailures,omitempty"`
+
+	// The number of seconds an IP address remains blocked for. Defaults to 15 minutes.
+	BlockFor int `json:"blockFor,omitempty"`
+}
+
+// NetworkConfig represents the configuration for the networks the clients can connect from.
+type NetworkConfig struct {
+
+	// The networks in CIDR notation, such as "10.0.0.0/8", the clients are allowed to connect
+	// from. If not specified, clients can connect from any network which is not denied.
+	Allow []string `json:"allow,omitempty"`
+
+	// The networks in CIDR notation the clients are not allowed to connect from. This takes
+	// precedence over the allowed networks.
+	Deny []string `json:"deny,omitempty"`
+
+	// If set, every connection must start with a PROXY protocol header (version 1 or 2) and
+	// the address of the client is taken from it. This should only be enabled when the broker
+	// can only be reached through the proxy, such as a load balancer.
+	Proxy bool `json:"proxy,omitempty"`
+}
+
+// HashingConfig represents the configuration for the handling of collisions of the hashes
+// of the channels, given that the messages are routed by these hashes only.
+type HashingConfig struct {
+
+	// If set, the channel of every message is checked against the channels the client has
+	// subscribed to before the message is delivered, so that a channel with a colliding
+	// hash is never delivered to the subscribers of another one.
+	Verify bool `json:"verify,omitempty"`
+
+	// The number of channel segments to remember in order to detect the collisions, which
+	// are logged and counted. If not specified, the collisions are not detected.
+	Detect int `json:"detect,omitempty"`
 }
 
 // LoadProvider loads a provider from the configuration or panics if the configuration is
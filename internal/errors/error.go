@@ -27,6 +27,7 @@ type Error struct {
 	Request uint16 `json:"req,omitempty"`
 	Status  int    `json:"status"`
 	Message string `json:"message"`
+	Channel string `json:"channel,omitempty"`
 }
 
 // Error implements error interface.
@@ -56,4 +57,9 @@ var (
 	ErrTargetTooLong   = &Error{Status: 400, Message: "channel can not have more than 23 parts"}
 	ErrLinkInvalid     = &Error{Status: 400, Message: "the link must be an alphanumeric string of 1 or 2 characters"}
 	ErrUnauthorizedExt = &Error{Status: 401, Message: "the security key with extend permission can only be used for private links"}
+	ErrRateLimited     = &Error{Status: 429, Message: "the rate limit of messages per second was exceeded"}
+	ErrQuotaExceeded   = &Error{Status: 429, Message: "the daily quota of bytes was exceeded"}
+	ErrTooManyConns    = &Error{Status: 429, Message: "the limit of concurrent connections was reached"}
+	ErrRevoked         = &Error{Status: 401, Message: "the security key is no longer authorized and the subscription was revoked"}
+	ErrNetworkDenied   = &Error{Status: 403, Message: "the contract does not allow connections from the network of the client"}
 )
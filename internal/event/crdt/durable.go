@@ -193,6 +193,29 @@ func (s *Durable) Range(prefix []byte, tombstones bool, f func(string, Value) bo
 	})
 }
 
+// Purge removes the items for which the function returns true, without leaving a tombstone.
+func (s *Durable) Purge(f func(string, Value) bool) {
+	var keys []string
+	s.Range(nil, true, func(k string, v Value) bool {
+		if f(k, v) {
+			keys = append(keys, k)
+		}
+		return true
+	})
+
+	if len(keys) == 0 {
+		return
+	}
+
+	s.db.Update(func(tx *buntdb.Tx) error {
+		for _, k := range keys {
+			tx.Delete(k)
+			s.cache.Del(binary.ToBytes(k))
+		}
+		return nil
+	})
+}
+
 // Count returns the number of items in the set.
 func (s *Durable) Count() (count int) {
 	s.Range(nil, true, func(k string, v Value) bool {
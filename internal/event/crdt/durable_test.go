@@ -274,6 +274,22 @@ func TestDurableRange(t *testing.T) {
 	assert.Equal(t, 5, count)
 }
 
+func TestDurablePurge(t *testing.T) {
+	state := newDurableWith("",
+		map[string]Value{
+			"AA": newTime(60, 50, nil),
+			"AB": newTime(10, 50, nil), // Deleted
+			"BA": newTime(60, 50, nil),
+		})
+
+	state.Purge(func(k string, _ Value) bool {
+		return k[0] == 'A'
+	})
+	assert.Equal(t, 1, state.Count())
+	assert.False(t, state.Has("AA"))
+	assert.True(t, state.Has("BA"))
+}
+
 // ------------------------------------------------------------------------------------
 
 func TestDurableMarshal(t *testing.T) {
@@ -29,6 +29,7 @@ type Map interface {
 	Merge(Map)
 	Range([]byte, bool, func(string, Value) bool)
 	Count() int
+	Purge(func(string, Value) bool)
 }
 
 // New creates a new CRDT map.
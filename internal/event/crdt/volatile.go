@@ -145,6 +145,18 @@ func (s *Volatile) Range(prefix []byte, tombstones bool, f func(string, Value) b
 	}
 }
 
+// Purge removes the items for which the function returns true, without leaving a tombstone.
+func (s *Volatile) Purge(f func(string, Value) bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for k, v := range s.data {
+		if f(k, v) {
+			delete(s.data, k)
+		}
+	}
+}
+
 // Count returns the number of items in the set.
 func (s *Volatile) Count() (count int) {
 	s.lock.Lock()
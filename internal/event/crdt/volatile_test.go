@@ -90,6 +90,22 @@ func TestRange(t *testing.T) {
 	assert.Equal(t, 6, state.Count())
 }
 
+func TestPurge(t *testing.T) {
+	state := newVolatileWith(
+		map[string]Value{
+			"AA": newTime(60, 50, nil),
+			"AB": newTime(10, 50, nil), // Deleted
+			"BA": newTime(60, 50, nil),
+		})
+
+	state.Purge(func(k string, _ Value) bool {
+		return k[0] == 'A'
+	})
+	assert.Equal(t, 1, state.Count())
+	assert.False(t, state.Has("AA"))
+	assert.True(t, state.Has("BA"))
+}
+
 // ------------------------------------------------------------------------------------
 
 func TestTempMarshal(t *testing.T) {
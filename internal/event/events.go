@@ -15,6 +15,8 @@
 package event
 
 import (
+	"time"
+
 	"github.com/emitter-io/emitter/internal/message"
 	"github.com/emitter-io/emitter/internal/security"
 	"github.com/kelindar/binary"
@@ -26,6 +28,7 @@ const (
 	typeSub = uint8(iota)
 	typeBan
 	typeConn
+	typeBlock
 )
 
 // Event represents an encodable event that happened at some point in time.
@@ -94,7 +97,13 @@ func decodeSubscription(k string, v []byte) (e Subscription, err error) {
 // ------------------------------------------------------------------------------------
 
 // Ban represents a banned key event.
-type Ban string
+type Ban struct {
+	Target  string `binary:"-"` // The banned key.
+	Expires int64  // The unix time at which the ban expires, or zero if it never does.
+	Master  uint16 // The identifier of the master key which issued the ban.
+	User    string // The username of the connection which issued the ban.
+	Reason  string // The optional reason for the ban.
+}
 
 // Type returns the unit type.
 func (e *Ban) unitType() uint8 {
@@ -103,17 +112,67 @@ func (e *Ban) unitType() uint8 {
 
 // Key returns the event key.
 func (e Ban) Key() string {
-	return string(e)
+	return e.Target
 }
 
 // Val returns the event value.
 func (e Ban) Val() []byte {
-	return nil
+	buffer, _ := binary.Marshal(e)
+	return buffer
+}
+
+// IsExpired checks whether the ban has expired.
+func (e Ban) IsExpired() bool {
+	return e.Expires > 0 && e.Expires <= time.Now().Unix()
 }
 
 // decodeBan decodes the event
-func decodeBan(k string) (Ban, error) {
-	return Ban(k), nil
+func decodeBan(k string, v []byte) (e Ban, err error) {
+	if len(v) > 0 {
+		err = binary.Unmarshal(v, &e)
+	}
+
+	e.Target = k
+	return e, err
+}
+
+// ------------------------------------------------------------------------------------
+
+// Block represents a blocked IP address event.
+type Block struct {
+	Addr    string `binary:"-"` // The blocked IP address.
+	Expires int64  // The unix time at which the block expires.
+}
+
+// Type returns the unit type.
+func (e *Block) unitType() uint8 {
+	return typeBlock
+}
+
+// Key returns the event key.
+func (e Block) Key() string {
+	return e.Addr
+}
+
+// Val returns the event value.
+func (e Block) Val() []byte {
+	buffer, _ := binary.Marshal(e)
+	return buffer
+}
+
+// IsExpired checks whether the block has expired.
+func (e Block) IsExpired() bool {
+	return e.Expires > 0 && e.Expires <= time.Now().Unix()
+}
+
+// decodeBlock decodes the event
+func decodeBlock(k string, v []byte) (e Block, err error) {
+	if len(v) > 0 {
+		err = binary.Unmarshal(v, &e)
+	}
+
+	e.Addr = k
+	return e, err
 }
 
 // ------------------------------------------------------------------------------------
@@ -51,8 +51,8 @@ func TestEncodeSubscription(t *testing.T) {
 }
 
 func TestEncodeBan(t *testing.T) {
-	ev := Ban("a/b/c/d/e/")
-	assert.Nil(t, ev.Val())
+	ev := Ban{Target: "a/b/c/d/e/", Master: 2, User: "admin", Reason: "spam"}
+	assert.False(t, ev.IsExpired())
 
 	// Encode
 	enc := ev.Key()
@@ -64,7 +64,35 @@ func TestEncodeBan(t *testing.T) {
 	)
 
 	// Decode
-	dec, err := decodeBan(enc)
+	dec, err := decodeBan(enc, ev.Val())
+	assert.NoError(t, err)
+	assert.Equal(t, ev, dec)
+
+	// Bans replicated by older versions carry no value
+	dec, err = decodeBan(enc, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, Ban{Target: "a/b/c/d/e/"}, dec)
+}
+
+func TestEncodeBan_Expires(t *testing.T) {
+	ev := Ban{Target: "a/b/c/d/e/", Expires: 1600000000}
+	assert.NotNil(t, ev.Val())
+	assert.True(t, ev.IsExpired())
+
+	// Decode
+	dec, err := decodeBan(ev.Key(), ev.Val())
+	assert.NoError(t, err)
+	assert.Equal(t, ev, dec)
+}
+
+func TestEncodeBlock(t *testing.T) {
+	ev := Block{Addr: "10.0.0.1", Expires: 1600000000}
+	assert.Equal(t, typeBlock, ev.unitType())
+	assert.Equal(t, "10.0.0.1", ev.Key())
+	assert.True(t, ev.IsExpired())
+
+	// Decode
+	dec, err := decodeBlock(ev.Key(), ev.Val())
 	assert.NoError(t, err)
 	assert.Equal(t, ev, dec)
 }
@@ -39,9 +39,10 @@ func NewState(dir string) *State {
 	return &State{
 		durable: durable,
 		subsets: map[uint8]crdt.Map{
-			typeSub:  crdt.New(durable, ""),
-			typeBan:  crdt.New(durable, fileOf(dir, "ban.db")),
-			typeConn: crdt.New(durable, ""),
+			typeSub:   crdt.New(durable, ""),
+			typeBan:   crdt.New(durable, fileOf(dir, "ban.db")),
+			typeConn:  crdt.New(durable, ""),
+			typeBlock: crdt.New(durable, ""),
 		},
 	}
 }
@@ -100,6 +101,7 @@ func (st *State) Encode() [][]byte {
 func (st *State) Merge(other mesh.GossipData) mesh.GossipData {
 	count := 0
 	otherState := other.(*State)
+	otherState.Purge() // Make sure the expired events are not added back
 	for typ, lww := range st.subsets {
 		otherLww := otherState.subsets[typ] // Get the corresponding set to merge with
 		lww.Merge(otherLww)                 // Merges and changes otherState to be a delta
@@ -130,7 +132,37 @@ func (st *State) Del(ev Event) {
 // Has checks if the state contains an event.
 func (st *State) Has(ev Event) bool {
 	set := st.subsets[ev.unitType()]
-	return set.Has(ev.Key())
+	if ev.unitType() != typeBan && ev.unitType() != typeBlock {
+		return set.Has(ev.Key())
+	}
+
+	// Bans and blocks may carry an expiration time, after which they are no longer active
+	value := set.Get(ev.Key())
+	if !value.IsAdded() {
+		return false
+	}
+
+	if ev.unitType() == typeBlock {
+		block, err := decodeBlock(ev.Key(), value.Value())
+		return err == nil && !block.IsExpired()
+	}
+
+	ban, err := decodeBan(ev.Key(), value.Value())
+	return err == nil && !ban.IsExpired()
+}
+
+// Purge removes the bans and the blocks which have expired. Since every node purges them
+// on its own, they are removed without a tombstone and the state does not grow forever.
+func (st *State) Purge() {
+	st.subsets[typeBan].Purge(func(k string, v Value) bool {
+		ev, err := decodeBan(k, v.Value())
+		return err == nil && ev.IsExpired()
+	})
+
+	st.subsets[typeBlock].Purge(func(k string, v Value) bool {
+		ev, err := decodeBlock(k, v.Value())
+		return err == nil && ev.IsExpired()
+	})
 }
 
 // Subscriptions iterates through all of the subscription units. This call is
@@ -145,6 +177,18 @@ func (st *State) Subscriptions(f func(*Subscription, Value)) {
 	})
 }
 
+// Bans iterates through all of the active bans. This call is blocking and will
+// lock the entire set of bans while iterating.
+func (st *State) Bans(f func(*Ban, Value)) {
+	set := st.subsets[typeBan]
+	set.Range(nil, false, func(k string, t Value) bool {
+		if ev, err := decodeBan(k, t.Value()); err == nil && !ev.IsExpired() {
+			f(&ev, t)
+		}
+		return true
+	})
+}
+
 // SubscriptionsOf iterates through the subscription events for a specific peer.
 func (st *State) SubscriptionsOf(name mesh.PeerName, f func(*Subscription)) {
 	for k, v := range st.findEventsOf(typeSub, prefixOf(name), false) {
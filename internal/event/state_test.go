@@ -39,13 +39,13 @@ func setClock(t int64) {
 func Benchmark_State(b *testing.B) {
 	state := NewState(":memory:")
 	for i := 1; i <= 20000; i++ {
-		ev := Ban(strconv.Itoa(i))
+		ev := Ban{Target: strconv.Itoa(i)}
 		setClock(int64(i))
 		state.Add(&ev)
 	}
 
 	// Encode
-	target := Ban("10000")
+	target := Ban{Target: "10000"}
 	state.Has(&target)
 	time.Sleep(10 * time.Millisecond)
 	b.Run("contains", func(b *testing.B) {
@@ -175,6 +175,82 @@ func TestConnections(t *testing.T) {
 	assert.Equal(t, 1, count)
 }
 
+func TestBlocks(t *testing.T) {
+	state := NewState("")
+	state.Add(&Block{Addr: "10.0.0.1", Expires: time.Now().Add(time.Hour).Unix()})
+	state.Add(&Block{Addr: "10.0.0.2", Expires: time.Now().Add(-time.Hour).Unix()})
+
+	assert.True(t, state.Has(&Block{Addr: "10.0.0.1"}))
+	assert.False(t, state.Has(&Block{Addr: "10.0.0.2"}))
+	assert.False(t, state.Has(&Block{Addr: "10.0.0.3"}))
+
+	state.Del(&Block{Addr: "10.0.0.1"})
+	assert.False(t, state.Has(&Block{Addr: "10.0.0.1"}))
+}
+
+func TestBans(t *testing.T) {
+	for _, tc := range []struct {
+		dir string
+	}{
+		{dir: ":memory:"},
+		{dir: ""},
+	} {
+		state := NewState(tc.dir)
+		permanent := &Ban{Target: "a"}
+		active := &Ban{Target: "b", Expires: time.Now().Add(time.Hour).Unix()}
+		expired := &Ban{Target: "c", Expires: time.Now().Add(-time.Hour).Unix()}
+		state.Add(permanent)
+		state.Add(active)
+		state.Add(expired)
+
+		assert.True(t, state.Has(&Ban{Target: "a"}))
+		assert.True(t, state.Has(&Ban{Target: "b"}))
+		assert.False(t, state.Has(&Ban{Target: "c"}))
+		assert.False(t, state.Has(&Ban{Target: "d"}))
+
+		// Only the active bans should be listed
+		listed := make(map[string]bool)
+		state.Bans(func(ev *Ban, v Value) {
+			assert.NotZero(t, v.AddTime())
+			listed[ev.Target] = true
+		})
+		assert.Equal(t, map[string]bool{"a": true, "b": true}, listed)
+
+		// Encode / decode and make sure the expiration is replicated
+		dec, err := DecodeState(state.Encode()[0])
+		assert.NoError(t, err)
+		assert.True(t, dec.Has(&Ban{Target: "b"}))
+		assert.False(t, dec.Has(&Ban{Target: "c"}))
+		state.Close()
+	}
+}
+
+func TestPurge(t *testing.T) {
+	for _, dir := range []string{":memory:", ""} {
+		state := NewState(dir)
+		state.Add(&Ban{Target: "a"})
+		state.Add(&Ban{Target: "b", Expires: time.Now().Add(-time.Hour).Unix()})
+		state.Add(&Block{Addr: "10.0.0.1", Expires: time.Now().Add(time.Hour).Unix()})
+		state.Add(&Block{Addr: "10.0.0.2", Expires: time.Now().Add(-time.Hour).Unix()})
+
+		// The expired bans and blocks should be removed entirely
+		state.Purge()
+		assert.Equal(t, 1, state.subsets[typeBan].Count())
+		assert.Equal(t, 1, state.subsets[typeBlock].Count())
+		assert.True(t, state.Has(&Ban{Target: "a"}))
+		assert.True(t, state.Has(&Block{Addr: "10.0.0.1"}))
+
+		// The expired blocks of the other peers should not be merged back
+		other := NewState("")
+		other.Add(&Block{Addr: "10.0.0.2", Expires: time.Now().Add(-time.Hour).Unix()})
+		other.Add(&Block{Addr: "10.0.0.3", Expires: time.Now().Add(time.Hour).Unix()})
+		state.Merge(other)
+		assert.Equal(t, 2, state.subsets[typeBlock].Count())
+		assert.True(t, state.Has(&Block{Addr: "10.0.0.3"}))
+		state.Close()
+	}
+}
+
 func countAdded(state *State) (added int) {
 	set := state.subsets[typeSub]
 	set.Range(nil, false, func(_ string, v Value) bool {
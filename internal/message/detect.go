@@ -0,0 +1,102 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package message
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+
+	"github.com/emitter-io/emitter/internal/security/hash"
+)
+
+// Collision represents two different channel segments which have the same hash.
+type Collision struct {
+	Hash   uint32 // The hash of both of the segments.
+	First  string // The segment seen first.
+	Second string // The segment which collided with the first one.
+}
+
+// Detector detects the collisions of the hashes of channel segments. Since the SSIDs are
+// made of these hashes, two channels with colliding segments would otherwise receive the
+// messages of each other.
+type Detector struct {
+	sync.Mutex
+	seen     map[uint32]string  // The segments seen, by their hash.
+	pairs    map[Collision]bool // The collisions detected, so each one is only counted once.
+	capacity int                // The maximum number of segments to remember.
+	count    int64              // The number of collisions detected.
+}
+
+// NewDetector creates a new collision detector which remembers up to the provided number
+// of segments. Once full, it starts over.
+func NewDetector(capacity int) *Detector {
+	return &Detector{
+		seen:     make(map[uint32]string),
+		pairs:    make(map[Collision]bool),
+		capacity: capacity,
+	}
+}
+
+// Observe records the segments of a channel and returns the collisions with the segments
+// seen before which were not reported yet, if any. The wildcards are ignored.
+func (d *Detector) Observe(channel []byte) (out []Collision) {
+	d.Lock()
+	defer d.Unlock()
+
+	for _, segment := range bytes.Split(channel, []byte{'/'}) {
+		if len(segment) == 0 || isWildcard(segment) {
+			continue
+		}
+
+		h := hash.Of(segment)
+		prev, ok := d.seen[h]
+		switch {
+		case !ok:
+			if len(d.seen) >= d.capacity {
+				d.seen = make(map[uint32]string)
+			}
+			d.seen[h] = string(segment)
+		case prev != string(segment):
+			collision := Collision{
+				Hash:   h,
+				First:  prev,
+				Second: string(segment),
+			}
+
+			if d.pairs[collision] {
+				continue
+			}
+			if len(d.pairs) >= d.capacity {
+				d.pairs = make(map[Collision]bool)
+			}
+
+			d.pairs[collision] = true
+			atomic.AddInt64(&d.count, 1)
+			out = append(out, collision)
+		}
+	}
+	return
+}
+
+// Count returns the total number of collisions detected.
+func (d *Detector) Count() int64 {
+	return atomic.LoadInt64(&d.count)
+}
+
+// isWildcard checks whether the segment is a wildcard.
+func isWildcard(segment []byte) bool {
+	return len(segment) == 1 && (segment[0] == '+' || segment[0] == '#' || segment[0] == '*')
+}
@@ -0,0 +1,42 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetector(t *testing.T) {
+	d := NewDetector(3)
+	assert.Empty(t, d.Observe([]byte("a/c244/+/#/")))
+	assert.Empty(t, d.Observe([]byte("a/c244/")))
+	assert.Equal(t, []Collision{{
+		Hash:   2960499559,
+		First:  "c244",
+		Second: "c239655",
+	}}, d.Observe([]byte("b/c239655/")))
+	assert.EqualValues(t, 1, d.Count())
+
+	// The same collision is only counted once
+	assert.Empty(t, d.Observe([]byte("b/c239655/")))
+	assert.EqualValues(t, 1, d.Count())
+
+	// Once full, the detector starts over
+	assert.Empty(t, d.Observe([]byte("c/")))
+	assert.Empty(t, d.Observe([]byte("c239655/")))
+	assert.EqualValues(t, 1, d.Count())
+}
@@ -15,6 +15,7 @@
 package message
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/binary"
 	"math"
@@ -80,6 +81,18 @@ func (id ID) Time() int64 {
 	return int64(math.MaxUint32-binary.BigEndian.Uint32(id[4:8])) + offset
 }
 
+// Before returns whether the message ID is chronologically before the other one. The
+// IDs of the same second are ordered by their sequence and origin, so that the order of
+// the messages gathered from different nodes is always the same.
+func (id ID) Before(other ID) bool {
+	if t0, t1 := id.Time(), other.Time(); t0 != t1 {
+		return t0 < t1
+	}
+
+	// The sequence is reversed as well, so the greater key comes first
+	return bytes.Compare(id[8:], other[8:]) > 0
+}
+
 // Contract retrieves the contract from the message ID.
 func (id ID) Contract() uint32 {
 	return binary.BigEndian.Uint32(id[fixed : fixed+4])
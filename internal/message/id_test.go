@@ -64,6 +64,19 @@ func TestID_Match(t *testing.T) {
 	assert.False(t, id.Match(Ssid{2, 2, 3, 4, 5}, 0, math.MaxInt64))
 }
 
+func TestID_Before(t *testing.T) {
+	id1 := NewID(Ssid{1, 2, 3})
+	id2 := NewID(Ssid{1, 2, 3})
+	id3 := NewID(Ssid{1, 2, 3})
+	id3.SetTime(id1.Time() - 1)
+
+	assert.True(t, id1.Before(id2))
+	assert.False(t, id2.Before(id1))
+	assert.False(t, id1.Before(id1))
+	assert.True(t, id3.Before(id1))
+	assert.False(t, id1.Before(id3))
+}
+
 func TestID_Ssid(t *testing.T) {
 	in := Ssid{1, 2, 3, 4, 5, 6}
 	id := NewID(in)
@@ -118,9 +118,9 @@ func NewFrame(capacity int) Frame {
 	return make(Frame, 0, capacity)
 }
 
-// Sort sorts the frame
+// Sort sorts the frame chronologically
 func (f Frame) Sort() {
-	sort.Slice(f, func(i, j int) bool { return f[i].Time() < f[j].Time() })
+	sort.Slice(f, func(i, j int) bool { return f[i].ID.Before(f[j].ID) })
 }
 
 // Split splits the frame by a specified number of bytes into two slices.
@@ -145,6 +145,26 @@ func (f *Frame) Limit(n int) {
 	}
 }
 
+// Dedupe removes the messages with the same ID, sorting the frame chronologically
+func (f *Frame) Dedupe() {
+	f.Sort()
+	out := (*f)[:0]
+	for _, m := range *f {
+		if len(out) == 0 || !bytes.Equal(out[len(out)-1].ID, m.ID) {
+			out = append(out, m)
+		}
+	}
+	*f = out
+}
+
+// Head takes the first N elements, sorted by message time
+func (f *Frame) Head(n int) {
+	f.Sort()
+	if len(*f) > n {
+		*f = (*f)[:n]
+	}
+}
+
 // Encode encodes the message frame
 func (f *Frame) Encode() []byte {
 
@@ -124,6 +124,34 @@ func TestFrameLimit(t *testing.T) {
 	assert.Equal(t, "a/b/d/", string(f[1].Channel))
 }
 
+func TestFrameHead(t *testing.T) {
+	f := Frame{
+		newTestMessage(Ssid{1, 2, 1}, "a/b/a/", "hello aba"),
+		newTestMessage(Ssid{1, 2, 2}, "a/b/b/", "hello abb"),
+		newTestMessage(Ssid{1, 2, 3}, "a/b/c/", "hello abc"),
+		newTestMessage(Ssid{1, 2, 4}, "a/b/d/", "hello abd"),
+	}
+
+	f[0], f[3] = f[3], f[0]
+	f.Head(2)
+	assert.Len(t, f, 2)
+	assert.Equal(t, "a/b/a/", string(f[0].Channel))
+	assert.Equal(t, "a/b/b/", string(f[1].Channel))
+}
+
+func TestFrameDedupe(t *testing.T) {
+	f := Frame{
+		newTestMessage(Ssid{1, 2, 1}, "a/b/a/", "hello aba"),
+		newTestMessage(Ssid{1, 2, 2}, "a/b/b/", "hello abb"),
+	}
+
+	f = append(f, f[1], f[0], f[1])
+	f.Dedupe()
+	assert.Len(t, f, 2)
+	assert.Equal(t, "a/b/a/", string(f[0].Channel))
+	assert.Equal(t, "a/b/b/", string(f[1].Channel))
+}
+
 func TestFrameSplit(t *testing.T) {
 	f := Frame{
 		newTestMessage(Ssid{1, 2, 1}, "a/b/a/", "hello aba"),
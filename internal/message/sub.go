@@ -15,6 +15,7 @@
 package message
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/hex"
 	"sync"
@@ -34,6 +35,9 @@ const (
 	share         = uint32(1480642916)
 )
 
+// The prefix of the shared subscriptions, followed by the name of the group.
+var sharePrefix = []byte("$share/")
+
 // Query represents a constant SSID for a query.
 var Query = Ssid{system, query}
 
@@ -309,3 +313,55 @@ func (s *Counters) getOrCreate(ssid Ssid, channel []byte) (meter *Counter) {
 	s.m[key] = meter
 	return
 }
+
+// ------------------------------------------------------------------------------------
+
+// Match checks whether a subscribed channel, which may contain wildcards, matches the
+// channel of a message. The SSIDs only contain the hashes of the channel segments so
+// this allows to verify the actual strings, should two different channels collide.
+func Match(pattern, channel []byte) bool {
+	if bytes.HasPrefix(pattern, sharePrefix) {
+		if i := bytes.IndexByte(pattern[len(sharePrefix):], '/'); i >= 0 {
+			pattern = pattern[len(sharePrefix)+i+1:]
+		}
+	}
+
+	for len(pattern) > 0 {
+		i := bytes.IndexByte(pattern, '/')
+		if i < 0 {
+			i = len(pattern)
+		}
+
+		// Multi-level wildcard matches the rest of the channel
+		segment := pattern[:i]
+		if len(segment) == 1 && segment[0] == '#' {
+			return true
+		}
+
+		// We've run out of channel segments before the end of the pattern
+		j := bytes.IndexByte(channel, '/')
+		if j < 0 {
+			if j = len(channel); j == 0 {
+				return false
+			}
+		}
+
+		if !(len(segment) == 1 && segment[0] == '+') && !bytes.Equal(segment, channel[:j]) {
+			return false
+		}
+
+		pattern, channel = advance(pattern, i), advance(channel, j)
+	}
+
+	// Since the default matcher also delivers the messages of the sub-channels, whatever
+	// is left in the channel is fine.
+	return true
+}
+
+// advance skips the segment along with its separator.
+func advance(text []byte, i int) []byte {
+	if i < len(text) {
+		return text[i+1:]
+	}
+	return text[i:]
+}
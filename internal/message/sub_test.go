@@ -199,6 +199,31 @@ func TestSub_IncrementOnce(t *testing.T) {
 	assert.Equal(t, 1, counters.m[key1].Counter)
 }
 
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		channel string
+		match   bool
+	}{
+		{pattern: "a/b/c/", channel: "a/b/c/", match: true},
+		{pattern: "a/b/", channel: "a/b/c/", match: true},
+		{pattern: "a/+/c/", channel: "a/b/c/", match: true},
+		{pattern: "a/#/", channel: "a/b/c/", match: true},
+		{pattern: "+/", channel: "a/", match: true},
+		{pattern: "$share/group/a/b/", channel: "a/b/", match: true},
+		{pattern: "a/b/c/", channel: "a/b/", match: false},
+		{pattern: "a/b/c/", channel: "a/b/d/", match: false},
+		{pattern: "a/+/c/", channel: "a/b/d/", match: false},
+		{pattern: "c244/", channel: "c239655/", match: false},
+		{pattern: "$share/group/a/", channel: "b/", match: false},
+		{pattern: "a/", channel: "", match: false},
+	}
+
+	for _, tc := range tests {
+		assert.Equal(t, tc.match, Match([]byte(tc.pattern), []byte(tc.channel)), tc.pattern+" "+tc.channel)
+	}
+}
+
 func TestCollisions(t *testing.T) {
 	subs := newSubscribers()
 	count := 100000
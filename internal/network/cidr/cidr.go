@@ -0,0 +1,98 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package cidr
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+)
+
+// List represents a list of IP networks, such as "10.0.0.0/8" or "2001:db8::/32".
+type List []*net.IPNet
+
+// Parse parses a list of networks in CIDR notation. A single IP address without a prefix
+// length is parsed as a network containing only that address.
+func Parse(networks ...string) (List, error) {
+	list := make(List, 0, len(networks))
+	for _, v := range networks {
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, network)
+	}
+
+	return list, nil
+}
+
+// Contains checks whether an address, with or without a port, is within any of the
+// networks of the list.
+func (l List) Contains(addr string) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range l {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Strings returns the networks of the list in CIDR notation.
+func (l List) Strings() []string {
+	out := make([]string, 0, len(l))
+	for _, network := range l {
+		out = append(out, network.String())
+	}
+	return out
+}
+
+// MarshalJSON encodes the list as an array of strings in CIDR notation.
+func (l List) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.Strings())
+}
+
+// UnmarshalJSON decodes the list from an array of strings in CIDR notation.
+func (l *List) UnmarshalJSON(b []byte) error {
+	var networks []string
+	if err := json.Unmarshal(b, &networks); err != nil {
+		return err
+	}
+
+	list, err := Parse(networks...)
+	if err != nil {
+		return err
+	}
+
+	*l = list
+	return nil
+}
@@ -0,0 +1,75 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package cidr
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	list, err := Parse("10.0.0.0/8", "192.168.1.1", "2001:db8::/32", "::1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.0/8", "192.168.1.1/32", "2001:db8::/32", "::1/128"}, list.Strings())
+
+	_, err = Parse("10.0.0.0/33")
+	assert.Error(t, err)
+
+	_, err = Parse("factory")
+	assert.Error(t, err)
+}
+
+func TestContains(t *testing.T) {
+	list, err := Parse("10.0.0.0/8", "192.168.1.1", "2001:db8::/32")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		addr     string
+		expected bool
+	}{
+		{addr: "10.1.2.3", expected: true},
+		{addr: "10.1.2.3:8080", expected: true},
+		{addr: "192.168.1.1", expected: true},
+		{addr: "192.168.1.2", expected: false},
+		{addr: "[2001:db8::5]:443", expected: true},
+		{addr: "2001:db9::5", expected: false},
+		{addr: "pipe", expected: false},
+		{addr: "", expected: false},
+	}
+
+	for _, tc := range tests {
+		assert.Equal(t, tc.expected, list.Contains(tc.addr), tc.addr)
+	}
+
+	assert.False(t, List(nil).Contains("10.1.2.3"))
+}
+
+func TestJSON(t *testing.T) {
+	var v struct {
+		Networks List `json:"networks"`
+	}
+
+	assert.NoError(t, json.Unmarshal([]byte(`{"networks":["10.0.0.0/8","127.0.0.1"]}`), &v))
+	assert.True(t, v.Networks.Contains("127.0.0.1"))
+
+	b, err := json.Marshal(v)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"networks":["10.0.0.0/8","127.0.0.1/32"]}`, string(b))
+
+	assert.Error(t, json.Unmarshal([]byte(`{"networks":["10.0.0.0/x"]}`), &v))
+	assert.Error(t, json.Unmarshal([]byte(`{"networks":"10.0.0.0/8"}`), &v))
+}
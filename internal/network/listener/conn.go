@@ -30,6 +30,7 @@ import (
 type Conn struct {
 	sync.RWMutex
 	socket net.Conn           // The underlying network connection.
+	remote net.Addr           // The address of the client, if provided by the proxy.
 	writer bytes.Buffer       // The buffered write queue.
 	reader sniffer            // The reader which performs sniffing.
 	limit  *rate.Limiter      // The write rate limiter.
@@ -104,6 +105,9 @@ func (m *Conn) LocalAddr() net.Addr {
 
 // RemoteAddr returns the remote network address.
 func (m *Conn) RemoteAddr() net.Addr {
+	if m.remote != nil {
+		return m.remote
+	}
 	return m.socket.RemoteAddr()
 }
 
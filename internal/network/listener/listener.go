@@ -70,6 +70,7 @@ var noTimeout time.Duration
 type Config struct {
 	TLS       *tls.Config // The TLS/SSL configuration.
 	FlushRate int         // The maximum flush rate (QPS) per connection.
+	Proxy     bool        // Whether connections start with a PROXY protocol header.
 }
 
 // New announces on the local network address laddr. The syntax of laddr is
@@ -83,11 +84,6 @@ func New(address string, config Config) (*Listener, error) {
 		return nil, err
 	}
 
-	// If we have a TLS configuration provided, wrap the listener in TLS
-	if config.TLS != nil {
-		l = tls.NewListener(l, config.TLS)
-	}
-
 	return &Listener{
 		root:         l,
 		bufferSize:   1024,
@@ -175,10 +171,31 @@ func (m *Listener) Serve() error {
 func (m *Listener) serve(c net.Conn, donec <-chan struct{}, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	muc := newConn(c, m.config.FlushRate)
 	if m.readTimeout > noTimeout {
 		_ = c.SetReadDeadline(time.Now().Add(m.readTimeout))
 	}
+
+	// If we are behind a proxy, the header tells us the address of the actual client. The
+	// header precedes the TLS handshake, and an invalid one only concerns this client.
+	var remote net.Addr
+	if m.config.Proxy {
+		addr, err := readProxy(c)
+		if err != nil {
+			_ = c.Close()
+			m.errorHandler(err)
+			return
+		}
+		remote = addr
+	}
+
+	// If we have a TLS configuration provided, wrap the connection in TLS
+	if m.config.TLS != nil {
+		c = tls.Server(c, m.config.TLS)
+	}
+
+	muc := newConn(c, m.config.FlushRate)
+	muc.remote = remote
+
 	for _, sl := range m.matchers {
 		for _, processor := range sl.matchers {
 			matched := processor(muc.startSniffing())
@@ -0,0 +1,131 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package listener
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidProxy is returned whenever a connection does not start with a valid PROXY
+// protocol header while the listener expects one.
+var ErrInvalidProxy = errors.New("mux: invalid proxy protocol header")
+
+// The signatures of the PROXY protocol headers.
+var (
+	proxyV1 = []byte("PROXY ")
+	proxyV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	proxyMaxV1 = 107  // The maximum length of a version 1 header, including CRLF.
+	proxyMaxV2 = 4096 // The maximum length of the addresses and extensions in version 2.
+)
+
+// readProxy reads a PROXY protocol header (version 1 or 2) from the connection and returns
+// the address of the original client. The address is nil if the header is valid, but does
+// not carry the address, for example for health checks of the proxy itself. The reads are
+// not buffered, so the rest of the stream remains intact for the sniffing.
+func readProxy(r io.Reader) (net.Addr, error) {
+	head := make([]byte, len(proxyV2))
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.Equal(head, proxyV2):
+		return readProxyV2(r)
+	case bytes.HasPrefix(head, proxyV1):
+		return readProxyV1(r, head)
+	default:
+		return nil, ErrInvalidProxy
+	}
+}
+
+// readProxyV1 reads the rest of a human-readable header, such as
+// "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n".
+func readProxyV1(r io.Reader, head []byte) (net.Addr, error) {
+	line := append(make([]byte, 0, proxyMaxV1), head...)
+	for b := make([]byte, 1); !bytes.HasSuffix(line, []byte("\r\n")); {
+		if len(line) >= proxyMaxV1 {
+			return nil, ErrInvalidProxy
+		}
+
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidProxy
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, ErrInvalidProxy
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads the rest of a binary header, right after its signature.
+func readProxyV2(r io.Reader) (net.Addr, error) {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+
+	size := int(binary.BigEndian.Uint16(head[2:]))
+	if head[0]>>4 != 2 || size > proxyMaxV2 {
+		return nil, ErrInvalidProxy
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	// The LOCAL command is used by the proxy for its own connections
+	if head[0]&0x0f == 0 {
+		return nil, nil
+	}
+
+	switch head[1] >> 4 {
+	case 1: // AF_INET
+		if size < 12 {
+			return nil, ErrInvalidProxy
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 2: // AF_INET6
+		if size < 36 {
+			return nil, ErrInvalidProxy
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	default: // AF_UNSPEC or AF_UNIX, keep the address of the proxy
+		return nil, nil
+	}
+}
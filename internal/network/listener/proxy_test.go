@@ -0,0 +1,171 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package listener
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadProxy(t *testing.T) {
+	v2 := func(cmd, fam byte, body ...byte) string {
+		head := append([]byte{}, proxyV2...)
+		head = append(head, cmd, fam, 0, byte(len(body)))
+		return string(append(head, body...))
+	}
+
+	tests := []struct {
+		header string
+		addr   string
+		err    bool
+	}{
+		{header: "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", addr: "192.168.0.1:56324"},
+		{header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", addr: "[2001:db8::1]:56324"},
+		{header: "PROXY UNKNOWN\r\n"},
+		{header: "PROXY TCP4 192.168.0.1 192.168.0.11\r\n", err: true},
+		{header: "PROXY TCP4 192.168.0.x 192.168.0.11 56324 443\r\n", err: true},
+		{header: "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443", err: true},
+		{header: "GET / HTTP/1.1\r\n", err: true},
+		{header: "PROXY", err: true},
+		{header: v2(0x21, 0x11, 10, 0, 0, 1, 10, 0, 0, 2, 0xdc, 0x04, 0x01, 0xbb), addr: "10.0.0.1:56324"},
+		{header: v2(0x20, 0x11, 10, 0, 0, 1, 10, 0, 0, 2, 0xdc, 0x04, 0x01, 0xbb)},
+		{header: v2(0x21, 0x00)},
+		{header: v2(0x21, 0x11, 10, 0, 0, 1), err: true},
+		{header: v2(0x11, 0x11), err: true},
+	}
+
+	for _, tc := range tests {
+		r := bytes.NewBufferString(tc.header + "rest")
+		addr, err := readProxy(r)
+		assert.Equal(t, tc.err, err != nil, tc.header)
+		if tc.err {
+			continue
+		}
+
+		// The rest of the stream must remain untouched
+		rest, _ := ioutil.ReadAll(r)
+		assert.Equal(t, "rest", string(rest))
+		if tc.addr == "" {
+			assert.Nil(t, addr)
+		} else {
+			assert.Equal(t, tc.addr, addr.String())
+		}
+	}
+}
+
+func TestConn_Proxied(t *testing.T) {
+	conn := newConn(new(fakeConn), 0)
+	defer conn.Close()
+
+	addr, err := readProxy(bytes.NewBufferString("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"))
+	assert.NoError(t, err)
+
+	conn.remote = addr
+	assert.Equal(t, "192.168.0.1:56324", conn.RemoteAddr().String())
+}
+
+func TestListener_ProxyInvalid(t *testing.T) {
+	l, err := New("127.0.0.1:0", Config{Proxy: true})
+	assert.NoError(t, err)
+	defer l.Close()
+
+	any := l.Match(MatchAny())
+	served := make(chan error, 1)
+	go func() { served <- l.Serve() }()
+
+	// Neither a health check nor a client without a header should stop the listener
+	for _, header := range []string{"", "GET / HTTP/1.1\r\n\r\n"} {
+		c, err := net.Dial("tcp", l.Addr().String())
+		assert.NoError(t, err)
+		c.Write([]byte(header))
+		c.Close()
+	}
+
+	// The next client should still be served
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	defer c.Close()
+	c.Write([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nhello"))
+
+	conn, err := any.Accept()
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "192.168.0.1:56324", conn.RemoteAddr().String())
+
+	buffer := make([]byte, 5)
+	_, err = io.ReadFull(conn, buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buffer))
+	assert.Len(t, served, 0)
+}
+
+func TestListener_ProxyTLS(t *testing.T) {
+	l, err := New("127.0.0.1:0", Config{Proxy: true, TLS: &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t)},
+	}})
+	assert.NoError(t, err)
+	defer l.Close()
+
+	any := l.Match(MatchAny())
+	go l.Serve()
+
+	// The header is sent by the proxy before the TLS handshake of the client
+	raw, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	defer raw.Close()
+	raw.Write([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"))
+
+	client := tls.Client(raw, &tls.Config{InsecureSkipVerify: true})
+	go client.Write([]byte("hello"))
+
+	conn, err := any.Accept()
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "192.168.0.1:56324", conn.RemoteAddr().String())
+
+	buffer := make([]byte, 5)
+	_, err = io.ReadFull(conn, buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buffer))
+}
+
+// testCertificate generates a self-signed certificate.
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
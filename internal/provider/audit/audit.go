@@ -0,0 +1,387 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	netHTTP "net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/emitter-io/config"
+	"github.com/emitter-io/emitter/internal/async"
+	"github.com/emitter-io/emitter/internal/network/http"
+	"github.com/emitter-io/emitter/internal/provider/logging"
+	"github.com/emitter-io/stats"
+)
+
+// The default number of events the HTTP sink keeps while they can not be posted.
+const defaultBuffer = 10000
+
+// Various types of the audited events.
+const (
+	EventKeygen       = "keygen"
+	EventBan          = "ban"
+	EventUnban        = "unban"
+	EventUnauthorized = "unauthorized"
+	EventBlock        = "block"
+	EventConnect      = "connect"
+	EventDisconnect   = "disconnect"
+)
+
+// Actor represents the client which performed an audited action.
+type Actor struct {
+	Addr     string `json:"addr,omitempty"`     // The IP address of the client.
+	Username string `json:"username,omitempty"` // The username provided during MQTT connect.
+	ClientID string `json:"client,omitempty"`   // The client ID provided during MQTT connect.
+}
+
+// Client represents a connected client whose actions are audited.
+type Client interface {
+	Addr() string
+	Username() string
+	ClientID() string
+}
+
+// ActorOf returns the actor for a connected client.
+func ActorOf(c Client) Actor {
+	return Actor{
+		Addr:     c.Addr(),
+		Username: c.Username(),
+		ClientID: c.ClientID(),
+	}
+}
+
+// ActorOfRequest returns the actor for an HTTP request.
+func ActorOfRequest(r *netHTTP.Request) Actor {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+
+	return Actor{Addr: addr}
+}
+
+// Event represents a single entry of the audit log.
+type Event struct {
+	Actor
+	Time     time.Time `json:"time"`               // The time of the event.
+	Type     string    `json:"type"`               // The type of the event, such as "keygen" or "ban".
+	Contract uint32    `json:"contract,omitempty"` // The contract concerned.
+	Master   uint16    `json:"master,omitempty"`   // The master key used, if any.
+	Channel  string    `json:"channel,omitempty"`  // The channel concerned, without the key.
+	Access   string    `json:"access,omitempty"`   // The permissions of a generated key.
+	Target   string    `json:"target,omitempty"`   // The key which was banned or unbanned.
+	Reason   string    `json:"reason,omitempty"`   // The reason provided for a ban.
+	Count    int       `json:"count,omitempty"`    // The number of consecutive failures.
+}
+
+// Auditor represents a sink for the security audit log.
+type Auditor interface {
+	config.Provider
+	io.Closer
+
+	// Record records an event in the audit log.
+	Record(*Event)
+}
+
+// Measurable represents an audit sink which reports its own metrics.
+type Measurable interface {
+	Measure(m stats.Measurer)
+}
+
+// stamp sets the time of the event, if it was not set.
+func stamp(ev *Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+}
+
+// ------------------------------------------------------------------------------------
+
+// Noop implements Auditor contract.
+var _ Auditor = new(Noop)
+
+// Noop represents an audit sink which does nothing.
+type Noop struct{}
+
+// NewNoop creates a new no-op audit sink.
+func NewNoop() *Noop {
+	return new(Noop)
+}
+
+// Name returns the name of the provider.
+func (s *Noop) Name() string {
+	return "noop"
+}
+
+// Configure configures the provider.
+func (s *Noop) Configure(config map[string]interface{}) error {
+	return nil
+}
+
+// Record records an event in the audit log.
+func (s *Noop) Record(*Event) {}
+
+// Close closes the provider.
+func (s *Noop) Close() error {
+	return nil
+}
+
+// ------------------------------------------------------------------------------------
+
+// File implements Auditor contract.
+var _ Auditor = new(File)
+
+// File represents an audit sink which appends the events to a file, one JSON per line.
+type File struct {
+	sync.Mutex
+	file io.WriteCloser // The file to write to.
+}
+
+// NewFile creates a new file audit sink.
+func NewFile() *File {
+	return new(File)
+}
+
+// Name returns the name of the provider.
+func (s *File) Name() string {
+	return "file"
+}
+
+// Configure configures the provider.
+func (s *File) Configure(config map[string]interface{}) (err error) {
+	path := "audit.log"
+	if v, ok := config["path"]; ok {
+		if p, ok := v.(string); ok {
+			path = p
+		}
+	}
+
+	s.file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	return
+}
+
+// Record records an event in the audit log.
+func (s *File) Record(ev *Event) {
+	stamp(ev)
+	encoded, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if _, err := s.file.Write(append(encoded, '\n')); err != nil {
+		logging.LogError("file audit", "writing event", err)
+	}
+}
+
+// Close closes the provider.
+func (s *File) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.file != nil {
+		return s.file.Close()
+	}
+	return nil
+}
+
+// ------------------------------------------------------------------------------------
+
+// HTTP implements Auditor contract.
+var _ Auditor = new(HTTP)
+var _ Measurable = new(HTTP)
+
+// HTTP represents an audit sink which periodically posts the events over HTTP. The events
+// which could not be posted are kept and posted again later on, up to the buffer size, after
+// which the oldest events are dropped.
+type HTTP struct {
+	sync.Mutex
+	url     string             // The url to post to.
+	http    http.Client        // The http client to use.
+	head    []http.HeaderValue // The http headers to add with each request.
+	pending []*Event           // The events which are not yet posted.
+	buffer  int                // The maximum number of events pending.
+	dropped int64              // The number of events dropped since the buffer was full.
+	cancel  context.CancelFunc // The cancellation function.
+}
+
+// NewHTTP creates a new HTTP audit sink.
+func NewHTTP() *HTTP {
+	return &HTTP{
+		buffer: defaultBuffer,
+	}
+}
+
+// Name returns the name of the provider.
+func (s *HTTP) Name() string {
+	return "http"
+}
+
+// Configure configures the provider.
+func (s *HTTP) Configure(config map[string]interface{}) (err error) {
+	if config == nil {
+		return errors.New("Configuration was not provided for HTTP audit provider")
+	}
+
+	// Get the interval from the provider configuration
+	interval := time.Second
+	if v, ok := config["interval"]; ok {
+		if i, ok := v.(float64); ok {
+			interval = time.Duration(i) * time.Millisecond
+		}
+	}
+
+	// Get the maximum number of events to keep while they can not be posted
+	if v, ok := config["buffer"]; ok {
+		if n, ok := v.(float64); ok && n > 0 {
+			s.buffer = int(n)
+		}
+	}
+
+	// Get the authorization header to add to the request
+	s.head = []http.HeaderValue{http.NewHeader("Content-Type", "application/json")}
+	if v, ok := config["authorization"]; ok {
+		if header, ok := v.(string); ok {
+			s.head = append(s.head, http.NewHeader("Authorization", header))
+		}
+	}
+
+	// Get the url from the provider configuration
+	if url, ok := config["url"]; ok {
+		s.url = url.(string)
+		s.http, err = http.NewClient(30 * time.Second)
+		s.cancel = async.Repeat(context.Background(), interval, s.flush)
+		return
+	}
+
+	return errors.New("The 'url' parameter was not provider in the configuration for HTTP audit provider")
+}
+
+// Record records an event in the audit log.
+func (s *HTTP) Record(ev *Event) {
+	stamp(ev)
+	s.Lock()
+	s.pending = append(s.pending, ev)
+	s.trim()
+	s.Unlock()
+}
+
+// Measure reports the number of events pending and dropped.
+func (s *HTTP) Measure(m stats.Measurer) {
+	s.Lock()
+	defer s.Unlock()
+	m.Measure("audit.pending", int32(len(s.pending)))
+	m.Measure("audit.dropped", int32(s.dropped))
+}
+
+// flush posts all of the pending events. If they can not be posted, they are kept so the
+// next flush attempts to post them again.
+func (s *HTTP) flush() {
+	s.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	encoded, err := json.Marshal(pending)
+	if err == nil {
+		if _, err = s.http.Post(s.url, encoded, nil, s.head...); err == nil {
+			return
+		}
+	}
+
+	logging.LogError("http audit", "posting events", err)
+	s.Lock()
+	s.pending = append(pending, s.pending...)
+	s.trim()
+	s.Unlock()
+}
+
+// trim drops the oldest pending events once there are more of them than the buffer
+// allows. This must be called while holding the lock.
+func (s *HTTP) trim() {
+	if n := len(s.pending) - s.buffer; n > 0 {
+		s.pending = append(s.pending[:0], s.pending[n:]...)
+		s.dropped += int64(n)
+	}
+}
+
+// Close closes the provider, posting the pending events.
+func (s *HTTP) Close() error {
+	if s.cancel != nil {
+		s.cancel()
+		s.flush()
+	}
+
+	return nil
+}
+
+// ------------------------------------------------------------------------------------
+
+// Self implements Auditor contract.
+var _ Auditor = new(Self)
+
+// Self represents an audit sink which publishes the events into a system channel.
+type Self struct {
+	channel string               // The channel name to publish into.
+	publish func(string, []byte) // The publish function to use.
+}
+
+// NewSelf creates a new self-publishing audit sink.
+func NewSelf(selfPublish func(string, []byte)) *Self {
+	return &Self{
+		publish: selfPublish,
+		channel: "audit",
+	}
+}
+
+// Name returns the name of the provider.
+func (s *Self) Name() string {
+	return "self"
+}
+
+// Configure configures the provider.
+func (s *Self) Configure(config map[string]interface{}) error {
+	if c, ok := config["channel"]; ok {
+		s.channel = c.(string)
+	}
+
+	s.channel = fmt.Sprintf("%s/", s.channel)
+	return nil
+}
+
+// Record records an event in the audit log.
+func (s *Self) Record(ev *Event) {
+	stamp(ev)
+	if encoded, err := json.Marshal(ev); err == nil {
+		s.publish(s.channel, encoded)
+	}
+}
+
+// Close closes the provider.
+func (s *Self) Close() error {
+	return nil
+}
@@ -0,0 +1,158 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	netHTTP "net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/network/http"
+	"github.com/emitter-io/stats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestNoop(t *testing.T) {
+	s := NewNoop()
+	assert.Equal(t, "noop", s.Name())
+	assert.NoError(t, s.Configure(nil))
+	assert.NotPanics(t, func() {
+		s.Record(&Event{Type: EventConnect})
+	})
+	assert.NoError(t, s.Close())
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	s := NewFile()
+	assert.Equal(t, "file", s.Name())
+	assert.NoError(t, s.Configure(map[string]interface{}{
+		"path": path,
+	}))
+
+	s.Record(&Event{Type: EventBan, Target: "key", Reason: "spam"})
+	s.Record(&Event{Type: EventUnban, Target: "key"})
+	assert.NoError(t, s.Close())
+
+	b, err := os.ReadFile(path)
+	assert.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	assert.Len(t, lines, 2)
+
+	var ev Event
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &ev))
+	assert.Equal(t, EventBan, ev.Type)
+	assert.Equal(t, "spam", ev.Reason)
+	assert.False(t, ev.Time.IsZero())
+}
+
+func TestHTTP(t *testing.T) {
+	s := NewHTTP()
+	assert.Equal(t, "http", s.Name())
+	assert.Error(t, s.Configure(nil))
+	assert.Error(t, s.Configure(map[string]interface{}{}))
+	assert.NoError(t, s.Configure(map[string]interface{}{
+		"url":           "http://localhost/audit",
+		"authorization": "Bearer abc",
+		"interval":      3600000.0,
+	}))
+	assert.Len(t, s.head, 2)
+
+	h := http.NewMockClient()
+	h.On("Post", "http://localhost/audit", mock.MatchedBy(func(b []byte) bool {
+		var events []Event
+		return json.Unmarshal(b, &events) == nil && len(events) == 2
+	}), mock.Anything, mock.Anything).Return([]byte{}, nil).Once()
+	s.http = h
+
+	s.Record(&Event{Type: EventConnect, Actor: Actor{Addr: "10.0.0.1"}})
+	s.Record(&Event{Type: EventDisconnect, Actor: Actor{Addr: "10.0.0.1"}})
+	assert.NoError(t, s.Close())
+	h.AssertExpectations(t)
+	assert.Empty(t, s.pending)
+}
+
+func TestHTTP_Failure(t *testing.T) {
+	s := NewHTTP()
+	assert.NoError(t, s.Configure(map[string]interface{}{
+		"url":      "http://localhost/audit",
+		"interval": 3600000.0,
+		"buffer":   3.0,
+	}))
+
+	// The events which could not be posted should be kept
+	h := http.NewMockClient()
+	h.On("Post", "http://localhost/audit", mock.Anything, mock.Anything, mock.Anything).
+		Return([]byte{}, errors.New("unavailable")).Once()
+	s.http = h
+
+	s.Record(&Event{Type: EventConnect, Actor: Actor{Addr: "10.0.0.1"}})
+	s.Record(&Event{Type: EventConnect, Actor: Actor{Addr: "10.0.0.2"}})
+	s.flush()
+	assert.Len(t, s.pending, 2)
+
+	// Once the buffer is full, the oldest events should be dropped
+	s.Record(&Event{Type: EventConnect, Actor: Actor{Addr: "10.0.0.3"}})
+	s.Record(&Event{Type: EventConnect, Actor: Actor{Addr: "10.0.0.4"}})
+	assert.Len(t, s.pending, 3)
+	assert.Equal(t, "10.0.0.2", s.pending[0].Addr)
+	assert.Equal(t, int64(1), s.dropped)
+
+	m := stats.New()
+	s.Measure(m)
+	assert.NotEmpty(t, m.Snapshot())
+
+	// The kept events should be posted again
+	h.On("Post", "http://localhost/audit", mock.MatchedBy(func(b []byte) bool {
+		var events []Event
+		return json.Unmarshal(b, &events) == nil && len(events) == 3 && events[0].Addr == "10.0.0.2"
+	}), mock.Anything, mock.Anything).Return([]byte{}, nil).Once()
+	assert.NoError(t, s.Close())
+	h.AssertExpectations(t)
+	assert.Empty(t, s.pending)
+}
+
+func TestSelf(t *testing.T) {
+	var channel string
+	var payload []byte
+	s := NewSelf(func(c string, b []byte) {
+		channel, payload = c, b
+	})
+
+	assert.Equal(t, "self", s.Name())
+	assert.NoError(t, s.Configure(nil))
+
+	now := time.Unix(1600000000, 0).UTC()
+	s.Record(&Event{Time: now, Type: EventKeygen, Contract: 1, Master: 2, Channel: "a/", Access: "rw"})
+	assert.Equal(t, "audit/", channel)
+	assert.Equal(t, `{"time":"2020-09-13T12:26:40Z","type":"keygen","contract":1,"master":2,"channel":"a/","access":"rw"}`, string(payload))
+	assert.NoError(t, s.Close())
+}
+
+func TestActorOfRequest(t *testing.T) {
+	r, _ := netHTTP.NewRequest("POST", "/keygen", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	assert.Equal(t, Actor{Addr: "10.0.0.1"}, ActorOfRequest(r))
+
+	r.RemoteAddr = "invalid"
+	assert.Equal(t, Actor{Addr: "invalid"}, ActorOfRequest(r))
+}
@@ -0,0 +1,183 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/coocood/freecache"
+	"github.com/emitter-io/config"
+	"github.com/emitter-io/emitter/internal/network/http"
+	"github.com/emitter-io/emitter/internal/provider/logging"
+)
+
+// Various actions which are authorized by the provider.
+const (
+	ActionConnect   = "connect"
+	ActionSubscribe = "subscribe"
+	ActionPublish   = "publish"
+)
+
+// Request represents an authorization request for an action of a client.
+type Request struct {
+	Action   string `json:"action"`             // The action to authorize, such as "connect", "subscribe" or "publish".
+	Username string `json:"username"`           // The username provided by the client during MQTT connect.
+	ClientID string `json:"client"`             // The client ID provided by the client during MQTT connect.
+	Channel  string `json:"channel,omitempty"`  // The channel, without the key, for subscribe and publish.
+	Contract uint32 `json:"contract,omitempty"` // The contract of the key used for subscribe and publish.
+}
+
+// Provider represents an authorization provider which is consulted in addition to the
+// security keys, so the tenancy rules can be enforced by an external service.
+type Provider interface {
+	config.Provider
+
+	// Authorize checks whether the action is allowed.
+	Authorize(*Request) bool
+}
+
+// ------------------------------------------------------------------------------------
+
+// Noop implements Provider contract.
+var _ Provider = new(NoopProvider)
+
+// NoopProvider represents an authorization provider which allows everything.
+type NoopProvider struct{}
+
+// NewNoop creates a new no-op authorization provider.
+func NewNoop() *NoopProvider {
+	return new(NoopProvider)
+}
+
+// Name returns the name of the provider.
+func (p *NoopProvider) Name() string {
+	return "noop"
+}
+
+// Configure configures the provider
+func (p *NoopProvider) Configure(config map[string]interface{}) error {
+	return nil
+}
+
+// Authorize checks whether the action is allowed.
+func (p *NoopProvider) Authorize(*Request) bool {
+	return true
+}
+
+// ------------------------------------------------------------------------------------
+
+// HTTPProvider implements Provider contract.
+var _ Provider = new(HTTPProvider)
+
+// HTTPProvider represents an authorization provider which calls a webhook over HTTP
+// and caches the decisions.
+type HTTPProvider struct {
+	url      string             // The url to post to.
+	http     http.Client        // The http client to use.
+	head     []http.HeaderValue // The http headers to add with each request.
+	cache    *freecache.Cache   // The cache for the decisions.
+	ttl      int                // The time-to-live of the cached decisions, in seconds.
+	failOpen bool               // Whether the action is allowed when the webhook fails.
+}
+
+// NewHTTP creates a new HTTP authorization provider.
+func NewHTTP() *HTTPProvider {
+	return new(HTTPProvider)
+}
+
+// Name returns the name of the provider.
+func (p *HTTPProvider) Name() string {
+	return "http"
+}
+
+// Configure configures the provider.
+func (p *HTTPProvider) Configure(config map[string]interface{}) (err error) {
+	if config == nil {
+		return errors.New("Configuration was not provided for HTTP authorization provider")
+	}
+
+	// Get the time-to-live of the cached decisions
+	p.ttl = 60
+	if v, ok := config["ttl"]; ok {
+		if i, ok := v.(float64); ok {
+			p.ttl = int(math.Ceil(i / 1000))
+		}
+	}
+
+	// Get the timeout of the webhook calls
+	timeout := 5 * time.Second
+	if v, ok := config["timeout"]; ok {
+		if i, ok := v.(float64); ok {
+			timeout = time.Duration(i) * time.Millisecond
+		}
+	}
+
+	// Get whether we should allow the action if the webhook fails
+	if v, ok := config["failOpen"]; ok {
+		p.failOpen, _ = v.(bool)
+	}
+
+	// Get the authorization header to add to the request
+	p.head = []http.HeaderValue{http.NewHeader("Content-Type", "application/json")}
+	if v, ok := config["authorization"]; ok {
+		if header, ok := v.(string); ok {
+			p.head = append(p.head, http.NewHeader("Authorization", header))
+		}
+	}
+
+	// Get the url from the provider configuration
+	if url, ok := config["url"]; ok {
+		p.url = url.(string)
+		p.cache = freecache.NewCache(8 << 20) // 8MB
+		p.http, err = http.NewClient(timeout)
+		return
+	}
+
+	return errors.New("The 'url' parameter was not provider in the configuration for HTTP authorization provider")
+}
+
+// Authorize checks whether the action is allowed.
+func (p *HTTPProvider) Authorize(r *Request) bool {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return false
+	}
+
+	// Check if we have a cached decision first
+	if v, err := p.cache.Get(body); err == nil && len(v) == 1 {
+		return v[0] == 1
+	}
+
+	// Call the webhook and fail according to the configuration
+	var resp struct {
+		Allow bool `json:"allow"`
+	}
+	if _, err := p.http.Post(p.url, body, &resp, p.head...); err != nil {
+		logging.LogError("http authorization", "calling webhook", err)
+		return p.failOpen
+	}
+
+	// Cache the decision
+	decision := byte(0)
+	if resp.Allow {
+		decision = 1
+	}
+
+	p.cache.Set(body, []byte{decision}, p.ttl)
+	return resp.Allow
+}
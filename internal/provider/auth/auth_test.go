@@ -0,0 +1,96 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package auth
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/coocood/freecache"
+	"github.com/emitter-io/emitter/internal/network/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestNoop(t *testing.T) {
+	p := NewNoop()
+	assert.Equal(t, "noop", p.Name())
+	assert.NoError(t, p.Configure(nil))
+	assert.True(t, p.Authorize(&Request{Action: ActionConnect}))
+}
+
+func TestHTTP_Configure(t *testing.T) {
+	p := NewHTTP()
+	assert.Equal(t, "http", p.Name())
+	assert.Error(t, p.Configure(nil))
+	assert.Error(t, p.Configure(map[string]interface{}{}))
+
+	err := p.Configure(map[string]interface{}{
+		"url":           "http://localhost/authorize",
+		"authorization": "Bearer abc",
+		"ttl":           1500.0,
+		"timeout":       1000.0,
+		"failOpen":      true,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost/authorize", p.url)
+	assert.Equal(t, 2, p.ttl)
+	assert.True(t, p.failOpen)
+	assert.Len(t, p.head, 2)
+	assert.NotNil(t, p.http)
+}
+
+func TestHTTP_Authorize(t *testing.T) {
+	allowed := &Request{Action: ActionSubscribe, Username: "joe", Channel: "a/b/"}
+	denied := &Request{Action: ActionPublish, Username: "joe", Channel: "a/b/"}
+
+	h := http.NewMockClient()
+	h.On("Post", "http://localhost/authorize", mock.MatchedBy(func(b []byte) bool {
+		return string(b) == `{"action":"subscribe","username":"joe","client":"","channel":"a/b/"}`
+	}), mock.Anything, mock.Anything).Return([]byte{}, nil).Run(func(args mock.Arguments) {
+		args.Get(2).(*struct {
+			Allow bool `json:"allow"`
+		}).Allow = true
+	}).Once()
+	h.On("Post", "http://localhost/authorize", mock.Anything, mock.Anything, mock.Anything).Return([]byte{}, nil).Once()
+
+	p := &HTTPProvider{
+		url:   "http://localhost/authorize",
+		http:  h,
+		cache: freecache.NewCache(1 << 20),
+		ttl:   60,
+	}
+
+	// Call twice, the second time must be served from the cache
+	for i := 0; i < 2; i++ {
+		assert.True(t, p.Authorize(allowed))
+		assert.False(t, p.Authorize(denied))
+	}
+	h.AssertNumberOfCalls(t, "Post", 2)
+}
+
+func TestHTTP_Fail(t *testing.T) {
+	h := http.NewMockClient()
+	h.On("Post", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return([]byte{}, errors.New("boom"))
+
+	p := &HTTPProvider{
+		http:  h,
+		cache: freecache.NewCache(1 << 20),
+	}
+
+	assert.False(t, p.Authorize(&Request{Action: ActionConnect}))
+	p.failOpen = true
+	assert.True(t, p.Authorize(&Request{Action: ActionConnect}))
+}
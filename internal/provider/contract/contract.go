@@ -16,6 +16,7 @@ package contract
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"sync"
@@ -23,6 +24,7 @@ import (
 
 	"github.com/emitter-io/config"
 	"github.com/emitter-io/emitter/internal/async"
+	"github.com/emitter-io/emitter/internal/network/cidr"
 	"github.com/emitter-io/emitter/internal/network/http"
 	"github.com/emitter-io/emitter/internal/provider/logging"
 	"github.com/emitter-io/emitter/internal/provider/usage"
@@ -41,14 +43,47 @@ const (
 type Contract interface {
 	Validate(key security.Key) bool // Validate checks the security key with the contract.
 	Stats() usage.Meter             // Gets the usage statistics.
+	Limits() Limits                 // Gets the rate and volume limits.
+	Permits(addr string) bool       // Checks whether a client address is allowed to connect.
+}
+
+// Limits represents the rate and volume limits of a contract, both for the contract as
+// a whole and for each of its keys.
+type Limits struct {
+	Contract Limit       `json:"contract,omitempty"` // The limits of the contract as a whole.
+	Key      Limit       `json:"key,omitempty"`      // The limits of each individual key.
+	Storage  []Retention `json:"storage,omitempty"`  // The retention policies and quotas of the stored messages.
+}
+
+// Limit represents a set of rate and volume limits, zero meaning unlimited.
+type Limit struct {
+	Rate        int   `json:"rate,omitempty"`        // The maximum number of messages per second.
+	Daily       int64 `json:"daily,omitempty"`       // The maximum number of bytes per day.
+	Connections int   `json:"connections,omitempty"` // The maximum number of concurrent connections.
+}
+
+// IsZero checks whether no limit is set.
+func (l *Limit) IsZero() bool {
+	return l.Rate == 0 && l.Daily == 0 && l.Connections == 0
+}
+
+// Retention represents the retention policy, the storage quota and the replication factor
+// of the messages stored on the channels starting with a prefix, zero meaning unlimited.
+type Retention struct {
+	Channel  string `json:"channel,omitempty"`  // The channel prefix, empty meaning every channel.
+	Retain   uint32 `json:"retain,omitempty"`   // The maximum number of seconds to keep a message for.
+	Bytes    int64  `json:"bytes,omitempty"`    // The maximum number of bytes to keep, the oldest messages evicted first.
+	Replicas int    `json:"replicas,omitempty"` // The number of nodes to store each message on, one by default.
 }
 
 // contract represents a contract (user account).
 type contract struct {
-	ID        uint32      `json:"id"`     // Gets or sets the contract id.
-	MasterID  uint16      `json:"master"` // Gets or sets the master id.
-	Signature uint32      `json:"sign"`   // Gets or sets the signature of the contract.
-	State     uint8       `json:"state"`  // Gets or sets the state of the contract.
+	ID        uint32      `json:"id"`                 // Gets or sets the contract id.
+	MasterID  uint16      `json:"master"`             // Gets or sets the master id.
+	Signature uint32      `json:"sign"`               // Gets or sets the signature of the contract.
+	State     uint8       `json:"state"`              // Gets or sets the state of the contract.
+	Quota     Limits      `json:"limits,omitempty"`   // Gets or sets the rate and volume limits.
+	Networks  cidr.List   `json:"networks,omitempty"` // Gets or sets the networks the clients must connect from.
 	stats     usage.Meter // Gets the usage stats.
 }
 
@@ -65,6 +100,17 @@ func (c *contract) Stats() usage.Meter {
 	return c.stats
 }
 
+// Limits gets the rate and volume limits.
+func (c *contract) Limits() Limits {
+	return c.Quota
+}
+
+// Permits checks whether a client address is allowed to connect. If the contract is not
+// restricted to any networks, all of the addresses are allowed.
+func (c *contract) Permits(addr string) bool {
+	return len(c.Networks) == 0 || c.Networks.Contains(addr)
+}
+
 // Provider represents an interface for a contract provider.
 type Provider interface {
 	config.Provider
@@ -113,30 +159,61 @@ var _ Provider = new(SingleContractProvider)
 
 // SingleContractProvider provides contracts on premise.
 type SingleContractProvider struct {
-	owner *contract      // The owner contract.
-	usage usage.Metering // The usage stats container.
+	owner   *contract      // The owner contract.
+	retired []*contract    // The contracts of the retired licenses.
+	usage   usage.Metering // The usage stats container.
 }
 
-// NewSingleContractProvider creates a new single contract provider.
-func NewSingleContractProvider(license license.License, metering usage.Metering) *SingleContractProvider {
+// NewSingleContractProvider creates a new single contract provider. The contracts of the
+// retired licenses, if any, are still provided so the keys issued with them remain valid.
+func NewSingleContractProvider(license license.License, metering usage.Metering, retired ...license.License) *SingleContractProvider {
 	p := new(SingleContractProvider)
-	p.owner = new(contract)
-	p.owner.MasterID = 1
-	p.owner.ID = license.Contract()
-	p.owner.Signature = license.Signature()
-	p.owner.State = ContractStateAllowed
 	p.usage = metering
-	p.owner.stats = p.usage.Get(license.Contract()).(usage.Meter)
+	p.owner = p.newContract(license)
+	for _, l := range retired {
+		p.retired = append(p.retired, p.newContract(l))
+	}
 	return p
 }
 
+// newContract creates a new allowed contract for a license.
+func (p *SingleContractProvider) newContract(license license.License) *contract {
+	c := new(contract)
+	c.MasterID = 1
+	c.ID = license.Contract()
+	c.Signature = license.Signature()
+	c.State = ContractStateAllowed
+	c.stats = p.usage.Get(license.Contract()).(usage.Meter)
+	return c
+}
+
 // Name returns the name of the provider.
 func (p *SingleContractProvider) Name() string {
 	return "single"
 }
 
-// Configure configures the provider.
+// Configure configures the provider. The rate and volume limits of the contracts can be
+// specified using the "limits" parameter and the networks the clients must connect from
+// using the "networks" parameter.
 func (p *SingleContractProvider) Configure(config map[string]interface{}) error {
+	var settings struct {
+		Limits   Limits    `json:"limits"`
+		Networks cidr.List `json:"networks"`
+	}
+
+	// Decode the settings by round-tripping through JSON
+	b, err := json.Marshal(config)
+	if err == nil {
+		err = json.Unmarshal(b, &settings)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, c := range append([]*contract{p.owner}, p.retired...) {
+		c.Quota = settings.Limits
+		c.Networks = settings.Networks
+	}
 	return nil
 }
 
@@ -147,11 +224,17 @@ func (p *SingleContractProvider) Create() (Contract, error) {
 
 // Get returns a ContractData fetched by its id.
 func (p *SingleContractProvider) Get(id uint32) (Contract, bool) {
-	if p.owner == nil || p.owner.ID != id {
-		return nil, false
+	if p.owner != nil && p.owner.ID == id {
+		return p.owner, true
 	}
 
-	return p.owner, true
+	for _, c := range p.retired {
+		if c.ID == id {
+			return c, true
+		}
+	}
+
+	return nil, false
 }
 
 // ------------------------------------------------------------------------------------
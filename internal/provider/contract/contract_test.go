@@ -61,6 +61,49 @@ func TestSingleContractProvider_Create(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestSingleContractProvider_Limits(t *testing.T) {
+	p, license := testNewSingleContractProvider()
+	assert.NoError(t, p.Configure(map[string]interface{}{
+		"limits": map[string]interface{}{
+			"contract": map[string]interface{}{"rate": 100.0, "daily": 1000000.0},
+			"key":      map[string]interface{}{"connections": 5.0},
+			"storage": []interface{}{
+				map[string]interface{}{"channel": "a/", "retain": 60.0, "bytes": 1000.0},
+			},
+		},
+	}))
+
+	c, ok := p.Get(license.Contract())
+	assert.True(t, ok)
+	assert.Equal(t, Limits{
+		Contract: Limit{Rate: 100, Daily: 1000000},
+		Key:      Limit{Connections: 5},
+		Storage:  []Retention{{Channel: "a/", Retain: 60, Bytes: 1000}},
+	}, c.Limits())
+
+	assert.Error(t, p.Configure(map[string]interface{}{
+		"limits": "invalid",
+	}))
+}
+
+func TestSingleContractProvider_Networks(t *testing.T) {
+	p, license := testNewSingleContractProvider()
+	c, ok := p.Get(license.Contract())
+	assert.True(t, ok)
+	assert.True(t, c.Permits("203.0.113.7"))
+
+	assert.NoError(t, p.Configure(map[string]interface{}{
+		"networks": []interface{}{"10.0.0.0/8", "192.168.1.1"},
+	}))
+	assert.True(t, c.Permits("10.1.2.3"))
+	assert.True(t, c.Permits("192.168.1.1"))
+	assert.False(t, c.Permits("203.0.113.7"))
+
+	assert.Error(t, p.Configure(map[string]interface{}{
+		"networks": []interface{}{"factory"},
+	}))
+}
+
 func TestSingleContractProvider_Get(t *testing.T) {
 	p, license := testNewSingleContractProvider()
 	contractByID, ok1 := p.Get(license.Contract())
@@ -72,6 +115,25 @@ func TestSingleContractProvider_Get(t *testing.T) {
 	assert.Nil(t, contractByWrongID)
 }
 
+func TestSingleContractProvider_Retired(t *testing.T) {
+	l, _ := license.Parse("zT83oDV0DWY5_JysbSTPTDr8KB0AAAAAAAAAAAAAAAI")
+	retired := license.NewV3()
+	p := NewSingleContractProvider(l, new(usage.NoopStorage), retired)
+
+	c, ok := p.Get(l.Contract())
+	assert.True(t, ok)
+	assert.Equal(t, p.owner, c)
+
+	c, ok = p.Get(retired.Contract())
+	assert.True(t, ok)
+
+	key := security.Key(make([]byte, 24))
+	key.SetMaster(1)
+	key.SetContract(retired.Contract())
+	key.SetSignature(retired.Signature())
+	assert.True(t, c.Validate(key))
+}
+
 func TestSingleContractProvider_Validate(t *testing.T) {
 	p, license := testNewSingleContractProvider()
 	contract, ok := p.Get(license.Contract())
@@ -38,6 +38,18 @@ func (mock *Contract) Stats() usage.Meter {
 	return mockArgs.Get(0).(usage.Meter)
 }
 
+// Limits returns the rate and volume limits.
+func (mock *Contract) Limits() contract.Limits {
+	mockArgs := mock.Called()
+	return mockArgs.Get(0).(contract.Limits)
+}
+
+// Permits checks whether a client address is allowed to connect.
+func (mock *Contract) Permits(addr string) bool {
+	mockArgs := mock.Called(addr)
+	return mockArgs.Bool(0)
+}
+
 // ContractProvider is the mock provider for contracts
 type ContractProvider struct {
 	mock.Mock
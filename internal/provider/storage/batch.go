@@ -0,0 +1,183 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package storage
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/emitter-io/emitter/internal/provider/logging"
+	"github.com/emitter-io/stats"
+)
+
+var errClosed = errors.New("the storage is closed")
+
+const (
+	defaultFlush = 100                   // 100 milliseconds
+	defaultQueue = 10000                 // messages
+	writeRetries = 3                     // The number of times a failed batch is retried.
+	retryDelay   = 50 * time.Millisecond // The delay before a retry, which grows with each attempt.
+)
+
+// batcher writes the entries to the database in the background, in batches which are
+// committed either once full or once the flush interval has elapsed. The queue is bounded,
+// so the writers are blocked when the database can not keep up.
+type batcher struct {
+	sync.RWMutex
+	db      *badger.DB            // The underlying database to write to.
+	queue   chan *badger.Entry    // The entries waiting to be written.
+	size    int                   // The maximum number of entries in a batch.
+	flush   time.Duration         // The maximum time an entry waits in the queue.
+	closed  bool                  // Whether the batcher is closed.
+	closing chan struct{}         // Signals the writer to flush and stop.
+	done    chan struct{}         // Signaled by the writer once it has stopped.
+	batches int64                 // The number of batches committed.
+	written int64                 // The number of entries written.
+	failed  int64                 // The number of entries which failed to be written.
+	dropped func([]*badger.Entry) // Called with the entries which could not be written.
+}
+
+// newBatcher creates a new batcher and starts writing in the background. The entries which
+// still can not be written once retried are handed over to the dropped function.
+func newBatcher(db *badger.DB, size int, flush time.Duration, queue int, dropped func([]*badger.Entry)) *batcher {
+	b := &batcher{
+		db:      db,
+		queue:   make(chan *badger.Entry, queue),
+		size:    size,
+		flush:   flush,
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+		dropped: dropped,
+	}
+
+	go b.run()
+	return b
+}
+
+// Enqueue adds the entries to the queue, waiting for room if the queue is full.
+func (b *batcher) Enqueue(entries []*badger.Entry) error {
+	b.RLock()
+	defer b.RUnlock()
+	if b.closed {
+		return errClosed
+	}
+
+	for _, entry := range entries {
+		b.queue <- entry
+	}
+	return nil
+}
+
+// Close flushes the queued entries and stops the writer.
+func (b *batcher) Close() {
+	b.Lock()
+	closed := b.closed
+	b.closed = true
+	b.Unlock()
+
+	if !closed {
+		close(b.closing)
+		<-b.done
+	}
+}
+
+// Measure reports the metrics of the batcher.
+func (b *batcher) Measure(m stats.Measurer) {
+	m.Measure("ssd.queue", int32(len(b.queue)))
+	m.Measure("ssd.batches", int32(atomic.LoadInt64(&b.batches)))
+	m.Measure("ssd.written", int32(atomic.LoadInt64(&b.written)))
+	m.Measure("ssd.failed", int32(atomic.LoadInt64(&b.failed)))
+}
+
+// run writes the queued entries until the batcher is closed.
+func (b *batcher) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.flush)
+	defer ticker.Stop()
+
+	batch := make([]*badger.Entry, 0, b.size)
+	for {
+		select {
+		case entry := <-b.queue:
+			if batch = append(batch, entry); len(batch) >= b.size {
+				batch = b.commit(batch)
+			}
+		case <-ticker.C:
+			batch = b.commit(batch)
+		case <-b.closing:
+			for len(b.queue) > 0 {
+				if batch = append(batch, <-b.queue); len(batch) >= b.size {
+					batch = b.commit(batch)
+				}
+			}
+			b.commit(batch)
+			return
+		}
+	}
+}
+
+// commit writes the batch to the database and returns the emptied batch. A failed batch is
+// retried a few times before its entries are dropped.
+func (b *batcher) commit(batch []*badger.Entry) []*badger.Entry {
+	if len(batch) == 0 {
+		return batch
+	}
+
+	// The database replaces the keys of the entries it writes, so keep the original ones
+	keys := make([][]byte, 0, len(batch))
+	for _, entry := range batch {
+		keys = append(keys, entry.Key)
+	}
+
+	err := b.write(batch)
+	for attempt := 1; err != nil && attempt <= writeRetries; attempt++ {
+		logging.LogError("ssd", "write batch", err)
+		time.Sleep(time.Duration(attempt) * retryDelay)
+		for i, entry := range batch {
+			batch[i] = &badger.Entry{Key: keys[i], Value: entry.Value, ExpiresAt: entry.ExpiresAt}
+		}
+		err = b.write(batch)
+	}
+
+	if err != nil {
+		logging.LogError("ssd", "drop batch", err)
+		atomic.AddInt64(&b.failed, int64(len(batch)))
+		if b.dropped != nil {
+			b.dropped(batch)
+		}
+	} else {
+		atomic.AddInt64(&b.written, int64(len(batch)))
+	}
+
+	atomic.AddInt64(&b.batches, 1)
+	return batch[:0]
+}
+
+// write writes the entries in a single write batch, which is split into several
+// transactions by the database if needed.
+func (b *batcher) write(entries []*badger.Entry) error {
+	wb := b.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	for _, entry := range entries {
+		if err := wb.SetEntry(entry); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
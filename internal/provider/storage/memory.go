@@ -51,6 +51,12 @@ func (s *InMemory) Configure(config map[string]interface{}) error {
 	opts.SyncWrites = true
 	opts.InMemory = true
 
+	// Get the retention policies and quotas
+	policies, err := parsePolicies(config)
+	if err != nil {
+		return err
+	}
+
 	// Attempt to open the database
 	db, err := badger.Open(opts)
 	if err != nil {
@@ -58,8 +64,18 @@ func (s *InMemory) Configure(config map[string]interface{}) error {
 	}
 
 	// Setup the database and start GC
+	ctx, cancel := context.WithCancel(context.Background())
 	s.db = db
 	s.retain = configUint32(config, "retain", defaultRetain)
-	s.cancel = async.Repeat(context.Background(), 30*time.Minute, s.GC)
+	s.policies = policies
+	s.usage = newQuotas()
+	s.cancel = cancel
+	async.Repeat(ctx, 30*time.Minute, s.GC)
+
+	// If the members of the cluster are known, replicate the messages as the policies require
+	if cluster, ok := s.survey.(service.Cluster); ok {
+		s.cluster = cluster
+		async.Repeat(ctx, rebalanceInterval, s.rebalance)
+	}
 	return err
 }
@@ -70,6 +70,12 @@ func TestInMemory_QueryOrdered(t *testing.T) {
 	testOrder(t, store)
 }
 
+func TestInMemory_QueryAscending(t *testing.T) {
+	store := new(InMemory)
+	store.Configure(nil)
+	testAscending(t, store)
+}
+
 func TestInMemory_QueryRange(t *testing.T) {
 	store := new(InMemory)
 	store.Configure(nil)
@@ -117,12 +123,10 @@ func TestInMemory_Query(t *testing.T) {
 		if tc.gathered == nil {
 			s.survey = nil
 		} else {
-			s.survey = surveyFunc(func(string, []byte) (message.Awaiter, error) {
-				return &mockAwaiter{f: func(_ time.Duration) [][]byte { return [][]byte{tc.gathered} }}, nil
-			})
+			s.survey = surveyResponse(lookupResponse{Frame: tc.gathered})
 		}
 
-		out, err := s.Query(tc.query, zero, zero, nil, tc.limit)
+		out, err := s.Query(tc.query, zero, zero, nil, Descending, tc.limit)
 		assert.NoError(t, err)
 
 		count := 0
@@ -152,7 +156,7 @@ func TestInMemory_lookup(t *testing.T) {
 	}
 
 	for _, tc := range tests {
-		matches := s.lookup(newLookupQuery(tc.query, zero, zero, nil, tc.limit))
+		matches, _ := s.lookup(newLookupQuery(tc.query, zero, zero, nil, Descending, tc.limit))
 		assert.Equal(t, tc.count, len(matches))
 	}
 }
@@ -172,13 +176,13 @@ func TestInMemory_OnSurvey(t *testing.T) {
 		{name: "ssdstore"},
 		{
 			name:        "ssdstore",
-			query:       newLookupQuery(message.Ssid{0, 1}, zero, zero, nil, 1),
+			query:       newLookupQuery(message.Ssid{0, 1}, zero, zero, nil, Descending, 1),
 			expectOk:    true,
 			expectCount: 1,
 		},
 		{
 			name:        "ssdstore",
-			query:       newLookupQuery(message.Ssid{0, 1}, zero, zero, nil, 10),
+			query:       newLookupQuery(message.Ssid{0, 1}, zero, zero, nil, Descending, 10),
 			expectOk:    true,
 			expectCount: 2,
 		},
@@ -189,7 +193,9 @@ func TestInMemory_OnSurvey(t *testing.T) {
 		resp, ok := s.OnSurvey(tc.name, q)
 		assert.Equal(t, tc.expectOk, ok)
 		if tc.expectOk && ok {
-			msgs, err := message.DecodeFrame(resp)
+			var result lookupResponse
+			assert.NoError(t, binary.Unmarshal(resp, &result))
+			msgs, err := message.DecodeFrame(result.Frame)
 			assert.NoError(t, err)
 			assert.Equal(t, tc.expectCount, len(msgs))
 		}
@@ -0,0 +1,364 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/provider/contract"
+	"github.com/emitter-io/emitter/internal/security/hash"
+)
+
+const (
+	evictTo      = 0.9         // The share of the quota to evict down to, so the eviction does not run on every message.
+	policyExpiry = time.Minute // The time the policies of a contract are cached for.
+)
+
+// Policy represents the retention policy, the storage quota and the replication factor of
+// the messages stored by a contract on the channels starting with a prefix, zero meaning
+// unlimited.
+type Policy struct {
+	Contract uint32 `json:"contract,omitempty"` // The contract, zero meaning every contract.
+	Channel  string `json:"channel,omitempty"`  // The channel prefix, empty meaning every channel.
+	Retain   uint32 `json:"retain,omitempty"`   // The maximum number of seconds to keep a message for.
+	Bytes    int64  `json:"bytes,omitempty"`    // The maximum number of bytes to keep.
+	Replicas int    `json:"replicas,omitempty"` // The number of nodes to store each message on, one by default.
+}
+
+// policyKey returns the key the usage of the policy is tracked with, per contract.
+func (p *Policy) key(contract uint32) policyKey {
+	return policyKey{contract: contract, channel: p.Channel}
+}
+
+// Policies represents a set of policies.
+type Policies []Policy
+
+// parsePolicies decodes the policies from the provider configuration.
+func parsePolicies(config map[string]interface{}) (out Policies, err error) {
+	v, ok := config["policies"]
+	if !ok {
+		return nil, nil
+	}
+
+	b, err := json.Marshal(v)
+	if err == nil {
+		err = json.Unmarshal(b, &out)
+	}
+	return
+}
+
+// withContract appends the retention policies supplied by the contract provider.
+func (p Policies) withContract(id uint32, c contract.Contract) Policies {
+	limits := c.Limits()
+	if len(limits.Storage) == 0 {
+		return p
+	}
+
+	out := make(Policies, 0, len(p)+len(limits.Storage))
+	out = append(out, p...)
+	for _, v := range limits.Storage {
+		out = append(out, Policy{
+			Contract: id,
+			Channel:  v.Channel,
+			Retain:   v.Retain,
+			Bytes:    v.Bytes,
+			Replicas: v.Replicas,
+		})
+	}
+	return out
+}
+
+// Find returns the policy for a channel of a contract. The most specific one applies, the
+// one with the longest channel prefix and then the one of the contract itself.
+func (p Policies) Find(contract uint32, channel []byte) (found Policy, ok bool) {
+	best := -1
+	for _, v := range p {
+		if (v.Contract != 0 && v.Contract != contract) || !bytes.HasPrefix(channel, []byte(v.Channel)) {
+			continue
+		}
+
+		score := 2 * len(v.Channel)
+		if v.Contract != 0 {
+			score++
+		}
+
+		if score > best {
+			found, ok, best = v, true, score
+		}
+	}
+	return
+}
+
+// ------------------------------------------------------------------------------------
+
+// policySet represents the policies which may apply to the messages of a contract. These are
+// merged with the ones of the contract once and cached, rather than on every message.
+type policySet struct {
+	contract contract.Contract // The contract, if found.
+	policies Policies          // The policies which may apply to the contract.
+	queries  [][]uint32        // The hashes of the complete segments of the channel of each policy.
+	partial  []bool            // Whether the channel of each policy ends within a segment.
+	expires  int64             // The time the set expires at, in unix nanoseconds.
+}
+
+// newPolicySet creates the set of the policies of a contract.
+func newPolicySet(id uint32, policies Policies, c contract.Contract) *policySet {
+	if c != nil {
+		policies = policies.withContract(id, c)
+	}
+
+	set := &policySet{
+		contract: c,
+		expires:  time.Now().Add(policyExpiry).UnixNano(),
+	}
+
+	for _, v := range policies {
+		if v.Contract == 0 || v.Contract == id {
+			query, partial := queryOf(v.Channel)
+			set.policies = append(set.policies, v)
+			set.queries = append(set.queries, query)
+			set.partial = append(set.partial, partial)
+		}
+	}
+	return set
+}
+
+// FindSsid returns the policy for the SSID of a stored message, so its channel does not need
+// to be read. Since the SSID only contains the hashes of the segments, the policy can not be
+// found if the channel of one which may apply ends within a segment, in which case the result
+// is not exact.
+func (p *policySet) FindSsid(ssid message.Ssid) (found Policy, ok, exact bool) {
+	best := -1
+	for i, v := range p.policies {
+		if !hasQuery(ssid, p.queries[i]) {
+			continue
+		}
+
+		if p.partial[i] {
+			return Policy{}, false, false
+		}
+
+		score := 2 * len(v.Channel)
+		if v.Contract != 0 {
+			score++
+		}
+
+		if score > best {
+			found, ok, best = v, true, score
+		}
+	}
+	return found, ok, true
+}
+
+// Replicas returns the number of replicas which store every message matching the SSID of a
+// query, or zero if some of them may be stored by other nodes. This is only the case if the
+// policy of the query and every policy of its sub-channels replicate the messages.
+func (p *policySet) Replicas(ssid message.Ssid) int {
+	policy, ok, exact := p.FindSsid(ssid)
+	if !ok || !exact || policy.Replicas <= 1 {
+		return 0
+	}
+
+	n := policy.Replicas
+	for i, v := range p.policies {
+		if !isBelow(p.queries[i], ssid) {
+			continue
+		}
+
+		if v.Replicas <= 1 {
+			return 0
+		}
+
+		if v.Replicas > n {
+			n = v.Replicas
+		}
+	}
+	return n
+}
+
+// queryOf returns the hashes of the complete segments of a channel prefix, and whether it
+// ends within a segment.
+func queryOf(channel string) (query []uint32, partial bool) {
+	segments := strings.Split(channel, "/")
+	for _, v := range segments[:len(segments)-1] {
+		query = append(query, hash.OfString(v))
+	}
+	return query, segments[len(segments)-1] != ""
+}
+
+// hasQuery checks whether the SSID of a message starts with the hashes of a channel prefix.
+func hasQuery(ssid message.Ssid, query []uint32) bool {
+	if len(ssid) <= len(query) {
+		return false
+	}
+
+	for i, v := range query {
+		if ssid[i+1] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// isBelow checks whether a channel prefix is the one of a sub-channel of the SSID of a query.
+func isBelow(query []uint32, ssid message.Ssid) bool {
+	if len(ssid) == 0 || len(query) < len(ssid) {
+		return false
+	}
+
+	for i, v := range ssid[1:] {
+		if query[i] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// ------------------------------------------------------------------------------------
+
+// policyKey represents a key of the usage of a policy by a contract.
+type policyKey struct {
+	contract uint32
+	channel  string
+}
+
+// tally represents the number of bytes stored, both per contract and per policy.
+type tally struct {
+	contracts map[uint32]int64    // The bytes stored by each contract.
+	policies  map[policyKey]int64 // The bytes stored under each of the policies with a quota.
+}
+
+// newTally creates a new tally.
+func newTally() tally {
+	return tally{
+		contracts: make(map[uint32]int64),
+		policies:  make(map[policyKey]int64),
+	}
+}
+
+// add records the bytes stored and returns the new totals of both the contract and the
+// policy, if it has a quota.
+func (t tally) add(contract uint32, policy *Policy, size int64) (total, used int64) {
+	t.contracts[contract] += size
+	total = t.contracts[contract]
+	if policy != nil && policy.Bytes > 0 {
+		key := policy.key(contract)
+		t.policies[key] += size
+		used = t.policies[key]
+	}
+	return
+}
+
+// quotas tracks the number of bytes stored, both per contract and per policy. Since the
+// database drops the expired messages on its own, the bytes are also tallied by the hour
+// they expire by, so they can be removed from the usage once expired.
+type quotas struct {
+	sync.Mutex
+	tally                       // The bytes currently stored.
+	expiring map[int64]tally    // The bytes which expire by each hour, in unix hours.
+	evicting map[policyKey]bool // The policies which are currently being evicted.
+}
+
+// newQuotas creates a new usage tracker.
+func newQuotas() *quotas {
+	return &quotas{
+		tally:    newTally(),
+		expiring: make(map[int64]tally),
+		evicting: make(map[policyKey]bool),
+	}
+}
+
+// Add records the bytes stored, or removed if negative, along with the time they expire at
+// and returns the new totals of both the contract and the policy, if it has a quota.
+func (q *quotas) Add(contract uint32, policy *Policy, size, expires int64) (total, used int64) {
+	q.Lock()
+	defer q.Unlock()
+
+	if expires > 0 {
+		hour := expires/3600 + 1
+		if _, ok := q.expiring[hour]; !ok {
+			q.expiring[hour] = newTally()
+		}
+		q.expiring[hour].add(contract, policy, size)
+	}
+
+	return q.add(contract, policy, size)
+}
+
+// Expire removes the bytes which have expired by the provided time from the usage and
+// returns the contracts whose usage has changed.
+func (q *quotas) Expire(now time.Time) (changed []uint32) {
+	q.Lock()
+	defer q.Unlock()
+
+	seen := make(map[uint32]bool)
+	for hour, expired := range q.expiring {
+		if hour*3600 > now.Unix() {
+			continue
+		}
+
+		for id, size := range expired.contracts {
+			q.contracts[id] -= size
+			if !seen[id] {
+				seen[id] = true
+				changed = append(changed, id)
+			}
+		}
+
+		for key, size := range expired.policies {
+			q.policies[key] -= size
+		}
+		delete(q.expiring, hour)
+	}
+	return
+}
+
+// Contract returns the number of bytes stored by a contract.
+func (q *quotas) Contract(contract uint32) int64 {
+	q.Lock()
+	defer q.Unlock()
+	return q.contracts[contract]
+}
+
+// Policy returns the number of bytes stored under a policy by a contract.
+func (q *quotas) Policy(key policyKey) int64 {
+	q.Lock()
+	defer q.Unlock()
+	return q.policies[key]
+}
+
+// TryEvict marks the policy as being evicted and returns whether it wasn't already.
+func (q *quotas) TryEvict(key policyKey) bool {
+	q.Lock()
+	defer q.Unlock()
+	if q.evicting[key] {
+		return false
+	}
+
+	q.evicting[key] = true
+	return true
+}
+
+// Evicted marks the eviction of the policy as done.
+func (q *quotas) Evicted(key policyKey) {
+	q.Lock()
+	defer q.Unlock()
+	delete(q.evicting, key)
+}
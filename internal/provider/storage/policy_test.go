@@ -0,0 +1,174 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/provider/contract"
+	"github.com/emitter-io/emitter/internal/provider/contract/mock"
+	"github.com/emitter-io/emitter/internal/security/hash"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicies_Find(t *testing.T) {
+	policies := Policies{
+		{Retain: 10},
+		{Channel: "a/", Retain: 20},
+		{Contract: 1, Retain: 30},
+		{Contract: 1, Channel: "a/", Retain: 40},
+		{Contract: 2, Channel: "a/b/", Retain: 50},
+	}
+
+	tests := []struct {
+		contract uint32
+		channel  string
+		retain   uint32
+	}{
+		{contract: 3, channel: "x/", retain: 10},
+		{contract: 3, channel: "a/b/", retain: 20},
+		{contract: 1, channel: "x/", retain: 30},
+		{contract: 1, channel: "a/b/", retain: 40},
+		{contract: 2, channel: "a/b/c/", retain: 50},
+		{contract: 2, channel: "a/c/", retain: 20},
+	}
+
+	for _, tc := range tests {
+		policy, ok := policies.Find(tc.contract, []byte(tc.channel))
+		assert.True(t, ok)
+		assert.Equal(t, tc.retain, policy.Retain, tc.channel)
+	}
+
+	_, ok := Policies{{Contract: 1}}.Find(2, []byte("a/"))
+	assert.False(t, ok)
+}
+
+func TestPolicies_Parse(t *testing.T) {
+	policies, err := parsePolicies(map[string]interface{}{
+		"policies": []interface{}{
+			map[string]interface{}{"contract": 1, "channel": "a/", "retain": 60, "bytes": 1000},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, Policies{{Contract: 1, Channel: "a/", Retain: 60, Bytes: 1000}}, policies)
+
+	policies, err = parsePolicies(map[string]interface{}{})
+	assert.NoError(t, err)
+	assert.Nil(t, policies)
+
+	_, err = parsePolicies(map[string]interface{}{"policies": "invalid"})
+	assert.Error(t, err)
+}
+
+func TestPolicies_WithContract(t *testing.T) {
+	c := new(mock.Contract)
+	c.On("Limits").Return(contract.Limits{
+		Storage: []contract.Retention{{Channel: "a/", Bytes: 100, Replicas: 3}},
+	})
+
+	policies := Policies{{Retain: 10}}.withContract(5, c)
+	assert.Equal(t, Policies{
+		{Retain: 10},
+		{Contract: 5, Channel: "a/", Bytes: 100, Replicas: 3},
+	}, policies)
+}
+
+func TestPolicySet_FindSsid(t *testing.T) {
+	set := newPolicySet(1, Policies{
+		{Retain: 10},
+		{Channel: "a/", Retain: 20},
+		{Contract: 1, Channel: "a/b/", Retain: 30},
+		{Contract: 2, Channel: "c/", Retain: 40},
+		{Channel: "d/e", Retain: 50},
+	}, nil)
+	assert.Len(t, set.policies, 4)
+
+	tests := []struct {
+		channel []string
+		retain  uint32
+		exact   bool
+	}{
+		{channel: []string{"x"}, retain: 10, exact: true},
+		{channel: []string{"a"}, retain: 20, exact: true},
+		{channel: []string{"a", "b", "c"}, retain: 30, exact: true},
+		{channel: []string{"c"}, retain: 10, exact: true},
+		{channel: []string{"d", "x"}, exact: false},
+	}
+
+	for _, tc := range tests {
+		ssid := message.Ssid{1}
+		for _, v := range tc.channel {
+			ssid = append(ssid, hash.OfString(v))
+		}
+
+		policy, _, exact := set.FindSsid(ssid)
+		assert.Equal(t, tc.exact, exact)
+		assert.Equal(t, tc.retain, policy.Retain)
+	}
+}
+
+func TestPolicySet_Replicas(t *testing.T) {
+	set := newPolicySet(1, Policies{
+		{Channel: "a/", Replicas: 2},
+		{Channel: "a/b/", Replicas: 3},
+		{Channel: "a/c/", Replicas: 1},
+		{Channel: "d/e", Replicas: 2},
+	}, nil)
+
+	tests := []struct {
+		channel  []string
+		replicas int
+	}{
+		{channel: []string{"x"}, replicas: 0},
+		{channel: []string{"a"}, replicas: 0},
+		{channel: []string{"a", "b"}, replicas: 3},
+		{channel: []string{"a", "b", "c"}, replicas: 3},
+		{channel: []string{"a", "d"}, replicas: 2},
+		{channel: []string{"a", "c"}, replicas: 0},
+		{channel: []string{"d"}, replicas: 0},
+	}
+
+	for _, tc := range tests {
+		ssid := message.Ssid{1}
+		for _, v := range tc.channel {
+			ssid = append(ssid, hash.OfString(v))
+		}
+
+		assert.Equal(t, tc.replicas, set.Replicas(ssid), tc.channel)
+	}
+}
+
+func TestQuotas_Expire(t *testing.T) {
+	now := time.Now()
+	policy := &Policy{Channel: "a/", Bytes: 100}
+	q := newQuotas()
+	q.Add(1, policy, 10, now.Add(time.Minute).Unix())
+	q.Add(1, nil, 5, 0)
+	q.Add(2, nil, 5, now.Add(48*time.Hour).Unix())
+
+	total, used := q.Add(1, policy, 20, now.Add(time.Minute).Unix())
+	assert.Equal(t, int64(35), total)
+	assert.Equal(t, int64(30), used)
+
+	// The bytes removed do not expire anymore
+	q.Add(1, policy, -20, now.Add(time.Minute).Unix())
+	assert.Empty(t, q.Expire(now))
+	assert.Equal(t, []uint32{1}, q.Expire(now.Add(2*time.Hour)))
+	assert.Equal(t, int64(5), q.Contract(1))
+	assert.Equal(t, int64(0), q.Policy(policy.key(1)))
+	assert.Equal(t, int64(5), q.Contract(2))
+}
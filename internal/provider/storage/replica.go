@@ -0,0 +1,411 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/emitter-io/emitter/internal/provider/logging"
+)
+
+const (
+	replicaTimeout    = 2 * time.Second        // The time to wait for a replica to acknowledge.
+	replicaFlush      = 100 * time.Millisecond // The interval to send the copies to the replicas at.
+	rebalanceInterval = 10 * time.Second       // The interval to check the membership of the cluster at.
+	rebalanceBatch    = 1000                   // The number of keys read before the copies are sent.
+	replicaRetries    = 3                      // The number of times a frame is sent again to a replica.
+)
+
+// replicasOf returns the members of the cluster which store the messages of a channel. They
+// are chosen with rendezvous hashing, so that every node agrees on them and only a few of
+// them change when a node joins or leaves the cluster. Only the contract and the first segment
+// of the channel are hashed, so that the sub-channels have the same replicas and a query can
+// be sent to these only.
+func replicasOf(members []uint64, ssid message.Ssid, n int) []uint64 {
+	if len(ssid) > 2 {
+		ssid = ssid[:2]
+	}
+
+	key := uint64(14695981039346656037)
+	for _, v := range ssid {
+		key = mix(key ^ uint64(v))
+	}
+
+	ranked := make([]uint64, len(members))
+	copy(ranked, members)
+	sort.Slice(ranked, func(i, j int) bool {
+		wi, wj := mix(key^ranked[i]), mix(key^ranked[j])
+		return wi > wj || (wi == wj && ranked[i] < ranked[j])
+	})
+
+	if n < len(ranked) {
+		ranked = ranked[:n]
+	}
+	return ranked
+}
+
+// mix scrambles the bits of a 64-bit integer (splitmix64 finalizer).
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// contains checks whether a member is in the set.
+func contains(members []uint64, member uint64) bool {
+	for _, v := range members {
+		if v == member {
+			return true
+		}
+	}
+	return false
+}
+
+// ------------------------------------------------------------------------------------
+
+// outbox collects the copies of the messages to send to each replica, so that they are sent
+// in frames which remain reasonably small instead of one by one. The frames are kept until
+// the replicas acknowledge them, along with the local copies of the messages which this node
+// is not a replica of.
+type outbox struct {
+	sync.Mutex
+	pending map[uint64]message.Frame // The frames being filled, per peer.
+	sizes   map[uint64]int           // The size of the frames being filled, per peer.
+	ready   []outgoing               // The frames which are full and ready to be sent.
+	handoff map[string][]uint64      // The replicas yet to acknowledge a local copy, per message.
+}
+
+// outgoing represents a frame of messages to send to a peer.
+type outgoing struct {
+	peer     uint64
+	frame    message.Frame
+	attempts int // The number of times the frame was sent already.
+}
+
+// newOutbox creates a new outbox.
+func newOutbox() *outbox {
+	return &outbox{
+		pending: make(map[uint64]message.Frame),
+		sizes:   make(map[uint64]int),
+		handoff: make(map[string][]uint64),
+	}
+}
+
+// Add adds a copy of the message to the frame of a peer.
+func (o *outbox) Add(peer uint64, m *message.Message) {
+	o.Lock()
+	defer o.Unlock()
+
+	o.pending[peer] = append(o.pending[peer], *m)
+	if o.sizes[peer] += len(m.ID) + len(m.Channel) + len(m.Payload); o.sizes[peer] >= mqtt.MaxMessageSize {
+		o.ready = append(o.ready, outgoing{peer: peer, frame: o.pending[peer]})
+		delete(o.pending, peer)
+		delete(o.sizes, peer)
+	}
+}
+
+// Drain removes and returns every frame of the outbox.
+func (o *outbox) Drain() []outgoing {
+	o.Lock()
+	defer o.Unlock()
+
+	out := o.ready
+	for peer, frame := range o.pending {
+		out = append(out, outgoing{peer: peer, frame: frame})
+	}
+
+	o.ready = nil
+	o.pending = make(map[uint64]message.Frame)
+	o.sizes = make(map[uint64]int)
+	return out
+}
+
+// Retry puts back a frame which was not acknowledged, so it is sent again with the next ones.
+// It returns false once the frame was sent too many times, in which case the local copies of
+// its messages are kept.
+func (o *outbox) Retry(out outgoing) bool {
+	o.Lock()
+	defer o.Unlock()
+
+	if out.attempts++; out.attempts <= replicaRetries {
+		o.ready = append(o.ready, out)
+		return true
+	}
+
+	for _, m := range out.frame {
+		delete(o.handoff, string(m.ID))
+	}
+	return false
+}
+
+// Handoff records that the local copy of a message is to be removed once every replica has
+// acknowledged it.
+func (o *outbox) Handoff(id message.ID, replicas []uint64) {
+	o.Lock()
+	defer o.Unlock()
+	o.handoff[string(id)] = append([]uint64(nil), replicas...)
+}
+
+// Acked records that a peer acknowledged a frame and returns the IDs of the local copies
+// which every replica acknowledged since.
+func (o *outbox) Acked(peer uint64, frame message.Frame) (done []message.ID) {
+	o.Lock()
+	defer o.Unlock()
+
+	for _, m := range frame {
+		waiting, ok := o.handoff[string(m.ID)]
+		if !ok {
+			continue
+		}
+
+		remaining := waiting[:0]
+		for _, v := range waiting {
+			if v != peer {
+				remaining = append(remaining, v)
+			}
+		}
+
+		if o.handoff[string(m.ID)] = remaining; len(remaining) == 0 {
+			delete(o.handoff, string(m.ID))
+			done = append(done, m.ID)
+		}
+	}
+	return
+}
+
+// ------------------------------------------------------------------------------------
+
+// replicate stores the message on the replicas of its channel. A copy is sent to every other
+// replica and, if this node is not one of them, the local copy is only kept until all of the
+// replicas have acknowledged theirs.
+func (s *SSD) replicate(m *message.Message, n int) error {
+	if err := s.store(m); err != nil {
+		return err
+	}
+
+	self := s.cluster.ID()
+	replicas := replicasOf(s.cluster.Members(), m.Ssid(), n)
+	if !contains(replicas, self) {
+		s.outbox.Handoff(m.ID, replicas)
+	}
+
+	for _, peer := range replicas {
+		if peer != self {
+			s.outbox.Add(peer, copyOf(m))
+		}
+	}
+	return nil
+}
+
+// copyOf copies a message, so it can be sent once the buffers of the original are reused.
+func copyOf(m *message.Message) *message.Message {
+	return &message.Message{
+		ID:      append(message.ID(nil), m.ID...),
+		Channel: append([]byte(nil), m.Channel...),
+		Payload: append([]byte(nil), m.Payload...),
+		TTL:     m.TTL,
+	}
+}
+
+// flush sends the frames of the outbox to the replicas and waits for the acknowledgements,
+// all of them within the same deadline. The frames which are not acknowledged are sent again
+// by the next flush.
+func (s *SSD) flush() {
+	type sent struct {
+		outgoing
+		awaiter message.Awaiter
+	}
+
+	var awaiting []sent
+	for _, out := range s.outbox.Drain() {
+		awaiter, err := s.cluster.Ask(out.peer, "ssdreplica", out.frame.Encode())
+		if err != nil {
+			logging.LogError("ssd", "replicate messages", err)
+			s.retry(out)
+			continue
+		}
+
+		awaiting = append(awaiting, sent{outgoing: out, awaiter: awaiter})
+	}
+
+	var done []message.ID
+	deadline := time.Now().Add(replicaTimeout)
+	for _, v := range awaiting {
+		if len(v.awaiter.Gather(time.Until(deadline))) == 0 {
+			logging.LogTarget("ssd", "replica did not acknowledge", v.peer)
+			s.retry(v.outgoing)
+			continue
+		}
+
+		done = append(done, s.outbox.Acked(v.peer, v.frame)...)
+	}
+
+	// Remove the local copies which every replica now stores
+	if len(done) > 0 {
+		if _, err := s.remove(newDeleteQuery(nil, time.Unix(0, 0), time.Unix(0, 0), done)); err != nil {
+			logging.LogError("ssd", "remove replicated messages", err)
+		}
+	}
+}
+
+// retry sends a frame again with the next flush, unless it was sent too many times already.
+func (s *SSD) retry(out outgoing) {
+	if !s.outbox.Retry(out) {
+		logging.LogTarget("ssd", "replica frame dropped", out.peer)
+	}
+}
+
+// onReplica stores the copies of the messages sent by another node.
+func (s *SSD) onReplica(payload []byte) ([]byte, bool) {
+	frame, err := message.DecodeFrame(payload)
+	if err != nil {
+		return nil, false
+	}
+
+	for i := range frame {
+		if err := s.store(&frame[i]); err != nil {
+			logging.LogError("ssd", "store replica", err)
+			return nil, false
+		}
+	}
+
+	return []byte{}, true
+}
+
+// rebalance copies the stored messages to the nodes which became their replicas since the
+// membership of the cluster last changed. Out of the previous replicas which are still alive,
+// only the first one sends the copies, while every node holding a message sends it if none
+// of them is alive anymore. The keys are read in passes, the copies of each pass being sent
+// before the next one starts.
+func (s *SSD) rebalance() {
+	if s.cluster == nil {
+		return
+	}
+
+	members := s.cluster.Members()
+	sort.Slice(members, func(i, j int) bool { return members[i] < members[j] })
+	previous := s.members
+	if equal(previous, members) {
+		return
+	}
+
+	s.members = members
+	if previous == nil {
+		return // Nothing to compare with
+	}
+
+	self := s.cluster.ID()
+	for from := []byte{}; from != nil; {
+		next, err := s.each(from, rebalanceBatch, func(item *badger.Item, policy Policy) {
+			ssid := message.ID(item.Key()).Ssid()
+			before := replicasOf(previous, ssid, policy.Replicas)
+			after := replicasOf(members, ssid, policy.Replicas)
+
+			// Find the first of the previous replicas which is still alive
+			sender := self
+			for _, peer := range before {
+				if contains(members, peer) {
+					sender = peer
+					break
+				}
+			}
+
+			if sender != self {
+				return
+			}
+
+			// Only read the messages which are sent to the new replicas
+			var targets []uint64
+			for _, peer := range after {
+				if peer != self && !contains(before, peer) {
+					targets = append(targets, peer)
+				}
+			}
+
+			if len(targets) == 0 {
+				return
+			}
+
+			msg, err := loadMessage(item)
+			if err != nil {
+				return
+			}
+
+			for _, peer := range targets {
+				s.outbox.Add(peer, &msg)
+			}
+		})
+		if err != nil {
+			logging.LogError("ssd", "rebalance messages", err)
+			return
+		}
+
+		from = next
+		s.flush()
+	}
+}
+
+// each iterates through the keys of the stored messages which are replicated on several
+// nodes, starting from a key. It stops after reading a number of keys and returns the key to
+// continue from, or nil once every key was read. The value of a message is only read when its
+// SSID is not enough to find its policy.
+func (s *SSD) each(from []byte, limit int, fn func(item *badger.Item, policy Policy)) (next []byte, err error) {
+	err = s.db.View(func(tx *badger.Txn) error {
+		it := tx.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+		})
+		defer it.Close()
+
+		read := 0
+		for it.Seek(from); it.Valid(); it.Next() {
+			if read++; read > limit {
+				next = it.Item().KeyCopy(nil)
+				return nil
+			}
+
+			if it.Item().IsDeletedOrExpired() {
+				continue
+			}
+
+			if policy, err := s.policyOfItem(it.Item()); err == nil && policy != nil && policy.Replicas > 1 {
+				fn(it.Item(), *policy)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// equal checks whether two sorted sets of members are equal.
+func equal(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
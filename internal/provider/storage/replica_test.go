@@ -0,0 +1,326 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package storage
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/emitter-io/emitter/internal/security/hash"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCluster represents a cluster which records the messages sent to its members.
+type testCluster struct {
+	sync.Mutex
+	id      uint64
+	members []uint64
+	sent    map[uint64]message.Frame
+	asked   map[uint64]int
+	down    map[uint64]bool
+	queried int
+}
+
+func newTestCluster(id uint64, members ...uint64) *testCluster {
+	return &testCluster{
+		id:      id,
+		members: members,
+		sent:    make(map[uint64]message.Frame),
+		asked:   make(map[uint64]int),
+		down:    make(map[uint64]bool),
+	}
+}
+
+func (c *testCluster) ID() uint64 {
+	return c.id
+}
+
+func (c *testCluster) Members() []uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return append([]uint64(nil), c.members...)
+}
+
+func (c *testCluster) Query(string, []byte) (message.Awaiter, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.queried++
+	return &mockAwaiter{f: func(_ time.Duration) [][]byte { return nil }}, nil
+}
+
+func (c *testCluster) Ask(peer uint64, query string, payload []byte) (message.Awaiter, error) {
+	if query == "ssdstore" {
+		c.Lock()
+		defer c.Unlock()
+		c.asked[peer]++
+		return &mockAwaiter{f: func(_ time.Duration) [][]byte { return nil }}, nil
+	}
+
+	frame, err := message.DecodeFrame(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.sent[peer] = append(c.sent[peer], frame...)
+	if c.down[peer] {
+		return &mockAwaiter{f: func(_ time.Duration) [][]byte { return nil }}, nil
+	}
+	return &mockAwaiter{f: func(_ time.Duration) [][]byte { return [][]byte{{}} }}, nil
+}
+
+// Opens an NewSSD which is a member of the cluster and runs a test on it.
+func runReplicaTest(cluster *testCluster, test func(store *SSD)) {
+	dir, _ := os.MkdirTemp("", "emitter")
+	store := NewSSD(cluster, nil)
+	store.Configure(map[string]interface{}{
+		"dir": dir,
+		"policies": []interface{}{
+			map[string]interface{}{"channel": "a/", "replicas": 2},
+		},
+	})
+
+	defer os.RemoveAll(dir)
+	defer store.Close()
+	test(store)
+}
+
+func TestReplicasOf(t *testing.T) {
+	members := []uint64{1, 2, 3, 4, 5}
+	for i := uint32(0); i < 100; i++ {
+		ssid := message.Ssid{1, i}
+		replicas := replicasOf(members, ssid, 3)
+		assert.Len(t, replicas, 3)
+		assert.Equal(t, replicas, replicasOf([]uint64{5, 4, 3, 2, 1}, ssid, 3))
+		assert.Len(t, replicasOf(members, ssid, 10), 5)
+
+		// Only the new member may replace one of the replicas
+		changed := 0
+		for _, v := range replicasOf(append(members, 6), ssid, 3) {
+			if !contains(replicas, v) {
+				assert.Equal(t, uint64(6), v)
+				changed++
+			}
+		}
+		assert.LessOrEqual(t, changed, 1)
+	}
+}
+
+func TestSSD_Replicate(t *testing.T) {
+	cluster := newTestCluster(1, 1, 2, 3)
+	runReplicaTest(cluster, func(s *SSD) {
+		expect := make(map[uint64]int)
+		local := 0
+		for i := uint32(0); i < 20; i++ {
+			m := testMessage(i, 1, 0)
+			m.Channel = []byte("a/b/")
+			assert.NoError(t, s.Store(m))
+			for _, peer := range replicasOf(cluster.members, m.Ssid(), 2) {
+				if peer != 1 {
+					expect[peer]++
+				} else {
+					local++
+				}
+			}
+		}
+
+		// The messages which are not replicated stay on this node
+		assert.NoError(t, s.Store(testMessage(1, 1, 1)))
+		assert.Empty(t, cluster.sent)
+
+		// The copies are sent in a single frame per replica and only the replicas store them
+		s.flush()
+		assert.NotZero(t, local)
+		assert.Equal(t, local+1, storedCount(s))
+		assert.NotEmpty(t, cluster.sent)
+		for peer, frame := range cluster.sent {
+			assert.Len(t, frame, expect[peer])
+			for _, m := range frame {
+				assert.Contains(t, replicasOf(cluster.members, m.Ssid(), 2), peer)
+			}
+		}
+	})
+}
+
+func TestSSD_ReplicateRetry(t *testing.T) {
+	cluster := newTestCluster(1, 1, 2, 3)
+	runReplicaTest(cluster, func(s *SSD) {
+		var m *message.Message
+		for i := uint32(0); m == nil; i++ {
+			if v := message.New(message.Ssid{i, hash.OfString("a")}, []byte("a/"), []byte("hi")); !contains(replicasOf(cluster.members, v.Ssid(), 2), 1) {
+				m = v
+			}
+		}
+		m.TTL = 100
+
+		// The local copy is kept while one of the replicas does not acknowledge
+		replicas := replicasOf(cluster.members, m.Ssid(), 2)
+		cluster.down[replicas[1]] = true
+		assert.NoError(t, s.Store(m))
+		s.flush()
+		assert.Equal(t, 1, storedCount(s))
+		assert.Len(t, cluster.sent[replicas[0]], 1)
+		assert.Len(t, cluster.sent[replicas[1]], 1)
+
+		// The frame is sent again until the replica acknowledges it
+		s.flush()
+		assert.Len(t, cluster.sent[replicas[0]], 1)
+		assert.Len(t, cluster.sent[replicas[1]], 2)
+
+		cluster.down[replicas[1]] = false
+		s.flush()
+		assert.Len(t, cluster.sent[replicas[1]], 3)
+		assert.Zero(t, storedCount(s))
+
+		// The frame is dropped once sent too many times, but the local copy remains
+		cluster.down[replicas[1]] = true
+		m.ID = message.NewID(m.Ssid())
+		assert.NoError(t, s.Store(m))
+		for i := 0; i < replicaRetries+2; i++ {
+			s.flush()
+		}
+
+		assert.Len(t, cluster.sent[replicas[1]], 3+replicaRetries+1)
+		assert.Equal(t, 1, storedCount(s))
+		assert.Empty(t, s.outbox.handoff)
+	})
+}
+
+func TestSSD_QueryReplicas(t *testing.T) {
+	cluster := newTestCluster(1, 1, 2, 3, 4, 5)
+	runReplicaTest(cluster, func(s *SSD) {
+		zero := time.Unix(0, 0)
+		replicated := message.NewSsid(0, security.ParseChannel([]byte("key/a/b/")).Query)
+		_, err := s.Query(replicated, zero, zero, nil, Descending, 10)
+		assert.NoError(t, err)
+		assert.Zero(t, cluster.queried)
+
+		// Only the replicas of the channel are asked
+		replicas := replicasOf(cluster.members, replicated, 2)
+		for _, peer := range []uint64{2, 3, 4, 5} {
+			assert.Equal(t, contains(replicas, peer), cluster.asked[peer] == 1)
+		}
+
+		// The messages which are not replicated may be stored by any node
+		other := message.NewSsid(0, security.ParseChannel([]byte("key/b/")).Query)
+		_, err = s.Query(other, zero, zero, nil, Descending, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, cluster.queried)
+	})
+}
+
+func TestSSD_OnReplica(t *testing.T) {
+	runSSDTest(func(s *SSD) {
+		frame := getNTestMessages(4)
+		resp, ok := s.OnSurvey("ssdreplica", frame.Encode())
+		assert.True(t, ok)
+		assert.Empty(t, resp)
+
+		zero := time.Unix(0, 0)
+		out, err := s.Query(message.Ssid{0, 1}, zero, zero, nil, Descending, 10)
+		assert.NoError(t, err)
+		assert.Len(t, out, 2)
+
+		_, ok = s.OnSurvey("ssdreplica", []byte{1, 2, 3})
+		assert.False(t, ok)
+	})
+}
+
+func TestSSD_Rebalance(t *testing.T) {
+	cluster := newTestCluster(1, 1, 2)
+	runReplicaTest(cluster, func(s *SSD) {
+		var frame message.Frame
+		for i := uint32(0); i < 50; i++ {
+			m := message.New(message.Ssid{i, hash.OfString("a"), hash.OfString("b")}, []byte("a/b/"), []byte("hi"))
+			m.TTL = 100
+			frame = append(frame, *m)
+		}
+
+		// Only the messages this node is the first previous replica of are sent to the new member
+		expect := 0
+		assert.NoError(t, s.storeFrame(frame))
+		for _, m := range frame {
+			before := replicasOf([]uint64{1, 2}, m.Ssid(), 2)
+			if before[0] == 1 && contains(replicasOf([]uint64{1, 2, 3}, m.Ssid(), 2), 3) {
+				expect++
+			}
+		}
+
+		cluster.Lock()
+		cluster.members = []uint64{3, 2, 1}
+		cluster.Unlock()
+
+		s.rebalance()
+		s.flush()
+		assert.NotZero(t, expect)
+		assert.Len(t, cluster.sent[3], expect)
+		assert.Empty(t, cluster.sent[2])
+
+		// Nothing is sent while the membership remains the same
+		s.rebalance()
+		s.flush()
+		assert.Len(t, cluster.sent[3], expect)
+	})
+}
+
+func TestSSD_Each(t *testing.T) {
+	cluster := newTestCluster(1, 1, 2)
+	runReplicaTest(cluster, func(s *SSD) {
+		var frame message.Frame
+		for i := uint32(0); i < 10; i++ {
+			m := message.New(message.Ssid{i, hash.OfString("a")}, []byte("a/"), []byte("hi"))
+			m.TTL = 100
+			frame = append(frame, *m)
+		}
+
+		// The messages which are not replicated are skipped
+		frame = append(frame, *testMessage(1, 1, 1))
+		assert.NoError(t, s.storeFrame(frame))
+
+		// The keys are read in passes, each one continuing from where the previous one stopped
+		count, passes := 0, 0
+		for from := []byte{}; from != nil; passes++ {
+			next, err := s.each(from, 4, func(item *badger.Item, policy Policy) {
+				assert.Equal(t, 2, policy.Replicas)
+				count++
+			})
+
+			assert.NoError(t, err)
+			from = next
+		}
+
+		assert.Equal(t, 10, count)
+		assert.Equal(t, 3, passes)
+	})
+}
+
+// storedCount returns the number of messages stored locally.
+func storedCount(store *SSD) (count int) {
+	store.db.View(func(tx *badger.Txn) error {
+		it := tx.NewIterator(badger.IteratorOptions{})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			count++
+		}
+		return nil
+	})
+	return
+}
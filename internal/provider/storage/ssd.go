@@ -15,33 +15,50 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"math"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/badger/v3"
 	"github.com/emitter-io/emitter/internal/async"
 	"github.com/emitter-io/emitter/internal/message"
 	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/emitter-io/emitter/internal/provider/contract"
 	"github.com/emitter-io/emitter/internal/provider/logging"
 	"github.com/emitter-io/emitter/internal/service"
+	"github.com/emitter-io/stats"
 	"github.com/kelindar/binary"
 )
 
 // ------------------------------------------------------------------------------------ //
 
+var _ Measurable = new(SSD)
+
 // SSD represents an SSD-optimized storage storage.
 type SSD struct {
-	retain uint32             // The configured TTL for 'retained' messages.
-	survey service.Surveyor   // The cluster surveyor.
-	db     *badger.DB         // The underlying database to use for messages.
-	cancel context.CancelFunc // The cancellation function.
+	retain    uint32             // The configured TTL for 'retained' messages.
+	policies  Policies           // The configured retention policies and quotas.
+	contracts contract.Provider  // The contracts, which can supply their own policies (optional).
+	cache     sync.Map           // The policies of each contract, merged with the configured ones.
+	usage     *quotas            // The number of bytes stored per contract and per policy.
+	survey    service.Surveyor   // The cluster surveyor.
+	cluster   service.Cluster    // The cluster to replicate the messages within (optional).
+	members   []uint64           // The members of the cluster, as of the last rebalance.
+	outbox    *outbox            // The copies of the messages waiting to be sent to the replicas.
+	db        *badger.DB         // The underlying database to use for messages.
+	writer    *batcher           // The background writer, if the batching is enabled.
+	running   sync.WaitGroup     // The evictions and replications running in the background.
+	cancel    context.CancelFunc // The cancellation function.
 }
 
 // NewSSD creates a new SSD-optimized storage storage.
-func NewSSD(survey service.Surveyor) *SSD {
+func NewSSD(survey service.Surveyor, contracts contract.Provider) *SSD {
 	return &SSD{
-		survey: survey,
+		survey:    survey,
+		contracts: contracts,
 	}
 }
 
@@ -74,34 +91,212 @@ func (s *SSD) Configure(config map[string]interface{}) error {
 
 	//opts.ValueLogLoadingMode = options.FileIO
 
+	// Get the retention policies and quotas
+	policies, err := parsePolicies(config)
+	if err != nil {
+		return err
+	}
+
 	// Attempt to open the database
 	db, err := badger.Open(opts)
 	if err != nil {
 		return err
 	}
 
-	// Setup the database and start GC
+	// Setup the database, count what is stored and start GC in the background
+	ctx, cancel := context.WithCancel(context.Background())
 	s.db = db
 	s.retain = configUint32(config, "retain", defaultRetain)
-	s.cancel = async.Repeat(context.Background(), 30*time.Minute, s.GC)
+	s.policies = policies
+	s.usage = newQuotas()
+	s.cancel = cancel
+	s.running.Add(1)
+	snapshot := db.NewTransaction(false)
+	go func() {
+		defer s.running.Done()
+		if s.recount(ctx, snapshot); ctx.Err() == nil {
+			async.Repeat(ctx, 30*time.Minute, s.GC)
+		}
+	}()
+
+	// If the members of the cluster are known, replicate the messages as the policies require
+	if cluster, ok := s.survey.(service.Cluster); ok {
+		s.cluster = cluster
+		s.outbox = newOutbox()
+		async.Repeat(ctx, replicaFlush, s.flush)
+		async.Repeat(ctx, rebalanceInterval, s.rebalance)
+	}
+
+	// If configured, write the messages in batches in the background
+	if size := configUint32(config, "batch", 0); size > 0 {
+		s.writer = newBatcher(db, int(size),
+			time.Duration(configUint32(config, "flush", defaultFlush))*time.Millisecond,
+			int(configUint32(config, "queue", defaultQueue)), s.dropped)
+	}
 	return nil
 }
 
-// Store appends the messages to the store.
+// Store appends the messages to the store. If the policy of the channel requires to store the
+// messages on several nodes, the message is stored by the replicas of the channel instead.
 func (s *SSD) Store(m *message.Message) error {
+	if policy, governed := s.policyOf(m.Contract(), m.Channel); governed && policy.Replicas > 1 && s.cluster != nil {
+		return s.replicate(m, policy.Replicas)
+	}
+
+	return s.store(m)
+}
+
+// store appends the messages to the local store.
+func (s *SSD) store(m *message.Message) (err error) {
+	policy, governed := s.policyOf(m.Contract(), m.Channel)
 	if m.TTL == message.RetainedTTL {
 		m.TTL = s.retain
 	}
 
-	// TODO: add batching instead of storing one by one
-	return s.storeFrame(message.Frame{*m})
+	// The retention policy caps the TTL of the message
+	if governed && policy.Retain > 0 && m.TTL > policy.Retain {
+		m.TTL = policy.Retain
+	}
+
+	// Queue the message for the background writer, if batching is enabled. The message is
+	// tracked beforehand, since the writer untracks the messages it fails to write.
+	entries := encodeFrame(message.Frame{*m})
+	if s.writer != nil {
+		s.track(m.Contract(), policy, governed, int64(len(m.ID)+len(entries[0].Value)), int64(entries[0].ExpiresAt))
+		if err = s.writer.Enqueue(entries); err != nil {
+			s.dropped(entries)
+		}
+		return
+	}
+
+	if err = s.write(entries); err == nil {
+		s.track(m.Contract(), policy, governed, int64(len(m.ID)+len(entries[0].Value)), int64(entries[0].ExpiresAt))
+	}
+	return
+}
+
+// policiesOf returns the policies which may apply to the messages of a contract.
+func (s *SSD) policiesOf(id uint32) *policySet {
+	if v, ok := s.cache.Load(id); ok && v.(*policySet).expires > time.Now().UnixNano() {
+		return v.(*policySet)
+	}
+
+	var c contract.Contract
+	if s.contracts != nil {
+		if found, ok := s.contracts.Get(id); ok {
+			c = found
+		}
+	}
+
+	set := newPolicySet(id, s.policies, c)
+	s.cache.Store(id, set)
+	return set
+}
+
+// policyOf returns the policy which applies to a channel of a contract, if any.
+func (s *SSD) policyOf(id uint32, channel []byte) (Policy, bool) {
+	return s.policiesOf(id).policies.Find(id, channel)
+}
+
+// policyOfItem returns the policy which applies to a stored message, if any. The channel of
+// the message is only read if its SSID is not enough to find the policy.
+func (s *SSD) policyOfItem(item *badger.Item) (*Policy, error) {
+	return s.policyOfKey(item.Key(), func() ([]byte, error) {
+		msg, err := loadMessage(item)
+		return msg.Channel, err
+	})
+}
+
+// policyOfKey returns the policy which applies to the message with the key, if any. The
+// channel is only read if the SSID of the key is not enough to find the policy.
+func (s *SSD) policyOfKey(k []byte, channel func() ([]byte, error)) (*Policy, error) {
+	key := message.ID(k)
+	set := s.policiesOf(key.Contract())
+	policy, governed, exact := set.FindSsid(key.Ssid())
+	if !exact {
+		ch, err := channel()
+		if err != nil {
+			return nil, err
+		}
+
+		policy, governed = set.policies.Find(key.Contract(), ch)
+	}
+
+	if !governed {
+		return nil, nil
+	}
+	return &policy, nil
+}
+
+// dropped removes the entries which could not be written by the batcher from the usage.
+func (s *SSD) dropped(entries []*badger.Entry) {
+	removed := make([]stored, 0, len(entries))
+	for _, entry := range entries {
+		value := entry.Value
+		policy, err := s.policyOfKey(entry.Key, func() ([]byte, error) {
+			msg, err := message.DecodeMessage(value)
+			return msg.Channel, err
+		})
+		if err != nil {
+			continue
+		}
+
+		removed = append(removed, stored{
+			key:     entry.Key,
+			size:    int64(len(entry.Key) + len(entry.Value)),
+			expires: int64(entry.ExpiresAt),
+			policy:  policy,
+		})
+	}
+
+	s.untrack(removed)
+}
+
+// track records the size of a stored message, reports the usage of the contract and
+// starts evicting the oldest messages once the quota of the policy is exceeded.
+func (s *SSD) track(id uint32, policy Policy, governed bool, size, expires int64) {
+	var quota *Policy
+	if governed {
+		quota = &policy
+	}
+
+	total, used := s.usage.Add(id, quota, size, expires)
+	s.report(id, total)
+	if governed && policy.Bytes > 0 && used > policy.Bytes && s.usage.TryEvict(policy.key(id)) {
+		s.running.Add(1)
+		go func() {
+			defer s.running.Done()
+			s.evict(id, policy)
+		}()
+	}
+}
+
+// untrack removes the sizes of the messages removed from the store and reports the usage
+// of their contracts.
+func (s *SSD) untrack(removed []stored) {
+	for _, m := range removed {
+		id := message.ID(m.key).Contract()
+		total, _ := s.usage.Add(id, m.policy, -m.size, m.expires)
+		s.report(id, total)
+	}
+}
+
+// report reports the number of bytes stored by a contract through its usage meter.
+func (s *SSD) report(id uint32, total int64) {
+	if c := s.policiesOf(id).contract; c != nil {
+		c.Stats().SetStored(total)
+	}
 }
 
 // storeFrame appends the frame of messages to the store.
 func (s *SSD) storeFrame(msgs message.Frame) error {
-	encoded := encodeFrame(msgs)
+	return s.write(encodeFrame(msgs))
+}
+
+// write appends the encoded messages to the store.
+func (s *SSD) write(entries []*badger.Entry) error {
 	return s.db.Update(func(tx *badger.Txn) error {
-		for _, m := range encoded {
+		for _, m := range entries {
 			entry := m // Copy address
 			tx.SetEntry(entry)
 		}
@@ -124,32 +319,130 @@ func encodeFrame(msgs message.Frame) []*badger.Entry {
 
 // Query performs a query and attempts to fetch last n messages where
 // n is specified by limit argument. From and until times can also be specified
-// for time-series retrieval.
-func (s *SSD) Query(ssid message.Ssid, from, until time.Time, startFromID message.ID, limit int) (message.Frame, error) {
+// for time-series retrieval. When ascending order is requested, the first n messages
+// are fetched instead. The resulting frame is always sorted chronologically. Fewer
+// messages may be returned if they do not fit into a single message, in which case the
+// query can be continued from the last message returned.
+func (s *SSD) Query(ssid message.Ssid, from, until time.Time, startFromID message.ID, order Order, limit int) (message.Frame, error) {
 
 	// Construct a query and lookup locally first
-	query := newLookupQuery(ssid, from, until, startFromID, limit)
-	match := s.lookup(query)
+	query := newLookupQuery(ssid, from, until, startFromID, order, limit)
+	match, truncated := s.lookup(query)
+
+	// If a lookup was truncated, the messages beyond its last one can not be returned
+	// since the ones of that node in between are missing.
+	var boundary message.ID
+	if truncated {
+		boundary = match[len(match)-1].ID
+	}
 
-	// Issue the message survey to the cluster
-	if req, err := binary.Marshal(query); err == nil && s.survey != nil {
+	// Issue the message survey to the replicas of the channel or to the entire cluster
+	for _, resp := range s.gather(ssid, query) {
+		var result lookupResponse
+		if err := binary.Unmarshal(resp, &result); err != nil {
+			continue
+		}
+
+		if frame, err := message.DecodeFrame(result.Frame); err == nil {
+			if result.Truncated && len(frame) > 0 {
+				boundary = query.horizon(boundary, frame[len(frame)-1].ID)
+			}
+			match = append(match, frame...)
+		}
+	}
+
+	if boundary != nil {
+		query.cut(&match, boundary)
+	}
+
+	// The replicas return the same messages, so we need to remove the duplicates
+	match.Dedupe()
+	query.limit(&match)
+	return match, nil
+}
+
+// gather sends the lookup query to the other nodes and waits for their responses. If every
+// message matching the query is replicated, only the replicas of the channel are asked.
+func (s *SSD) gather(ssid message.Ssid, query lookupQuery) (responses [][]byte) {
+	req, err := binary.Marshal(query)
+	if err != nil || s.survey == nil {
+		return nil
+	}
+
+	n := 0
+	if s.cluster != nil {
+		n = s.policiesOf(ssid.Contract()).Replicas(ssid)
+	}
+
+	// Wait for all responses to come back (or a deadline)
+	if n <= 1 {
 		if awaiter, err := s.survey.Query("ssdstore", req); err == nil {
+			responses = awaiter.Gather(2000 * time.Millisecond)
+		}
+		return
+	}
+
+	var awaiters []message.Awaiter
+	self := s.cluster.ID()
+	for _, peer := range replicasOf(s.cluster.Members(), ssid, n) {
+		if peer != self {
+			if awaiter, err := s.cluster.Ask(peer, "ssdstore", req); err == nil {
+				awaiters = append(awaiters, awaiter)
+			}
+		}
+	}
 
-			// Wait for all presence updates to come back (or a deadline)
+	deadline := time.Now().Add(2000 * time.Millisecond)
+	for _, awaiter := range awaiters {
+		responses = append(responses, awaiter.Gather(time.Until(deadline))...)
+	}
+	return
+}
+
+// Delete removes the messages matching the SSID within the time window, including the
+// ones of the sub-channels. If IDs are provided, only the matching messages with these
+// IDs are removed. It returns the number of messages removed across the cluster.
+func (s *SSD) Delete(ssid message.Ssid, from, until time.Time, ids []message.ID) (int, error) {
+
+	// Construct a query and delete locally first
+	query := newDeleteQuery(ssid, from, until, ids)
+	removed, err := s.remove(query)
+	if err != nil {
+		return 0, err
+	}
+
+	// Since the messages can be replicated, count each of them only once
+	deleted := make(map[string]struct{}, len(removed))
+	for _, id := range removed {
+		deleted[string(id)] = struct{}{}
+	}
+
+	// Issue the delete survey to the cluster
+	if req, err := binary.Marshal(query); err == nil && s.survey != nil {
+		if awaiter, err := s.survey.Query("ssddelete", req); err == nil {
 			for _, resp := range awaiter.Gather(2000 * time.Millisecond) {
-				if frame, err := message.DecodeFrame(resp); err == nil {
-					match = append(match, frame...)
+				var ids []message.ID
+				if err := binary.Unmarshal(resp, &ids); err == nil {
+					for _, id := range ids {
+						deleted[string(id)] = struct{}{}
+					}
 				}
 			}
 		}
 	}
 
-	match.Limit(limit)
-	return match, nil
+	return len(deleted), nil
 }
 
 // OnSurvey handles an incoming cluster lookup request.
 func (s *SSD) OnSurvey(surveyType string, payload []byte) ([]byte, bool) {
+	switch surveyType {
+	case "ssddelete":
+		return s.onDelete(payload)
+	case "ssdreplica":
+		return s.onReplica(payload)
+	}
+
 	if surveyType != "ssdstore" {
 		return nil, false
 	}
@@ -168,38 +461,123 @@ func (s *SSD) OnSurvey(surveyType string, payload []byte) ([]byte, bool) {
 	//logging.LogTarget("ssd", surveyType+" survey received", query)
 
 	// Send back the response
-	f := s.lookup(query)
-	b := f.Encode()
-	return b, true
+	f, truncated := s.lookup(query)
+	b, err := binary.Marshal(lookupResponse{
+		Frame:     f.Encode(),
+		Truncated: truncated,
+	})
+	return b, err == nil
 }
 
-// Lookup performs a against the storage.
-func (s *SSD) lookup(q lookupQuery) (matches message.Frame) {
+// onDelete handles an incoming cluster delete request.
+func (s *SSD) onDelete(payload []byte) ([]byte, bool) {
+	var query deleteQuery
+	if err := binary.Unmarshal(payload, &query); err != nil || len(query.Ssid) < 2 {
+		return nil, false
+	}
+
+	removed, err := s.remove(query)
+	if err != nil {
+		logging.LogError("ssd", "delete messages", err)
+	}
+
+	b, err := binary.Marshal(removed)
+	return b, err == nil
+}
+
+// remove deletes the matching messages stored locally and returns the IDs of the ones deleted.
+func (s *SSD) remove(q deleteQuery) ([]message.ID, error) {
+	var matches []stored
+	if err := s.db.View(func(tx *badger.Txn) error {
+		if len(q.IDs) > 0 {
+			for _, id := range q.IDs {
+				if !id.Match(q.Ssid, q.From, q.Until) {
+					continue
+				}
+
+				if item, err := tx.Get(id); err == nil {
+					if msg, err := s.storedOf(item); err == nil {
+						matches = append(matches, msg)
+					}
+				}
+			}
+			return nil
+		}
+
+		it := tx.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+		})
+		defer it.Close()
+
+		// Same as the lookup, iterate from 'until' back to 'from'
+		for it.Seek(message.NewPrefix(q.Ssid, q.Until)); it.Valid() &&
+			message.ID(it.Item().Key()).HasPrefix(q.Ssid, q.From); it.Next() {
+			if !message.ID(it.Item().Key()).Match(q.Ssid, q.From, q.Until) {
+				continue
+			}
+
+			if msg, err := s.storedOf(it.Item()); err == nil {
+				matches = append(matches, msg)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Delete the messages in a single batch
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, msg := range matches {
+		if err := wb.Delete(msg.key); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := wb.Flush(); err != nil {
+		return nil, err
+	}
+
+	// Update the usage of the contracts and of their policies
+	s.untrack(matches)
+	removed := make([]message.ID, 0, len(matches))
+	for _, msg := range matches {
+		removed = append(removed, msg.key)
+	}
+	return removed, nil
+}
+
+// Lookup performs a against the storage. The lookup stops early if the matching messages
+// would not fit into a single message anymore, in which case it is truncated.
+func (s *SSD) lookup(q lookupQuery) (matches message.Frame, truncated bool) {
 	matches = make(message.Frame, 0, q.Limit)
 	if err := s.db.View(func(tx *badger.Txn) error {
 		it := tx.NewIterator(badger.IteratorOptions{
 			PrefetchValues: false,
+			Reverse:        q.Order == Ascending,
 		})
 		defer it.Close()
 
-		// Since we're starting backwards, seek to the 'until' position first and then
-		// we'll iterate forward but have reverse time ('until' -> 'from')
-		var prefix message.ID
-		if len(q.StartFromID) == 0 {
-			prefix = message.NewPrefix(q.Ssid, q.Until)
-			it.Seek(prefix)
-		} else {
-			it.Seek(q.StartFromID)
-			if !it.Valid() {
-				return nil
+		switch {
+		case len(q.StartFromID) > 0:
+			// Continue right after the ID we've started from, in the same direction
+			if it.Seek(q.StartFromID); it.Valid() && bytes.Equal(it.Item().Key(), q.StartFromID) {
+				it.Next()
 			}
-			it.Next()
+		case q.Order == Ascending:
+			// Since the time is reversed, seek right after the 'from' position first and then
+			// we'll iterate backwards but have chronological time ('from' -> 'until')
+			it.Seek(message.NewPrefix(q.Ssid, floor(q.From)))
+		default:
+			// Since we're starting backwards, seek to the 'until' position first and then
+			// we'll iterate forward but have reverse time ('until' -> 'from')
+			it.Seek(message.NewPrefix(q.Ssid, q.Until))
 		}
 
 		matchesSize := 0
 		// Seek the prefix and check the key so we can quickly exit the iteration.
 		for ; it.Valid() &&
-			message.ID(it.Item().Key()).HasPrefix(q.Ssid, q.From) &&
+			q.within(it.Item().Key()) &&
 			len(matches) < q.Limit; it.Next() {
 			if !message.ID(it.Item().Key()).Match(q.Ssid, q.From, q.Until) {
 				continue
@@ -211,7 +589,8 @@ func (s *SSD) lookup(q lookupQuery) (matches message.Frame) {
 				continue
 			}
 
-			if matchesSize += len(msg.Payload) + len(msg.ID) + len(msg.Channel); matchesSize > mqtt.MaxMessageSize {
+			if matchesSize += len(msg.Payload) + len(msg.ID) + len(msg.Channel); matchesSize > mqtt.MaxMessageSize && len(matches) > 0 {
+				truncated = true
 				break
 			}
 
@@ -230,9 +609,28 @@ func (s *SSD) Close() error {
 		s.cancel()
 	}
 
+	// Send the copies which are still waiting to the replicas
+	if s.outbox != nil {
+		s.flush()
+	}
+
+	// Flush the queued messages before closing the database
+	if s.writer != nil {
+		s.writer.Close()
+	}
+
+	s.running.Wait()
+
 	return s.db.Close()
 }
 
+// Measure reports the metrics of the background writer, if batching is enabled.
+func (s *SSD) Measure(m stats.Measurer) {
+	if s.writer != nil {
+		s.writer.Measure(m)
+	}
+}
+
 // LoadMessage loads the message from badger item.
 func loadMessage(item *badger.Item) (message.Message, error) {
 	data, err := item.ValueCopy(nil)
@@ -243,7 +641,184 @@ func loadMessage(item *badger.Item) (message.Message, error) {
 	return message.DecodeMessage(data)
 }
 
-// GC runs the garbage collection on the storage
+// GC runs the garbage collection on the storage and removes the expired messages from the
+// usage, since these are dropped by the database on its own.
 func (s *SSD) GC() {
 	s.db.RunValueLogGC(0.50)
+	for _, id := range s.usage.Expire(time.Now()) {
+		s.report(id, s.usage.Contract(id))
+	}
+}
+
+// stored represents a stored message, as seen while iterating through the keys.
+type stored struct {
+	key     []byte  // The key of the message.
+	size    int64   // The number of bytes the message takes in the database.
+	expires int64   // The time the message expires at, in unix seconds.
+	policy  *Policy // The policy which applies to the message, if any.
+}
+
+// storedOf reads a stored message from its key, along with the policy which applies to it.
+func (s *SSD) storedOf(item *badger.Item) (stored, error) {
+	policy, err := s.policyOfItem(item)
+	return stored{
+		key:     item.KeyCopy(nil),
+		size:    int64(len(item.Key())) + item.ValueSize(),
+		expires: int64(item.ExpiresAt()),
+		policy:  policy,
+	}, err
+}
+
+// recount counts the bytes stored per contract and per policy once the storage is opened.
+// The messages stored in the meantime are not part of the snapshot iterated through, since
+// these are counted as they are stored.
+func (s *SSD) recount(ctx context.Context, snapshot *badger.Txn) {
+	defer snapshot.Discard()
+	it := snapshot.NewIterator(badger.IteratorOptions{
+		PrefetchValues: false,
+	})
+	defer it.Close()
+
+	counted := make(map[uint32]bool)
+	for it.Rewind(); it.Valid() && ctx.Err() == nil; it.Next() {
+		msg, err := s.storedOf(it.Item())
+		if err != nil {
+			continue
+		}
+
+		id := message.ID(msg.key).Contract()
+		s.usage.Add(id, msg.policy, msg.size, msg.expires)
+		counted[id] = true
+	}
+
+	for id := range counted {
+		s.report(id, s.usage.Contract(id))
+	}
+}
+
+// evict deletes the oldest messages stored under a policy of a contract, until its usage
+// is back under the quota.
+func (s *SSD) evict(id uint32, policy Policy) {
+	key := policy.key(id)
+	defer s.usage.Evicted(key)
+
+	var evicted []stored
+	excess := s.usage.Policy(key) - int64(float64(policy.Bytes)*evictTo)
+	if err := s.oldest(id, policy, func(msg stored) bool {
+		evicted = append(evicted, msg)
+		excess -= msg.size
+		return excess > 0
+	}); err != nil {
+		logging.LogError("ssd", "evict messages", err)
+		return
+	}
+
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, msg := range evicted {
+		if err := wb.Delete(msg.key); err != nil {
+			logging.LogError("ssd", "evict messages", err)
+			return
+		}
+	}
+
+	if err := wb.Flush(); err != nil {
+		logging.LogError("ssd", "evict messages", err)
+		return
+	}
+
+	s.untrack(evicted)
+}
+
+// oldest iterates through the keys of the messages stored under a policy of a contract, from
+// the oldest one, until the function returns false. The keys of the messages are prefixed
+// with their contract and first segment and sorted from the newest one, so these are read
+// backwards. The messages of a policy which applies to every channel are spread across the
+// prefixes of the contract, so these are read together and merged by their time.
+func (s *SSD) oldest(id uint32, policy Policy, fn func(stored) bool) error {
+	key := policy.key(id)
+	query, _ := queryOf(policy.Channel)
+	return s.db.View(func(tx *badger.Txn) error {
+		var prefixes [][]byte
+		if len(query) > 0 {
+			prefixes = append(prefixes, prefixOf(id^query[0]))
+		} else {
+			prefixes = prefixesOf(tx, id)
+		}
+
+		// Read the keys of every prefix backwards, from the oldest message
+		var cursors []*badger.Iterator
+		for _, prefix := range prefixes {
+			it := tx.NewIterator(badger.IteratorOptions{
+				Prefix:  prefix,
+				Reverse: true,
+			})
+			defer it.Close()
+
+			if it.Seek(append(prefix, 0xff, 0xff, 0xff, 0xff)); it.ValidForPrefix(prefix) {
+				cursors = append(cursors, it)
+			}
+		}
+
+		for len(cursors) > 0 {
+			next := 0
+			for i := 1; i < len(cursors); i++ {
+				if message.ID(cursors[i].Item().Key()).Before(cursors[next].Item().Key()) {
+					next = i
+				}
+			}
+
+			it := cursors[next]
+			if !s.visit(it.Item(), id, key, query, fn) {
+				return nil
+			}
+
+			if it.Next(); !it.Valid() {
+				cursors = append(cursors[:next], cursors[next+1:]...)
+			}
+		}
+		return nil
+	})
+}
+
+// visit reads a stored message of a contract and calls the function with it, if it is stored
+// under the policy with the key and matches the query. It returns false once the function does.
+func (s *SSD) visit(item *badger.Item, id uint32, key policyKey, query []uint32, fn func(stored) bool) bool {
+	if message.ID(item.Key()).Contract() != id || !hasQuery(message.ID(item.Key()).Ssid(), query) {
+		return true
+	}
+
+	msg, err := s.storedOf(item)
+	if err != nil || msg.policy == nil || msg.policy.key(id) != key {
+		return true
+	}
+	return fn(msg)
+}
+
+// prefixesOf returns the prefixes of the keys of the messages stored by a contract, one per
+// first segment of their channels. Only the first key of every prefix is read, the rest is
+// skipped by seeking to the next prefix.
+func prefixesOf(tx *badger.Txn, id uint32) (prefixes [][]byte) {
+	it := tx.NewIterator(badger.IteratorOptions{})
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); {
+		k := it.Item().Key()
+		prefix := uint32(k[0])<<24 | uint32(k[1])<<16 | uint32(k[2])<<8 | uint32(k[3])
+		if message.ID(k).Contract() == id {
+			prefixes = append(prefixes, prefixOf(prefix))
+		}
+
+		if prefix == math.MaxUint32 {
+			break
+		}
+		it.Seek(prefixOf(prefix + 1))
+	}
+	return
+}
+
+// prefixOf returns the prefix of the keys of the messages, which combines their contract and
+// the first segment of their channel.
+func prefixOf(v uint32) []byte {
+	return []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
 }
@@ -16,13 +16,20 @@ package storage
 import (
 	"context"
 	"fmt"
+	"math/rand"
 	"os"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/dgraph-io/badger/v3"
 	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/provider/contract"
+	"github.com/emitter-io/emitter/internal/provider/contract/mock"
+	"github.com/emitter-io/emitter/internal/provider/usage"
+	"github.com/emitter-io/emitter/internal/security/hash"
 	"github.com/emitter-io/stats"
 	"github.com/kelindar/binary"
 	"github.com/stretchr/testify/assert"
@@ -46,7 +53,7 @@ func runSSDTest(test func(store *SSD)) {
 
 	// Prepare a store
 	dir, _ := os.MkdirTemp("", "emitter")
-	store := NewSSD(nil)
+	store := NewSSD(nil, nil)
 	store.Configure(map[string]interface{}{
 		"dir": dir,
 	})
@@ -71,7 +78,7 @@ func TestSSD_Query(t *testing.T) {
 		assert.NoError(t, err)
 
 		zero := time.Unix(0, 0)
-		f, err := store.Query([]uint32{0, 3, 2, 6}, zero, zero, nil, 5)
+		f, err := store.Query([]uint32{0, 3, 2, 6}, zero, zero, nil, Descending, 5)
 		assert.NoError(t, err)
 		assert.Len(t, f, 1)
 	})
@@ -83,6 +90,12 @@ func TestSSD_QueryOrdered(t *testing.T) {
 	})
 }
 
+func TestSSD_QueryAscending(t *testing.T) {
+	runSSDTest(func(store *SSD) {
+		testAscending(t, store)
+	})
+}
+
 func TestSSD_QueryStartFromID(t *testing.T) {
 	runSSDTest(func(store *SSD) {
 		testStartFromID(t, store)
@@ -107,6 +120,303 @@ func TestSSD_QueryRange(t *testing.T) {
 	})
 }
 
+func TestSSD_StoreBatched(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "emitter")
+	defer os.RemoveAll(dir)
+
+	// Only the full batches are written until the store is closed
+	store := NewSSD(nil, nil)
+	assert.NoError(t, store.Configure(map[string]interface{}{
+		"dir":   dir,
+		"batch": float64(4),
+		"flush": float64(60000),
+		"queue": float64(2),
+	}))
+
+	for _, m := range getNTestMessages(10) {
+		msg := m
+		assert.NoError(t, store.Store(&msg))
+	}
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&store.writer.written) == 8
+	}, time.Second, 10*time.Millisecond)
+
+	// Closing flushes the rest of the queue
+	assert.NoError(t, store.Close())
+	assert.EqualValues(t, 10, store.writer.written)
+	assert.EqualValues(t, 3, store.writer.batches)
+	assert.Equal(t, errClosed, store.Store(&getNTestMessages(1)[0]))
+
+	// Every message must be there once reopened
+	store = NewSSD(nil, nil)
+	assert.NoError(t, store.Configure(map[string]interface{}{
+		"dir": dir,
+	}))
+	defer store.Close()
+
+	zero := time.Unix(0, 0)
+	for i, m := range getNTestMessages(10) {
+		f, err := store.Query(m.Ssid(), zero, zero, nil, Descending, 1)
+		assert.NoError(t, err)
+		assert.Len(t, f, 1, i)
+	}
+}
+
+func TestSSD_StoreFlushed(t *testing.T) {
+	runSSDTest(func(store *SSD) {
+		store.writer = newBatcher(store.db, 100, 10*time.Millisecond, 100, store.dropped)
+		defer store.writer.Close()
+
+		for _, m := range getNTestMessages(3) {
+			msg := m
+			assert.NoError(t, store.Store(&msg))
+		}
+
+		assert.Eventually(t, func() bool {
+			return atomic.LoadInt64(&store.writer.written) == 3
+		}, time.Second, 10*time.Millisecond)
+
+		f, err := store.Query(message.Ssid{0, 0, 2}, time.Unix(0, 0), time.Unix(0, 0), nil, Descending, 10)
+		assert.NoError(t, err)
+		assert.Len(t, f, 2)
+
+		m := stats.New()
+		store.Measure(m)
+		assert.NotEmpty(t, m.Snapshot())
+	})
+}
+
+func TestSSD_StoreDropped(t *testing.T) {
+	runSSDTest(func(store *SSD) {
+		store.policies = Policies{{Contract: 1, Bytes: 1 << 20}}
+
+		// The database refuses every message larger than its value threshold, even once retried
+		db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithValueThreshold(1024).WithLogger(nil))
+		assert.NoError(t, err)
+		defer db.Close()
+		store.writer = newBatcher(db, 100, 10*time.Millisecond, 100, store.dropped)
+		defer store.writer.Close()
+
+		for i := 0; i < 3; i++ {
+			payload := make([]byte, 2048)
+			rand.Read(payload)
+			m := message.New(message.Ssid{1, hash.OfString("a")}, []byte("a/"), payload)
+			assert.NoError(t, store.Store(m))
+		}
+
+		// The messages which could not be written are no longer part of the usage
+		assert.Eventually(t, func() bool {
+			return atomic.LoadInt64(&store.writer.failed) == 3
+		}, 2*time.Second, 10*time.Millisecond)
+		assert.Zero(t, atomic.LoadInt64(&store.writer.written))
+		assert.Zero(t, store.usage.Contract(1))
+	})
+}
+
+func TestSSD_Retention(t *testing.T) {
+	runSSDTest(func(store *SSD) {
+		store.policies = Policies{{Contract: 1, Channel: "a/", Retain: 60}}
+
+		tests := []struct {
+			channel string
+			ttl     uint32
+			expect  uint32
+		}{
+			{channel: "a/b/", ttl: 1000, expect: 60},
+			{channel: "a/b/", ttl: 30, expect: 30},
+			{channel: "a/b/", ttl: message.RetainedTTL, expect: 60},
+			{channel: "b/", ttl: message.RetainedTTL, expect: defaultRetain},
+		}
+
+		for _, tc := range tests {
+			m := message.New(message.Ssid{1, 2}, []byte(tc.channel), []byte("hi"))
+			m.TTL = tc.ttl
+			assert.NoError(t, store.Store(m))
+			assert.Equal(t, tc.expect, m.TTL)
+		}
+	})
+}
+
+func TestSSD_Quota(t *testing.T) {
+	now := time.Now().Unix()
+	newMessage := func(i int) *message.Message {
+		m := message.New(message.Ssid{1, hash.OfString("a"), hash.OfString("b")}, []byte("a/b/"), make([]byte, 100))
+		m.ID.SetTime(now - 100 + int64(i))
+		m.TTL = 1000
+		return m
+	}
+
+	// Keep up to ten and a half of the messages
+	size := sizeOf(newMessage(0))
+	meter := &testMeter{Meter: usage.NewMeter(1)}
+	c := new(mock.Contract)
+	c.On("Stats").Return(meter)
+	c.On("Limits").Return(contract.Limits{
+		Storage: []contract.Retention{{Channel: "a/", Bytes: 10*size + size/2}},
+	})
+
+	contracts := mock.NewContractProvider()
+	contracts.On("Get", uint32(1)).Return(c, true)
+
+	runSSDTest(func(store *SSD) {
+		store.contracts = contracts
+
+		// Store 20 messages, with the oldest ones first
+		for i := 0; i < 20; i++ {
+			assert.NoError(t, store.Store(newMessage(i)))
+			store.running.Wait()
+		}
+
+		// Messages on other channels are not part of the quota
+		other := message.New(message.Ssid{1, hash.OfString("b")}, []byte("b/"), []byte("hi"))
+		other.TTL = 1000
+		assert.NoError(t, store.Store(other))
+
+		// Only the newest messages should remain, within the quota
+		f, err := store.Query(message.Ssid{1, hash.OfString("a"), hash.OfString("b")}, time.Unix(0, 0), time.Unix(0, 0), nil, Descending, 100)
+		assert.NoError(t, err)
+		assert.Len(t, f, 10)
+		for _, m := range f {
+			assert.GreaterOrEqual(t, m.Time(), now-100+10)
+		}
+
+		// The usage is reported through the meter of the contract
+		total := storedBytes(store, 1)
+		assert.Equal(t, total, store.usage.Contract(1))
+		assert.Equal(t, total, meter.stored)
+	})
+}
+
+func TestSSD_QuotaContract(t *testing.T) {
+	now := time.Now().Unix()
+	newMessage := func(i int) *message.Message {
+		channel := []string{"a", "b"}[i%2]
+		m := message.New(message.Ssid{1, hash.OfString(channel)}, []byte(channel+"/"), make([]byte, 100))
+		m.ID.SetTime(now - 100 + int64(i))
+		m.TTL = 1000
+		return m
+	}
+
+	runSSDTest(func(store *SSD) {
+		size := sizeOf(newMessage(0))
+		store.policies = Policies{{Contract: 1, Bytes: 10*size + size/2}}
+
+		// The oldest messages are evicted first, whatever their channel
+		for i := 0; i < 20; i++ {
+			assert.NoError(t, store.Store(newMessage(i)))
+			store.running.Wait()
+		}
+
+		var times []int64
+		for _, channel := range []string{"a", "b"} {
+			f, err := store.Query(message.Ssid{1, hash.OfString(channel)}, time.Unix(0, 0), time.Unix(0, 0), nil, Descending, 100)
+			assert.NoError(t, err)
+			for _, m := range f {
+				times = append(times, m.Time())
+			}
+		}
+
+		assert.Len(t, times, 10)
+		for _, v := range times {
+			assert.GreaterOrEqual(t, v, now-100+10)
+		}
+		assert.Equal(t, storedBytes(store, 1), store.usage.Contract(1))
+	})
+}
+
+func TestSSD_Oldest(t *testing.T) {
+	now := time.Now().Unix()
+	runSSDTest(func(store *SSD) {
+		store.policies = Policies{{Contract: 1, Bytes: 1 << 20}}
+		for i, channel := range []string{"a", "b", "c", "a", "c", "b"} {
+			for _, id := range []uint32{1, 2} {
+				m := message.New(message.Ssid{id, hash.OfString(channel)}, []byte(channel+"/"), []byte("hi"))
+				m.ID.SetTime(now - 100 + int64(i))
+				m.TTL = 1000
+				assert.NoError(t, store.Store(m))
+			}
+		}
+
+		// The messages of every channel of the contract are merged, from the oldest one
+		var times []int64
+		assert.NoError(t, store.oldest(1, store.policies[0], func(m stored) bool {
+			assert.Equal(t, uint32(1), message.ID(m.key).Contract())
+			times = append(times, message.ID(m.key).Time())
+			return len(times) < 4
+		}))
+
+		assert.Equal(t, []int64{now - 100, now - 99, now - 98, now - 97}, times)
+	})
+}
+
+func TestSSD_Recount(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "emitter")
+	defer os.RemoveAll(dir)
+
+	open := func() *SSD {
+		store := NewSSD(nil, nil)
+		assert.NoError(t, store.Configure(map[string]interface{}{
+			"dir": dir,
+			"policies": []interface{}{
+				map[string]interface{}{"contract": 1, "channel": "a/", "bytes": 100000},
+			},
+		}))
+		store.running.Wait()
+		return store
+	}
+
+	store := open()
+	for i := 0; i < 10; i++ {
+		m := message.New(message.Ssid{1 + uint32(i%2), hash.OfString("a")}, []byte("a/"), []byte("hello"))
+		m.TTL = 1000
+		assert.NoError(t, store.Store(m))
+	}
+
+	key := policyKey{contract: 1, channel: "a/"}
+	total, used := store.usage.Contract(1), store.usage.Policy(key)
+	assert.Equal(t, storedBytes(store, 1), total)
+	assert.Equal(t, total, used)
+	assert.NoError(t, store.Close())
+
+	// What is stored is counted once opened again
+	store = open()
+	defer store.Close()
+	assert.Equal(t, total, store.usage.Contract(1))
+	assert.Equal(t, used, store.usage.Policy(key))
+	assert.Equal(t, storedBytes(store, 2), store.usage.Contract(2))
+}
+
+// sizeOf returns the number of bytes a message takes in the database.
+func sizeOf(m *message.Message) int64 {
+	return int64(len(m.ID) + len(m.Encode()))
+}
+
+// storedBytes returns the number of bytes stored by a contract.
+func storedBytes(store *SSD, id uint32) (total int64) {
+	store.db.View(func(tx *badger.Txn) error {
+		it := tx.NewIterator(badger.IteratorOptions{})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if message.ID(it.Item().Key()).Contract() == id {
+				total += int64(len(it.Item().Key())) + it.Item().ValueSize()
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// testMeter records the number of bytes stored.
+type testMeter struct {
+	usage.Meter
+	stored int64
+}
+
+func (m *testMeter) SetStored(size int64) {
+	m.stored = size
+}
+
 func TestSSD_QuerySurveyed(t *testing.T) {
 	runSSDTest(func(s *SSD) {
 		const wildcard = uint32(1815237614)
@@ -117,23 +427,22 @@ func TestSSD_QuerySurveyed(t *testing.T) {
 			query    []uint32
 			limit    int
 			count    int
-			gathered []byte
+			gathered message.Frame
 		}{
 			{query: []uint32{0, 3, 2, 7}, limit: 10, count: 1},
 			{query: []uint32{0, 1}, limit: 5, count: 2},
-			{query: []uint32{0, 1}, limit: 5, count: 5, gathered: msgs.Encode()},
+			{query: []uint32{0, 1}, limit: 5, count: 5, gathered: msgs},
+			{query: []uint32{0, 1}, limit: 5, count: 2, gathered: msgs[2:4]}, // Replicas
 		}
 
 		for _, tc := range tests {
 			if tc.gathered == nil {
 				s.survey = nil
 			} else {
-				s.survey = surveyFunc(func(string, []byte) (message.Awaiter, error) {
-					return &mockAwaiter{f: func(_ time.Duration) [][]byte { return [][]byte{tc.gathered} }}, nil
-				})
+				s.survey = surveyResponse(lookupResponse{Frame: tc.gathered.Encode()})
 			}
 
-			out, err := s.Query(tc.query, zero, zero, nil, tc.limit)
+			out, err := s.Query(tc.query, zero, zero, nil, Descending, tc.limit)
 			assert.NoError(t, err)
 			count := 0
 			for range out {
@@ -144,6 +453,129 @@ func TestSSD_QuerySurveyed(t *testing.T) {
 	})
 }
 
+func TestSSD_QueryTruncated(t *testing.T) {
+	newMessage := func(offset int64, payload string) message.Message {
+		msg := message.New(message.Ssid{0, 1, 2}, []byte("a/b/c/"), []byte(payload))
+		msg.TTL = message.RetainedTTL
+		msg.ID.SetTime(msg.ID.Time() + offset)
+		return *msg
+	}
+
+	tests := []struct {
+		order    Order
+		gathered message.Frame // In the order of the lookup
+		expected []string
+	}{
+		{
+			order:    Descending,
+			gathered: message.Frame{newMessage(95, "r95"), newMessage(85, "r85")},
+			expected: []string{"r85", "l90", "r95"},
+		},
+		{
+			order:    Ascending,
+			gathered: message.Frame{newMessage(5, "r5"), newMessage(15, "r15")},
+			expected: []string{"l0", "r5", "l10", "r15"},
+		},
+	}
+
+	for _, tc := range tests {
+		runSSDTest(func(s *SSD) {
+			for i := int64(0); i < 10; i++ {
+				msg := newMessage(i*10, fmt.Sprintf("l%d", i*10))
+				assert.NoError(t, s.Store(&msg))
+			}
+
+			// The remote node has more messages than it could send back
+			s.survey = surveyResponse(lookupResponse{
+				Frame:     tc.gathered.Encode(),
+				Truncated: true,
+			})
+
+			zero := time.Unix(0, 0)
+			out, err := s.Query(message.Ssid{0, 1, 2}, zero, zero, nil, tc.order, 10)
+			assert.NoError(t, err)
+
+			var payloads []string
+			for _, m := range out {
+				payloads = append(payloads, string(m.Payload))
+			}
+			assert.Equal(t, tc.expected, payloads)
+		})
+	}
+}
+
+func TestSSD_Delete(t *testing.T) {
+	runSSDTest(func(s *SSD) {
+		msgs := getNTestMessages(10)
+		msgs[9].ID.SetTime(time.Now().Add(-time.Hour).Unix())
+		for _, m := range msgs {
+			msg := m
+			assert.NoError(t, s.Store(&msg))
+		}
+
+		zero := time.Unix(0, 0)
+		tests := []struct {
+			ssid  message.Ssid
+			from  time.Time
+			until time.Time
+			ids   []message.ID
+			count int
+		}{
+			{ssid: message.Ssid{0, 1}, count: 2},
+			{ssid: message.Ssid{0, 1}, count: 0},
+			{ssid: message.Ssid{0, 2}, ids: []message.ID{msgs[4].ID, msgs[6].ID}, count: 1},
+			{ssid: message.Ssid{0, 4}, from: time.Now().Add(-time.Minute), count: 1},
+			{ssid: message.Ssid{0, 4}, until: time.Now().Add(-time.Minute), count: 1},
+		}
+
+		for _, tc := range tests {
+			if tc.from.IsZero() {
+				tc.from = zero
+			}
+			if tc.until.IsZero() {
+				tc.until = zero
+			}
+
+			n, err := s.Delete(tc.ssid, tc.from, tc.until, tc.ids)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.count, n)
+		}
+
+		f, err := s.Query(message.Ssid{0, 2}, zero, zero, nil, Descending, 10)
+		assert.NoError(t, err)
+		assert.Len(t, f, 1)
+		assert.Equal(t, msgs[5].ID, f[0].ID)
+
+		// The messages removed by the other nodes are counted as well, once per replica
+		remote, _ := binary.Marshal([]message.ID{msgs[6].ID, msgs[7].ID, message.NewID(message.Ssid{0, 3, 2, 99})})
+		s.survey = surveyFunc(func(string, []byte) (message.Awaiter, error) {
+			return &mockAwaiter{f: func(_ time.Duration) [][]byte { return [][]byte{remote} }}, nil
+		})
+
+		n, err := s.Delete(message.Ssid{0, 3}, zero, zero, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, n)
+	})
+}
+
+func TestSSD_OnSurveyDelete(t *testing.T) {
+	runSSDTest(func(s *SSD) {
+		s.storeFrame(getNTestMessages(10))
+		zero := time.Unix(0, 0)
+
+		q, _ := binary.Marshal(newDeleteQuery(message.Ssid{0, 1}, zero, zero, nil))
+		resp, ok := s.OnSurvey("ssddelete", q)
+		assert.True(t, ok)
+
+		var ids []message.ID
+		assert.NoError(t, binary.Unmarshal(resp, &ids))
+		assert.Len(t, ids, 2)
+
+		_, ok = s.OnSurvey("ssddelete", []byte{})
+		assert.False(t, ok)
+	})
+}
+
 func TestSSD_OnSurvey(t *testing.T) {
 	runSSDTest(func(s *SSD) {
 		s.storeFrame(getNTestMessages(10))
@@ -158,13 +590,13 @@ func TestSSD_OnSurvey(t *testing.T) {
 			{name: "ssdstore"},
 			{
 				name:        "ssdstore",
-				query:       newLookupQuery(message.Ssid{0, 1}, zero, zero, nil, 1),
+				query:       newLookupQuery(message.Ssid{0, 1}, zero, zero, nil, Descending, 1),
 				expectOk:    true,
 				expectCount: 1,
 			},
 			{
 				name:        "ssdstore",
-				query:       newLookupQuery(message.Ssid{0, 1}, zero, zero, nil, 10),
+				query:       newLookupQuery(message.Ssid{0, 1}, zero, zero, nil, Descending, 10),
 				expectOk:    true,
 				expectCount: 2,
 			},
@@ -175,7 +607,9 @@ func TestSSD_OnSurvey(t *testing.T) {
 			resp, ok := s.OnSurvey(tc.name, q)
 			assert.Equal(t, tc.expectOk, ok)
 			if tc.expectOk && ok {
-				msgs, err := message.DecodeFrame(resp)
+				var result lookupResponse
+				assert.NoError(t, binary.Unmarshal(resp, &result))
+				msgs, err := message.DecodeFrame(result.Frame)
 				assert.NoError(t, err)
 				assert.Equal(t, tc.expectCount, len(msgs))
 			}
@@ -328,7 +762,7 @@ func benchmarkQuery(b *testing.B, store *SSD, last int, m *stats.Metric) {
 				return
 
 			default:
-				store.Query(ssid, t0, t1, nil, last)
+				store.Query(ssid, t0, t1, nil, Descending, last)
 				m.Update(int32(last))
 			}
 		}
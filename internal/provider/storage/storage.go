@@ -23,6 +23,7 @@ import (
 	"github.com/emitter-io/emitter/internal/message"
 	"github.com/emitter-io/emitter/internal/security"
 	"github.com/emitter-io/emitter/internal/service/survey"
+	"github.com/emitter-io/stats"
 )
 
 var (
@@ -33,6 +34,10 @@ const (
 	defaultRetain = 2592000 // 30-days
 )
 
+// MaxLast is the default maximum number of messages which can be retrieved by a single
+// request, either with the 'last' option of a subscription or through the history.
+const MaxLast = 1000
+
 // Storage represents a message storage contract that message storage provides
 // must fulfill.
 type Storage interface {
@@ -48,8 +53,30 @@ type Storage interface {
 
 	// Query performs a query and attempts to fetch last n messages where
 	// n is specified by limit argument. From and until times can also be specified
-	// for time-series retrieval.
-	Query(ssid message.Ssid, from, until time.Time, startFromID message.ID, limit int) (message.Frame, error)
+	// for time-series retrieval. When ascending order is requested, the first n messages
+	// are fetched instead. The resulting frame is always sorted chronologically. Fewer
+	// messages may be returned if they do not fit into a single message, in which case the
+	// query can be continued from the last message returned.
+	Query(ssid message.Ssid, from, until time.Time, startFromID message.ID, order Order, limit int) (message.Frame, error)
+
+	// Delete removes the messages matching the SSID within the time window, including the
+	// ones of the sub-channels. If IDs are provided, only the matching messages with these
+	// IDs are removed. It returns the number of messages removed.
+	Delete(ssid message.Ssid, from, until time.Time, ids []message.ID) (int, error)
+}
+
+// Order represents the order in which the messages are retrieved.
+type Order uint8
+
+// Various retrieval orders
+const (
+	Descending Order = iota // Retrieves the newest messages first, going back in time.
+	Ascending               // Retrieves the oldest messages first, going forward in time.
+)
+
+// Measurable represents a storage which reports its own metrics.
+type Measurable interface {
+	Measure(m stats.Measurer)
 }
 
 // ------------------------------------------------------------------------------------
@@ -65,27 +92,104 @@ func window(from, until time.Time) (int64, int64) {
 	return t0, t1
 }
 
+// floor returns the time right before the beginning of a time window, bounded by the
+// minimum time which can be encoded in a message ID.
+func floor(t0 int64) int64 {
+	if t0 <= security.MinTime {
+		return security.MinTime
+	}
+
+	return t0 - 1
+}
+
 // The lookup query to send out to the cluster.
 type lookupQuery struct {
 	Ssid        message.Ssid // The ssid to match.
 	From        int64        // The beginning of the time window.
 	Until       int64        // The end of the time window.
 	StartFromID message.ID   // The ID to start from when retrieving message, used for pagination.
+	Order       Order        // The order in which the messages are retrieved.
 	Limit       int          // The maximum number of elements to return.
 }
 
 // newLookupQuery creates a new lookup query
-func newLookupQuery(ssid message.Ssid, from, until time.Time, startFromID message.ID, limit int) lookupQuery {
+func newLookupQuery(ssid message.Ssid, from, until time.Time, startFromID message.ID, order Order, limit int) lookupQuery {
 	t0, t1 := window(from, until)
 	return lookupQuery{
 		Ssid:        ssid,
 		From:        t0,
 		Until:       t1,
 		StartFromID: startFromID,
+		Order:       order,
 		Limit:       limit,
 	}
 }
 
+// within checks whether the iteration of the query is still within the time window.
+func (q *lookupQuery) within(id message.ID) bool {
+	if q.Order == Ascending {
+		return id.HasPrefix(q.Ssid, 0) && id.Time() <= q.Until
+	}
+
+	return id.HasPrefix(q.Ssid, q.From)
+}
+
+// limit limits the merged frame to the requested number of messages.
+func (q *lookupQuery) limit(frame *message.Frame) {
+	if q.Order == Ascending {
+		frame.Head(q.Limit)
+		return
+	}
+
+	frame.Limit(q.Limit)
+}
+
+// horizon returns the one of two boundaries which is reached first when iterating in the
+// order of the query.
+func (q *lookupQuery) horizon(boundary, id message.ID) message.ID {
+	if boundary == nil || (q.Order == Ascending) == id.Before(boundary) {
+		return id
+	}
+
+	return boundary
+}
+
+// cut removes from the frame the messages beyond the boundary, in the order of the query.
+func (q *lookupQuery) cut(frame *message.Frame, boundary message.ID) {
+	filtered := (*frame)[:0]
+	for _, m := range *frame {
+		if q.Order == Ascending && !boundary.Before(m.ID) || q.Order == Descending && !m.ID.Before(boundary) {
+			filtered = append(filtered, m)
+		}
+	}
+	*frame = filtered
+}
+
+// The lookup response sent back to the cluster.
+type lookupResponse struct {
+	Frame     []byte // The encoded frame of the messages found.
+	Truncated bool   // Whether the lookup stopped early as the frame reached the maximum size.
+}
+
+// The delete query to send out to the cluster.
+type deleteQuery struct {
+	Ssid  message.Ssid // The ssid to match.
+	From  int64        // The beginning of the time window.
+	Until int64        // The end of the time window.
+	IDs   []message.ID // The IDs of the messages to delete, if only these are deleted.
+}
+
+// newDeleteQuery creates a new delete query
+func newDeleteQuery(ssid message.Ssid, from, until time.Time, ids []message.ID) deleteQuery {
+	t0, t1 := window(from, until)
+	return deleteQuery{
+		Ssid:  ssid,
+		From:  t0,
+		Until: t1,
+		IDs:   ids,
+	}
+}
+
 // configUint32 retrieves an uint32 from the config
 func configUint32(config map[string]interface{}, name string, defaultValue uint32) uint32 {
 	if v, ok := config[name]; ok {
@@ -131,11 +235,21 @@ func (s *Noop) Store(m *message.Message) error {
 
 // Query performs a query and attempts to fetch last n messages where
 // n is specified by limit argument. From and until times can also be specified
-// for time-series retrieval.
-func (s *Noop) Query(ssid message.Ssid, from, until time.Time, startFromID message.ID, limit int) (message.Frame, error) {
+// for time-series retrieval. When ascending order is requested, the first n messages
+// are fetched instead. The resulting frame is always sorted chronologically. Fewer
+// messages may be returned if they do not fit into a single message, in which case the
+// query can be continued from the last message returned.
+func (s *Noop) Query(ssid message.Ssid, from, until time.Time, startFromID message.ID, order Order, limit int) (message.Frame, error) {
 	return nil, nil
 }
 
+// Delete removes the messages matching the SSID within the time window, including the
+// ones of the sub-channels. If IDs are provided, only the matching messages with these
+// IDs are removed. It returns the number of messages removed.
+func (s *Noop) Delete(ssid message.Ssid, from, until time.Time, ids []message.ID) (int, error) {
+	return 0, nil
+}
+
 // Close gracefully terminates the storage and ensures that every related
 // resource is properly disposed.
 func (s *Noop) Close() error {
@@ -21,6 +21,7 @@ import (
 
 	"github.com/emitter-io/emitter/internal/message"
 	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/kelindar/binary"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -30,6 +31,14 @@ func (s surveyFunc) Query(q string, b []byte) (message.Awaiter, error) {
 	return s(q, b)
 }
 
+// surveyResponse returns a survey which gathers a single lookup response.
+func surveyResponse(resp lookupResponse) surveyFunc {
+	b, _ := binary.Marshal(resp)
+	return func(string, []byte) (message.Awaiter, error) {
+		return &mockAwaiter{f: func(_ time.Duration) [][]byte { return [][]byte{b} }}, nil
+	}
+}
+
 func testMessage(a, b, c uint32) *message.Message {
 	return &message.Message{
 		ID:      message.NewID(message.Ssid{0, a, b, c}),
@@ -48,7 +57,7 @@ func TestNoop_Store(t *testing.T) {
 func TestNoop_Query(t *testing.T) {
 	s := new(Noop)
 	zero := time.Unix(0, 0)
-	r, err := s.Query(testMessage(1, 2, 3).Ssid(), zero, zero, nil, 10)
+	r, err := s.Query(testMessage(1, 2, 3).Ssid(), zero, zero, nil, Descending, 10)
 	assert.NoError(t, err)
 	for range r {
 		t.Errorf("Should be empty")
@@ -81,7 +90,7 @@ func testOrder(t *testing.T, store Storage) {
 
 	// Issue a query
 	zero := time.Unix(0, 0)
-	f, err := store.Query([]uint32{0, 1, 2}, zero, zero, nil, 5)
+	f, err := store.Query([]uint32{0, 1, 2}, zero, zero, nil, Descending, 5)
 	assert.NoError(t, err)
 
 	assert.Len(t, f, 5)
@@ -104,7 +113,7 @@ func testRetained(t *testing.T, store Storage) {
 
 	// Issue a query
 	zero := time.Unix(0, 0)
-	f, err := store.Query([]uint32{0, 1, 2}, zero, zero, nil, 1)
+	f, err := store.Query([]uint32{0, 1, 2}, zero, zero, nil, Descending, 1)
 	assert.NoError(t, err)
 
 	assert.Len(t, f, 1)
@@ -127,7 +136,7 @@ func testRange(t *testing.T, store Storage) {
 	}
 
 	// Issue a query
-	f, err := store.Query([]uint32{0, 1, 2}, time.Unix(t0, 0), time.Unix(t1, 0), nil, 5)
+	f, err := store.Query([]uint32{0, 1, 2}, time.Unix(t0, 0), time.Unix(t1, 0), nil, Descending, 5)
 	assert.NoError(t, err)
 
 	assert.Len(t, f, 5)
@@ -170,7 +179,7 @@ func testStartFromID(t *testing.T, store Storage) {
 
 	// Issue a query, starting at the fourth message ID and going back 2.
 	zero := time.Unix(0, 0)
-	f, err := store.Query([]uint32{0, 1, 2}, zero, zero, fourth, 2)
+	f, err := store.Query([]uint32{0, 1, 2}, zero, zero, fourth, Descending, 2)
 	assert.NoError(t, err)
 
 	assert.Len(t, f, 2)
@@ -178,12 +187,62 @@ func testStartFromID(t *testing.T, store Storage) {
 	assert.Equal(t, 3, int(f[1].Payload[0]))
 
 	// Issue a query, starting at the first message ID and going back 2.
-	f, err = store.Query([]uint32{0, 1, 2}, zero, zero, f[0].ID, 2)
+	f, err = store.Query([]uint32{0, 1, 2}, zero, zero, f[0].ID, Descending, 2)
 	assert.NoError(t, err)
 	assert.Equal(t, 0, int(f[0].Payload[0]))
 	assert.Equal(t, 1, int(f[1].Payload[0]))
 }
 
+// Test the ascending order and the pagination in both directions.
+func testAscending(t *testing.T, store Storage) {
+	var t0, t1 int64
+	for i := int64(0); i < 100; i++ {
+		msg := message.New(message.Ssid{0, 1, 2}, []byte("a/b/c/"), []byte(fmt.Sprintf("%d", i)))
+		msg.TTL = message.RetainedTTL
+		msg.ID.SetTime(msg.ID.Time() + (i/2)*10000) // Two messages per second
+		if i == 50 {
+			t0 = msg.ID.Time()
+		}
+		if i == 60 {
+			t1 = msg.ID.Time()
+		}
+
+		assert.NoError(t, store.Store(msg))
+	}
+
+	// Issue a query, starting from the oldest message
+	zero := time.Unix(0, 0)
+	f, err := store.Query([]uint32{0, 1, 2}, zero, zero, nil, Ascending, 5)
+	assert.NoError(t, err)
+	assert.Len(t, f, 5)
+	for i, expect := range []string{"0", "1", "2", "3", "4"} {
+		assert.Equal(t, expect, string(f[i].Payload))
+	}
+
+	// Continue forward from the last message
+	f, err = store.Query([]uint32{0, 1, 2}, zero, zero, f[4].ID, Ascending, 3)
+	assert.NoError(t, err)
+	assert.Len(t, f, 3)
+	for i, expect := range []string{"5", "6", "7"} {
+		assert.Equal(t, expect, string(f[i].Payload))
+	}
+
+	// Go back from the first message
+	f, err = store.Query([]uint32{0, 1, 2}, zero, zero, f[0].ID, Descending, 3)
+	assert.NoError(t, err)
+	assert.Len(t, f, 3)
+	for i, expect := range []string{"2", "3", "4"} {
+		assert.Equal(t, expect, string(f[i].Payload))
+	}
+
+	// Issue a query within a time window
+	f, err = store.Query([]uint32{0, 1, 2}, time.Unix(t0, 0), time.Unix(t1, 0), nil, Ascending, 20)
+	assert.NoError(t, err)
+	assert.Len(t, f, 12)
+	assert.Equal(t, "50", string(f[0].Payload))
+	assert.Equal(t, "61", string(f[11].Payload))
+}
+
 func testMaxResponseSizeReached(t *testing.T, store Storage) {
 	for i := int64(0); i < 10; i++ {
 		payload := make([]byte, mqtt.MaxMessageSize/5)
@@ -194,7 +253,7 @@ func testMaxResponseSizeReached(t *testing.T, store Storage) {
 	}
 
 	zero := time.Unix(0, 0)
-	f, err := store.Query([]uint32{0, 1, 2}, zero, zero, nil, 10)
+	f, err := store.Query([]uint32{0, 1, 2}, zero, zero, nil, Descending, 10)
 	assert.NoError(t, err)
 
 	assert.Len(t, f, 4)
@@ -27,6 +27,7 @@ type Meter interface {
 	AddIngress(size int64) // Records the ingress message size.
 	AddEgress(size int64)  // Records the egress message size.
 	AddDevice(addr string) // Records the device address.
+	SetStored(size int64)  // Records the number of bytes currently stored.
 }
 
 // NewMeter constructs a new usage statistics instance.
@@ -43,6 +44,7 @@ type usage struct {
 	TrafficIn int64
 	MessageEg int64
 	TrafficEg int64
+	Stored    int64
 	Contract  uint32
 	Lock      *sync.Mutex
 	Devices   *hyperloglog.Sketch
@@ -72,6 +74,11 @@ func (t *usage) AddDevice(addr string) {
 	t.Devices.Insert([]byte(addr))
 }
 
+// Records the number of bytes currently stored.
+func (t *usage) SetStored(size int64) {
+	atomic.StoreInt64(&t.Stored, size)
+}
+
 // DeviceCount returns the estimated number of devices.
 func (t *usage) DeviceCount() int {
 	t.Lock.Lock()
@@ -92,6 +99,7 @@ func (t *usage) reset() encodedUsage {
 	old.TrafficIn = atomic.SwapInt64(&t.TrafficIn, 0)
 	old.MessageEg = atomic.SwapInt64(&t.MessageEg, 0)
 	old.TrafficEg = atomic.SwapInt64(&t.TrafficEg, 0)
+	old.Stored = atomic.LoadInt64(&t.Stored) // Not a counter, so it's kept as is
 	old.Devices = devices
 	return old
 }
@@ -106,6 +114,7 @@ func (t *usage) merge(other *usage) {
 	atomic.AddInt64(&t.TrafficIn, other.TrafficIn)
 	atomic.AddInt64(&t.MessageEg, other.MessageEg)
 	atomic.AddInt64(&t.TrafficEg, other.TrafficEg)
+	atomic.StoreInt64(&t.Stored, other.Stored)
 }
 
 // encodedUsage represents a single encoded usage which will be transferred
@@ -117,6 +126,7 @@ type encodedUsage struct {
 	TrafficEg int64
 	Contract  uint32
 	Devices   []byte
+	Stored    int64
 }
 
 // Converts the encoded usage to a normal usage.
@@ -129,6 +139,7 @@ func (t encodedUsage) toUsage() usage {
 		TrafficIn: t.TrafficIn,
 		MessageEg: t.MessageEg,
 		TrafficEg: t.TrafficEg,
+		Stored:    t.Stored,
 		Contract:  t.Contract,
 		Lock:      new(sync.Mutex),
 		Devices:   d,
@@ -52,10 +52,13 @@ func TestMeterReset(t *testing.T) {
 	meter.AddIngress(1000)
 	meter.AddDevice("123")
 	meter.AddDevice("153")
+	meter.SetStored(5000)
 	old1 := meter.reset().toUsage()
 
 	// Assert
 	assert.Equal(t, int64(1000), old1.TrafficIn)
+	assert.Equal(t, int64(5000), old1.Stored)
+	assert.Equal(t, int64(5000), meter.Stored)
 	assert.Equal(t, int64(0), meter.TrafficIn)
 	assert.Equal(t, 0, meter.DeviceCount())
 	assert.Equal(t, 2, old1.DeviceCount())
@@ -64,6 +67,7 @@ func TestMeterReset(t *testing.T) {
 	meter.AddIngress(1000)
 	meter.AddDevice("123")
 	meter.AddDevice("345")
+	meter.SetStored(3000)
 	old2 := meter.reset().toUsage()
 
 	// Assert
@@ -75,5 +79,6 @@ func TestMeterReset(t *testing.T) {
 	// Merge in
 	old1.merge(&old2)
 	assert.Equal(t, int64(2000), old1.TrafficIn)
+	assert.Equal(t, int64(3000), old1.Stored)
 	assert.Equal(t, 3, old1.DeviceCount())
 }
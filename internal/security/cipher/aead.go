@@ -0,0 +1,93 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package cipher
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+
+	"github.com/emitter-io/emitter/internal/security"
+)
+
+// The size of an encrypted key, consisting of the nonce, the key and the authentication tag.
+const aeadKeySize = 12 + 24 + 16
+
+// AEAD represents a security cipher which encrypts the security keys with AES-256 in GCM
+// mode, so any tampering with an encrypted key is detected during its decryption.
+type AEAD struct {
+	aead cipher.AEAD
+}
+
+// NewAEAD creates a new authenticated encryption cipher.
+func NewAEAD(key []byte) (*AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("aead: invalid cryptographic key")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AEAD{aead: aead}, nil
+}
+
+// EncryptKey encrypts the key and return a base-64 encoded string.
+func (c *AEAD) EncryptKey(k security.Key) (string, error) {
+	if len(k) != 24 {
+		return "", errors.New("cipher: the key provided is not valid")
+	}
+
+	// Generate a random nonce and seal the key right after it
+	buffer := make([]byte, c.aead.NonceSize(), aeadKeySize)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+
+	buffer = c.aead.Seal(buffer, buffer, k, nil)
+	return base64.RawURLEncoding.EncodeToString(buffer), nil
+}
+
+// DecryptKey decrypts the security key from a base64 encoded string and verifies that it
+// was not tampered with.
+func (c *AEAD) DecryptKey(buffer []byte) (security.Key, error) {
+	if base64.RawURLEncoding.DecodedLen(len(buffer)) != aeadKeySize {
+		return nil, errors.New("cipher: the key provided is not valid")
+	}
+
+	// Warning: we do a base64 decode in the same underlying buffer, to save up
+	// on memory allocations. Keep in mind that the previous data will be lost.
+	n, err := decodeKey(buffer, buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	// Open the sealed key, which also authenticates it
+	nonce, sealed := buffer[:c.aead.NonceSize()], buffer[c.aead.NonceSize():n]
+	key, err := c.aead.Open(sealed[:0], nonce, sealed, nil)
+	if err != nil {
+		return nil, errors.New("cipher: the key provided is not authentic")
+	}
+
+	return security.Key(key), nil
+}
@@ -0,0 +1,95 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package cipher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAEAD() *AEAD {
+	cipher, _ := NewAEAD([]byte("0123456789abcdef0123456789abcdef"))
+	return cipher
+}
+
+func Test_AEAD(t *testing.T) {
+	cipher := newTestAEAD()
+	key := security.Key(make([]byte, 24))
+	key.SetSalt(999)
+	key.SetMaster(2)
+	key.SetContract(123)
+	key.SetSignature(777)
+	key.SetPermissions(security.AllowReadWrite)
+	key.SetTarget("a/b/c/")
+	key.SetExpires(time.Unix(1497683272, 0).UTC())
+
+	encoded, err := cipher.EncryptKey(key)
+	assert.NoError(t, err)
+	assert.Len(t, encoded, 70)
+
+	decoded, err := cipher.DecryptKey([]byte(encoded))
+	assert.NoError(t, err)
+	assert.Equal(t, key, decoded)
+
+	// Encrypting the same key twice should produce different outputs
+	other, err := cipher.EncryptKey(key)
+	assert.NoError(t, err)
+	assert.NotEqual(t, encoded, other)
+}
+
+func Test_AEAD_Tampered(t *testing.T) {
+	cipher := newTestAEAD()
+	key := security.Key(make([]byte, 24))
+	key.SetContract(123)
+	key.SetPermissions(security.AllowMaster)
+
+	encoded, err := cipher.EncryptKey(key)
+	assert.NoError(t, err)
+
+	// Flip every character, one at a time, and make sure it is rejected
+	for i := 0; i < len(encoded)-1; i++ {
+		tampered := []byte(encoded)
+		if tampered[i] == 'A' {
+			tampered[i] = 'B'
+		} else {
+			tampered[i] = 'A'
+		}
+
+		_, err := cipher.DecryptKey(tampered)
+		assert.Error(t, err, i)
+	}
+
+	// A key encrypted with a different cipher should be rejected
+	other, _ := NewAEAD([]byte("abcdef0123456789abcdef0123456789"))
+	_, err = other.DecryptKey([]byte(encoded))
+	assert.Error(t, err)
+}
+
+func Test_AEAD_Errors(t *testing.T) {
+	_, err := NewAEAD([]byte("short"))
+	assert.Error(t, err)
+
+	cipher := newTestAEAD()
+	_, err = cipher.EncryptKey(security.Key(make([]byte, 10)))
+	assert.Error(t, err)
+
+	for _, key := range []string{"", "um4m30suos9k0tNjZiO19FyGNtmZjRlN", string(make([]byte, 70))} {
+		_, err := cipher.DecryptKey([]byte(key))
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,142 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package jwt
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/config"
+	"github.com/emitter-io/emitter/internal/security"
+)
+
+// Various errors returned when authorizing the tokens.
+var (
+	ErrClaims       = errors.New("jwt: token issuer or audience does not match")
+	ErrContract     = errors.New("jwt: no master key is configured for the contract of the token")
+	ErrUnauthorized = errors.New("jwt: token does not grant the permission on the channel")
+)
+
+// Authorizer maps the verified tokens to security keys.
+type Authorizer struct {
+	verifier *Verifier               // The verifier for the signatures.
+	masters  map[uint32]security.Key // The master keys, by contract.
+	issuer   string                  // The expected issuer.
+	audience string                  // The expected audience.
+}
+
+// New creates a new token authorizer from the configuration, decrypting the master keys
+// with the provided function.
+func New(cfg *config.JWTConfig, decrypt func(string) (security.Key, error)) (*Authorizer, error) {
+	a := &Authorizer{
+		verifier: NewVerifier(),
+		masters:  make(map[uint32]security.Key, len(cfg.Masters)),
+		issuer:   cfg.Issuer,
+		audience: cfg.Audience,
+	}
+
+	// Decrypt all of the master keys
+	for _, raw := range cfg.Masters {
+		master, err := decrypt(raw)
+		if err != nil || !master.IsMaster() {
+			return nil, errors.New("jwt: the configured key is not a valid master key")
+		}
+
+		a.masters[master.Contract()] = master
+	}
+
+	// Load the shared secret, the public keys and the key set
+	if cfg.Secret != "" {
+		a.verifier.AddSecret([]byte(cfg.Secret))
+	}
+
+	for _, file := range cfg.Keys {
+		if data, err := os.ReadFile(file); err != nil {
+			return nil, err
+		} else if err := a.verifier.AddPEM(data); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.JWKS != "" {
+		if data, err := os.ReadFile(cfg.JWKS); err != nil {
+			return nil, err
+		} else if err := a.verifier.AddJWKS(data); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// Verify verifies the token and its claims.
+func (a *Authorizer) Verify(token string) (*Claims, error) {
+	claims, err := a.verifier.Parse(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if (a.issuer != "" && claims.Issuer != a.issuer) || (a.audience != "" && !claims.Audience.Contains(a.audience)) {
+		return nil, ErrClaims
+	}
+
+	if _, ok := a.masterOf(claims); !ok {
+		return nil, ErrContract
+	}
+
+	return claims, nil
+}
+
+// Key verifies the token and returns a security key derived from the channel pattern of
+// the token which grants the requested permission on the channel.
+func (a *Authorizer) Key(token string, channel *security.Channel, permission uint8) (security.Key, error) {
+	claims, err := a.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	master, _ := a.masterOf(claims)
+	for pattern, access := range claims.Channels {
+		key := security.Key(make([]byte, 24))
+		key.SetMaster(master.Master())
+		key.SetContract(master.Contract())
+		key.SetSignature(master.Signature())
+		key.SetPermissions(security.ParseAccess(access))
+		if claims.Expires > 0 {
+			key.SetExpires(time.Unix(claims.Expires, 0))
+		}
+
+		// Only return the key if it actually allows the channel
+		if key.SetTarget(pattern) == nil && key.HasPermission(permission) && key.ValidateChannel(channel) {
+			return key, nil
+		}
+	}
+
+	return nil, ErrUnauthorized
+}
+
+// masterOf finds the master key for the contract of the token. If the token does not
+// specify a contract, the only master key configured is used.
+func (a *Authorizer) masterOf(claims *Claims) (security.Key, bool) {
+	if claims.Contract == 0 && len(a.masters) == 1 {
+		for _, master := range a.masters {
+			return master, true
+		}
+	}
+
+	master, ok := a.masters[claims.Contract]
+	return master, ok
+}
@@ -0,0 +1,120 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package jwt
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/config"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/emitter-io/emitter/internal/security/license"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testLicense = "zT83oDV0DWY5_JysbSTPTDr8KB0AAAAAAAAAAAAAAAI:1"
+	testSecret  = "kBCZch5re3Ue-kpG1Aa8Vo7BYvXZ3UwR"
+)
+
+func newTestAuthorizer(t *testing.T, cfg *config.JWTConfig) (*Authorizer, error) {
+	l, err := license.Parse(testLicense)
+	assert.NoError(t, err)
+
+	cipher, err := l.Cipher()
+	assert.NoError(t, err)
+
+	return New(cfg, func(k string) (security.Key, error) {
+		return cipher.DecryptKey([]byte(k))
+	})
+}
+
+func TestAuthorizer_New(t *testing.T) {
+	jwks := path.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(jwks, []byte(`{"keys":[{"kty":"oct","k":"c2VjcmV0"}]}`), 0644))
+
+	_, err := newTestAuthorizer(t, &config.JWTConfig{Masters: []string{testSecret}, JWKS: jwks})
+	assert.NoError(t, err)
+
+	_, err = newTestAuthorizer(t, &config.JWTConfig{Masters: []string{"invalid"}})
+	assert.Error(t, err)
+
+	_, err = newTestAuthorizer(t, &config.JWTConfig{Masters: []string{testSecret}, Keys: []string{"missing.pem"}})
+	assert.Error(t, err)
+
+	_, err = newTestAuthorizer(t, &config.JWTConfig{Masters: []string{testSecret}, JWKS: "missing.json"})
+	assert.Error(t, err)
+}
+
+func TestAuthorizer_Key(t *testing.T) {
+	secret := []byte("secret")
+	a, err := newTestAuthorizer(t, &config.JWTConfig{
+		Masters:  []string{testSecret},
+		Secret:   string(secret),
+		Issuer:   "idp",
+		Audience: "emitter",
+	})
+	assert.NoError(t, err)
+
+	expires := time.Now().Add(time.Hour).Unix()
+	valid := sign(HS256, "", secret, &Claims{
+		Issuer:   "idp",
+		Audience: Audience{"emitter"},
+		Expires:  expires,
+		Channels: map[string]string{
+			"users/123/#/":    "r",
+			"commands/123/":   "w",
+			"rooms/+/public/": "p",
+		},
+	})
+
+	tests := []struct {
+		token      string
+		channel    string
+		permission uint8
+		err        error
+	}{
+		{token: valid, channel: "users/123/a/b/", permission: security.AllowRead},
+		{token: valid, channel: "commands/123/", permission: security.AllowWrite},
+		{token: valid, channel: "rooms/1/public/", permission: security.AllowPresence},
+		{token: valid, channel: "commands/123/", permission: security.AllowRead, err: ErrUnauthorized},
+		{token: valid, channel: "users/456/", permission: security.AllowRead, err: ErrUnauthorized},
+		{token: "a.b.c", channel: "users/123/", permission: security.AllowRead, err: ErrMalformed},
+		{
+			token:      sign(HS256, "", secret, &Claims{Issuer: "other", Audience: Audience{"emitter"}}),
+			channel:    "users/123/",
+			permission: security.AllowRead,
+			err:        ErrClaims,
+		},
+		{
+			token:      sign(HS256, "", secret, &Claims{Issuer: "idp", Audience: Audience{"emitter"}, Contract: 42}),
+			channel:    "users/123/",
+			permission: security.AllowRead,
+			err:        ErrContract,
+		},
+	}
+
+	for _, tc := range tests {
+		key, err := a.Key(tc.token, security.MakeChannel(tc.token, tc.channel), tc.permission)
+		assert.Equal(t, tc.err, err, tc.channel)
+		if tc.err == nil {
+			assert.False(t, key.IsMaster())
+			assert.Equal(t, uint32(0x3afc281d), key.Contract())
+			assert.Equal(t, expires, key.Expires().Unix())
+		}
+	}
+}
@@ -0,0 +1,216 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Various errors returned when verifying the tokens.
+var (
+	ErrMalformed = errors.New("jwt: token is malformed")
+	ErrAlgorithm = errors.New("jwt: signing algorithm is not supported")
+	ErrSignature = errors.New("jwt: signature is invalid")
+	ErrExpired   = errors.New("jwt: token is expired or not valid yet")
+)
+
+// Supported signing algorithms.
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	ES256 = "ES256"
+)
+
+// IsToken checks whether the string looks like a compact-serialized token.
+func IsToken(text string) bool {
+	return strings.Count(text, ".") == 2
+}
+
+// header represents the header of the token.
+type header struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+// Claims represents the claims of a token which are used for authorization.
+type Claims struct {
+	Issuer    string            `json:"iss,omitempty"`      // The issuer of the token.
+	Subject   string            `json:"sub,omitempty"`      // The subject of the token.
+	Audience  Audience          `json:"aud,omitempty"`      // The intended audience of the token.
+	Expires   int64             `json:"exp,omitempty"`      // The UNIX timestamp after which the token is expired.
+	NotBefore int64             `json:"nbf,omitempty"`      // The UNIX timestamp before which the token is not valid.
+	Contract  uint32            `json:"contract,omitempty"` // The contract the token was issued for.
+	Channels  map[string]string `json:"channels,omitempty"` // The channel patterns mapped to their access letters.
+}
+
+// IsValidAt checks whether the claims are valid at a specific time.
+func (c *Claims) IsValidAt(now time.Time) bool {
+	unix := now.Unix()
+	return (c.Expires == 0 || unix < c.Expires) && (c.NotBefore == 0 || unix >= c.NotBefore)
+}
+
+// Audience represents an audience claim which can be either a string or an array.
+type Audience []string
+
+// UnmarshalJSON unmarshals the audience from either a string or an array of strings.
+func (a *Audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+// Contains checks whether the audience contains a specific value.
+func (a Audience) Contains(value string) bool {
+	for _, v := range a {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ------------------------------------------------------------------------------------
+
+// verificationKey represents a key which can be used to verify a signature.
+type verificationKey struct {
+	id  string      // The optional key identifier.
+	key interface{} // The key, either a []byte, *rsa.PublicKey or *ecdsa.PublicKey.
+}
+
+// Verifier verifies the signatures of the tokens against a set of keys.
+type Verifier struct {
+	keys []verificationKey // The keys to use for verification.
+}
+
+// NewVerifier creates a new verifier.
+func NewVerifier() *Verifier {
+	return new(Verifier)
+}
+
+// AddSecret adds a shared secret used for HS256 signatures.
+func (v *Verifier) AddSecret(secret []byte) {
+	v.keys = append(v.keys, verificationKey{key: secret})
+}
+
+// Parse parses the token, verifies its signature and validity period and returns
+// the claims of the token.
+func (v *Verifier) Parse(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	// Decode the header first, so we can figure out the algorithm
+	var head header
+	if err := decodeSegment(parts[0], &head); err != nil {
+		return nil, ErrMalformed
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	// Verify the signature of the token
+	if err := v.verify(&head, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	// Decode the claims and check the validity period
+	claims := new(Claims)
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, ErrMalformed
+	}
+
+	if !claims.IsValidAt(time.Now()) {
+		return nil, ErrExpired
+	}
+
+	return claims, nil
+}
+
+// verify verifies the signature using one of the candidate keys.
+func (v *Verifier) verify(head *header, input string, signature []byte) error {
+	digest := sha256.Sum256([]byte(input))
+	for _, candidate := range v.keys {
+		if head.KeyID != "" && candidate.id != "" && head.KeyID != candidate.id {
+			continue
+		}
+
+		switch key := candidate.key.(type) {
+		case []byte:
+			if head.Algorithm == HS256 && verifyHMAC(key, input, signature) {
+				return nil
+			}
+		case *rsa.PublicKey:
+			if head.Algorithm == RS256 && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			if head.Algorithm == ES256 && verifyECDSA(key, digest[:], signature) {
+				return nil
+			}
+		}
+	}
+
+	switch head.Algorithm {
+	case HS256, RS256, ES256:
+		return ErrSignature
+	default:
+		return ErrAlgorithm
+	}
+}
+
+// verifyHMAC verifies the HMAC-SHA256 signature.
+func verifyHMAC(secret []byte, input string, signature []byte) bool {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(input))
+	return hmac.Equal(signature, mac.Sum(nil))
+}
+
+// verifyECDSA verifies the ECDSA P-256 signature, which is encoded as r || s.
+func verifyECDSA(key *ecdsa.PublicKey, digest, signature []byte) bool {
+	if len(signature) != 64 {
+		return false
+	}
+
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	return ecdsa.Verify(key, digest, r, s)
+}
+
+// decodeSegment decodes a base64url-encoded JSON segment of the token.
+func decodeSegment(segment string, out interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(raw, out)
+}
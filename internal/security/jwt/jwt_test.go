@@ -0,0 +1,110 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sign creates a signed token for testing.
+func sign(alg, kid string, key interface{}, claims interface{}) string {
+	head, _ := json.Marshal(header{Algorithm: alg, KeyID: kid})
+	body, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(head) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(input))
+
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(input))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, _ := ecdsa.Sign(rand.Reader, k, digest[:])
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestIsToken(t *testing.T) {
+	assert.True(t, IsToken("a.b.c"))
+	assert.False(t, IsToken("kBCZch5re3Ue-kpG1Aa8Vo7BYvXZ3UwR"))
+	assert.False(t, IsToken("emitter"))
+}
+
+func TestParse(t *testing.T) {
+	secret := []byte("secret")
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	valid := &Claims{Subject: "joe", Expires: time.Now().Add(time.Hour).Unix()}
+
+	v := NewVerifier()
+	v.AddSecret(secret)
+	v.keys = append(v.keys,
+		verificationKey{key: &rsaKey.PublicKey},
+		verificationKey{id: "ec", key: &ecKey.PublicKey},
+	)
+
+	tests := []struct {
+		token string
+		err   error
+	}{
+		{token: "abc", err: ErrMalformed},
+		{token: "a.b.c", err: ErrMalformed},
+		{token: sign(HS256, "", secret, valid)},
+		{token: sign(RS256, "", rsaKey, valid)},
+		{token: sign(ES256, "ec", ecKey, valid)},
+		{token: sign(ES256, "other", ecKey, valid), err: ErrSignature},
+		{token: sign(HS256, "", []byte("wrong"), valid), err: ErrSignature},
+		{token: sign("none", "", nil, valid), err: ErrAlgorithm},
+		{token: sign(HS256, "", secret, &Claims{Expires: 1}), err: ErrExpired},
+		{token: sign(HS256, "", secret, &Claims{NotBefore: time.Now().Add(time.Hour).Unix()}), err: ErrExpired},
+	}
+
+	for _, tc := range tests {
+		claims, err := v.Parse(tc.token)
+		assert.Equal(t, tc.err, err)
+		if tc.err == nil {
+			assert.Equal(t, "joe", claims.Subject)
+		}
+	}
+}
+
+func TestAudience(t *testing.T) {
+	var c Claims
+	assert.NoError(t, json.Unmarshal([]byte(`{"aud":"a"}`), &c))
+	assert.True(t, c.Audience.Contains("a"))
+
+	assert.NoError(t, json.Unmarshal([]byte(`{"aud":["b","c"]}`), &c))
+	assert.True(t, c.Audience.Contains("c"))
+	assert.False(t, c.Audience.Contains("a"))
+}
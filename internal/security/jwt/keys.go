@@ -0,0 +1,173 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+)
+
+// ErrKeyInvalid is returned when the verification key can not be parsed.
+var ErrKeyInvalid = errors.New("jwt: verification key is invalid or not supported")
+
+// AddPEM adds a PEM-encoded RSA or ECDSA public key, or a certificate containing one.
+func (v *Verifier) AddPEM(data []byte) error {
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			return nil
+		}
+
+		key, err := parsePEMBlock(block)
+		if err != nil {
+			return err
+		}
+
+		v.keys = append(v.keys, verificationKey{key: key})
+		data = rest
+	}
+}
+
+// parsePEMBlock parses a single PEM block into a public key.
+func parsePEMBlock(block *pem.Block) (key interface{}, err error) {
+	switch block.Type {
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	default:
+		return nil, ErrKeyInvalid
+	}
+}
+
+// ------------------------------------------------------------------------------------
+
+// jwk represents a single JSON web key.
+type jwk struct {
+	Type  string `json:"kty"`
+	ID    string `json:"kid"`
+	Curve string `json:"crv"`
+	N     string `json:"n"`
+	E     string `json:"e"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+	K     string `json:"k"`
+}
+
+// AddJWKS adds all of the keys of a JSON web key set.
+func (v *Verifier) AddJWKS(data []byte) error {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return err
+	}
+
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return err
+		}
+
+		v.keys = append(v.keys, verificationKey{id: k.ID, key: key})
+	}
+	return nil
+}
+
+// publicKey converts the web key to a key usable for verification.
+func (k *jwk) publicKey() (interface{}, error) {
+	switch k.Type {
+	case "oct":
+		return decodeBase64(k.K)
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, ErrKeyInvalid
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Curve != "P-256" {
+			return nil, ErrKeyInvalid
+		}
+
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	default:
+		return nil, ErrKeyInvalid
+	}
+}
+
+// decodeBase64 decodes a base64url-encoded value, with or without the padding.
+func decodeBase64(value string) ([]byte, error) {
+	if value == "" {
+		return nil, ErrKeyInvalid
+	}
+
+	return base64.RawURLEncoding.DecodeString(trimPadding(value))
+}
+
+// decodeBigInt decodes a base64url-encoded big-endian integer.
+func decodeBigInt(value string) (*big.Int, error) {
+	raw, err := decodeBase64(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(raw), nil
+}
+
+// trimPadding removes the base64 padding characters.
+func trimPadding(value string) string {
+	for len(value) > 0 && value[len(value)-1] == '=' {
+		value = value[:len(value)-1]
+	}
+	return value
+}
@@ -0,0 +1,84 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddPEM(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	pkix, _ := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix})...)
+
+	v := NewVerifier()
+	assert.NoError(t, v.AddPEM(data))
+	assert.Len(t, v.keys, 2)
+
+	_, err := v.Parse(sign(ES256, "", ecKey, &Claims{Subject: "joe"}))
+	assert.NoError(t, err)
+
+	// Invalid block
+	assert.Error(t, v.AddPEM(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte{1, 2}})))
+}
+
+func TestAddJWKS(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+	jwks := fmt.Sprintf(`{"keys":[
+		{"kty":"RSA","kid":"r1","n":"%s","e":"%s"},
+		{"kty":"EC","kid":"e1","crv":"P-256","x":"%s","y":"%s"},
+		{"kty":"oct","kid":"h1","k":"%s"}
+	]}`,
+		encode(rsaKey.N.Bytes()), encode(big.NewInt(int64(rsaKey.E)).Bytes()),
+		encode(ecKey.X.Bytes()), encode(ecKey.Y.Bytes()),
+		encode([]byte("secret")),
+	)
+
+	v := NewVerifier()
+	assert.NoError(t, v.AddJWKS([]byte(jwks)))
+	assert.Len(t, v.keys, 3)
+
+	for _, token := range []string{
+		sign(RS256, "r1", rsaKey, &Claims{}),
+		sign(ES256, "e1", ecKey, &Claims{}),
+		sign(HS256, "h1", []byte("secret"), &Claims{}),
+		sign(HS256, "", []byte("secret"), &Claims{}),
+	} {
+		_, err := v.Parse(token)
+		assert.NoError(t, err)
+	}
+
+	// Unsupported keys
+	assert.Error(t, v.AddJWKS([]byte(`{"keys":[{"kty":"OKP"}]}`)))
+	assert.Error(t, v.AddJWKS([]byte(`{"keys":[{"kty":"EC","crv":"P-384"}]}`)))
+	assert.Error(t, v.AddJWKS([]byte(`invalid`)))
+}
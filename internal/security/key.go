@@ -52,6 +52,29 @@ var (
 	ErrTargetTooLong = errors.New("channel can not have more than 23 parts")
 )
 
+// Multi-channel keys are made of several keys joined with a separator, each of which grants
+// its own permissions on its own channel pattern.
+const (
+	KeySeparator = ":" // The separator of the keys in a multi-channel key.
+	MaxKeys      = 16  // The maximum number of keys in a multi-channel key.
+)
+
+// IsMultiKey checks whether an encrypted key is a multi-channel key.
+func IsMultiKey(raw string) bool {
+	return strings.Contains(raw, KeySeparator)
+}
+
+// SplitKey splits an encrypted multi-channel key into the keys it is made of. A single
+// key is returned as is.
+func SplitKey(raw string) []string {
+	return strings.Split(raw, KeySeparator)
+}
+
+// JoinKeys joins several encrypted keys into a multi-channel key.
+func JoinKeys(raw ...string) string {
+	return strings.Join(raw, KeySeparator)
+}
+
 // Key represents a security key.
 type Key []byte
 
@@ -233,6 +256,67 @@ func (k Key) SetTarget(channel string) error {
 	return nil
 }
 
+// TargetPattern returns the target channel pattern of the key. Since the key only contains
+// the hash of the target, static parts of the pattern are recovered from the channel if
+// it is provided and matches the key, otherwise they are represented with '?'.
+func (k Key) TargetPattern(ch *Channel) string {
+	target := uint32(k[16])<<24 | uint32(k[17])<<16 | uint32(k[18])<<8 | uint32(k[19])
+	targetPath := uint32(k[12])<<16 | uint32(k[13])<<8 | uint32(k[14])
+
+	// Split the channel into parts, only if the channel matches the key
+	var parts []string
+	if ch != nil && k.ValidateChannel(ch) {
+		parts = strings.Split(strings.TrimRight(string(ch.Channel), "/"), "/")
+	}
+
+	// Retro-compatibility: if there's no depth specified, only the first part is validated
+	if targetPath == 0 {
+		switch {
+		case target == 1325880984: // hash("")
+			return "#/"
+		case len(parts) > 0:
+			return parts[0] + "/#/"
+		default:
+			return "?/#/"
+		}
+	}
+
+	maxDepth := 0
+	for i := uint32(0); i < 23; i++ {
+		if ((targetPath >> i) & 1) == 1 {
+			maxDepth = 23 - int(i)
+			break
+		}
+	}
+
+	// If no depth defined, all the parts in key target were wildcards (+)
+	if maxDepth == 0 {
+		if len(parts) == 0 {
+			return "?/"
+		}
+		maxDepth = len(parts)
+	}
+
+	pattern := make([]string, 0, maxDepth)
+	for idx := 0; idx < maxDepth; idx++ {
+		switch {
+		case ((targetPath >> (22 - uint32(idx))) & 1) == 0:
+			pattern = append(pattern, "+")
+		case len(parts) > idx:
+			pattern = append(pattern, parts[idx])
+		default:
+			pattern = append(pattern, "?")
+		}
+	}
+
+	// Get the first bit, whether the key is the exact match or not
+	if ((targetPath >> 23) & 1) == 0 {
+		pattern = append(pattern, "#")
+	}
+
+	return strings.Join(pattern, "/") + "/"
+}
+
 // Expires gets the expiration date for the key.
 func (k Key) Expires() time.Time {
 	expire := int64(uint32(k[20])<<24 | uint32(k[21])<<16 | uint32(k[22])<<8 | uint32(k[23]))
@@ -284,3 +368,51 @@ func (k Key) SetPermission(flag uint8, value bool) {
 		k.SetPermissions(k.Permissions() &^ flag)
 	}
 }
+
+// ParseAccess parses the permission flags from a string of access letters, such as "rwslpex".
+func ParseAccess(access string) uint8 {
+	required := AllowNone
+	for i := 0; i < len(access); i++ {
+		switch c := access[i]; c {
+		case 'r':
+			required |= AllowRead
+		case 'w':
+			required |= AllowWrite
+		case 's':
+			required |= AllowStore
+		case 'l':
+			required |= AllowLoad
+		case 'p':
+			required |= AllowPresence
+		case 'e':
+			required |= AllowExtend
+		case 'x':
+			required |= AllowExecute
+		}
+	}
+
+	return required
+}
+
+// FormatAccess formats the permission flags as a string of access letters, such as "rwslpex".
+func FormatAccess(permissions uint8) string {
+	access := make([]byte, 0, 7)
+	for _, p := range []struct {
+		flag   uint8
+		letter byte
+	}{
+		{AllowRead, 'r'},
+		{AllowWrite, 'w'},
+		{AllowStore, 's'},
+		{AllowLoad, 'l'},
+		{AllowPresence, 'p'},
+		{AllowExtend, 'e'},
+		{AllowExecute, 'x'},
+	} {
+		if permissions&p.flag == p.flag {
+			access = append(access, p.letter)
+		}
+	}
+
+	return string(access)
+}
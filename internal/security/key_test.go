@@ -152,3 +152,60 @@ func TestKey(t *testing.T) {
 	assert.True(t, key.IsMaster())
 	assert.True(t, key.HasPermission(AllowMaster))
 }
+
+func TestParseAccess(t *testing.T) {
+	assert.Equal(t, AllowNone, ParseAccess(""))
+	assert.Equal(t, AllowReadWrite, ParseAccess("rw"))
+	assert.Equal(t, AllowAll, ParseAccess("rwslpex"))
+	assert.Equal(t, AllowRead|AllowPresence, ParseAccess("rpm"))
+}
+
+func TestFormatAccess(t *testing.T) {
+	assert.Equal(t, "", FormatAccess(AllowNone))
+	assert.Equal(t, "", FormatAccess(AllowMaster))
+	assert.Equal(t, "rw", FormatAccess(AllowReadWrite))
+	assert.Equal(t, "rwslpex", FormatAccess(AllowAll))
+	assert.Equal(t, "rp", FormatAccess(ParseAccess("rpm")))
+}
+
+func TestKey_TargetPattern(t *testing.T) {
+	tests := []struct {
+		target  string
+		channel string
+		expect  string
+	}{
+		{target: "a/b/c/", expect: "?/?/?/"},
+		{target: "a/b/c/", channel: "a/b/c/", expect: "a/b/c/"},
+		{target: "a/b/c/", channel: "a/b/d/", expect: "?/?/?/"},
+		{target: "a/+/c/", expect: "?/+/?/"},
+		{target: "a/+/c/", channel: "a/x/c/", expect: "a/+/c/"},
+		{target: "a/b/c/#/", expect: "?/?/?/#/"},
+		{target: "a/b/c/#/", channel: "a/b/c/d/e/", expect: "a/b/c/#/"},
+		{target: "+/+/", expect: "?/"},
+		{target: "+/+/", channel: "x/y/", expect: "+/+/"},
+		{target: "#/", expect: "#/"},
+		{target: "#/", channel: "x/y/", expect: "#/"},
+	}
+
+	for _, tc := range tests {
+		key := Key(make([]byte, 24))
+		assert.NoError(t, key.SetTarget(tc.target))
+
+		var channel *Channel
+		if tc.channel != "" {
+			channel = ParseChannel([]byte("key/" + tc.channel))
+		}
+
+		assert.Equal(t, tc.expect, key.TargetPattern(channel), tc.target+" "+tc.channel)
+	}
+}
+
+func TestMultiKey(t *testing.T) {
+	assert.False(t, IsMultiKey("xm-N4nS8b9NnPBq1FGg7Pr2JPNVixPmw"))
+	assert.Equal(t, []string{"xm-N4nS8b9NnPBq1FGg7Pr2JPNVixPmw"}, SplitKey("xm-N4nS8b9NnPBq1FGg7Pr2JPNVixPmw"))
+
+	raw := JoinKeys("a", "b", "c")
+	assert.Equal(t, "a:b:c", raw)
+	assert.True(t, IsMultiKey(raw))
+	assert.Equal(t, []string{"a", "b", "c"}, SplitKey(raw))
+}
@@ -44,7 +44,7 @@ type License interface {
 // New generates a new license and master key. This uses the most up-to-date version
 // of the license to generate a new one.
 func New() (string, string) {
-	license := NewV3()
+	license := NewV4()
 	if secret, err := license.NewMasterKey(1); err != nil {
 		panic(err)
 	} else if cipher, err := license.Cipher(); err != nil {
@@ -69,11 +69,29 @@ func Parse(data string) (License, error) {
 		return parseV2(data[:len(data)-2])
 	case strings.HasSuffix(data, ":3"):
 		return parseV3(data[:len(data)-2])
+	case strings.HasSuffix(data, ":4"):
+		return parseV4(data[:len(data)-2])
 	default:
 		return parseV1(data)
 	}
 }
 
+// Version returns the version of the license.
+func Version(license License) int {
+	switch license.(type) {
+	case *V1:
+		return 1
+	case *V2:
+		return 2
+	case *V3:
+		return 3
+	case *V4:
+		return 4
+	default:
+		return 0
+	}
+}
+
 // RandN generates a crypto-random N bytes.
 func randN(n int) []byte {
 	raw := make([]byte, n)
@@ -75,6 +75,7 @@ func TestParseLicense(t *testing.T) {
 	}{
 		{license: "", err: true},
 		{license: "zT83oDV0DWY5_JysbSTPTDr8KB0AAAAAAAAAAAAAAAI#", err: true},
+		{license: "xxxxxx:1", err: true},
 		{license: "zT83oDV0DWY5_JysbSTPTDr8KB0AAAAAFCDVAAAAAAI", expected: &V1{
 			EncryptionKey: "zT83oDV0DWY5_JysbSTPTA",
 			User:          989603869,
@@ -101,3 +102,11 @@ func TestParseLicense(t *testing.T) {
 		}
 	}
 }
+
+func TestVersion(t *testing.T) {
+	assert.Equal(t, 1, Version(NewV1()))
+	assert.Equal(t, 2, Version(NewV2()))
+	assert.Equal(t, 3, Version(NewV3()))
+	assert.Equal(t, 4, Version(NewV4()))
+	assert.Equal(t, 0, Version(nil))
+}
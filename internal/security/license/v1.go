@@ -17,6 +17,7 @@ package license
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"math"
 	"math/big"
 	"time"
@@ -64,6 +65,11 @@ func parseV1(data string) (*V1, error) {
 		return nil, err
 	}
 
+	// Make sure we have enough bytes to parse
+	if len(raw) < 32 {
+		return nil, errors.New("license: invalid length of a v1 license")
+	}
+
 	// Get the expiration time
 	expiry := int64(be.Uint32(raw[24:28]))
 	if expiry > 0 {
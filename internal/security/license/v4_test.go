@@ -0,0 +1,73 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package license
+
+import (
+	"testing"
+
+	"github.com/emitter-io/emitter/internal/security/cipher"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewV4(t *testing.T) {
+	l := NewV4()
+	l.User = 0x11248139
+	l.Sign = 0x10062b50
+	l.Index = 0x1
+	assert.Len(t, l.EncryptionKey, 32)
+
+	c, err := l.Cipher()
+	assert.NotNil(t, c)
+	assert.NoError(t, err)
+
+	text := l.String()
+	assert.NotEqual(t, "", text)
+	assert.Equal(t, ":4", text[len(text)-2:])
+
+	out, err := parseV4(text[:len(text)-2])
+	assert.NoError(t, err)
+	assert.Equal(t, l, out)
+
+	master, err := l.NewMasterKey(9)
+	assert.NoError(t, err)
+	assert.Equal(t, 9, int(master.Master()))
+
+	// The master key should survive the round trip through the cipher
+	encrypted, err := c.EncryptKey(master)
+	assert.NoError(t, err)
+	decrypted, err := c.DecryptKey([]byte(encrypted))
+	assert.NoError(t, err)
+	assert.Equal(t, master, decrypted)
+}
+
+func TestParseV4(t *testing.T) {
+	l, err := Parse("LKwgkiNnlCb3dPpdKXqdUxst1xuILGu7CSF6e6VQDE4gU3a5gpKJAdDWmIABAQ:4")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0x11248139), l.Contract())
+	assert.Equal(t, uint32(0x10062b50), l.Signature())
+	assert.Equal(t, uint32(0x1), l.Master())
+
+	c, err := l.Cipher()
+	assert.NoError(t, err)
+	assert.IsType(t, new(cipher.AEAD), c)
+}
+
+func TestParseV4_Invalid(t *testing.T) {
+	_, err := Parse("``````````:4")
+	assert.Error(t, err)
+
+	_, err = Parse("xxxxxx:4")
+	assert.Error(t, err)
+}
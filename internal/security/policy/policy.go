@@ -0,0 +1,132 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package policy
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/emitter-io/emitter/internal/config"
+	"github.com/emitter-io/emitter/internal/provider/contract"
+	"github.com/emitter-io/emitter/internal/security"
+)
+
+// Key is the key placeholder used to access the public channels anonymously.
+const Key = "public"
+
+// ErrMaster is returned when the master key of a policy is not valid.
+var ErrMaster = errors.New("policy: the configured key is not a valid master key")
+
+// Policy allows the channels under a prefix to be accessed anonymously, on behalf of the
+// contract which owns them.
+type Policy struct {
+	key   security.Key   // The key derived for the channels of the policy.
+	limit contract.Limit // The limits shared by all of the anonymous clients.
+}
+
+// Policies represents a set of anonymous access policies.
+type Policies []Policy
+
+// New creates the policies from the configuration. The key of each policy is derived from
+// its master key, decrypted with the provided function, or from the owner key if none is
+// specified.
+func New(cfg []config.PublicConfig, owner security.Key, decrypt func(string) (security.Key, error)) (Policies, error) {
+	policies := make(Policies, 0, len(cfg))
+	for _, v := range cfg {
+		if v.Channel == "" {
+			return nil, security.ErrTargetInvalid
+		}
+
+		master := owner
+		if v.Master != "" {
+			key, err := decrypt(v.Master)
+			if err != nil || !key.IsMaster() {
+				return nil, ErrMaster
+			}
+			master = key
+		}
+
+		// Anonymous clients should never be able to extend the channels
+		key := security.Key(make([]byte, 24))
+		key.SetMaster(master.Master())
+		key.SetContract(master.Contract())
+		key.SetSignature(master.Signature())
+		key.SetPermissions(security.ParseAccess(v.Access) &^ (security.AllowMaster | security.AllowExtend))
+		if err := key.SetTarget(prefixOf(v.Channel)); err != nil {
+			return nil, err
+		}
+
+		policies = append(policies, Policy{
+			key: key,
+			limit: contract.Limit{
+				Rate:        v.Rate,
+				Daily:       v.Daily,
+				Connections: v.Connections,
+			},
+		})
+	}
+
+	return policies, nil
+}
+
+// prefixOf converts a channel prefix to a wildcard channel pattern.
+func prefixOf(channel string) string {
+	if !strings.HasSuffix(channel, "/") {
+		channel += "/"
+	}
+	if !strings.HasSuffix(channel, "#/") {
+		channel += "#/"
+	}
+	return channel
+}
+
+// Authorize checks whether any of the policies grants the permission on the channel and
+// returns the contract which owns it along with the key of the policy.
+func (p Policies) Authorize(contracts contract.Provider, channel *security.Channel, permission uint8) (contract.Contract, security.Key, bool) {
+	for _, policy := range p {
+		if !policy.key.HasPermission(permission) || !policy.key.ValidateChannel(channel) {
+			continue
+		}
+
+		c, ok := contracts.Get(policy.key.Contract())
+		if !ok || !c.Validate(policy.key) {
+			return nil, nil, false
+		}
+
+		// Copy the key, since the caller owns it
+		key := append(security.Key(nil), policy.key...)
+		return &owner{Contract: c, limit: policy.limit}, key, true
+	}
+
+	return nil, nil, false
+}
+
+// ------------------------------------------------------------------------------------
+
+// owner represents the contract which owns the public channels. The usage is metered to
+// the contract, while the limits of the policy replace the limits of its keys.
+type owner struct {
+	contract.Contract
+	limit contract.Limit
+}
+
+// Limits gets the rate and volume limits.
+func (c *owner) Limits() contract.Limits {
+	limits := c.Contract.Limits()
+	if !c.limit.IsZero() {
+		limits.Key = c.limit
+	}
+	return limits
+}
@@ -0,0 +1,113 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package policy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/emitter-io/emitter/internal/config"
+	"github.com/emitter-io/emitter/internal/provider/contract"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/emitter-io/emitter/internal/service/fake"
+	"github.com/stretchr/testify/assert"
+)
+
+// newOwner creates a master key for a contract.
+func newOwner(id uint32) security.Key {
+	key := security.Key(make([]byte, 24))
+	key.SetMaster(1)
+	key.SetContract(id)
+	key.SetPermissions(security.AllowMaster)
+	return key
+}
+
+// contracts provides the fake contracts.
+type contracts struct {
+	contract.NoopContractProvider
+	found map[uint32]contract.Contract
+}
+
+func (p *contracts) Get(id uint32) (contract.Contract, bool) {
+	c, ok := p.found[id]
+	return c, ok
+}
+
+func TestAuthorize(t *testing.T) {
+	policies, err := New([]config.PublicConfig{
+		{Channel: "status/", Access: "rl"},
+		{Channel: "market/#/", Access: "rwe", Master: "other", Rate: 10},
+	}, newOwner(1), func(string) (security.Key, error) {
+		return newOwner(2), nil
+	})
+	assert.NoError(t, err)
+
+	provider := &contracts{found: map[uint32]contract.Contract{
+		1: &fake.Contract{Quota: contract.Limits{Key: contract.Limit{Rate: 100}}},
+		2: &fake.Contract{Quota: contract.Limits{Key: contract.Limit{Rate: 100}}},
+	}}
+
+	tests := []struct {
+		channel    string
+		permission uint8
+		contract   uint32
+		rate       int
+	}{
+		{channel: "public/status/", permission: security.AllowRead, contract: 1, rate: 100},
+		{channel: "public/status/eu/", permission: security.AllowLoad, contract: 1, rate: 100},
+		{channel: "public/status/", permission: security.AllowWrite},
+		{channel: "public/private/", permission: security.AllowRead},
+		{channel: "public/market/eur/", permission: security.AllowWrite, contract: 2, rate: 10},
+		{channel: "public/market/eur/", permission: security.AllowExtend},
+	}
+
+	for _, tc := range tests {
+		c, key, ok := policies.Authorize(provider, security.ParseChannel([]byte(tc.channel)), tc.permission)
+		assert.Equal(t, tc.contract != 0, ok, tc.channel)
+		if ok {
+			assert.Equal(t, tc.contract, key.Contract())
+			assert.Equal(t, tc.rate, c.Limits().Key.Rate)
+		}
+	}
+}
+
+func TestAuthorize_Refused(t *testing.T) {
+	policies, err := New([]config.PublicConfig{{Channel: "status/", Access: "r"}}, newOwner(1), nil)
+	assert.NoError(t, err)
+
+	channel := security.ParseChannel([]byte("public/status/"))
+	_, _, ok := policies.Authorize(&contracts{found: map[uint32]contract.Contract{
+		1: &fake.Contract{Invalid: true},
+	}}, channel, security.AllowRead)
+	assert.False(t, ok)
+
+	_, _, ok = policies.Authorize(&contracts{}, channel, security.AllowRead)
+	assert.False(t, ok)
+}
+
+func TestNew_Invalid(t *testing.T) {
+	_, err := New([]config.PublicConfig{{Access: "r"}}, newOwner(1), nil)
+	assert.Error(t, err)
+
+	_, err = New([]config.PublicConfig{{Channel: "status/", Master: "x"}}, newOwner(1), func(string) (security.Key, error) {
+		return nil, errors.New("invalid")
+	})
+	assert.Equal(t, ErrMaster, err)
+
+	_, err = New([]config.PublicConfig{{Channel: "status/", Master: "x"}}, newOwner(1), func(string) (security.Key, error) {
+		return make(security.Key, 24), nil
+	})
+	assert.Equal(t, ErrMaster, err)
+}
@@ -65,6 +65,18 @@ func (m *memberlist) Fallback(name mesh.PeerName) (*Peer, bool) {
 	return nil, false
 }
 
+// Active returns the names of the active peers.
+func (m *memberlist) Active() []mesh.PeerName {
+	names := make([]mesh.PeerName, 0, 8)
+	m.list.Range(func(k, v interface{}) bool {
+		if peer := v.(*Peer); peer.IsActive() {
+			names = append(names, peer.name)
+		}
+		return true
+	})
+	return names
+}
+
 // Touch updates the last activity time
 func (m *memberlist) Touch(name mesh.PeerName) {
 	peer, _ := m.GetOrAdd(name)
@@ -38,6 +38,18 @@ func TestFallback(t *testing.T) {
 	assert.Equal(t, 2200, int(f.name))
 }
 
+func TestActive(t *testing.T) {
+	m := newMemberlist(newPeer)
+	assert.Empty(t, m.Active())
+
+	m.GetOrAdd(1900)
+	m.GetOrAdd(2000)
+	p, _ := m.GetOrAdd(2500)
+	p.activity = 0
+
+	assert.ElementsMatch(t, []mesh.PeerName{1900, 2000}, m.Active())
+}
+
 func newPeer(name mesh.PeerName) *Peer {
 	return &Peer{
 		name:     name,
@@ -184,7 +184,11 @@ func (s *Swarm) Listen(ctx context.Context) {
 
 	// Every few seconds, attempt to reinforce our cluster structure by
 	// initiating connections with all of our peers.
-	s.cancel = async.Repeat(ctx, 5*time.Second, s.update)
+	ctx, s.cancel = context.WithCancel(ctx)
+	async.Repeat(ctx, 5*time.Second, s.update)
+
+	// Every once in a while, remove the bans and the blocks which have expired
+	async.Repeat(ctx, time.Minute, s.state.Purge)
 
 	// Start the router
 	s.router.Start()
@@ -293,6 +297,17 @@ func (s *Swarm) NumPeers() int {
 	return 0
 }
 
+// Members returns the names of the active peers of the cluster, including ourselves.
+func (s *Swarm) Members() []uint64 {
+	members := []uint64{uint64(s.name)}
+	for _, name := range s.members.Active() {
+		if name != s.name {
+			members = append(members, uint64(name))
+		}
+	}
+	return members
+}
+
 // Gossip returns the state of everything we know; gets called periodically.
 func (s *Swarm) Gossip() (complete mesh.GossipData) {
 	return s.state
@@ -364,6 +379,11 @@ func (s *Swarm) Contains(ev event.Event) bool {
 	return s.state.Has(ev)
 }
 
+// Bans iterates through all of the active key bans within the cluster.
+func (s *Swarm) Bans(f func(*event.Ban, event.Value)) {
+	s.state.Bans(f)
+}
+
 // Close terminates the connection.
 func (s *Swarm) Close() error {
 	if s.cancel != nil {
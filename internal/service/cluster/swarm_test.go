@@ -91,6 +91,7 @@ func TestNewSwarm_Scenario(t *testing.T) {
 	// Find peer
 	peer := s.findPeer(123)
 	assert.NotNil(t, peer)
+	assert.Equal(t, []uint64{1, 123}, s.Members())
 
 	// Send to active peer
 	err = s.SendTo(123, &msg)
@@ -100,6 +101,7 @@ func TestNewSwarm_Scenario(t *testing.T) {
 	peer.activity = 0
 	err = s.SendTo(123, &msg)
 	assert.Error(t, err)
+	assert.Equal(t, []uint64{1}, s.Members())
 
 	// Remove that peer, it should not be there
 	s.onPeerOffline(123)
@@ -18,8 +18,11 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/emitter-io/emitter/internal/errors"
 	"github.com/emitter-io/emitter/internal/event"
 	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/provider/audit"
+	"github.com/emitter-io/emitter/internal/provider/auth"
 	"github.com/emitter-io/emitter/internal/provider/contract"
 	"github.com/emitter-io/emitter/internal/provider/usage"
 	"github.com/emitter-io/emitter/internal/security"
@@ -29,12 +32,14 @@ import (
 var (
 	_ service.Authorizer = new(Authorizer)
 	_ service.Replicator = new(Replicator)
+	_ service.Banlist    = new(Replicator)
 	_ service.PubSub     = new(PubSub)
 	_ service.Conn       = new(Conn)
 	_ service.Decryptor  = new(Decryptor)
 	_ contract.Contract  = new(Contract)
 	_ service.Surveyor   = new(Surveyor)
 	_ service.Notifier   = new(Notifier)
+	_ auth.Provider      = new(Access)
 )
 
 // ------------------------------------------------------------------------------------
@@ -45,6 +50,7 @@ type Authorizer struct {
 	Target    string
 	ExtraPerm uint8
 	Success   bool
+	Networks  []string
 }
 
 // Authorize provides a fake implementation.
@@ -58,7 +64,8 @@ func (f *Authorizer) Authorize(channel *security.Channel, perms uint8) (contract
 
 	key.SetContract(f.Contract)
 	return &Contract{
-		Invalid: !f.Success,
+		Invalid:  !f.Success,
+		Networks: f.Networks,
 	}, key, f.Success
 }
 
@@ -121,7 +128,10 @@ func (f *Replicator) initialize() {
 // Contains provides a fake implementation.
 func (f *Replicator) Contains(ev event.Event) bool {
 	f.initialize()
-	_, ok := f.data[ev.Key()]
+	stored, ok := f.data[ev.Key()]
+	if ban, isBan := stored.(*event.Ban); isBan && ban.IsExpired() {
+		return false
+	}
 	return ok
 }
 
@@ -135,6 +145,16 @@ func (f *Replicator) Notify(ev event.Event, enabled bool) {
 	}
 }
 
+// Bans provides a fake implementation.
+func (f *Replicator) Bans(fn func(*event.Ban, event.Value)) {
+	f.initialize()
+	for _, ev := range f.data {
+		if ban, ok := ev.(*event.Ban); ok && !ban.IsExpired() {
+			fn(ban, make(event.Value, 16))
+		}
+	}
+}
+
 // ------------------------------------------------------------------------------------
 
 // Notifier fake.
@@ -160,6 +180,9 @@ type Conn struct {
 	Disabled  bool
 	Outgoing  []message.Message
 	Shortcuts map[string]string
+	Grants    []*security.Channel
+	ConnKey   string
+	Refused   *errors.Error
 }
 
 // Initializes the fake.
@@ -200,16 +223,41 @@ func (f *Conn) CanUnsubscribe(message.Ssid, []byte) bool {
 	return !f.Disabled
 }
 
+// Grant provides a fake implementation.
+func (f *Conn) Grant(_ message.Ssid, channel *security.Channel) {
+	f.Grants = append(f.Grants, channel)
+}
+
+// Admit provides a fake implementation.
+func (f *Conn) Admit(contract.Contract, security.Key) *errors.Error {
+	return f.Refused
+}
+
 // LocalID provides a fake implementation.
 func (f *Conn) LocalID() security.ID {
 	return security.ID(f.ConnID)
 }
 
+// Addr provides a fake implementation.
+func (f *Conn) Addr() string {
+	return "127.0.0.1"
+}
+
 // Username provides a fake implementation.
 func (f *Conn) Username() string {
 	return fmt.Sprintf("user of %v", f.ConnID)
 }
 
+// ClientID provides a fake implementation.
+func (f *Conn) ClientID() string {
+	return fmt.Sprintf("client of %v", f.ConnID)
+}
+
+// Key provides a fake implementation.
+func (f *Conn) Key() string {
+	return f.ConnKey
+}
+
 // Track provides a fake implementation.
 func (f *Conn) Track(contract.Contract) {
 
@@ -243,10 +291,15 @@ type Decryptor struct {
 	Contract    uint32
 	Permissions uint8
 	Target      string
+	Invalid     bool
 }
 
 // DecryptKey provides a fake implementation.
 func (f *Decryptor) DecryptKey(k string) (security.Key, error) {
+	if f.Invalid {
+		return nil, fmt.Errorf("key %v is invalid", k)
+	}
+
 	key := make(security.Key, 24)
 	key.SetTarget(f.Target)
 	key.SetPermissions(f.Permissions)
@@ -258,7 +311,9 @@ func (f *Decryptor) DecryptKey(k string) (security.Key, error) {
 
 // Contract fake.
 type Contract struct {
-	Invalid bool
+	Invalid  bool
+	Quota    contract.Limits
+	Networks []string
 }
 
 // Validate validates the contract data against a key.
@@ -271,6 +326,55 @@ func (f *Contract) Stats() usage.Meter {
 	return usage.NewNoop().Get(1)
 }
 
+// Limits gets the rate and volume limits.
+func (f *Contract) Limits() contract.Limits {
+	return f.Quota
+}
+
+// Permits checks whether a client address is allowed to connect.
+func (f *Contract) Permits(addr string) bool {
+	if len(f.Networks) == 0 {
+		return true
+	}
+
+	for _, v := range f.Networks {
+		if v == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// ------------------------------------------------------------------------------------
+
+// Auditor fake.
+type Auditor struct {
+	audit.Noop
+	Events []audit.Event
+}
+
+// Record provides a fake implementation.
+func (f *Auditor) Record(ev *audit.Event) {
+	f.Events = append(f.Events, *ev)
+}
+
+// ------------------------------------------------------------------------------------
+
+// Limiter fake.
+type Limiter struct {
+	Err *errors.Error
+}
+
+// Admit provides a fake implementation.
+func (f *Limiter) Admit(service.Conn, contract.Contract, security.Key) *errors.Error {
+	return f.Err
+}
+
+// Allow provides a fake implementation.
+func (f *Limiter) Allow(contract.Contract, security.Key, int64) *errors.Error {
+	return f.Err
+}
+
 // ------------------------------------------------------------------------------------
 
 // Surveyor fake.
@@ -291,3 +395,27 @@ type awaiter struct {
 func (a *awaiter) Gather(timeout time.Duration) [][]byte {
 	return a.r
 }
+
+// ------------------------------------------------------------------------------------
+
+// Access fake.
+type Access struct {
+	Denied   bool
+	Requests []auth.Request
+}
+
+// Name provides a fake implementation.
+func (f *Access) Name() string {
+	return "fake"
+}
+
+// Configure provides a fake implementation.
+func (f *Access) Configure(map[string]interface{}) error {
+	return nil
+}
+
+// Authorize provides a fake implementation.
+func (f *Access) Authorize(r *auth.Request) bool {
+	f.Requests = append(f.Requests, *r)
+	return !f.Denied
+}
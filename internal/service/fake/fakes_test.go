@@ -58,10 +58,15 @@ func TestPubSub(t *testing.T) {
 
 func TestReplicator(t *testing.T) {
 	f := new(Replicator)
-	ev := event.Ban("abc")
+	ev := event.Ban{Target: "abc"}
 
 	f.Notify(&ev, true)
 	assert.True(t, f.Contains(&ev))
+
+	count := 0
+	f.Bans(func(*event.Ban, event.Value) { count++ })
+	assert.Equal(t, 1, count)
+
 	f.Notify(&ev, false)
 	assert.False(t, f.Contains(&ev))
 }
@@ -0,0 +1,177 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package guard
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/event"
+	"github.com/emitter-io/emitter/internal/service"
+)
+
+// Various defaults for the protection.
+const (
+	defaultConnFailures = 10               // The failures after which a connection is dropped.
+	defaultAddrFailures = 50               // The failures per minute after which an address is blocked.
+	defaultBlockFor     = 15 * time.Minute // The duration of the block.
+	delayAfter          = 3                // The failures after which the connection is slowed down.
+	delayBase           = 100 * time.Millisecond
+	delayMax            = 5 * time.Second
+	pruneEvery          = 1024 // The number of failures after which the stale counters are pruned.
+)
+
+// Guard protects the service against brute-force attacks by counting the authorization
+// failures of each IP address and blocking the addresses which fail too often. The
+// blocklist is shared across the cluster, if one is configured.
+type Guard struct {
+	cluster  service.Replicator // The cluster to share the blocklist with (optional).
+	limit    int                // The failures per minute after which an address is blocked.
+	conns    uint32             // The failures after which a connection is dropped.
+	blockFor time.Duration      // The duration of the block.
+	counters sync.Map           // The failure counters, by address.
+	blocked  sync.Map           // The local blocklist, used without a cluster.
+	failures int64              // The total number of authorization failures.
+	refused  int64              // The total number of attempts refused due to a block.
+}
+
+// counter represents the failures of an address within a minute.
+type counter struct {
+	sync.Mutex
+	minute int64 // The minute the failures are counted for.
+	count  int   // The number of failures.
+}
+
+// New creates a new guard. The zero thresholds are replaced with the defaults.
+func New(cluster service.Replicator, connFailures, addrFailures int, blockFor time.Duration) *Guard {
+	if connFailures <= 0 {
+		connFailures = defaultConnFailures
+	}
+	if addrFailures <= 0 {
+		addrFailures = defaultAddrFailures
+	}
+	if blockFor <= 0 {
+		blockFor = defaultBlockFor
+	}
+
+	return &Guard{
+		cluster:  cluster,
+		limit:    addrFailures,
+		conns:    uint32(connFailures),
+		blockFor: blockFor,
+	}
+}
+
+// OnFailure counts an authorization failure of an address and blocks the address once it
+// fails too often. It returns whether the address was blocked as a result.
+func (g *Guard) OnFailure(addr string) (blocked bool) {
+	if n := atomic.AddInt64(&g.failures, 1); n%pruneEvery == 0 {
+		g.prune()
+	}
+
+	v, _ := g.counters.LoadOrStore(addr, new(counter))
+	c := v.(*counter)
+	c.Lock()
+	defer c.Unlock()
+	if minute := time.Now().Unix() / 60; c.minute != minute {
+		c.minute = minute
+		c.count = 0
+	}
+
+	if c.count++; c.count != g.limit {
+		return false
+	}
+
+	g.block(addr)
+	return true
+}
+
+// IsBlocked checks whether an address is blocked.
+func (g *Guard) IsBlocked(addr string) bool {
+	if g.cluster != nil {
+		return g.cluster.Contains(&event.Block{Addr: addr})
+	}
+
+	v, ok := g.blocked.Load(addr)
+	return ok && v.(int64) > time.Now().Unix()
+}
+
+// Refuse counts a connection or a request which was refused due to a block.
+func (g *Guard) Refuse() {
+	atomic.AddInt64(&g.refused, 1)
+}
+
+// ShouldDrop checks whether a connection with a number of failures should be dropped.
+func (g *Guard) ShouldDrop(failures uint32) bool {
+	return failures >= g.conns
+}
+
+// Delay returns the delay to apply to a connection with a number of failures, which
+// doubles with each failure.
+func (g *Guard) Delay(failures uint32) time.Duration {
+	if failures < delayAfter {
+		return 0
+	}
+
+	if n := failures - delayAfter; n < 6 {
+		if delay := delayBase << n; delay < delayMax {
+			return delay
+		}
+	}
+	return delayMax
+}
+
+// Failures returns the total number of authorization failures.
+func (g *Guard) Failures() int64 {
+	return atomic.LoadInt64(&g.failures)
+}
+
+// Refused returns the total number of attempts refused due to a block.
+func (g *Guard) Refused() int64 {
+	return atomic.LoadInt64(&g.refused)
+}
+
+// block blocks an address, across the cluster if one is configured.
+func (g *Guard) block(addr string) {
+	expires := time.Now().Add(g.blockFor).Unix()
+	if g.cluster != nil {
+		g.cluster.Notify(&event.Block{Addr: addr, Expires: expires}, true)
+		return
+	}
+
+	g.blocked.Store(addr, expires)
+}
+
+// prune removes the stale failure counters and the expired local blocks.
+func (g *Guard) prune() {
+	now := time.Now().Unix()
+	g.counters.Range(func(k, v interface{}) bool {
+		c := v.(*counter)
+		c.Lock()
+		if c.minute != now/60 {
+			g.counters.Delete(k)
+		}
+		c.Unlock()
+		return true
+	})
+
+	g.blocked.Range(func(k, v interface{}) bool {
+		if v.(int64) <= now {
+			g.blocked.Delete(k)
+		}
+		return true
+	})
+}
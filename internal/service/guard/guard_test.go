@@ -0,0 +1,97 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package guard
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/event"
+	"github.com/emitter-io/emitter/internal/service/fake"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGuard_Local(t *testing.T) {
+	g := New(nil, 0, 3, time.Hour)
+	assert.False(t, g.OnFailure("10.0.0.1"))
+	assert.False(t, g.OnFailure("10.0.0.1"))
+	assert.False(t, g.IsBlocked("10.0.0.1"))
+
+	// The third failure should block the address
+	assert.True(t, g.OnFailure("10.0.0.1"))
+	assert.True(t, g.IsBlocked("10.0.0.1"))
+	assert.False(t, g.IsBlocked("10.0.0.2"))
+	assert.Equal(t, int64(3), g.Failures())
+	assert.Zero(t, g.Refused())
+
+	// Only the attempts which are actually refused are counted
+	g.Refuse()
+	assert.Equal(t, int64(1), g.Refused())
+
+	// Blocks should expire
+	g.blocked.Store("10.0.0.1", time.Now().Add(-time.Second).Unix())
+	assert.False(t, g.IsBlocked("10.0.0.1"))
+
+	g.prune()
+	_, ok := g.blocked.Load("10.0.0.1")
+	assert.False(t, ok)
+}
+
+func TestGuard_Cluster(t *testing.T) {
+	cluster := new(fake.Replicator)
+	g := New(cluster, 0, 2, time.Hour)
+	g.OnFailure("10.0.0.1")
+	g.OnFailure("10.0.0.1")
+
+	// The block should be replicated
+	assert.True(t, cluster.Contains(&event.Block{Addr: "10.0.0.1"}))
+	assert.True(t, g.IsBlocked("10.0.0.1"))
+
+	// Another node sharing the blocklist should refuse the address as well
+	other := New(cluster, 0, 0, 0)
+	assert.True(t, other.IsBlocked("10.0.0.1"))
+}
+
+func TestGuard_Delay(t *testing.T) {
+	g := New(nil, 0, 0, 0)
+	assert.Equal(t, time.Duration(0), g.Delay(0))
+	assert.Equal(t, time.Duration(0), g.Delay(2))
+	assert.Equal(t, 100*time.Millisecond, g.Delay(3))
+	assert.Equal(t, 200*time.Millisecond, g.Delay(4))
+	assert.Equal(t, 3200*time.Millisecond, g.Delay(8))
+	assert.Equal(t, 5*time.Second, g.Delay(9))
+	assert.Equal(t, 5*time.Second, g.Delay(1000))
+}
+
+func TestGuard_ShouldDrop(t *testing.T) {
+	g := New(nil, 0, 0, 0)
+	assert.False(t, g.ShouldDrop(defaultConnFailures-1))
+	assert.True(t, g.ShouldDrop(defaultConnFailures))
+
+	g = New(nil, 2, 0, 0)
+	assert.True(t, g.ShouldDrop(2))
+}
+
+func TestGuard_Prune(t *testing.T) {
+	g := New(nil, 0, 0, 0)
+	g.OnFailure("10.0.0.1")
+
+	v, _ := g.counters.Load("10.0.0.1")
+	v.(*counter).minute = 0
+	g.prune()
+
+	_, ok := g.counters.Load("10.0.0.1")
+	assert.False(t, ok)
+}
@@ -16,20 +16,37 @@ package history
 
 import (
 	"encoding/json"
+	"net/http"
 
 	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/event"
 	"github.com/emitter-io/emitter/internal/message"
 	"github.com/emitter-io/emitter/internal/provider/logging"
+	"github.com/emitter-io/emitter/internal/provider/storage"
 	"github.com/emitter-io/emitter/internal/security"
 	"github.com/emitter-io/emitter/internal/service"
-	"github.com/kelindar/binary"
 )
 
 // Request represents a historical messages request.
 type Request struct {
-	Key         string     `json:"key"`     // The channel key for this request.
-	Channel     string     `json:"channel"` // The target channel for this request.
-	StartFromID message.ID `json:"startFromID,omitempty"`
+	Key         string       `json:"key"`     // The channel key for this request.
+	Channel     string       `json:"channel"` // The target channel for this request.
+	StartFromID message.ID   `json:"startFromID,omitempty"`
+	Order       string       `json:"order,omitempty"`  // The order of retrieval, either "desc" (default) or "asc".
+	Delete      bool         `json:"delete,omitempty"` // Whether the messages should be deleted instead.
+	IDs         []message.ID `json:"ids,omitempty"`    // The IDs of the messages to delete, if only these are deleted.
+}
+
+// order returns the requested order of retrieval
+func (r *Request) order() (storage.Order, bool) {
+	switch r.Order {
+	case "", "desc":
+		return storage.Descending, true
+	case "asc":
+		return storage.Ascending, true
+	default:
+		return storage.Descending, false
+	}
 }
 
 type Message struct {
@@ -38,8 +55,10 @@ type Message struct {
 	Payload []byte     `json:"payload"` // The payload of the message
 }
 type Response struct {
-	Request  uint16    `json:"req,omitempty"` // The corresponding request ID.
-	Messages []Message `json:"messages"`      // The history of messages.
+	Request  uint16     `json:"req,omitempty"`    // The corresponding request ID.
+	Messages []Message  `json:"messages"`         // The history of messages, sorted chronologically.
+	Cursor   message.ID `json:"cursor,omitempty"` // The ID to start from for the next page, in the same order.
+	Done     bool       `json:"done"`             // Whether this is the last response for the request.
 }
 
 // ForRequest sets the request ID in the response for matching
@@ -47,6 +66,18 @@ func (r *Response) ForRequest(id uint16) {
 	r.Request = id
 }
 
+// DeleteResponse represents a response to a request to delete historical messages.
+type DeleteResponse struct {
+	Request uint16 `json:"req,omitempty"` // The corresponding request ID.
+	Status  int    `json:"status"`        // The status of the response.
+	Deleted int    `json:"deleted"`       // The number of messages deleted.
+}
+
+// ForRequest sets the request ID in the response for matching
+func (r *DeleteResponse) ForRequest(id uint16) {
+	r.Request = id
+}
+
 // OnRequest handles a request of historical messages.
 func (s *Service) OnRequest(c service.Conn, payload []byte) (service.Response, bool) {
 	var request Request
@@ -54,11 +85,59 @@ func (s *Service) OnRequest(c service.Conn, payload []byte) (service.Response, b
 		return errors.ErrBadRequest, false
 	}
 
+	return s.process(&request)
+}
+
+// OnHTTP occurs when a new HTTP history request is received.
+func (s *Service) OnHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Deserialize the body.
+	var request Request
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	// Process the request and write the status code
+	resp, _ := s.process(&request)
+	if err, ok := resp.(*errors.Error); ok {
+		w.WriteHeader(err.Status)
+	}
+
+	// Write every part of a streamed response, one JSON document per line
+	encoder := json.NewEncoder(w)
+	if stream, ok := resp.(service.Streamer); ok {
+		for part, more := stream.Next(); more; part, more = stream.Next() {
+			encoder.Encode(part)
+		}
+		return
+	}
+
+	encoder.Encode(resp)
+}
+
+// process processes a request of historical messages.
+func (s *Service) process(request *Request) (service.Response, bool) {
 	channel := security.ParseChannel([]byte(request.Channel))
 	if channel.ChannelType == security.ChannelInvalid {
 		return errors.ErrBadRequest, false
 	}
 
+	if request.Delete {
+		return s.delete(request, channel)
+	}
+
+	order, ok := request.order()
+	if !ok {
+		return errors.ErrBadRequest, false
+	}
+
 	// Check the authorization and permissions
 	_, key, allowed := s.auth.Authorize(channel, security.AllowLoad)
 	if !allowed {
@@ -72,25 +151,66 @@ func (s *Service) OnRequest(c service.Conn, payload []byte) (service.Response, b
 		limit = v
 	}
 
+	// Make sure a single request can't retrieve the entire history of a channel
+	if limit > int64(s.maxLast) {
+		limit = int64(s.maxLast)
+	}
+
 	ssid := message.NewSsid(key.Contract(), channel.Query)
 	t0, t1 := channel.Window() // Get the window
+	return &stream{
+		store: s.store,
+		ssid:  ssid,
+		from:  t0,
+		until: t1,
+		order: order,
+		next:  request.StartFromID,
+		left:  int(limit),
+	}, true
+}
 
-	msgs, err := s.store.Query(ssid, t0, t1, request.StartFromID, int(limit))
+// delete deletes the historical messages of a channel, either with a key which allows to
+// store on the channel or with a master key of the contract.
+func (s *Service) delete(request *Request, channel *security.Channel) (service.Response, bool) {
+	var contract uint32
+	if _, key, allowed := s.auth.Authorize(channel, security.AllowStore); allowed {
+		contract = key.Contract()
+	} else if key, ok := s.master(request.Key); ok {
+		contract = key.Contract()
+	} else {
+		return errors.ErrUnauthorized, false
+	}
+
+	// Deleting with wildcards is not supported, since the matching is done on hashes
+	if channel.ChannelType != security.ChannelStatic {
+		return errors.ErrForbidden, false
+	}
+
+	ssid := message.NewSsid(contract, channel.Query)
+	t0, t1 := channel.Window()
+	count, err := s.store.Delete(ssid, t0, t1, request.IDs)
 	if err != nil {
-		logging.LogError("conn", "query last messages", err)
+		logging.LogError("history", "delete messages", err)
 		return errors.ErrServerError, false
 	}
 
-	resp := &Response{
-		Messages: make([]Message, 0, len(msgs)),
+	return &DeleteResponse{
+		Status:  200,
+		Deleted: count,
+	}, true
+}
+
+// master decrypts a master key, which must be accepted by its contract and not banned.
+func (s *Service) master(raw string) (security.Key, bool) {
+	key, err := s.keygen.DecryptKey(raw)
+	if err != nil || !key.IsMaster() || key.IsExpired() {
+		return nil, false
 	}
-	for _, m := range msgs {
-		msg := m
-		resp.Messages = append(resp.Messages, Message{
-			ID:      msg.ID,
-			Channel: binary.ToString(&msg.Channel),
-			Payload: msg.Payload,
-		})
+
+	if s.cluster != nil && s.cluster.Contains(&event.Ban{Target: raw}) {
+		return nil, false
 	}
-	return resp, true
+
+	contract, found := s.contracts.Get(key.Contract())
+	return key, found && contract.Validate(key)
 }
@@ -16,15 +16,32 @@ package history
 
 import (
 	"encoding/json"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/event"
 	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	secmock "github.com/emitter-io/emitter/internal/provider/contract/mock"
 	"github.com/emitter-io/emitter/internal/provider/storage"
 	"github.com/emitter-io/emitter/internal/security"
+	"github.com/emitter-io/emitter/internal/service"
 	"github.com/emitter-io/emitter/internal/service/fake"
 	"github.com/stretchr/testify/assert"
 )
 
+// drain collects every part of a streamed response.
+func drain(resp service.Response) (parts []*Response) {
+	stream := resp.(service.Streamer)
+	for part, more := stream.Next(); more; part, more = stream.Next() {
+		parts = append(parts, part.(*Response))
+	}
+	return
+}
+
 // TestHistory tests the history service.
 func TestHistory(t *testing.T) {
 	ssid := message.Ssid{1, 3238259379, 500706888, 1027807523}
@@ -36,7 +53,7 @@ func TestHistory(t *testing.T) {
 		ExtraPerm: security.AllowLoad,
 	}
 	// Create new service
-	service := New(auth, store)
+	service := New(auth, new(fake.Decryptor), nil, nil, store)
 	connection := &fake.Conn{}
 
 	// The most basic request, on an empty store.
@@ -66,7 +83,7 @@ func TestHistory(t *testing.T) {
 	// The request should have succeeded and returned a response.
 	assert.Equal(t, true, ok)
 	// The response should have returned the last message as per MQTT spec.
-	assert.Equal(t, 1, len(response.(*Response).Messages))
+	assert.Equal(t, 1, len(drain(response)[0].Messages))
 
 	store.Store(&message.Message{
 		ID:      message.NewID(ssid),
@@ -80,5 +97,289 @@ func TestHistory(t *testing.T) {
 	// The request should have succeeded and returned a response.
 	assert.Equal(t, true, ok)
 	// The response should have returned the last 2 messages.
-	assert.Equal(t, 2, len(response.(*Response).Messages))
+	assert.Equal(t, 2, len(drain(response)[0].Messages))
+}
+
+func TestHistory_Order(t *testing.T) {
+	ssid := message.NewSsid(1, security.ParseChannel([]byte("key/a/b/c/")).Query)
+	store := storage.NewInMemory(nil)
+	store.Configure(nil)
+	for _, payload := range []string{"1", "2", "3", "4", "5"} {
+		store.Store(&message.Message{
+			ID:      message.NewID(ssid),
+			Channel: []byte("a/b/c/"),
+			Payload: []byte(payload),
+			TTL:     30,
+		})
+	}
+
+	s := New(&fake.Authorizer{
+		Success:   true,
+		Contract:  1,
+		ExtraPerm: security.AllowLoad,
+	}, new(fake.Decryptor), nil, nil, store)
+
+	// query issues a request and returns the payloads along with the cursor
+	query := func(request Request) ([]string, message.ID) {
+		b, _ := json.Marshal(request)
+		resp, ok := s.OnRequest(new(fake.Conn), b)
+		assert.True(t, ok)
+
+		parts := drain(resp)
+		assert.Len(t, parts, 1)
+
+		var payloads []string
+		for _, m := range parts[0].Messages {
+			payloads = append(payloads, string(m.Payload))
+		}
+		return payloads, parts[0].Cursor
+	}
+
+	// Page forward, from the oldest message
+	out, cursor := query(Request{Channel: "key/a/b/c/?last=2", Order: "asc"})
+	assert.Equal(t, []string{"1", "2"}, out)
+	out, cursor = query(Request{Channel: "key/a/b/c/?last=2", Order: "asc", StartFromID: cursor})
+	assert.Equal(t, []string{"3", "4"}, out)
+
+	// Page backward, from the newest message
+	out, cursor = query(Request{Channel: "key/a/b/c/?last=2", Order: "desc"})
+	assert.Equal(t, []string{"4", "5"}, out)
+	out, cursor = query(Request{Channel: "key/a/b/c/?last=2", StartFromID: cursor})
+	assert.Equal(t, []string{"2", "3"}, out)
+
+	// Turn around and page forward again
+	out, _ = query(Request{Channel: "key/a/b/c/?last=2", Order: "asc", StartFromID: cursor})
+	assert.Equal(t, []string{"3", "4"}, out)
+
+	// Unknown order
+	b, _ := json.Marshal(Request{Channel: "key/a/b/c/", Order: "random"})
+	resp, ok := s.OnRequest(new(fake.Conn), b)
+	assert.False(t, ok)
+	assert.Equal(t, errors.ErrBadRequest, resp)
+}
+
+func TestHistory_Stream(t *testing.T) {
+	ssid := message.NewSsid(1, security.ParseChannel([]byte("key/a/b/c/")).Query)
+	store := storage.NewInMemory(nil)
+	store.Configure(nil)
+	for i := 0; i < 10; i++ {
+		payload := make([]byte, mqtt.MaxMessageSize/4)
+		payload[0] = byte(i)
+		store.Store(&message.Message{
+			ID:      message.NewID(ssid),
+			Channel: []byte("a/b/c/"),
+			Payload: payload,
+			TTL:     30,
+		})
+	}
+
+	s := New(&fake.Authorizer{
+		Success:   true,
+		Contract:  1,
+		ExtraPerm: security.AllowLoad,
+	}, new(fake.Decryptor), nil, nil, store)
+
+	for _, order := range []string{"asc", "desc"} {
+		b, _ := json.Marshal(Request{Channel: "key/a/b/c/?last=9", Order: order})
+		resp, ok := s.OnRequest(new(fake.Conn), b)
+		assert.True(t, ok)
+
+		// Every part must fit into a single message and only the last one is done
+		var received []byte
+		parts := drain(resp)
+		assert.True(t, len(parts) > 1)
+		for i, part := range parts {
+			encoded, _ := json.Marshal(part)
+			assert.True(t, len(encoded) < mqtt.MaxMessageSize)
+			assert.Equal(t, i == len(parts)-1, part.Done)
+			assert.NotEmpty(t, part.Cursor)
+			for _, m := range part.Messages {
+				received = append(received, m.Payload[0])
+			}
+		}
+
+		switch order {
+		case "asc":
+			assert.Equal(t, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8}, received)
+		case "desc":
+			assert.ElementsMatch(t, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9}, received)
+			assert.Equal(t, byte(9), parts[0].Messages[len(parts[0].Messages)-1].Payload[0])
+		}
+	}
+
+	// The number of messages retrieved is capped
+	s.Cap(3)
+	b, _ := json.Marshal(Request{Channel: "key/a/b/c/?last=9", Order: "asc"})
+	resp, _ := s.OnRequest(new(fake.Conn), b)
+	var capped []byte
+	for _, part := range drain(resp) {
+		for _, m := range part.Messages {
+			capped = append(capped, m.Payload[0])
+		}
+	}
+	assert.Equal(t, []byte{0, 1, 2}, capped)
+
+	// The stream fails if the storage fails
+	s = New(&fake.Authorizer{
+		Success:   true,
+		Contract:  1,
+		ExtraPerm: security.AllowLoad,
+	}, new(fake.Decryptor), nil, nil, new(buggyStore))
+
+	b, _ = json.Marshal(Request{Channel: "key/a/b/c/?last=9"})
+	resp, ok := s.OnRequest(new(fake.Conn), b)
+	assert.True(t, ok)
+	next, more := resp.(service.Streamer).Next()
+	assert.True(t, more)
+	assert.Equal(t, errors.ErrServerError, next)
+	_, more = resp.(service.Streamer).Next()
+	assert.False(t, more)
+}
+
+func TestHistory_Delete(t *testing.T) {
+	tests := []struct {
+		request  Request
+		success  bool
+		master   bool
+		banned   bool
+		invalid  bool
+		expected int
+		status   int
+	}{
+		{request: Request{Channel: "key/a/b/c/"}, success: true, expected: 3, status: 200},
+		{request: Request{Channel: "key/a/b/"}, success: true, expected: 4, status: 200},
+		{request: Request{Channel: "key/a/b/c/", Key: "master"}, master: true, expected: 3, status: 200},
+		{request: Request{Channel: "key/a/b/c/", Key: "master"}, master: true, banned: true, status: 401},
+		{request: Request{Channel: "key/a/b/c/", Key: "master"}, master: true, invalid: true, status: 401},
+		{request: Request{Channel: "key/a/b/c/", Key: "other"}, status: 401},
+		{request: Request{Channel: "key/a/+/c/"}, success: true, status: 403},
+		{request: Request{Channel: "key/a/b/c/?from=1999999999"}, success: true, expected: 0, status: 200},
+		{request: Request{Channel: "a"}, success: true, status: 400},
+	}
+
+	for _, tc := range tests {
+		store := storage.NewInMemory(nil)
+		store.Configure(nil)
+
+		// Store 3 messages on the channel and one on another
+		for _, channel := range []string{"a/b/c/", "a/b/c/", "a/b/c/", "a/b/d/"} {
+			store.Store(&message.Message{
+				ID:      message.NewID(message.NewSsid(1, security.ParseChannel([]byte("key/"+channel)).Query)),
+				Channel: []byte(channel),
+				Payload: []byte("hello"),
+				TTL:     30,
+			})
+		}
+
+		permissions := security.AllowRead
+		if tc.master {
+			permissions = security.AllowMaster
+		}
+
+		// The master key must be accepted by its contract and not banned
+		contracts := secmock.NewContractProvider()
+		contracts.On("Get", uint32(1)).Return(&fake.Contract{Invalid: tc.invalid}, true)
+		cluster := new(fake.Replicator)
+		if tc.banned {
+			cluster.Notify(&event.Ban{Target: "master"}, true)
+		}
+
+		s := New(&fake.Authorizer{
+			Success:   tc.success,
+			Contract:  1,
+			ExtraPerm: security.AllowStore,
+		}, &fake.Decryptor{
+			Contract:    1,
+			Permissions: permissions,
+		}, contracts, cluster, store)
+
+		tc.request.Delete = true
+		b, _ := json.Marshal(tc.request)
+		resp, ok := s.OnRequest(new(fake.Conn), b)
+		assert.Equal(t, tc.status == 200, ok)
+		if ok {
+			assert.Equal(t, tc.expected, resp.(*DeleteResponse).Deleted)
+		} else {
+			assert.Equal(t, tc.status, resp.(*errors.Error).Status)
+		}
+	}
+}
+
+func TestHistory_DeleteByID(t *testing.T) {
+	store := storage.NewInMemory(nil)
+	store.Configure(nil)
+	ssid := message.Ssid{1, 3238259379, 500706888, 1027807523}
+	msgs := make([]message.ID, 0, 3)
+	for i := 0; i < 3; i++ {
+		m := &message.Message{
+			ID:      message.NewID(ssid),
+			Channel: []byte("a/b/c/"),
+			Payload: []byte("hello"),
+			TTL:     30,
+		}
+		msgs = append(msgs, m.ID)
+		store.Store(m)
+	}
+
+	s := New(&fake.Authorizer{
+		Success:   true,
+		Contract:  1,
+		ExtraPerm: security.AllowStore,
+	}, new(fake.Decryptor), nil, nil, store)
+
+	// Only the requested message is deleted
+	b, _ := json.Marshal(&Request{
+		Channel: "key/a/b/c/",
+		Delete:  true,
+		IDs:     []message.ID{msgs[1]},
+	})
+
+	resp, ok := s.OnRequest(new(fake.Conn), b)
+	assert.True(t, ok)
+	assert.Equal(t, 1, resp.(*DeleteResponse).Deleted)
+
+	left, err := store.Query(ssid, time.Unix(0, 0), time.Unix(0, 0), nil, storage.Descending, 10)
+	assert.NoError(t, err)
+	assert.Len(t, left, 2)
+}
+
+func TestHistory_OnHTTP(t *testing.T) {
+	store := storage.NewInMemory(nil)
+	store.Configure(nil)
+	s := New(&fake.Authorizer{
+		Success:   true,
+		Contract:  1,
+		ExtraPerm: security.AllowStore,
+	}, new(fake.Decryptor), nil, nil, store)
+
+	tests := []struct {
+		method string
+		body   string
+		status int
+		output string
+	}{
+		{method: "GET", status: 404},
+		{method: "POST", body: "invalid", status: 400},
+		{method: "POST", body: `{"channel":"key/a/+/", "delete":true}`, status: 403},
+		{method: "POST", body: `{"channel":"key/a/b/", "delete":true}`, status: 200, output: `{"status":200,"deleted":0}` + "\n"},
+		{method: "POST", body: `{"channel":"key/a/b/"}`, status: 200, output: `{"messages":[],"done":true}` + "\n"},
+	}
+
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		s.OnHTTP(w, httptest.NewRequest(tc.method, "/history", strings.NewReader(tc.body)))
+		assert.Equal(t, tc.status, w.Code)
+		if tc.output != "" {
+			assert.Equal(t, tc.output, w.Body.String())
+		}
+	}
+}
+
+// buggyStore represents a storage which fails to query.
+type buggyStore struct {
+	storage.Noop
+}
+
+func (s *buggyStore) Query(ssid message.Ssid, from, until time.Time, startFromID message.ID, order storage.Order, limit int) (message.Frame, error) {
+	return nil, errors.ErrServerError
 }
@@ -15,6 +15,7 @@
 package history
 
 import (
+	"github.com/emitter-io/emitter/internal/provider/contract"
 	"github.com/emitter-io/emitter/internal/provider/storage"
 	"github.com/emitter-io/emitter/internal/security/hash"
 	"github.com/emitter-io/emitter/internal/service"
@@ -22,17 +23,33 @@ import (
 
 // Service represents a history service.
 type Service struct {
-	auth     service.Authorizer         // The authorizer to use.
-	store    storage.Storage            // The storage provider to use.
-	handlers map[uint32]service.Handler // The emitter request handlers.
+	auth      service.Authorizer         // The authorizer to use.
+	keygen    service.Decryptor          // The key decryptor to use for master keys.
+	contracts contract.Provider          // The contract provider to validate the master keys with.
+	cluster   service.Replicator         // The cluster service to check the bans with, or nil for a single node.
+	store     storage.Storage            // The storage provider to use.
+	handlers  map[uint32]service.Handler // The emitter request handlers.
+	maxLast   int                        // The maximum number of messages to retrieve per request.
 }
 
 // New creates a new publisher service.
-func New(auth service.Authorizer, store storage.Storage) *Service {
+func New(auth service.Authorizer, keygen service.Decryptor, contracts contract.Provider, cluster service.Replicator, store storage.Storage) *Service {
 	return &Service{
-		auth:     auth,
-		store:    store,
-		handlers: make(map[uint32]service.Handler),
+		auth:      auth,
+		keygen:    keygen,
+		contracts: contracts,
+		cluster:   cluster,
+		store:     store,
+		handlers:  make(map[uint32]service.Handler),
+		maxLast:   storage.MaxLast,
+	}
+}
+
+// Cap sets the maximum number of messages which can be retrieved with a single request.
+// The default one is kept if the maximum is not positive.
+func (s *Service) Cap(maxLast int) {
+	if maxLast > 0 {
+		s.maxLast = maxLast
 	}
 }
 
@@ -0,0 +1,159 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package history
+
+import (
+	"encoding/base64"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/emitter-io/emitter/internal/provider/logging"
+	"github.com/emitter-io/emitter/internal/provider/storage"
+	"github.com/emitter-io/emitter/internal/service"
+	"github.com/kelindar/binary"
+)
+
+const (
+	maxPartSize = mqtt.MaxMessageSize - 1024 // Leave some room for the envelope of the response.
+	overhead    = 48                         // The JSON overhead of a single message.
+)
+
+// stream represents a response of historical messages which is sent in several parts,
+// so that each of them fits into a single message.
+type stream struct {
+	store   storage.Storage // The storage provider to use.
+	ssid    message.Ssid    // The SSID to query.
+	from    time.Time       // The beginning of the time window.
+	until   time.Time       // The end of the time window.
+	order   storage.Order   // The order of retrieval.
+	next    message.ID      // The ID to continue the query from.
+	left    int             // The number of messages left to retrieve.
+	pending message.Frame   // The messages retrieved, but not sent yet.
+	err     error           // The error encountered while retrieving.
+	done    bool            // Whether the last part was sent.
+}
+
+// ForRequest sets the request ID in the response for matching. The ID is set on every
+// part of the stream instead.
+func (s *stream) ForRequest(id uint16) {}
+
+// Next returns the next part of the response, or false once every part was sent.
+func (s *stream) Next() (service.Response, bool) {
+	if s.done {
+		return nil, false
+	}
+
+	// Take the next part of the pending messages and look ahead, so we know whether this
+	// is the last part or not.
+	s.fetch()
+	part := s.take()
+	s.fetch()
+
+	if s.err != nil && len(part) == 0 {
+		logging.LogError("history", "query messages", s.err)
+		s.done = true
+		return errors.ErrServerError, true
+	}
+
+	resp := &Response{
+		Messages: make([]Message, 0, len(part)),
+		Cursor:   cursorOf(part, s.order),
+		Done:     len(s.pending) == 0 && s.err == nil,
+	}
+
+	for _, m := range part {
+		msg := m
+		resp.Messages = append(resp.Messages, Message{
+			ID:      msg.ID,
+			Channel: binary.ToString(&msg.Channel),
+			Payload: msg.Payload,
+		})
+	}
+
+	s.done = resp.Done
+	return resp, true
+}
+
+// fetch retrieves the next page of messages once all of the pending ones were sent. The
+// storage might return fewer messages than requested, so it is queried until it's empty.
+func (s *stream) fetch() {
+	if len(s.pending) > 0 || s.left <= 0 || s.err != nil {
+		return
+	}
+
+	msgs, err := s.store.Query(s.ssid, s.from, s.until, s.next, s.order, s.left)
+	if err != nil {
+		s.err = err
+		return
+	}
+
+	if len(msgs) == 0 {
+		s.left = 0
+		return
+	}
+
+	s.left -= len(msgs)
+	s.next = cursorOf(msgs, s.order)
+	s.pending = msgs
+}
+
+// take takes as many pending messages as fit into a single part, in the order of retrieval.
+func (s *stream) take() (part message.Frame) {
+	// The pages are sorted chronologically, so when going back in time the most
+	// recent messages need to be sent first.
+	descending := s.order == storage.Descending
+	size, n := 0, 0
+	for ; n < len(s.pending); n++ {
+		i := n
+		if descending {
+			i = len(s.pending) - 1 - n
+		}
+
+		if size += sizeOf(&s.pending[i]); size > maxPartSize && n > 0 {
+			break
+		}
+	}
+
+	if descending {
+		split := len(s.pending) - n
+		part, s.pending = s.pending[split:], s.pending[:split]
+		return
+	}
+
+	part, s.pending = s.pending[:n], s.pending[n:]
+	return
+}
+
+// sizeOf estimates the size of the message once encoded in JSON.
+func sizeOf(m *message.Message) int {
+	return base64.StdEncoding.EncodedLen(len(m.ID)) +
+		base64.StdEncoding.EncodedLen(len(m.Payload)) +
+		len(m.Channel) + overhead
+}
+
+// cursorOf returns the ID to continue from after a set of messages sorted chronologically,
+// which is the oldest one when going back in time and the newest one otherwise.
+func cursorOf(msgs message.Frame, order storage.Order) message.ID {
+	switch {
+	case len(msgs) == 0:
+		return nil
+	case order == storage.Ascending:
+		return msgs[len(msgs)-1].ID
+	default:
+		return msgs[0].ID
+	}
+}
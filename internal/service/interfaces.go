@@ -17,6 +17,7 @@ package service
 import (
 	"io"
 
+	"github.com/emitter-io/emitter/internal/errors"
 	"github.com/emitter-io/emitter/internal/event"
 	"github.com/emitter-io/emitter/internal/message"
 	"github.com/emitter-io/emitter/internal/provider/contract"
@@ -28,6 +29,12 @@ type Authorizer interface {
 	Authorize(*security.Channel, uint8) (contract.Contract, security.Key, bool)
 }
 
+// Limiter enforces the rate and volume limits of the contracts and of their keys.
+type Limiter interface {
+	Admit(Conn, contract.Contract, security.Key) *errors.Error
+	Allow(contract.Contract, security.Key, int64) *errors.Error
+}
+
 // PubSub represents a pubsub service.
 type PubSub interface {
 	Publish(*message.Message, func(message.Subscriber) bool) int64
@@ -44,6 +51,13 @@ type Response interface {
 	ForRequest(uint16)
 }
 
+// Streamer represents an emitter response which does not fit into a single message and
+// is sent as a sequence of responses instead.
+type Streamer interface {
+	Response
+	Next() (Response, bool)
+}
+
 // Surveyee handles the surveys.
 type Surveyee interface {
 	OnSurvey(string, []byte) ([]byte, bool)
@@ -54,14 +68,26 @@ type Surveyor interface {
 	Query(string, []byte) (message.Awaiter, error)
 }
 
+// Cluster represents the active members of the cluster, which can be surveyed individually.
+type Cluster interface {
+	ID() uint64
+	Members() []uint64
+	Ask(uint64, string, []byte) (message.Awaiter, error)
+}
+
 // Conn represents a connection interface.
 type Conn interface {
 	io.Closer
 	message.Subscriber
 	CanSubscribe(message.Ssid, []byte) bool
 	CanUnsubscribe(message.Ssid, []byte) bool
+	Grant(message.Ssid, *security.Channel)
+	Admit(contract.Contract, security.Key) *errors.Error
 	LocalID() security.ID
+	Addr() string
 	Username() string
+	ClientID() string
+	Key() string
 	Track(contract.Contract)
 	Links() map[string]string
 	GetLink([]byte) []byte
@@ -74,6 +100,12 @@ type Replicator interface {
 	Contains(event.Event) bool
 }
 
+// Banlist replicates the key bans within the cluster and lists them.
+type Banlist interface {
+	Replicator
+	Bans(func(*event.Ban, event.Value))
+}
+
 // Decryptor decrypts security keys.
 type Decryptor interface {
 	DecryptKey(string) (security.Key, error)
@@ -16,10 +16,15 @@ package keyban
 
 import (
 	"encoding/json"
+	"net/http"
 	"regexp"
+	"sort"
+	"time"
 
 	"github.com/emitter-io/emitter/internal/errors"
 	"github.com/emitter-io/emitter/internal/event"
+	"github.com/emitter-io/emitter/internal/provider/audit"
+	"github.com/emitter-io/emitter/internal/security"
 	"github.com/emitter-io/emitter/internal/service"
 )
 
@@ -31,44 +36,98 @@ var (
 type Service struct {
 	auth    service.Authorizer // The authorizer to use.
 	keygen  service.Decryptor  // The key generator to use.
-	cluster service.Replicator // The cluster service to use.
+	cluster service.Banlist    // The cluster service to use.
+	audit   audit.Auditor      // The audit log to record the bans in.
 }
 
 // New creates a new key blacklisting service.
-func New(auth service.Authorizer, keygen service.Decryptor, cluster service.Replicator) *Service {
+func New(auth service.Authorizer, keygen service.Decryptor, cluster service.Banlist, auditor audit.Auditor) *Service {
 	return &Service{
 		auth:    auth,
 		keygen:  keygen,
 		cluster: cluster,
+		audit:   auditor,
 	}
 }
 
-// OnRequest handles a request to create a link.
+// OnRequest handles a request to ban, unban or list the banned keys.
 func (s *Service) OnRequest(c service.Conn, payload []byte) (service.Response, bool) {
 	var message Request
 	if err := json.Unmarshal(payload, &message); err != nil {
 		return errors.ErrBadRequest, false
 	}
 
+	return s.process(&message, audit.ActorOf(c))
+}
+
+// OnHTTP occurs when a new HTTP key ban request is received.
+func (s *Service) OnHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Deserialize the body.
+	var message Request
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&message); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	// Process the request and write the status code
+	resp, _ := s.process(&message, audit.ActorOfRequest(r))
+	if err, ok := resp.(*errors.Error); ok {
+		w.WriteHeader(err.Status)
+	}
+
+	encoded, _ := json.Marshal(resp)
+	w.Write(encoded)
+}
+
+// process processes a key ban request on behalf of an actor.
+func (s *Service) process(message *Request, actor audit.Actor) (service.Response, bool) {
+
 	// Decrypt the secret/master key and make sure it's not expired
 	secretKey, err := s.keygen.DecryptKey(message.Secret)
 	if err != nil || secretKey.IsExpired() || !secretKey.IsMaster() {
 		return errors.ErrUnauthorized, false
 	}
 
-	// Make sure the target key is for the same contract
-	targetKey, err := s.keygen.DecryptKey(message.Target)
-	if err != nil || targetKey.Contract() != secretKey.Contract() {
-		return errors.ErrUnauthorized, false
+	// If we only need to list the bans, do not ban anything
+	if message.List {
+		return &ListResponse{
+			Status: 200,
+			Bans:   s.list(secretKey.Contract()),
+		}, true
+	}
+
+	// Make sure the target key, or each of the keys of a multi-channel key, is for the same contract
+	for _, target := range security.SplitKey(message.Target) {
+		targetKey, err := s.keygen.DecryptKey(target)
+		if err != nil || targetKey.Contract() != secretKey.Contract() {
+			return errors.ErrUnauthorized, false
+		}
+	}
+
+	// Depending on the flag, ban or unban the key. A ban is always replicated, since
+	// it might be changing the expiration time of an existing one.
+	bannedKey := event.Ban{
+		Target:  message.Target,
+		Expires: message.expires(),
+		Master:  secretKey.Master(),
+		User:    actor.Username,
+		Reason:  message.Reason,
 	}
 
-	// Depending on the flag, ban or unban the key
-	bannedKey := event.Ban(message.Target)
 	switch {
-	case message.Banned && !s.cluster.Contains(&bannedKey):
+	case message.Banned:
 		s.cluster.Notify(&bannedKey, true)
+		s.record(audit.EventBan, actor, secretKey, message)
 	case !message.Banned && s.cluster.Contains(&bannedKey):
 		s.cluster.Notify(&bannedKey, false)
+		s.record(audit.EventUnban, actor, secretKey, message)
 	}
 
 	// Success, return the response
@@ -77,3 +136,40 @@ func (s *Service) OnRequest(c service.Conn, payload []byte) (service.Response, b
 		Banned: message.Banned,
 	}, true
 }
+
+// record records a ban or an unban in the audit log.
+func (s *Service) record(eventType string, actor audit.Actor, secretKey security.Key, message *Request) {
+	s.audit.Record(&audit.Event{
+		Actor:    actor,
+		Type:     eventType,
+		Contract: secretKey.Contract(),
+		Master:   secretKey.Master(),
+		Target:   message.Target,
+		Reason:   message.Reason,
+	})
+}
+
+// list retrieves all of the active bans for a contract.
+func (s *Service) list(contract uint32) []Ban {
+	bans := make([]Ban, 0, 8)
+	s.cluster.Bans(func(ev *event.Ban, v event.Value) {
+		if key, err := s.keygen.DecryptKey(security.SplitKey(ev.Target)[0]); err != nil || key.Contract() != contract {
+			return
+		}
+
+		bans = append(bans, Ban{
+			Target:  ev.Target,
+			Created: time.Unix(0, v.AddTime()).Unix(),
+			Expires: ev.Expires,
+			Master:  ev.Master,
+			User:    ev.User,
+			Reason:  ev.Reason,
+		})
+	})
+
+	// Sort by creation time, so the most recent bans are last
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Created < bans[j].Created
+	})
+	return bans
+}
@@ -15,10 +15,14 @@
 package keyban
 
 import (
+	"bytes"
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/emitter-io/emitter/internal/event"
+	"github.com/emitter-io/emitter/internal/provider/audit"
 	"github.com/emitter-io/emitter/internal/security"
 	"github.com/emitter-io/emitter/internal/service/fake"
 	"github.com/stretchr/testify/assert"
@@ -60,6 +64,31 @@ func TestKeyBan(t *testing.T) {
 				Banned: false,
 			},
 		},
+		{
+			contract1: 1,
+			contract2: 1,
+			perms:     security.AllowMaster,
+			success:   true,
+			expected:  "b",
+			request: &Request{
+				Secret: "a",
+				Target: "b",
+				Banned: true,
+				TTL:    3600,
+			},
+		},
+		{ // Multi-channel key
+			contract1: 1,
+			contract2: 1,
+			perms:     security.AllowMaster,
+			success:   true,
+			expected:  "b:c",
+			request: &Request{
+				Secret: "a",
+				Target: "b:c",
+				Banned: true,
+			},
+		},
 		{
 			contract1: 1,
 			contract2: 2,
@@ -79,10 +108,10 @@ func TestKeyBan(t *testing.T) {
 		}, &fake.Decryptor{
 			Contract:    uint32(tc.contract2),
 			Permissions: tc.perms,
-		}, repl)
+		}, repl, new(fake.Auditor))
 
 		// Fill the replicator
-		initial := event.Ban(tc.initial)
+		initial := event.Ban{Target: tc.initial}
 		repl.Notify(&initial, tc.initial != "")
 
 		// Prepare the request
@@ -92,11 +121,85 @@ func TestKeyBan(t *testing.T) {
 		}
 
 		// Issue a request
-		_, ok := s.OnRequest(nil, b)
+		_, ok := s.OnRequest(new(fake.Conn), b)
 		assert.Equal(t, tc.success, ok)
 
 		// Make sure we have the key if expected
-		expected := event.Ban(tc.expected)
+		expected := event.Ban{Target: tc.expected}
 		assert.Equal(t, tc.expected != "", repl.Contains(&expected))
 	}
 }
+
+func TestKeyBan_List(t *testing.T) {
+	repl := new(fake.Replicator)
+	auditor := new(fake.Auditor)
+	s := New(&fake.Authorizer{
+		Contract: 1,
+		Success:  true,
+	}, &fake.Decryptor{
+		Contract:    1,
+		Permissions: security.AllowMaster,
+	}, repl, auditor)
+
+	// Ban a key with a reason
+	b, _ := json.Marshal(&Request{
+		Secret: "a",
+		Target: "b",
+		Banned: true,
+		Reason: "spam",
+	})
+	_, ok := s.OnRequest(&fake.Conn{ConnID: 5}, b)
+	assert.True(t, ok)
+	assert.Len(t, auditor.Events, 1)
+	assert.Equal(t, audit.EventBan, auditor.Events[0].Type)
+	assert.Equal(t, "user of 5", auditor.Events[0].Username)
+	assert.Equal(t, "b", auditor.Events[0].Target)
+	assert.Equal(t, "spam", auditor.Events[0].Reason)
+
+	// List the bans
+	b, _ = json.Marshal(&Request{
+		Secret: "a",
+		List:   true,
+	})
+	resp, ok := s.OnRequest(new(fake.Conn), b)
+	assert.True(t, ok)
+	assert.Equal(t, []Ban{{
+		Target: "b",
+		User:   "user of 5",
+		Reason: "spam",
+	}}, resp.(*ListResponse).Bans)
+}
+
+func TestKeyBan_OnHTTP(t *testing.T) {
+	tests := []struct {
+		method  string
+		perms   uint8
+		request *Request
+		code    int
+	}{
+		{method: "GET", code: 404},
+		{method: "POST", code: 400},
+		{method: "POST", code: 401, request: &Request{List: true}},
+		{method: "POST", code: 200, perms: security.AllowMaster, request: &Request{List: true}},
+		{method: "POST", code: 200, perms: security.AllowMaster, request: &Request{Target: "b", Banned: true}},
+	}
+
+	for _, tc := range tests {
+		s := New(new(fake.Authorizer), &fake.Decryptor{
+			Contract:    1,
+			Permissions: tc.perms,
+		}, new(fake.Replicator), new(fake.Auditor))
+
+		// Prepare the request
+		b, _ := json.Marshal(tc.request)
+		if tc.request == nil {
+			b = []byte("invalid")
+		}
+
+		req, _ := http.NewRequest(tc.method, "/keyban", bytes.NewBuffer(b))
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(s.OnHTTP)
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, tc.code, rr.Code)
+	}
+}
@@ -14,11 +14,27 @@
 
 package keyban
 
+import (
+	"time"
+)
+
 // Request represents a key ban request.
 type Request struct {
-	Secret string `json:"secret"` // The master key to use.
-	Target string `json:"target"` // The target key to ban.
-	Banned bool   `json:"banned"` // Whether the target should be banned or not.
+	Secret string `json:"secret"`           // The master key to use.
+	Target string `json:"target"`           // The target key to ban.
+	Banned bool   `json:"banned"`           // Whether the target should be banned or not.
+	TTL    int32  `json:"ttl,omitempty"`    // The duration of the ban in seconds, zero for a permanent ban.
+	Reason string `json:"reason,omitempty"` // The optional reason for the ban.
+	List   bool   `json:"list,omitempty"`   // Whether the active bans should be listed instead.
+}
+
+// expires returns the requested expiration time of the ban in unix seconds
+func (m *Request) expires() int64 {
+	if m.TTL <= 0 {
+		return 0
+	}
+
+	return time.Now().Add(time.Duration(m.TTL) * time.Second).Unix()
 }
 
 // ------------------------------------------------------------------------------------
@@ -34,3 +50,27 @@ type Response struct {
 func (r *Response) ForRequest(id uint16) {
 	r.Request = id
 }
+
+// ------------------------------------------------------------------------------------
+
+// ListResponse represents a response with the list of active bans.
+type ListResponse struct {
+	Request uint16 `json:"req,omitempty"`
+	Status  int    `json:"status"` // The status of the response
+	Bans    []Ban  `json:"bans"`   // The active bans for the contract.
+}
+
+// ForRequest sets the request ID in the response for matching
+func (r *ListResponse) ForRequest(id uint16) {
+	r.Request = id
+}
+
+// Ban represents a single active ban.
+type Ban struct {
+	Target  string `json:"target"`            // The banned key.
+	Created int64  `json:"created"`           // The UNIX timestamp of when the ban was issued.
+	Expires int64  `json:"expires,omitempty"` // The UNIX timestamp of when the ban expires.
+	Master  uint16 `json:"master"`            // The identifier of the master key which issued the ban.
+	User    string `json:"user,omitempty"`    // The username of the connection which issued the ban.
+	Reason  string `json:"reason,omitempty"`  // The reason for the ban.
+}
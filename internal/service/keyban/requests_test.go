@@ -16,6 +16,7 @@ package keyban
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -26,3 +27,15 @@ func Test_Response(t *testing.T) {
 	res.ForRequest(1)
 	assert.Equal(t, 1, int(res.Request))
 }
+
+func Test_ListResponse(t *testing.T) {
+	res := new(ListResponse)
+	res.ForRequest(1)
+	assert.Equal(t, 1, int(res.Request))
+}
+
+func TestRequest_Expires(t *testing.T) {
+	assert.Equal(t, int64(0), (&Request{}).expires())
+	assert.Equal(t, int64(0), (&Request{TTL: -1}).expires())
+	assert.InDelta(t, time.Now().Unix()+60, (&Request{TTL: 60}).expires(), 1)
+}
@@ -22,6 +22,7 @@ import (
 	"text/template"
 	"time"
 
+	"github.com/emitter-io/emitter/internal/provider/audit"
 	"github.com/emitter-io/emitter/internal/security"
 )
 
@@ -48,9 +49,10 @@ func (s *Service) HTTP() http.HandlerFunc {
 			ok := f.parse(r)
 			if ok {
 				if f.isValid() {
-					key, err := s.CreateKey(f.Key, f.Channel, f.access(), f.expires())
+					key, err := s.createKey(audit.ActorOfRequest(r), f.Key, f.Channel, f.access(), f.expires())
 					if err != nil {
 						f.Response = err.Error()
+						w.WriteHeader(err.Status)
 					} else {
 						f.Response = fmt.Sprintf("channel: %s\nkey    : %s", f.Channel, key)
 					}
@@ -25,6 +25,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/emitter-io/emitter/internal/provider/audit"
 	"github.com/emitter-io/emitter/internal/provider/contract"
 	"github.com/emitter-io/emitter/internal/provider/usage"
 	"github.com/emitter-io/emitter/internal/security/license"
@@ -42,7 +43,7 @@ func newTestProvider(t *testing.T) *Service {
 	assert.NoError(t, err)
 
 	provider := contract.NewSingleContractProvider(l, usage.NewNoop())
-	return New(cipher, provider, &authorizer{cipher, provider})
+	return New(cipher, provider, &authorizer{cipher, provider}, audit.NewNoop())
 }
 
 var keyGenResponseM = regexp.MustCompile(`(?s)<pre id="keygenResponse">(?P<response>.*)</pre>`)
@@ -20,10 +20,13 @@ import (
 	"fmt"
 	"math"
 	"math/big"
+	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/provider/audit"
 	"github.com/emitter-io/emitter/internal/provider/contract"
 	"github.com/emitter-io/emitter/internal/security"
 	"github.com/emitter-io/emitter/internal/security/hash"
@@ -31,19 +34,34 @@ import (
 	"github.com/emitter-io/emitter/internal/service"
 )
 
+const (
+	maxBatchSize  = 64 * 1024      // The maximum size of a batch response, so it fits into a single message.
+	maxBatchKeys  = 1000           // The maximum number of keys which can be requested in a single batch.
+	maxResultSize = 128            // The space reserved for the key or the error of each result in a batch.
+	retiredWindow = 24 * time.Hour // The period a key decrypted with a retired cipher is considered in use for.
+)
+
 // Service represents a key generation service.
 type Service struct {
-	cipher license.Cipher     // Cipher to use for the key generation
-	loader contract.Provider  // Contract loader to use to retrieve contracts
-	auth   service.Authorizer // The authorizer to use.
+	cipher  license.Cipher         // Cipher to use for the key generation
+	retired []license.Cipher       // Ciphers of the retired licenses, used for decryption only
+	used    []map[string]time.Time // The keys decrypted with each retired cipher, by the time last seen
+	lock    sync.Mutex             // The lock protecting the keys in use
+	loader  contract.Provider      // Contract loader to use to retrieve contracts
+	auth    service.Authorizer     // The authorizer to use.
+	audit   audit.Auditor          // The audit log to record the generated keys in.
 }
 
-// New creates a new key generation provider.
-func New(cipher license.Cipher, loader contract.Provider, auth service.Authorizer) *Service {
+// New creates a new key generation provider. New keys are always encrypted with the primary
+// cipher, while the keys encrypted with any of the retired ciphers can still be decrypted.
+func New(cipher license.Cipher, loader contract.Provider, auth service.Authorizer, auditor audit.Auditor, retired ...license.Cipher) *Service {
 	return &Service{
-		cipher: cipher,
-		loader: loader,
-		auth:   auth,
+		cipher:  cipher,
+		retired: retired,
+		used:    newUsed(len(retired)),
+		loader:  loader,
+		auth:    auth,
+		audit:   auditor,
 	}
 }
 
@@ -54,6 +72,17 @@ func (s *Service) OnRequest(c service.Conn, payload []byte) (service.Response, b
 		return errors.ErrBadRequest, false
 	}
 
+	// If a batch was requested, create all of the keys at once
+	actor := audit.ActorOf(c)
+	if len(message.Batch) > 0 {
+		return s.createBatch(actor, &message)
+	}
+
+	// If several channels were requested, create a multi-channel key
+	if len(message.Channels) > 0 {
+		return s.createMultiKey(actor, &message)
+	}
+
 	// Decrypt the parent key and make sure it's not expired
 	parentKey, err := s.DecryptKey(message.Key)
 	if err != nil || parentKey.IsExpired() {
@@ -62,7 +91,7 @@ func (s *Service) OnRequest(c service.Conn, payload []byte) (service.Response, b
 
 	// If the key provided is a master key, create a new key
 	if parentKey.IsMaster() {
-		key, err := s.CreateKey(message.Key, message.Channel, message.access(), message.expires())
+		key, err := s.createKey(actor, message.Key, message.Channel, message.access(), message.expires())
 		if err != nil {
 			return err, false
 		}
@@ -94,9 +123,205 @@ func (s *Service) OnRequest(c service.Conn, payload []byte) (service.Response, b
 	return errors.ErrUnauthorized, false
 }
 
-// DecryptKey decrypts a key and returns it
+// OnHTTP occurs when a new HTTP batch key generation request is received.
+func (s *Service) OnHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Deserialize the body.
+	var message Request
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&message); err != nil || len(message.Batch) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	// Process the request and write the status code
+	resp, _ := s.createBatch(audit.ActorOfRequest(r), &message)
+	if err, ok := resp.(*errors.Error); ok {
+		w.WriteHeader(err.Status)
+	}
+
+	encoded, _ := json.Marshal(resp)
+	w.Write(encoded)
+}
+
+// createBatch creates the keys of a batch, starting at the requested offset, until the
+// response reaches its maximum size.
+func (s *Service) createBatch(actor audit.Actor, message *Request) (service.Response, bool) {
+	masterKey, err := s.DecryptKey(message.Key)
+	if err != nil || !masterKey.IsMaster() || masterKey.IsExpired() {
+		return errors.ErrUnauthorized, false
+	}
+
+	if len(message.Batch) > maxBatchKeys || message.Offset < 0 || message.Offset >= len(message.Batch) {
+		return errors.ErrBadRequest, false
+	}
+
+	// Reserve some space for the envelope of the response
+	size := 128
+	resp := &BatchResponse{
+		Status: 200,
+		Keys:   make([]Result, 0, len(message.Batch)-message.Offset),
+	}
+
+	for i := message.Offset; i < len(message.Batch); i++ {
+		item := message.Batch[i]
+
+		// Stop before the response is full and let the caller request the next page, so
+		// that no key is created without being returned
+		if size += sizeOf(item.Channel); size > maxBatchSize && len(resp.Keys) > 0 {
+			resp.Next = i
+			break
+		}
+
+		result := Result{Status: 200, Channel: item.Channel}
+		if key, err := s.createKey(actor, message.Key, item.Channel, item.access(), item.expires()); err != nil {
+			result.Status = err.Status
+			result.Message = err.Message
+		} else {
+			result.Key = key
+		}
+
+		resp.Keys = append(resp.Keys, result)
+	}
+
+	return resp, true
+}
+
+// sizeOf returns the maximum size of an encoded result of a batch for a channel.
+func sizeOf(channel string) int {
+	encoded, _ := json.Marshal(&Result{Status: 200, Channel: channel})
+	return len(encoded) + len(`,"message":""`) + maxResultSize + 1
+}
+
+// createMultiKey creates a key for each of the requested channels and joins them into a
+// single multi-channel key. The channels which do not specify a TTL use the TTL of the request.
+func (s *Service) createMultiKey(actor audit.Actor, message *Request) (service.Response, bool) {
+	if len(message.Channels) > security.MaxKeys {
+		return errors.ErrBadRequest, false
+	}
+
+	keys := make([]string, 0, len(message.Channels))
+	channels := make([]string, 0, len(message.Channels))
+	for _, item := range message.Channels {
+		expires := item.expires()
+		if item.TTL == 0 {
+			expires = message.expires()
+		}
+
+		key, err := s.createKey(actor, message.Key, item.Channel, item.access(), expires)
+		if err != nil {
+			return err, false
+		}
+
+		keys = append(keys, key)
+		channels = append(channels, item.Channel)
+	}
+
+	return &Response{
+		Status:   200,
+		Key:      security.JoinKeys(keys...),
+		Channels: channels,
+	}, true
+}
+
+// DecryptKeyFor decrypts a multi-channel key and returns the first of its keys which grants
+// the permission on the channel. All of the keys must be issued for the same contract and
+// none of them can be repeated.
+func (s *Service) DecryptKeyFor(raw string, channel *security.Channel, permission uint8) (security.Key, error) {
+	parts := security.SplitKey(raw)
+	if len(parts) > security.MaxKeys {
+		return nil, errors.ErrUnauthorized
+	}
+
+	var found, first security.Key
+	seen := make(map[string]struct{}, len(parts))
+	for _, part := range parts {
+		if _, ok := seen[part]; ok {
+			return nil, errors.ErrUnauthorized
+		}
+		seen[part] = struct{}{}
+
+		key, err := s.DecryptKey(part)
+		if err != nil {
+			return nil, err
+		}
+
+		// Make sure the keys were not put together from different contracts
+		if first == nil {
+			first = key
+		} else if key.Contract() != first.Contract() {
+			return nil, errors.ErrUnauthorized
+		}
+
+		if found == nil && !key.IsExpired() && key.HasPermission(permission) && key.ValidateChannel(channel) {
+			found = key
+		}
+	}
+
+	if found == nil {
+		return nil, errors.ErrUnauthorized
+	}
+	return found, nil
+}
+
+// DecryptKey decrypts a key and returns it. If retired ciphers are configured and the key
+// decrypted with the primary cipher is not accepted by its contract, each of the retired
+// ciphers is attempted in turn.
 func (s *Service) DecryptKey(key string) (security.Key, error) {
-	return s.cipher.DecryptKey([]byte(key))
+	primary, err := s.cipher.DecryptKey([]byte(key))
+	if len(s.retired) == 0 || (err == nil && s.isValid(primary)) {
+		return primary, err
+	}
+
+	for i, cipher := range s.retired {
+		if k, err := cipher.DecryptKey([]byte(key)); err == nil && s.isValid(k) {
+			s.lock.Lock()
+			s.used[i][key] = time.Now()
+			s.lock.Unlock()
+			return k, nil
+		}
+	}
+
+	return primary, err
+}
+
+// RetiredKeys returns the number of distinct keys decrypted with each of the retired ciphers
+// during the last day. Once it drops to zero, the retired license can be safely removed.
+func (s *Service) RetiredKeys() []int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	expired := time.Now().Add(-retiredWindow)
+	counts := make([]int, len(s.used))
+	for i, keys := range s.used {
+		for k, seen := range keys {
+			if seen.Before(expired) {
+				delete(keys, k)
+			}
+		}
+		counts[i] = len(keys)
+	}
+	return counts
+}
+
+// newUsed creates the sets of keys in use for each of the retired ciphers.
+func newUsed(n int) []map[string]time.Time {
+	used := make([]map[string]time.Time, n)
+	for i := range used {
+		used[i] = make(map[string]time.Time)
+	}
+	return used
+}
+
+// isValid checks whether a decrypted key is accepted by its contract.
+func (s *Service) isValid(key security.Key) bool {
+	contract, ok := s.loader.Get(key.Contract())
+	return ok && contract.Validate(key)
 }
 
 // EncryptKey encrypts the security key
@@ -106,6 +331,11 @@ func (s *Service) EncryptKey(key security.Key) (string, error) {
 
 // CreateKey generates a key with the specified access and expiration time.
 func (s *Service) CreateKey(rawMasterKey, channel string, access uint8, expires time.Time) (string, *errors.Error) {
+	return s.createKey(audit.Actor{}, rawMasterKey, channel, access, expires)
+}
+
+// createKey generates a key on behalf of an actor and records it in the audit log.
+func (s *Service) createKey(actor audit.Actor, rawMasterKey, channel string, access uint8, expires time.Time) (string, *errors.Error) {
 	masterKey, err := s.DecryptKey(rawMasterKey)
 	if err != nil || !masterKey.IsMaster() || masterKey.IsExpired() {
 		return "", errors.ErrUnauthorized
@@ -158,6 +388,14 @@ func (s *Service) CreateKey(rawMasterKey, channel string, access uint8, expires
 		return "", errors.ErrServerError
 	}
 
+	s.audit.Record(&audit.Event{
+		Actor:    actor,
+		Type:     audit.EventKeygen,
+		Contract: key.Contract(),
+		Master:   key.Master(),
+		Channel:  channel,
+		Access:   security.FormatAccess(key.Permissions()),
+	})
 	return out, nil
 }
 
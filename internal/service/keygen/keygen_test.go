@@ -15,12 +15,16 @@
 package keygen
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/provider/audit"
 	"github.com/emitter-io/emitter/internal/provider/contract"
 	secmock "github.com/emitter-io/emitter/internal/provider/contract/mock"
 	"github.com/emitter-io/emitter/internal/provider/usage"
@@ -81,7 +85,7 @@ func TestKeyGen_Request(t *testing.T) {
 		s := New(cipher, provider, &fake.Authorizer{
 			Contract: uint32(tc.contract),
 			Success:  tc.contract != 0,
-		})
+		}, audit.NewNoop())
 
 		// Prepare the request
 		b, _ := json.Marshal(tc.request)
@@ -162,7 +166,7 @@ func TestExtendKey(t *testing.T) {
 			contract.On("Stats").Return(usage.NewMeter(0))
 			provider.On("Get", mock.Anything).Return(contract, tc.contractFound)
 			cipher, _ := license.Cipher()
-			p := New(cipher, provider, &authorizer{cipher, provider})
+			p := New(cipher, provider, &authorizer{cipher, provider}, audit.NewNoop())
 
 			channel, err := p.ExtendKey(tc.key, tc.channel, "ID", tc.access, tc.expires)
 			if tc.err != nil {
@@ -246,7 +250,7 @@ func TestCreateKey(t *testing.T) {
 			contract.On("Stats").Return(usage.NewMeter(0))
 			provider.On("Get", mock.Anything).Return(contract, tc.contractFound)
 			cipher, _ := license.Cipher()
-			p := New(cipher, provider, &authorizer{cipher, provider})
+			p := New(cipher, provider, &authorizer{cipher, provider}, audit.NewNoop())
 
 			_, err := p.CreateKey(tc.key, tc.channel, tc.access, tc.expires)
 			if tc.err != nil {
@@ -280,3 +284,263 @@ func (a *authorizer) Authorize(channel *security.Channel, permission uint8) (con
 	// Return the contract and the key
 	return contract, key, true
 }
+
+func TestDecryptKey_Retired(t *testing.T) {
+	primary := license.NewV3()
+	primaryCipher, _ := primary.Cipher()
+	retired, _ := license.Parse(keygenTestLicense)
+	retiredCipher, _ := retired.Cipher()
+
+	provider := contract.NewSingleContractProvider(primary, usage.NewNoop(), retired)
+	s := New(primaryCipher, provider, new(fake.Authorizer), audit.NewNoop(), retiredCipher)
+
+	// A key issued with the retired license should still be decrypted
+	key, err := s.DecryptKey(keygenTestSecret)
+	assert.NoError(t, err)
+	assert.True(t, key.IsMaster())
+	assert.Equal(t, retired.Contract(), key.Contract())
+	assert.Equal(t, []int{1}, s.RetiredKeys())
+
+	// The same key decrypted again is still a single key in use
+	_, err = s.DecryptKey(keygenTestSecret)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1}, s.RetiredKeys())
+
+	// A key issued with the primary license should not count towards the retired usage
+	master, _ := primary.NewMasterKey(1)
+	encrypted, _ := primaryCipher.EncryptKey(master)
+	key, err = s.DecryptKey(encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, primary.Contract(), key.Contract())
+	assert.Equal(t, []int{1}, s.RetiredKeys())
+
+	// The keys which were not seen recently are no longer in use
+	s.used[0][keygenTestSecret] = time.Now().Add(-2 * retiredWindow)
+	assert.Equal(t, []int{0}, s.RetiredKeys())
+
+	// New keys should be encrypted with the primary cipher
+	created, cerr := s.CreateKey(keygenTestSecret, "a/b/", security.AllowRead, time.Unix(0, 0))
+	assert.Nil(t, cerr)
+	key, err = primaryCipher.DecryptKey([]byte(created))
+	assert.NoError(t, err)
+	assert.Equal(t, retired.Contract(), key.Contract())
+}
+
+func newTestService() *Service {
+	license, _ := license.Parse(keygenTestLicense)
+	cipher, _ := license.Cipher()
+	provider := secmock.NewContractProvider()
+	provider.On("Get", mock.Anything).Return(&fake.Contract{}, true)
+	return New(cipher, provider, new(fake.Authorizer), audit.NewNoop())
+}
+
+func TestKeyGen_Batch(t *testing.T) {
+	s := newTestService()
+	b, _ := json.Marshal(&Request{
+		Key: keygenTestSecret,
+		Batch: []Item{
+			{Channel: "a/", Type: "rw"},
+			{Channel: "b/", Type: "r", TTL: 60},
+			{Channel: "c", Type: "r"},
+		},
+	})
+
+	resp, ok := s.OnRequest(&fake.Conn{ConnID: 1}, b)
+	assert.True(t, ok)
+
+	batch := resp.(*BatchResponse)
+	assert.Equal(t, 200, batch.Status)
+	assert.Equal(t, 0, batch.Next)
+	assert.Len(t, batch.Keys, 3)
+	assert.Equal(t, 200, batch.Keys[0].Status)
+	assert.NotEmpty(t, batch.Keys[0].Key)
+	assert.Equal(t, "b/", batch.Keys[1].Channel)
+	assert.NotEmpty(t, batch.Keys[1].Key)
+	assert.Equal(t, errors.ErrTargetInvalid.Status, batch.Keys[2].Status)
+	assert.Equal(t, errors.ErrTargetInvalid.Message, batch.Keys[2].Message)
+	assert.Empty(t, batch.Keys[2].Key)
+
+	key, err := s.DecryptKey(batch.Keys[1].Key)
+	assert.NoError(t, err)
+	assert.Equal(t, security.AllowRead, key.Permissions())
+	assert.False(t, key.Expires().Equal(time.Unix(0, 0)))
+}
+
+func TestKeyGen_Audit(t *testing.T) {
+	s := newTestService()
+	auditor := new(fake.Auditor)
+	s.audit = auditor
+
+	b, _ := json.Marshal(&Request{Key: keygenTestSecret, Channel: "a/b/", Type: "rw"})
+	_, ok := s.OnRequest(&fake.Conn{ConnID: 1}, b)
+	assert.True(t, ok)
+	assert.Equal(t, []audit.Event{{
+		Actor: audit.Actor{
+			Addr:     "127.0.0.1",
+			Username: "user of 1",
+			ClientID: "client of 1",
+		},
+		Type:     audit.EventKeygen,
+		Contract: 989603869,
+		Master:   1,
+		Channel:  "a/b/",
+		Access:   "rw",
+	}}, auditor.Events)
+}
+
+func TestKeyGen_BatchPaging(t *testing.T) {
+	s := newTestService()
+	auditor := new(fake.Auditor)
+	s.audit = auditor
+	request := &Request{Key: keygenTestSecret}
+	for i := 0; i < maxBatchKeys; i++ {
+		request.Batch = append(request.Batch, Item{Channel: fmt.Sprintf("device/%d/", i), Type: "rw"})
+	}
+
+	// Request all of the pages
+	var keys []Result
+	for {
+		resp, ok := s.createBatch(audit.Actor{}, request)
+		assert.True(t, ok)
+
+		encoded, _ := json.Marshal(resp)
+		assert.Less(t, len(encoded), maxBatchSize)
+
+		batch := resp.(*BatchResponse)
+		keys = append(keys, batch.Keys...)
+		if batch.Next == 0 {
+			break
+		}
+
+		assert.Equal(t, len(keys), batch.Next)
+		request.Offset = batch.Next
+	}
+
+	assert.Len(t, keys, maxBatchKeys)
+	assert.Equal(t, "device/999/", keys[999].Channel)
+
+	// Only the keys which were returned are created
+	assert.Len(t, auditor.Events, maxBatchKeys)
+}
+
+func TestKeyGen_BatchErrors(t *testing.T) {
+	s := newTestService()
+
+	// Not a master key
+	channelKey, _ := s.CreateKey(keygenTestSecret, "a/", security.AllowRead, time.Unix(0, 0))
+	_, ok := s.createBatch(audit.Actor{}, &Request{Key: channelKey, Batch: []Item{{Channel: "a/"}}})
+	assert.False(t, ok)
+
+	// Invalid offset
+	_, ok = s.createBatch(audit.Actor{}, &Request{Key: keygenTestSecret, Batch: []Item{{Channel: "a/"}}, Offset: 1})
+	assert.False(t, ok)
+
+	// Too many keys
+	_, ok = s.createBatch(audit.Actor{}, &Request{Key: keygenTestSecret, Batch: make([]Item, maxBatchKeys+1)})
+	assert.False(t, ok)
+}
+
+func TestKeyGen_OnHTTP(t *testing.T) {
+	tests := []struct {
+		method  string
+		request *Request
+		code    int
+	}{
+		{method: "GET", code: 404},
+		{method: "POST", code: 400},
+		{method: "POST", code: 400, request: &Request{Key: keygenTestSecret}},
+		{method: "POST", code: 401, request: &Request{Key: "invalid", Batch: []Item{{Channel: "a/"}}}},
+		{method: "POST", code: 200, request: &Request{Key: keygenTestSecret, Batch: []Item{{Channel: "a/"}}}},
+	}
+
+	for _, tc := range tests {
+		s := newTestService()
+
+		// Prepare the request
+		b, _ := json.Marshal(tc.request)
+		if tc.request == nil {
+			b = []byte("invalid")
+		}
+
+		req, _ := http.NewRequest(tc.method, "/keygen/batch", bytes.NewBuffer(b))
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(s.OnHTTP)
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, tc.code, rr.Code)
+	}
+}
+
+func TestKeyGen_MultiKey(t *testing.T) {
+	s := newTestService()
+	b, _ := json.Marshal(&Request{
+		Key: keygenTestSecret,
+		TTL: 60,
+		Channels: []Item{
+			{Channel: "users/1/#/", Type: "r"},
+			{Channel: "commands/1/", Type: "w"},
+			{Channel: "rooms/", Type: "p", TTL: 3600},
+		},
+	})
+
+	resp, ok := s.OnRequest(&fake.Conn{ConnID: 1}, b)
+	assert.True(t, ok)
+
+	multi := resp.(*Response)
+	assert.Equal(t, 200, multi.Status)
+	assert.Equal(t, []string{"users/1/#/", "commands/1/", "rooms/"}, multi.Channels)
+	assert.True(t, security.IsMultiKey(multi.Key))
+	assert.Len(t, security.SplitKey(multi.Key), 3)
+
+	tests := []struct {
+		channel    string
+		permission uint8
+		expected   uint8
+	}{
+		{channel: "users/1/inbox/", permission: security.AllowRead, expected: security.AllowRead},
+		{channel: "users/1/inbox/", permission: security.AllowWrite},
+		{channel: "users/2/inbox/", permission: security.AllowRead},
+		{channel: "commands/1/", permission: security.AllowWrite, expected: security.AllowWrite},
+		{channel: "commands/1/", permission: security.AllowRead},
+		{channel: "rooms/", permission: security.AllowPresence, expected: security.AllowPresence},
+	}
+
+	for _, tc := range tests {
+		channel := security.ParseChannel([]byte(multi.Key + "/" + tc.channel))
+		key, err := s.DecryptKeyFor(multi.Key, channel, tc.permission)
+		assert.Equal(t, tc.expected == 0, err != nil, tc.channel)
+		if err == nil {
+			assert.Equal(t, tc.expected, key.Permissions())
+			assert.False(t, key.Expires().Equal(time.Unix(0, 0)))
+		}
+	}
+}
+
+func TestKeyGen_MultiKeyErrors(t *testing.T) {
+	s := newTestService()
+
+	// Invalid channel
+	resp, ok := s.createMultiKey(audit.Actor{}, &Request{Key: keygenTestSecret, Channels: []Item{
+		{Channel: "a/", Type: "r"},
+		{Channel: "b", Type: "r"},
+	}})
+	assert.False(t, ok)
+	assert.Equal(t, errors.ErrTargetInvalid, resp)
+
+	// Too many channels
+	request := &Request{Key: keygenTestSecret}
+	for i := 0; i <= security.MaxKeys; i++ {
+		request.Channels = append(request.Channels, Item{Channel: "a/", Type: "r"})
+	}
+	_, ok = s.createMultiKey(audit.Actor{}, request)
+	assert.False(t, ok)
+
+	// A key which can not be decrypted invalidates the multi-channel key
+	channelKey, _ := s.CreateKey(keygenTestSecret, "a/", security.AllowRead, time.Unix(0, 0))
+	channel := security.ParseChannel([]byte("key/a/"))
+	_, err := s.DecryptKeyFor(security.JoinKeys(channelKey, "invalid"), channel, security.AllowRead)
+	assert.Error(t, err)
+
+	// A key which is repeated invalidates the multi-channel key
+	_, err = s.DecryptKeyFor(security.JoinKeys(channelKey, channelKey), channel, security.AllowRead)
+	assert.Error(t, err)
+}
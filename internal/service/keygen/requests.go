@@ -22,57 +22,87 @@ import (
 
 // Request represents a key generation request.
 type Request struct {
-	Key     string `json:"key"`     // The master key to use.
+	Key      string `json:"key"`                // The master key to use.
+	Channel  string `json:"channel"`            // The channel to create a key for.
+	Type     string `json:"type"`               // The permission set.
+	TTL      int32  `json:"ttl"`                // The TTL of the key.
+	Channels []Item `json:"channels,omitempty"` // The channels of a multi-channel key, each with its own permissions.
+	Batch    []Item `json:"batch,omitempty"`    // The keys to create in a single batch, up to a thousand.
+	Offset   int    `json:"offset,omitempty"`   // The offset in the batch to resume from.
+}
+
+// expires returns the requested expiration time
+func (m *Request) expires() time.Time {
+	return expiresIn(m.TTL)
+}
+
+// access returns the requested level of access
+func (m *Request) access() uint8 {
+	return security.ParseAccess(m.Type)
+}
+
+// Item represents a single key to create as part of a batch.
+type Item struct {
 	Channel string `json:"channel"` // The channel to create a key for.
 	Type    string `json:"type"`    // The permission set.
 	TTL     int32  `json:"ttl"`     // The TTL of the key.
 }
 
 // expires returns the requested expiration time
-func (m *Request) expires() time.Time {
-	if m.TTL == 0 {
-		return time.Unix(0, 0)
-	}
-
-	return time.Now().Add(time.Duration(m.TTL) * time.Second).UTC()
+func (m *Item) expires() time.Time {
+	return expiresIn(m.TTL)
 }
 
 // access returns the requested level of access
-func (m *Request) access() uint8 {
-	required := security.AllowNone
-	for i := 0; i < len(m.Type); i++ {
-		switch c := m.Type[i]; c {
-		case 'r':
-			required |= security.AllowRead
-		case 'w':
-			required |= security.AllowWrite
-		case 's':
-			required |= security.AllowStore
-		case 'l':
-			required |= security.AllowLoad
-		case 'p':
-			required |= security.AllowPresence
-		case 'e':
-			required |= security.AllowExtend
-		case 'x':
-			required |= security.AllowExecute
-		}
+func (m *Item) access() uint8 {
+	return security.ParseAccess(m.Type)
+}
+
+// expiresIn returns the expiration time for a TTL in seconds, zero meaning no expiration.
+func expiresIn(ttl int32) time.Time {
+	if ttl == 0 {
+		return time.Unix(0, 0)
 	}
 
-	return required
+	return time.Now().Add(time.Duration(ttl) * time.Second).UTC()
 }
 
 // ------------------------------------------------------------------------------------
 
 // Response represents a key generation response
 type Response struct {
-	Request uint16 `json:"req,omitempty"`
-	Status  int    `json:"status"`
-	Key     string `json:"key"`
-	Channel string `json:"channel"`
+	Request  uint16   `json:"req,omitempty"`
+	Status   int      `json:"status"`
+	Key      string   `json:"key"`
+	Channel  string   `json:"channel"`
+	Channels []string `json:"channels,omitempty"`
 }
 
 // ForRequest sets the request ID in the response for matching
 func (r *Response) ForRequest(id uint16) {
 	r.Request = id
 }
+
+// ------------------------------------------------------------------------------------
+
+// BatchResponse represents a batch key generation response. If not all of the keys fit into
+// a single response, the next offset to request is provided.
+type BatchResponse struct {
+	Request uint16   `json:"req,omitempty"`
+	Status  int      `json:"status"`
+	Keys    []Result `json:"keys"`           // The results for each of the keys.
+	Next    int      `json:"next,omitempty"` // The offset of the next page, if any.
+}
+
+// ForRequest sets the request ID in the response for matching
+func (r *BatchResponse) ForRequest(id uint16) {
+	r.Request = id
+}
+
+// Result represents a result of a single key generation in a batch.
+type Result struct {
+	Status  int    `json:"status"`            // The status of the key generation.
+	Channel string `json:"channel"`           // The channel the key was created for.
+	Key     string `json:"key,omitempty"`     // The key created.
+	Message string `json:"message,omitempty"` // The error message, if the key was not created.
+}
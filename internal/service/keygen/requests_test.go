@@ -41,3 +41,13 @@ func Test_expires(t *testing.T) {
 	res.ForRequest(1)
 	assert.Equal(t, 1, int(res.Request))
 }
+
+func Test_Item(t *testing.T) {
+	item := &Item{Type: "rw", TTL: 20}
+	assert.Less(t, time.Now().Unix(), item.expires().Unix())
+	assert.Equal(t, 6, int(item.access()))
+
+	res := new(BatchResponse)
+	res.ForRequest(1)
+	assert.Equal(t, 1, int(res.Request))
+}
@@ -0,0 +1,168 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package keyinfo
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/event"
+	"github.com/emitter-io/emitter/internal/provider/contract"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/emitter-io/emitter/internal/service"
+)
+
+// Service represents a key introspection service.
+type Service struct {
+	keygen    service.Decryptor  // The key generator to use.
+	contracts contract.Provider  // The contract provider to use.
+	cluster   service.Replicator // The cluster service to use, or nil for a single node.
+}
+
+// New creates a new key introspection service.
+func New(keygen service.Decryptor, contracts contract.Provider, cluster service.Replicator) *Service {
+	return &Service{
+		keygen:    keygen,
+		contracts: contracts,
+		cluster:   cluster,
+	}
+}
+
+// OnRequest handles a request to introspect a key.
+func (s *Service) OnRequest(c service.Conn, payload []byte) (service.Response, bool) {
+	var message Request
+	if err := json.Unmarshal(payload, &message); err != nil {
+		return errors.ErrBadRequest, false
+	}
+
+	return s.process(&message)
+}
+
+// OnHTTP occurs when a new HTTP key introspection request is received.
+func (s *Service) OnHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Deserialize the body.
+	var message Request
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&message); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	// Process the request and write the status code
+	resp, _ := s.process(&message)
+	if err, ok := resp.(*errors.Error); ok {
+		w.WriteHeader(err.Status)
+	}
+
+	encoded, _ := json.Marshal(resp)
+	w.Write(encoded)
+}
+
+// process processes a key introspection request. The key itself must be provided in the
+// request, which proves that the caller is in possession of it.
+func (s *Service) process(message *Request) (service.Response, bool) {
+	keys := make([]security.Key, 0, 1)
+	for _, raw := range security.SplitKey(message.Key) {
+		key, err := s.keygen.DecryptKey(raw)
+		if err != nil {
+			return errors.ErrUnauthorized, false
+		}
+		keys = append(keys, key)
+	}
+
+	// If a channel was provided, use it to recover the static parts of the target
+	var channel *security.Channel
+	if message.Channel != "" {
+		channel = security.ParseChannel([]byte("key/" + message.Channel))
+	}
+
+	key := keys[0]
+	resp := &Response{
+		Status:      200,
+		Contract:    key.Contract(),
+		Master:      key.Master(),
+		IsMaster:    key.IsMaster(),
+		Permissions: security.FormatAccess(key.Permissions()),
+		Expired:     key.IsExpired(),
+		Banned:      s.isBanned(message.Key),
+	}
+
+	// Check whether the contract of the key accepts it
+	contract, contractFound := s.contracts.Get(key.Contract())
+	resp.Valid = contractFound && contract.Validate(key)
+
+	// A multi-channel key grants its own permissions on each of its channel patterns and
+	// only expires once all of its keys do.
+	if len(keys) > 1 {
+		resp.Permissions = ""
+		for _, k := range keys {
+			resp.IsMaster = resp.IsMaster || k.IsMaster()
+			resp.Expired = resp.Expired && k.IsExpired()
+			resp.Valid = resp.Valid && k.Contract() == key.Contract() && contract.Validate(k)
+			resp.Grants = append(resp.Grants, grantOf(k, channel))
+		}
+		return resp, true
+	}
+
+	// Master keys are not bound to any channel
+	if !key.IsMaster() {
+		resp.Target = key.TargetPattern(channel)
+	}
+
+	if expires := key.Expires(); expires.Unix() > 0 {
+		resp.Expires = expires.Unix()
+	}
+
+	return resp, true
+}
+
+// grantOf describes one of the keys of a multi-channel key.
+func grantOf(key security.Key, channel *security.Channel) Grant {
+	grant := Grant{
+		Target:      key.TargetPattern(channel),
+		Permissions: security.FormatAccess(key.Permissions()),
+		Expired:     key.IsExpired(),
+	}
+
+	if expires := key.Expires(); expires.Unix() > 0 {
+		grant.Expires = expires.Unix()
+	}
+	return grant
+}
+
+// isBanned checks whether the key, or any of the keys a multi-channel key is made of, is banned.
+func (s *Service) isBanned(raw string) bool {
+	if s.cluster == nil {
+		return false
+	}
+
+	if s.cluster.Contains(&event.Ban{Target: raw}) {
+		return true
+	}
+
+	for _, part := range security.SplitKey(raw) {
+		if s.cluster.Contains(&event.Ban{Target: part}) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,197 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package keyinfo
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/event"
+	secmock "github.com/emitter-io/emitter/internal/provider/contract/mock"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/emitter-io/emitter/internal/service/fake"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestKeyInfo(t *testing.T) {
+	tests := []struct {
+		perms    uint8
+		invalid  bool
+		banned   bool
+		found    bool
+		request  *Request
+		expected *Response
+	}{
+		{request: nil},
+		{invalid: true, request: &Request{Key: "a"}},
+		{
+			perms:   security.AllowReadWrite,
+			found:   true,
+			request: &Request{Key: "a"},
+			expected: &Response{
+				Status:      200,
+				Contract:    1,
+				Permissions: "rw",
+				Target:      "?/?/",
+				Valid:       true,
+			},
+		},
+		{
+			perms:   security.AllowRead | security.AllowLoad,
+			banned:  true,
+			request: &Request{Key: "a", Channel: "a/b/"},
+			expected: &Response{
+				Status:      200,
+				Contract:    1,
+				Permissions: "rl",
+				Target:      "a/b/",
+				Banned:      true,
+			},
+		},
+		{
+			perms:   security.AllowReadWrite,
+			found:   true,
+			request: &Request{Key: "a:b"},
+			expected: &Response{
+				Status:   200,
+				Contract: 1,
+				Valid:    true,
+				Grants: []Grant{
+					{Target: "?/?/", Permissions: "rw"},
+					{Target: "?/?/", Permissions: "rw"},
+				},
+			},
+		},
+		{
+			perms:   security.AllowReadWrite,
+			found:   true,
+			banned:  true,
+			request: &Request{Key: "b:a"},
+			expected: &Response{
+				Status:   200,
+				Contract: 1,
+				Valid:    true,
+				Banned:   true,
+				Grants: []Grant{
+					{Target: "?/?/", Permissions: "rw"},
+					{Target: "?/?/", Permissions: "rw"},
+				},
+			},
+		},
+		{
+			perms:   security.AllowMaster,
+			found:   true,
+			request: &Request{Key: "a"},
+			expected: &Response{
+				Status:   200,
+				Contract: 1,
+				IsMaster: true,
+				Valid:    true,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		provider := secmock.NewContractProvider()
+		provider.On("Get", mock.Anything).Return(&fake.Contract{}, tc.found)
+
+		repl := new(fake.Replicator)
+		if tc.banned {
+			repl.Notify(&event.Ban{Target: "a"}, true)
+		}
+
+		s := New(&fake.Decryptor{
+			Contract:    1,
+			Permissions: tc.perms,
+			Target:      "a/b/",
+			Invalid:     tc.invalid,
+		}, provider, repl)
+
+		// Prepare the request
+		b, _ := json.Marshal(tc.request)
+		if tc.request == nil {
+			b = []byte("invalid")
+		}
+
+		// Issue a request
+		resp, ok := s.OnRequest(new(fake.Conn), b)
+		assert.Equal(t, tc.expected != nil, ok)
+		if tc.expected != nil {
+			assert.Equal(t, tc.expected, resp)
+		}
+	}
+}
+
+func TestKeyInfo_Expires(t *testing.T) {
+	provider := secmock.NewContractProvider()
+	provider.On("Get", mock.Anything).Return(&fake.Contract{}, true)
+	s := New(new(expiredDecryptor), provider, nil)
+
+	resp, ok := s.process(&Request{Key: "a"})
+	assert.True(t, ok)
+	assert.Equal(t, int64(1500000000), resp.(*Response).Expires)
+	assert.True(t, resp.(*Response).Expired)
+}
+
+func TestKeyInfo_OnHTTP(t *testing.T) {
+	tests := []struct {
+		method  string
+		invalid bool
+		request *Request
+		code    int
+	}{
+		{method: "GET", code: 404},
+		{method: "POST", code: 400},
+		{method: "POST", code: 401, invalid: true, request: &Request{Key: "a"}},
+		{method: "POST", code: 200, request: &Request{Key: "a"}},
+	}
+
+	for _, tc := range tests {
+		provider := secmock.NewContractProvider()
+		provider.On("Get", mock.Anything).Return(&fake.Contract{}, true)
+		s := New(&fake.Decryptor{
+			Contract: 1,
+			Invalid:  tc.invalid,
+		}, provider, new(fake.Replicator))
+
+		// Prepare the request
+		b, _ := json.Marshal(tc.request)
+		if tc.request == nil {
+			b = []byte("invalid")
+		}
+
+		req, _ := http.NewRequest(tc.method, "/keyinfo", bytes.NewBuffer(b))
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(s.OnHTTP)
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, tc.code, rr.Code)
+	}
+}
+
+type expiredDecryptor struct{}
+
+func (d *expiredDecryptor) DecryptKey(string) (security.Key, error) {
+	key := security.Key(make([]byte, 24))
+	key.SetContract(1)
+	key.SetPermissions(security.AllowRead)
+	key.SetTarget("a/")
+	key.SetExpires(time.Unix(1500000000, 0))
+	return key, nil
+}
@@ -0,0 +1,53 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package keyinfo
+
+// Request represents a key introspection request.
+type Request struct {
+	Key     string `json:"key"`               // The key to introspect.
+	Channel string `json:"channel,omitempty"` // The optional channel used to recover the target.
+}
+
+// ------------------------------------------------------------------------------------
+
+// Response represents a key introspection response.
+type Response struct {
+	Request     uint16  `json:"req,omitempty"`
+	Status      int     `json:"status"`            // The status of the response
+	Contract    uint32  `json:"contract"`          // The contract of the key.
+	Master      uint16  `json:"master"`            // The identifier of the master key of the key.
+	IsMaster    bool    `json:"isMaster"`          // Whether the key is a master key or not.
+	Permissions string  `json:"permissions"`       // The permissions of the key, such as "rwslpex".
+	Target      string  `json:"target,omitempty"`  // The target channel pattern of the key.
+	Expires     int64   `json:"expires,omitempty"` // The UNIX timestamp of when the key expires.
+	Expired     bool    `json:"expired"`           // Whether the key has already expired or not.
+	Valid       bool    `json:"valid"`             // Whether the key is accepted by its contract.
+	Banned      bool    `json:"banned"`            // Whether the key is banned or not.
+	Grants      []Grant `json:"grants,omitempty"`  // The channel patterns of a multi-channel key.
+}
+
+// ForRequest sets the request ID in the response for matching
+func (r *Response) ForRequest(id uint16) {
+	r.Request = id
+}
+
+// Grant represents the permissions one of the keys of a multi-channel key grants on its
+// channel pattern.
+type Grant struct {
+	Target      string `json:"target"`            // The target channel pattern of the key.
+	Permissions string `json:"permissions"`       // The permissions of the key, such as "rwslpex".
+	Expires     int64  `json:"expires,omitempty"` // The UNIX timestamp of when the key expires.
+	Expired     bool   `json:"expired"`           // Whether the key has already expired or not.
+}
@@ -20,6 +20,7 @@ import (
 
 	"github.com/emitter-io/emitter/internal/event"
 	"github.com/emitter-io/emitter/internal/message"
+	access "github.com/emitter-io/emitter/internal/provider/auth"
 	"github.com/emitter-io/emitter/internal/provider/storage"
 	"github.com/emitter-io/emitter/internal/security"
 	"github.com/emitter-io/emitter/internal/service/fake"
@@ -116,7 +117,7 @@ func TestPubSub_LastWill(t *testing.T) {
 		}
 
 		// Issue a request
-		s := New(auth, store, notify, trie)
+		s := New(auth, access.NewNoop(), new(fake.Limiter), store, notify, trie)
 		sub := new(fake.Conn)
 		s.Subscribe(sub, &event.Subscription{
 			Peer:    2,
@@ -130,7 +131,7 @@ func TestPubSub_LastWill(t *testing.T) {
 
 		// Query the storage
 		{
-			msgs, err := store.Query(ssid, time.Unix(0, 0), time.Now(), nil, 100)
+			msgs, err := store.Query(ssid, time.Unix(0, 0), time.Now(), nil, storage.Descending, 100)
 			assert.NoError(t, err)
 			assert.Equal(t, tc.expectStored, len(msgs))
 		}
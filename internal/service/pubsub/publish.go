@@ -15,10 +15,12 @@
 package pubsub
 
 import (
+	"bytes"
 	"encoding/json"
 	"github.com/emitter-io/emitter/internal/errors"
 	"github.com/emitter-io/emitter/internal/message"
 	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/emitter-io/emitter/internal/provider/auth"
 	"github.com/emitter-io/emitter/internal/security"
 	"github.com/emitter-io/emitter/internal/service"
 )
@@ -38,6 +40,9 @@ func (s *Service) Publish(m *message.Message, filter func(message.Subscriber) bo
 // OnPublish is a handler for MQTT Publish events.
 func (s *Service) OnPublish(c service.Conn, packet *mqtt.Publish) *errors.Error {
 	mqttTopic := c.GetLink(packet.Topic)
+	if len(mqttTopic) == 0 || bytes.Equal(mqttTopic, packet.Topic) {
+		mqttTopic = s.TopicOf(c, packet.Topic)
+	}
 
 	// Make sure we have a valid channel
 	channel := security.ParseChannel(mqttTopic)
@@ -67,7 +72,26 @@ func (s *Service) OnPublish(c service.Conn, packet *mqtt.Publish) *errors.Error
 		return errors.ErrUnauthorizedExt
 	}
 
+	// Consult the authorization provider
+	if !s.authorize(c, auth.ActionPublish, channel, key) {
+		return errors.ErrUnauthorized
+	}
+
+	// Make sure the contract allows the network of the client
+	if !contract.Permits(c.Addr()) {
+		return errors.ErrNetworkDenied
+	}
+
+	// Enforce the rate and volume limits of the contract and the key
+	if err := c.Admit(contract, key); err != nil {
+		return err
+	}
+	if err := s.limits.Allow(contract, key, int64(len(packet.Payload))); err != nil {
+		return err
+	}
+
 	// Create a new message
+	s.detect(channel.Channel)
 	msg := message.New(
 		message.NewSsid(key.Contract(), channel.Query),
 		channel.Channel,
@@ -123,6 +147,14 @@ func (s *Service) onEmitterRequest(c service.Conn, channel *security.Channel, pa
 			resp, ok = handle(c, payload)
 		}
 	}
+
+	// Send every part of a streamed response, one after another
+	if stream, ok := resp.(service.Streamer); ok {
+		for part, more := stream.Next(); more; part, more = stream.Next() {
+			sendResponse(c, channel.String(), part, requestID)
+		}
+		resp = nil
+	}
 	return
 }
 
@@ -18,11 +18,15 @@ import (
 	"testing"
 	"time"
 
+	"github.com/emitter-io/emitter/internal/errors"
 	"github.com/emitter-io/emitter/internal/event"
 	"github.com/emitter-io/emitter/internal/message"
 	"github.com/emitter-io/emitter/internal/network/mqtt"
+	access "github.com/emitter-io/emitter/internal/provider/auth"
 	"github.com/emitter-io/emitter/internal/provider/storage"
 	"github.com/emitter-io/emitter/internal/security"
+	"github.com/emitter-io/emitter/internal/security/hash"
+	"github.com/emitter-io/emitter/internal/service"
 	"github.com/emitter-io/emitter/internal/service/fake"
 	"github.com/emitter-io/emitter/internal/service/me"
 	"github.com/kelindar/binary/nocopy"
@@ -106,7 +110,7 @@ func TestPubSub_Publish(t *testing.T) {
 		}
 
 		// Issue a request
-		s := New(auth, store, notify, trie)
+		s := New(auth, access.NewNoop(), new(fake.Limiter), store, notify, trie)
 		sub := new(fake.Conn)
 		s.Subscribe(sub, &event.Subscription{
 			Peer:    2,
@@ -122,13 +126,100 @@ func TestPubSub_Publish(t *testing.T) {
 
 		// Query the storage
 		{
-			msgs, err := store.Query(ssid, time.Unix(0, 0), time.Now(), nil, 100)
+			msgs, err := store.Query(ssid, time.Unix(0, 0), time.Now(), nil, storage.Descending, 100)
 			assert.NoError(t, err)
 			assert.Equal(t, tc.expectStored, len(msgs))
 		}
 	}
 }
 
+func TestPubSub_Publish_Access(t *testing.T) {
+	for _, denied := range []bool{false, true} {
+		acl := &fake.Access{Denied: denied}
+		s := New(&fake.Authorizer{
+			Contract: 1,
+			Success:  true,
+		}, acl, new(fake.Limiter), storage.NewNoop(), new(fake.Notifier), message.NewTrie())
+
+		err := s.OnPublish(new(fake.Conn), &mqtt.Publish{
+			Topic:   []byte("key/a/b/c/"),
+			Payload: []byte("hello"),
+		})
+		assert.Equal(t, denied, err != nil)
+		assert.Equal(t, []access.Request{{
+			Action:   access.ActionPublish,
+			Username: "user of 0",
+			ClientID: "client of 0",
+			Channel:  "a/b/c/",
+			Contract: 1,
+		}}, acl.Requests)
+	}
+}
+
+func TestPubSub_Publish_Detect(t *testing.T) {
+	s := New(&fake.Authorizer{
+		Contract: 1,
+		Success:  true,
+	}, access.NewNoop(), new(fake.Limiter), storage.NewNoop(), new(fake.Notifier), message.NewTrie())
+	detector := message.NewDetector(100)
+	s.Observe(detector)
+
+	// The published channels are observed along with the subscribed ones
+	s.Subscribe(new(fake.Conn), &event.Subscription{
+		Ssid:    message.Ssid{1, hash.OfString("c244")},
+		Channel: []byte("c244/"),
+	})
+	assert.Nil(t, s.OnPublish(new(fake.Conn), &mqtt.Publish{
+		Topic:   []byte("key/c239655/"),
+		Payload: []byte("hello"),
+	}))
+	assert.EqualValues(t, 1, detector.Count())
+}
+
+func TestPubSub_Publish_Limited(t *testing.T) {
+	for _, limited := range []*errors.Error{nil, errors.ErrRateLimited} {
+		trie := message.NewTrie()
+		s := New(&fake.Authorizer{
+			Contract: 1,
+			Success:  true,
+		}, access.NewNoop(), &fake.Limiter{Err: limited}, storage.NewNoop(), new(fake.Notifier), trie)
+
+		// Subscribe a client directly
+		conn := new(fake.Conn)
+		trie.Subscribe(message.NewSsid(1, []uint32{hash.OfString("a")}), conn)
+
+		err := s.OnPublish(new(fake.Conn), &mqtt.Publish{
+			Topic:   []byte("key/a/"),
+			Payload: []byte("hello"),
+		})
+		assert.Equal(t, limited, err)
+		assert.Equal(t, limited == nil, len(conn.Outgoing) == 1)
+	}
+}
+
+func TestPubSub_Publish_Network(t *testing.T) {
+	for _, network := range []string{"127.0.0.1", "10.0.0.1"} {
+		trie := message.NewTrie()
+		s := New(&fake.Authorizer{
+			Contract: 1,
+			Success:  true,
+			Networks: []string{network},
+		}, access.NewNoop(), new(fake.Limiter), storage.NewNoop(), new(fake.Notifier), trie)
+
+		// Subscribe a client directly
+		conn := new(fake.Conn)
+		trie.Subscribe(message.NewSsid(1, []uint32{hash.OfString("a")}), conn)
+
+		denied := network != conn.Addr()
+		err := s.OnPublish(new(fake.Conn), &mqtt.Publish{
+			Topic:   []byte("key/a/"),
+			Payload: []byte("hello"),
+		})
+		assert.Equal(t, denied, err == errors.ErrNetworkDenied)
+		assert.Equal(t, !denied, len(conn.Outgoing) == 1)
+	}
+}
+
 func TestPubSub_Request(t *testing.T) {
 	tests := []struct {
 		contract int           // The contract ID
@@ -159,7 +250,7 @@ func TestPubSub_Request(t *testing.T) {
 		}
 
 		// Issue a request
-		s := New(auth, storage.NewNoop(), new(fake.Notifier), trie)
+		s := New(auth, access.NewNoop(), new(fake.Limiter), storage.NewNoop(), new(fake.Notifier), trie)
 		s.Handle("me", me.New().OnRequest)
 
 		c := new(fake.Conn)
@@ -168,3 +259,70 @@ func TestPubSub_Request(t *testing.T) {
 
 	}
 }
+
+func TestPubSub_Request_Stream(t *testing.T) {
+	s := New(&fake.Authorizer{
+		Contract: 1,
+		Success:  true,
+	}, access.NewNoop(), new(fake.Limiter), storage.NewNoop(), new(fake.Notifier), message.NewTrie())
+	s.Handle("stream", func(service.Conn, []byte) (service.Response, bool) {
+		return &testStream{parts: []service.Response{
+			errors.New("first"),
+			errors.New("second"),
+		}}, true
+	})
+
+	// Every part should be sent as a separate response
+	c := new(fake.Conn)
+	assert.Nil(t, s.OnPublish(c, &mqtt.Publish{
+		Topic: []byte("emitter/stream/"),
+	}))
+	assert.Len(t, c.Outgoing, 2)
+	assert.Contains(t, string(c.Outgoing[0].Payload), "first")
+	assert.Contains(t, string(c.Outgoing[1].Payload), "second")
+}
+
+// testStream represents a response which is sent in several parts.
+type testStream struct {
+	parts []service.Response
+}
+
+func (s *testStream) ForRequest(id uint16) {}
+
+func (s *testStream) Next() (service.Response, bool) {
+	if len(s.parts) == 0 {
+		return nil, false
+	}
+
+	part := s.parts[0]
+	s.parts = s.parts[1:]
+	return part, true
+}
+
+func TestPubSub_Keyless(t *testing.T) {
+	trie := message.NewTrie()
+	s := New(&fake.Authorizer{
+		Contract: 1,
+		Success:  true,
+	}, access.NewNoop(), new(fake.Limiter), storage.NewNoop(), new(fake.Notifier), trie)
+
+	// Only the plain topics of a keyless connection are prefixed with its key
+	c := &fake.Conn{ConnKey: "key"}
+	assert.Equal(t, "key/a/b/c/", string(s.TopicOf(c, []byte("a/b/c/"))))
+	assert.Equal(t, "emitter/me/", string(s.TopicOf(c, []byte("emitter/me/"))))
+	assert.Equal(t, "", string(s.TopicOf(c, nil)))
+	assert.Equal(t, "key/a/", string(s.TopicOf(new(fake.Conn), []byte("key/a/"))))
+
+	// Subscribe and publish using the plain topics, the outgoing topic remains plain
+	assert.Nil(t, s.OnSubscribe(c, []byte("a/b/")))
+	assert.Equal(t, 1, trie.Count())
+	assert.Nil(t, s.OnPublish(c, &mqtt.Publish{
+		Topic:   []byte("a/b/"),
+		Payload: []byte("hello"),
+	}))
+	assert.Len(t, c.Outgoing, 1)
+	assert.Equal(t, "a/b/", string(c.Outgoing[0].Channel))
+
+	assert.Nil(t, s.OnUnsubscribe(c, []byte("a/b/")))
+	assert.Equal(t, 0, trie.Count())
+}
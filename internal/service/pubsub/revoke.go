@@ -0,0 +1,48 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package pubsub
+
+import (
+	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/event"
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/provider/auth"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/emitter-io/emitter/internal/service"
+	"github.com/kelindar/binary/nocopy"
+)
+
+// Reauthorize checks whether the key a subscription was granted with is still authorized
+// and revokes the subscription if it is not, for example once the key has expired, has
+// been banned, its contract was refused or no longer allows the network of the client. The
+// authorization provider is consulted as well, which may refuse the subscription later on.
+func (s *Service) Reauthorize(c service.Conn, ssid message.Ssid, channel *security.Channel) *errors.Error {
+	contract, key, allowed := s.auth.Authorize(channel, security.AllowRead)
+	if allowed && contract.Permits(c.Addr()) && s.authorize(c, auth.ActionSubscribe, channel, key) {
+		return nil
+	}
+
+	// Unsubscribe the client from the channel
+	s.Unsubscribe(c, &event.Subscription{
+		Conn:    c.LocalID(),
+		User:    nocopy.String(c.Username()),
+		Ssid:    ssid,
+		Channel: channel.Channel,
+	})
+
+	err := errors.ErrRevoked.Copy()
+	err.Channel = string(channel.Channel)
+	return err
+}
@@ -0,0 +1,98 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package pubsub
+
+import (
+	"testing"
+
+	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/message"
+	access "github.com/emitter-io/emitter/internal/provider/auth"
+	"github.com/emitter-io/emitter/internal/provider/storage"
+	"github.com/emitter-io/emitter/internal/service/fake"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPubSub_Reauthorize(t *testing.T) {
+	trie := message.NewTrie()
+	auth := &fake.Authorizer{
+		Contract: 1,
+		Success:  true,
+	}
+
+	s := New(auth, access.NewNoop(), new(fake.Limiter), storage.NewNoop(), new(fake.Notifier), trie)
+	c := new(fake.Conn)
+
+	// Subscribe and make sure the key was granted
+	assert.Nil(t, s.OnSubscribe(c, []byte("key/a/b/c/")))
+	assert.Equal(t, 1, trie.Count())
+	assert.Len(t, c.Grants, 1)
+	assert.Equal(t, "key", string(c.Grants[0].Key))
+
+	// While still authorized, nothing should change
+	ssid := message.NewSsid(1, c.Grants[0].Query)
+	assert.Nil(t, s.Reauthorize(c, ssid, c.Grants[0]))
+	assert.Equal(t, 1, trie.Count())
+
+	// Once no longer authorized, the subscription should be revoked
+	auth.Success = false
+	err := s.Reauthorize(c, ssid, c.Grants[0])
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrRevoked.Status, err.Status)
+	assert.Equal(t, "a/b/c/", err.Channel)
+	assert.Equal(t, 0, trie.Count())
+}
+
+func TestPubSub_Reauthorize_Network(t *testing.T) {
+	trie := message.NewTrie()
+	auth := &fake.Authorizer{
+		Contract: 1,
+		Success:  true,
+	}
+
+	s := New(auth, access.NewNoop(), new(fake.Limiter), storage.NewNoop(), new(fake.Notifier), trie)
+	c := new(fake.Conn)
+	assert.Nil(t, s.OnSubscribe(c, []byte("key/a/b/c/")))
+	assert.Equal(t, 1, trie.Count())
+
+	// Once the contract is restricted to other networks, the subscription should be revoked
+	auth.Networks = []string{"10.0.0.1"}
+	ssid := message.NewSsid(1, c.Grants[0].Query)
+	err := s.Reauthorize(c, ssid, c.Grants[0])
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrRevoked.Status, err.Status)
+	assert.Equal(t, 0, trie.Count())
+}
+
+func TestPubSub_Reauthorize_Access(t *testing.T) {
+	trie := message.NewTrie()
+	acl := new(fake.Access)
+	s := New(&fake.Authorizer{
+		Contract: 1,
+		Success:  true,
+	}, acl, new(fake.Limiter), storage.NewNoop(), new(fake.Notifier), trie)
+	c := new(fake.Conn)
+	assert.Nil(t, s.OnSubscribe(c, []byte("key/a/b/c/")))
+	assert.Equal(t, 1, trie.Count())
+
+	// Once the authorization provider refuses the subscription, it should be revoked
+	acl.Denied = true
+	ssid := message.NewSsid(1, c.Grants[0].Query)
+	err := s.Reauthorize(c, ssid, c.Grants[0])
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrRevoked.Status, err.Status)
+	assert.Equal(t, 0, trie.Count())
+	assert.Equal(t, access.ActionSubscribe, acl.Requests[len(acl.Requests)-1].Action)
+}
@@ -15,29 +15,45 @@
 package pubsub
 
 import (
+	"bytes"
+	"fmt"
+
 	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/provider/auth"
+	"github.com/emitter-io/emitter/internal/provider/logging"
 	"github.com/emitter-io/emitter/internal/provider/storage"
+	"github.com/emitter-io/emitter/internal/security"
 	"github.com/emitter-io/emitter/internal/security/hash"
 	"github.com/emitter-io/emitter/internal/service"
 )
 
+// The prefix of the topics of the emitter requests, these never use the key of the connection.
+var emitterPrefix = []byte("emitter/")
+
 // Service represents a publish service.
 type Service struct {
 	auth     service.Authorizer         // The authorizer to use.
+	access   auth.Provider              // The authorization provider to consult.
+	limits   service.Limiter            // The rate and volume limits to enforce.
 	store    storage.Storage            // The storage provider to use.
 	notifier service.Notifier           // The notifier to use.
 	trie     *message.Trie              // The subscription matching trie.
 	handlers map[uint32]service.Handler // The emitter request handlers.
+	detector *message.Detector          // The detector of the channel hash collisions (optional).
+	maxLast  int                        // The maximum number of messages to replay on subscribe.
 }
 
 // New creates a new publisher service.
-func New(auth service.Authorizer, store storage.Storage, notifier service.Notifier, trie *message.Trie) *Service {
+func New(auth service.Authorizer, access auth.Provider, limits service.Limiter, store storage.Storage, notifier service.Notifier, trie *message.Trie) *Service {
 	return &Service{
 		auth:     auth,
+		access:   access,
+		limits:   limits,
 		store:    store,
 		notifier: notifier,
 		trie:     trie,
 		handlers: make(map[uint32]service.Handler),
+		maxLast:  storage.MaxLast,
 	}
 }
 
@@ -45,3 +61,53 @@ func New(auth service.Authorizer, store storage.Storage, notifier service.Notifi
 func (s *Service) Handle(request string, handler service.Handler) {
 	s.handlers[hash.OfString(request)] = handler
 }
+
+// Observe sets the detector the subscribed and published channels are recorded with, so
+// the collisions of their hashes are detected.
+func (s *Service) Observe(detector *message.Detector) {
+	s.detector = detector
+}
+
+// Cap sets the maximum number of messages which can be replayed with the 'last' option of
+// a subscription. The default one is kept if the maximum is not positive.
+func (s *Service) Cap(maxLast int) {
+	if maxLast > 0 {
+		s.maxLast = maxLast
+	}
+}
+
+// detect records the channel with the collision detector and logs the collisions of its
+// hashes with the channels seen before.
+func (s *Service) detect(channel []byte) {
+	if s.detector == nil {
+		return
+	}
+
+	for _, v := range s.detector.Observe(channel) {
+		logging.LogAction("pubsub", fmt.Sprintf("hash collision of '%s' and '%s' (%d)", v.First, v.Second, v.Hash))
+	}
+}
+
+// authorize consults the authorization provider whether the connection is allowed to
+// perform an action on a channel.
+func (s *Service) authorize(c service.Conn, action string, channel *security.Channel, key security.Key) bool {
+	return s.access.Authorize(&auth.Request{
+		Action:   action,
+		Username: c.Username(),
+		ClientID: c.ClientID(),
+		Channel:  string(channel.Channel),
+		Contract: key.Contract(),
+	})
+}
+
+// TopicOf returns the topic along with its key. In the keyless mode, the clients which have
+// presented a key during MQTT connect use plain topics, such as "a/b/c/", which are prefixed
+// with that key. The topics of the emitter requests are left as they are.
+func (s *Service) TopicOf(c service.Conn, topic []byte) []byte {
+	key := c.Key()
+	if key == "" || len(topic) == 0 || bytes.HasPrefix(topic, emitterPrefix) {
+		return topic
+	}
+
+	return append([]byte(key+"/"), topic...)
+}
@@ -16,11 +16,14 @@ package pubsub
 
 import (
 	"bytes"
+	"time"
 
 	"github.com/emitter-io/emitter/internal/errors"
 	"github.com/emitter-io/emitter/internal/event"
 	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/provider/auth"
 	"github.com/emitter-io/emitter/internal/provider/logging"
+	"github.com/emitter-io/emitter/internal/provider/storage"
 	"github.com/emitter-io/emitter/internal/security"
 	"github.com/emitter-io/emitter/internal/service"
 	"github.com/kelindar/binary/nocopy"
@@ -28,6 +31,7 @@ import (
 
 // Subscribe subscribes to a channel.
 func (s *Service) Subscribe(sub message.Subscriber, ev *event.Subscription) bool {
+	s.detect(ev.Channel)
 	if conn, ok := sub.(service.Conn); ok && !conn.CanSubscribe(ev.Ssid, ev.Channel) {
 		return false
 	}
@@ -42,6 +46,7 @@ func (s *Service) Subscribe(sub message.Subscriber, ev *event.Subscription) bool
 
 // OnSubscribe is a handler for MQTT Subscribe events.
 func (s *Service) OnSubscribe(c service.Conn, mqttTopic []byte) *errors.Error {
+	mqttTopic = s.TopicOf(c, mqttTopic)
 
 	// compatibility with paho.mqtt.golang
 	// https://github.com/eclipse/paho.mqtt.golang/blob/master/topic.go#L78
@@ -66,6 +71,21 @@ func (s *Service) OnSubscribe(c service.Conn, mqttTopic []byte) *errors.Error {
 		return errors.ErrUnauthorizedExt
 	}
 
+	// Consult the authorization provider
+	if !s.authorize(c, auth.ActionSubscribe, channel, key) {
+		return errors.ErrUnauthorized
+	}
+
+	// Make sure the contract allows the network of the client
+	if !contract.Permits(c.Addr()) {
+		return errors.ErrNetworkDenied
+	}
+
+	// Enforce the limit of concurrent connections of the contract and the key
+	if err := c.Admit(contract, key); err != nil {
+		return err
+	}
+
 	// Subscribe the client to the channel
 	ssid := message.NewSsid(key.Contract(), channel.Query)
 	s.Subscribe(c, &event.Subscription{
@@ -75,6 +95,9 @@ func (s *Service) OnSubscribe(c service.Conn, mqttTopic []byte) *errors.Error {
 		Channel: channel.Channel,
 	})
 
+	// Keep the key so the subscription can be revoked once it's no longer authorized
+	c.Grant(ssid, channel)
+
 	// Use limit = 1 if not specified, otherwise use the limit option. The limit now
 	// defaults to one as per MQTT spec we always need to send retained messages.
 	limit := int64(1)
@@ -85,20 +108,88 @@ func (s *Service) OnSubscribe(c service.Conn, mqttTopic []byte) *errors.Error {
 	// Check if the key has a load permission (also applies for retained)
 	if key.HasPermission(security.AllowLoad) {
 		t0, t1 := channel.Window() // Get the window
-		msgs, err := s.store.Query(ssid, t0, t1, nil, int(limit))
-		if err != nil {
+		if err := s.load(c, ssid, t0, t1, int(limit)); err != nil {
 			logging.LogError("conn", "query last messages", err)
 			return errors.ErrServerError
 		}
-
-		// Range over the messages in the channel and forward them
-		for _, m := range msgs {
-			msg := m // Copy message
-			c.Send(&msg)
-		}
 	}
 
 	// Write the stats
 	c.Track(contract)
 	return nil
 }
+
+// load sends the last messages of a channel, sorted chronologically. Since the storage might
+// return fewer messages than requested when they don't fit into a single message, the query
+// goes back in time page by page to find the oldest message first and then sends the pages
+// going forward from it, so that only a single page is kept in memory.
+func (s *Service) load(c service.Conn, ssid message.Ssid, from, until time.Time, limit int) error {
+	if limit > s.maxLast {
+		limit = s.maxLast
+	}
+
+	var first message.Frame
+	var oldest message.ID
+	count := 0
+	for count < limit {
+		msgs, err := s.store.Query(ssid, from, until, oldest, storage.Descending, limit-count)
+		if err != nil {
+			return err
+		}
+
+		if len(msgs) == 0 {
+			break
+		}
+
+		if first == nil {
+			first = msgs
+		}
+
+		count += len(msgs)
+		oldest = msgs[0].ID
+	}
+
+	// Most of the replays fit into a single page, which can be sent right away
+	if count == len(first) {
+		send(c, first)
+		return nil
+	}
+
+	// Go forward from the second of the oldest message and skip the ones before it
+	if t := oldest.Time(); t > from.Unix() {
+		from = time.Unix(t, 0)
+	}
+
+	var cursor message.ID
+	for left := count; left > 0; {
+		msgs, err := s.store.Query(ssid, from, until, cursor, storage.Ascending, left)
+		if err != nil {
+			return err
+		}
+
+		if len(msgs) == 0 {
+			break
+		}
+
+		cursor = msgs[len(msgs)-1].ID
+		for len(msgs) > 0 && msgs[0].ID.Before(oldest) {
+			msgs = msgs[1:]
+		}
+
+		if len(msgs) > left {
+			msgs = msgs[:left]
+		}
+
+		left -= len(msgs)
+		send(c, msgs)
+	}
+	return nil
+}
+
+// send forwards the messages to the connection.
+func send(c service.Conn, msgs message.Frame) {
+	for _, m := range msgs {
+		msg := m // Copy message
+		c.Send(&msg)
+	}
+}
@@ -15,11 +15,13 @@
 package pubsub
 
 import (
-	"errors"
 	"testing"
 	"time"
 
+	"github.com/emitter-io/emitter/internal/errors"
 	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	access "github.com/emitter-io/emitter/internal/provider/auth"
 	"github.com/emitter-io/emitter/internal/provider/storage"
 	"github.com/emitter-io/emitter/internal/security"
 	"github.com/emitter-io/emitter/internal/service/fake"
@@ -93,7 +95,7 @@ func TestPubSub_Subscribe(t *testing.T) {
 		}
 
 		// Create new service
-		s := New(auth, store, notify, trie)
+		s := New(auth, access.NewNoop(), new(fake.Limiter), store, notify, trie)
 		c := &fake.Conn{
 			Disabled: tc.disabled,
 		}
@@ -115,6 +117,78 @@ func TestPubSub_Subscribe(t *testing.T) {
 	}
 }
 
+func TestPubSub_Subscribe_Large(t *testing.T) {
+	ssid := message.Ssid{1, 3238259379, 500706888, 1027807523}
+	store := storage.NewInMemory(nil)
+	store.Configure(nil)
+	for i := 0; i < 10; i++ {
+		payload := make([]byte, mqtt.MaxMessageSize/4)
+		payload[0] = byte(i)
+		store.Store(&message.Message{
+			ID:      message.NewID(ssid),
+			Channel: []byte("a/b/c/"),
+			Payload: payload,
+			TTL:     30,
+		})
+	}
+
+	// The messages do not fit into a single query, but all of them should be replayed
+	s := New(&fake.Authorizer{
+		Contract:  1,
+		Success:   true,
+		ExtraPerm: security.AllowLoad,
+	}, access.NewNoop(), new(fake.Limiter), store, new(fake.Notifier), message.NewTrie())
+	c := new(fake.Conn)
+	assert.Nil(t, s.OnSubscribe(c, []byte("key/a/b/c/?last=9")))
+	assert.Len(t, c.Outgoing, 9)
+	for i, m := range c.Outgoing {
+		assert.Equal(t, byte(i+1), m.Payload[0])
+	}
+
+	// The number of messages replayed is capped
+	s.Cap(5)
+	c = new(fake.Conn)
+	assert.Nil(t, s.OnSubscribe(c, []byte("key/a/b/c/?last=9")))
+	assert.Len(t, c.Outgoing, 5)
+	for i, m := range c.Outgoing {
+		assert.Equal(t, byte(i+5), m.Payload[0])
+	}
+}
+
+func TestPubSub_Subscribe_Access(t *testing.T) {
+	for _, denied := range []bool{false, true} {
+		trie := message.NewTrie()
+		acl := &fake.Access{Denied: denied}
+		s := New(&fake.Authorizer{
+			Contract: 1,
+			Success:  true,
+		}, acl, new(fake.Limiter), storage.NewNoop(), new(fake.Notifier), trie)
+
+		err := s.OnSubscribe(new(fake.Conn), []byte("key/a/b/c/"))
+		assert.Equal(t, denied, err != nil)
+		assert.Equal(t, []access.Request{{
+			Action:   access.ActionSubscribe,
+			Username: "user of 0",
+			ClientID: "client of 0",
+			Channel:  "a/b/c/",
+			Contract: 1,
+		}}, acl.Requests)
+	}
+}
+
+func TestPubSub_Subscribe_Refused(t *testing.T) {
+	trie := message.NewTrie()
+	s := New(&fake.Authorizer{
+		Contract: 1,
+		Success:  true,
+	}, access.NewNoop(), new(fake.Limiter), storage.NewNoop(), new(fake.Notifier), trie)
+
+	// The connection over the limit of concurrent connections can not subscribe
+	err := s.OnSubscribe(&fake.Conn{Refused: errors.ErrTooManyConns}, []byte("key/a/b/c/"))
+	assert.Equal(t, errors.ErrTooManyConns, err)
+	assert.Zero(t, trie.Count())
+}
+
 func TestPubSub_Subscribe_Buggy(t *testing.T) {
 	tests := []struct {
 		contract     int    // The contract ID
@@ -144,7 +218,7 @@ func TestPubSub_Subscribe_Buggy(t *testing.T) {
 		}
 
 		// Create new service
-		s := New(auth, new(buggyStore), new(fake.Notifier), trie)
+		s := New(auth, access.NewNoop(), new(fake.Limiter), new(buggyStore), new(fake.Notifier), trie)
 		c := &fake.Conn{
 			Disabled: tc.disabled,
 		}
@@ -177,10 +251,14 @@ func (s *buggyStore) Store(m *message.Message) error {
 	return errors.New("not working")
 }
 
-func (s *buggyStore) Query(ssid message.Ssid, from, until time.Time, startFromID message.ID, limit int) (message.Frame, error) {
+func (s *buggyStore) Query(ssid message.Ssid, from, until time.Time, startFromID message.ID, order storage.Order, limit int) (message.Frame, error) {
 	return nil, errors.New("not working")
 }
 
+func (s *buggyStore) Delete(ssid message.Ssid, from, until time.Time, ids []message.ID) (int, error) {
+	return 0, errors.New("not working")
+}
+
 func (s *buggyStore) Close() error {
 	return errors.New("not working")
 }
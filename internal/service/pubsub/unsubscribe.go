@@ -42,7 +42,7 @@ func (s *Service) Unsubscribe(sub message.Subscriber, ev *event.Subscription) (o
 func (s *Service) OnUnsubscribe(c service.Conn, mqttTopic []byte) *errors.Error {
 
 	// Parse the channel
-	channel := security.ParseChannel(mqttTopic)
+	channel := security.ParseChannel(s.TopicOf(c, mqttTopic))
 	if channel.ChannelType == security.ChannelInvalid {
 		return errors.ErrBadRequest
 	}
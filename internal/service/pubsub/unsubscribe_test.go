@@ -19,6 +19,7 @@ import (
 
 	"github.com/emitter-io/emitter/internal/event"
 	"github.com/emitter-io/emitter/internal/message"
+	access "github.com/emitter-io/emitter/internal/provider/auth"
 	"github.com/emitter-io/emitter/internal/provider/storage"
 	"github.com/emitter-io/emitter/internal/security"
 	"github.com/emitter-io/emitter/internal/service/fake"
@@ -77,7 +78,7 @@ func TestPubSub_Unsubscribe(t *testing.T) {
 		}
 
 		// Create new service
-		s := New(auth, storage.NewNoop(), new(fake.Notifier), trie)
+		s := New(auth, access.NewNoop(), new(fake.Limiter), storage.NewNoop(), new(fake.Notifier), trie)
 
 		// Register few subscribers
 		for i := 0; i < 10; i++ {
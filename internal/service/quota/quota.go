@@ -0,0 +1,270 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package quota
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/provider/contract"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/emitter-io/emitter/internal/service"
+	"github.com/kelindar/rate"
+)
+
+const (
+	idleAfter  = 10 * time.Minute // The time after which an unused counter is removed.
+	pruneEvery = 4096             // The number of checks after which the idle counters are pruned.
+)
+
+// Cluster represents the cluster across which the limits are shared.
+type Cluster interface {
+	NumPeers() int
+}
+
+// Assert interface compliance
+var _ service.Limiter = new(Limiter)
+
+// Limiter enforces the rate and volume limits of the contracts and of their keys. Each
+// node of the cluster enforces an equal share of every limit, so the limits are only
+// approximately enforced across the cluster.
+type Limiter struct {
+	cluster  Cluster                 // The cluster to share the limits with (optional).
+	counters sync.Map                // The counters, by their scope.
+	checks   int64                   // The number of checks performed.
+	lock     sync.Mutex              // The lock protecting the admitted connections.
+	admitted map[security.ID][]scope // The scopes each of the connections was admitted in.
+}
+
+// New creates a new limiter.
+func New(cluster Cluster) *Limiter {
+	return &Limiter{
+		cluster:  cluster,
+		admitted: make(map[security.ID][]scope),
+	}
+}
+
+// scope identifies either a contract as a whole or one of its keys.
+type scope struct {
+	contract uint32
+	key      string
+}
+
+// counter represents the usage of a single scope.
+type counter struct {
+	sync.Mutex
+	rate  *rate.Limiter            // The rate limiter of the messages, created lazily.
+	day   int64                    // The day for which the volume is counted.
+	bytes int64                    // The volume in bytes for the current day.
+	conns map[security.ID]struct{} // The connections admitted.
+	seen  int64                    // The time the counter was last used, in seconds.
+	gone  bool                     // Whether the counter was pruned.
+}
+
+// isIdle checks whether the counter is no longer needed to enforce any of the limits.
+func (c *counter) isIdle(now int64) bool {
+	return len(c.conns) == 0 &&
+		(c.bytes == 0 || c.day != now/86400) &&
+		now-c.seen > int64(idleAfter/time.Second)
+}
+
+// Admit checks whether the connection can be admitted within the limit of concurrent
+// connections of the contract and of the key. The connection counts towards the limits
+// until it is released.
+func (l *Limiter) Admit(c service.Conn, contract contract.Contract, key security.Key) *errors.Error {
+	l.count()
+	limits := contract.Limits()
+	if err := l.admit(c.LocalID(), scope{contract: key.Contract()}, limits.Contract); err != nil {
+		return err
+	}
+
+	return l.admit(c.LocalID(), scope{contract: key.Contract(), key: string(key)}, limits.Key)
+}
+
+// Allow checks whether a message of a specified size is allowed within the rate and the
+// daily volume limits of the contract and of the key, and counts it if it is.
+func (l *Limiter) Allow(contract contract.Contract, key security.Key, size int64) *errors.Error {
+	l.count()
+	limits := contract.Limits()
+	owner := scope{contract: key.Contract()}
+	if err := l.allow(owner, limits.Contract, size); err != nil {
+		return err
+	}
+
+	// If the key is over its limits, the message should not count towards the contract
+	if err := l.allow(scope{contract: key.Contract(), key: string(key)}, limits.Key, size); err != nil {
+		l.undo(owner, limits.Contract, size)
+		return err
+	}
+
+	return nil
+}
+
+// Release releases the connection from all of the limits of concurrent connections.
+func (l *Limiter) Release(id security.ID) {
+	l.lock.Lock()
+	scopes := l.admitted[id]
+	delete(l.admitted, id)
+	l.lock.Unlock()
+
+	for _, s := range scopes {
+		if v, ok := l.counters.Load(s); ok {
+			c := v.(*counter)
+			c.Lock()
+			delete(c.conns, id)
+			c.Unlock()
+		}
+	}
+}
+
+// admit admits a connection within the limit of concurrent connections of a scope.
+func (l *Limiter) admit(id security.ID, s scope, limit contract.Limit) *errors.Error {
+	if limit.Connections <= 0 {
+		return nil
+	}
+
+	c := l.acquire(s)
+	defer c.Unlock()
+	if _, ok := c.conns[id]; ok {
+		return nil
+	}
+
+	if int64(len(c.conns)) >= l.share(int64(limit.Connections)) {
+		return errors.ErrTooManyConns
+	}
+
+	// Index the scope by connection, so the connection can be released quickly
+	c.conns[id] = struct{}{}
+	l.lock.Lock()
+	l.admitted[id] = append(l.admitted[id], s)
+	l.lock.Unlock()
+	return nil
+}
+
+// allow counts a message within the rate and the daily volume limits of a scope.
+func (l *Limiter) allow(s scope, limit contract.Limit, size int64) *errors.Error {
+	if limit.Rate <= 0 && limit.Daily <= 0 {
+		return nil
+	}
+
+	c := l.acquire(s)
+	defer c.Unlock()
+	if limit.Rate > 0 {
+		perSecond := int(l.share(int64(limit.Rate)))
+		if c.rate == nil {
+			c.rate = rate.New(perSecond, time.Second)
+		} else {
+			c.rate.UpdateRate(perSecond)
+		}
+
+		if c.rate.Limit() {
+			return errors.ErrRateLimited
+		}
+	}
+
+	if limit.Daily > 0 {
+		if day := today(); c.day != day {
+			c.day = day
+			c.bytes = 0
+		}
+
+		if c.bytes+size > l.share(limit.Daily) {
+			if limit.Rate > 0 {
+				c.rate.Undo()
+			}
+			return errors.ErrQuotaExceeded
+		}
+
+		c.bytes += size
+	}
+
+	return nil
+}
+
+// undo reverts a message previously counted within the limits of a scope.
+func (l *Limiter) undo(s scope, limit contract.Limit, size int64) {
+	if limit.Rate <= 0 && limit.Daily <= 0 {
+		return
+	}
+
+	c := l.acquire(s)
+	defer c.Unlock()
+	if limit.Rate > 0 && c.rate != nil {
+		c.rate.Undo()
+	}
+	if limit.Daily > 0 {
+		c.bytes -= size
+	}
+}
+
+// share returns the share of a limit this node enforces.
+func (l *Limiter) share(limit int64) int64 {
+	nodes := int64(1)
+	if l.cluster != nil {
+		nodes += int64(l.cluster.NumPeers())
+	}
+
+	return (limit + nodes - 1) / nodes
+}
+
+// acquire returns the locked counter of a scope, creating it if necessary.
+func (l *Limiter) acquire(s scope) *counter {
+	for {
+		v, ok := l.counters.Load(s)
+		if !ok {
+			v, _ = l.counters.LoadOrStore(s, &counter{
+				conns: make(map[security.ID]struct{}),
+			})
+		}
+
+		// If the counter was pruned in the meantime, a new one needs to be created
+		c := v.(*counter)
+		c.Lock()
+		if !c.gone {
+			c.seen = time.Now().Unix()
+			return c
+		}
+		c.Unlock()
+	}
+}
+
+// count counts a check and prunes the idle counters every once in a while.
+func (l *Limiter) count() {
+	if n := atomic.AddInt64(&l.checks, 1); n%pruneEvery == 0 {
+		l.prune()
+	}
+}
+
+// prune removes the counters which are no longer needed to enforce any of the limits.
+func (l *Limiter) prune() {
+	now := time.Now().Unix()
+	l.counters.Range(func(k, v interface{}) bool {
+		c := v.(*counter)
+		c.Lock()
+		if c.isIdle(now) {
+			c.gone = true
+			l.counters.Delete(k)
+		}
+		c.Unlock()
+		return true
+	})
+}
+
+// today returns the current day, as the number of days since the epoch.
+func today() int64 {
+	return time.Now().Unix() / 86400
+}
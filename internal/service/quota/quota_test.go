@@ -0,0 +1,156 @@
+/**********************************************************************************
+* Copyright (c) 2009-2020 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package quota
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/provider/contract"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/emitter-io/emitter/internal/service/fake"
+	"github.com/stretchr/testify/assert"
+)
+
+type peers int
+
+func (p peers) NumPeers() int {
+	return int(p)
+}
+
+func newKey(contract uint32, signature uint32) security.Key {
+	key := security.Key(make([]byte, 24))
+	key.SetContract(contract)
+	key.SetSignature(signature)
+	return key
+}
+
+func TestLimiter_Unlimited(t *testing.T) {
+	l := New(nil)
+	c := new(fake.Contract)
+	key := newKey(1, 1)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, l.Admit(&fake.Conn{ConnID: i}, c, key))
+		assert.Nil(t, l.Allow(c, key, 1000))
+	}
+}
+
+func TestLimiter_Rate(t *testing.T) {
+	l := New(nil)
+	c := &fake.Contract{Quota: contract.Limits{
+		Key: contract.Limit{Rate: 5},
+	}}
+
+	// The first key should run out of its allowance
+	key1 := newKey(1, 1)
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, l.Allow(c, key1, 10))
+	}
+	assert.Equal(t, errors.ErrRateLimited, l.Allow(c, key1, 10))
+
+	// The other key has its own allowance
+	assert.Nil(t, l.Allow(c, newKey(1, 2), 10))
+}
+
+func TestLimiter_Daily(t *testing.T) {
+	l := New(nil)
+	c := &fake.Contract{Quota: contract.Limits{
+		Contract: contract.Limit{Daily: 100},
+		Key:      contract.Limit{Daily: 60},
+	}}
+
+	key1, key2 := newKey(1, 1), newKey(1, 2)
+	assert.Nil(t, l.Allow(c, key1, 50))
+	assert.Equal(t, errors.ErrQuotaExceeded, l.Allow(c, key1, 20))
+
+	// The refused message should not count towards the contract
+	assert.Nil(t, l.Allow(c, key2, 50))
+	assert.Equal(t, errors.ErrQuotaExceeded, l.Allow(c, key2, 1))
+}
+
+func TestLimiter_Connections(t *testing.T) {
+	l := New(nil)
+	c := &fake.Contract{Quota: contract.Limits{
+		Contract: contract.Limit{Connections: 2},
+	}}
+
+	key := newKey(1, 1)
+	conn1, conn2, conn3 := &fake.Conn{ConnID: 1}, &fake.Conn{ConnID: 2}, &fake.Conn{ConnID: 3}
+	assert.Nil(t, l.Admit(conn1, c, key))
+	assert.Nil(t, l.Admit(conn1, c, key))
+	assert.Nil(t, l.Admit(conn2, c, key))
+	assert.Equal(t, errors.ErrTooManyConns, l.Admit(conn3, c, key))
+
+	// Once released, there should be room again
+	l.Release(conn1.LocalID())
+	assert.Nil(t, l.Admit(conn3, c, key))
+}
+
+func TestLimiter_Share(t *testing.T) {
+	assert.Equal(t, int64(100), New(nil).share(100))
+	assert.Equal(t, int64(50), New(peers(1)).share(100))
+	assert.Equal(t, int64(34), New(peers(2)).share(100))
+	assert.Equal(t, int64(1), New(peers(9)).share(1))
+}
+
+func TestLimiter_Prune(t *testing.T) {
+	l := New(nil)
+	c := &fake.Contract{Quota: contract.Limits{
+		Key: contract.Limit{Connections: 1, Rate: 5},
+	}}
+	daily := &fake.Contract{Quota: contract.Limits{
+		Key: contract.Limit{Daily: 100},
+	}}
+
+	conn := &fake.Conn{ConnID: 1}
+	connected, limited, metered := newKey(1, 1), newKey(1, 2), newKey(1, 3)
+	assert.Nil(t, l.Admit(conn, c, connected))
+	assert.Nil(t, l.Allow(c, limited, 10))
+	assert.Nil(t, l.Allow(daily, metered, 10))
+
+	// Pretend none of the counters were used for a while
+	idle := func() {
+		l.counters.Range(func(_, v interface{}) bool {
+			v.(*counter).seen -= int64(2 * idleAfter / time.Second)
+			return true
+		})
+	}
+
+	// Only the counters still enforcing a limit should be kept
+	idle()
+	l.prune()
+	assert.Equal(t, 2, countersOf(l))
+
+	// Once released, the connection should no longer keep its counter
+	l.Release(conn.LocalID())
+	assert.Empty(t, l.admitted)
+	idle()
+	l.prune()
+	assert.Equal(t, 1, countersOf(l))
+
+	// A pruned counter should be created again when needed
+	assert.Nil(t, l.Admit(conn, c, connected))
+	assert.Equal(t, errors.ErrTooManyConns, l.Admit(&fake.Conn{ConnID: 2}, c, connected))
+}
+
+func countersOf(l *Limiter) (n int) {
+	l.counters.Range(func(_, _ interface{}) bool {
+		n++
+		return true
+	})
+	return
+}
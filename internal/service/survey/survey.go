@@ -173,6 +173,36 @@ func (c *Surveyor) Query(query string, payload []byte) (message.Awaiter, error)
 	return awaiter, nil
 }
 
+// Ask issues a request to a single peer of the cluster.
+func (c *Surveyor) Ask(peer uint64, query string, payload []byte) (message.Awaiter, error) {
+
+	// Create an awaiter
+	awaiter := &queryAwaiter{
+		id:      atomic.AddUint32(&c.next, 1),
+		receive: make(chan []byte, 1),
+		maximum: 1,
+		manager: c,
+	}
+
+	// Store an awaiter
+	c.awaiters.Store(awaiter.id, awaiter)
+
+	// Prepare a channel with the reply-to address
+	channel := fmt.Sprintf("%v/%v", query, c.gossip.ID())
+
+	// Send the query as a message to the peer directly
+	if err := c.gossip.SendTo(mesh.PeerName(peer), message.New(
+		message.Ssid{idSystem, idQuery, awaiter.id},
+		[]byte(channel),
+		payload,
+	)); err != nil {
+		c.awaiters.Delete(awaiter.id)
+		return nil, err
+	}
+
+	return awaiter, nil
+}
+
 // queryAwaiter represents an asynchronously awaiting response channel.
 type queryAwaiter struct {
 	id      uint32      // The identifier of the query.
@@ -77,6 +77,42 @@ func TestQuery(t *testing.T) {
 	assert.Equal(t, "hello from 2", string(result[0]))
 }
 
+func TestAsk(t *testing.T) {
+	b1, out1 := newManager(1, 5)
+	b2, out2 := newManager(2, 5)
+
+	awaiter, err := b1.Ask(2, "test", nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, awaiter)
+
+	// Send the query to B2 only and the response back to B1
+	assert.NoError(t, b2.Send(<-out1))
+	assert.NoError(t, b1.Send(<-out2))
+
+	// Only one response is expected, even with more peers
+	result := awaiter.Gather(time.Second)
+	assert.Len(t, result, 1)
+	assert.Equal(t, "hello from 2", string(result[0]))
+}
+
+func TestAsk_Unreachable(t *testing.T) {
+	g := new(gossiperMock)
+	g.On("ID").Return(uint64(1))
+	g.On("SendTo", mock.Anything, mock.Anything).Return(errors.New("unreachable"))
+
+	q := New(nil, g)
+	_, err := q.Ask(2, "test", nil)
+	assert.Error(t, err)
+
+	// The awaiter should not be left behind
+	pending := 0
+	q.awaiters.Range(func(_, _ interface{}) bool {
+		pending++
+		return true
+	})
+	assert.Zero(t, pending)
+}
+
 func TestQuery_Timeout(t *testing.T) {
 	b1, _ := newManager(1, 2)
 
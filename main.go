@@ -43,7 +43,9 @@ func main() {
 	app.Command("load", "Runs the load testing client for emitter.", load.Run)
 	app.Command("license", "Manipulates licenses and secret keys.", func(cmd *cli.Cmd) {
 		cmd.Command("new", "Generates a new license and secret key pair.", license.New)
-		// TODO: add more sub-commands for license
+		cmd.Command("inspect", "Prints the version, contract, signature and master index of a license.", license.Inspect)
+		cmd.Command("master", "Generates an additional master key for a license.", license.Master)
+		cmd.Command("verify", "Decodes a key and prints its permissions, channel and expiry.", license.Verify)
 	})
 	app.Command("keygen", "Generates a new key for a channel.", keygen.NewKey)
 